@@ -11,6 +11,7 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 	"unicode"
 	"unicode/utf8"
@@ -20,8 +21,6 @@ import (
 	"github.com/aarzilli/yacco/util"
 )
 
-const SLOP = 128
-
 var nonwdRe = regexp.MustCompile(`\W+`)
 
 type Buffer struct {
@@ -34,14 +33,17 @@ type Buffer struct {
 	modTime        time.Time // time the file was modified on disk
 	onDiskChecksum *[sha1.Size]byte
 
+	// set when the file was changed on disk while the buffer had unsaved
+	// changes, cleared by Reload, Put and IgnoreDiskChanges
+	ChangedOnDisk bool
+
 	Props map[string]string
 
-	// gap buffer implementation
-	buf        []rune
-	sels       []*util.Sel
-	gap, gapsz int
+	text storage
+	sels []*util.Sel
 
 	ul undoList
+	cl changeLog
 
 	lock sync.RWMutex
 
@@ -82,13 +84,11 @@ func NewBuffer(dir, name string, create bool, indentchar string, hl hl.Highlight
 
 		Hl: hl,
 
-		buf:   make([]rune, SLOP),
-		gap:   0,
-		gapsz: SLOP,
+		text: newGapBuffer(),
 
 		Markat: -1,
 
-		ul: undoList{0, []undoInfo{}, true}}
+		ul: newUndoList()}
 
 	dirfile, err := os.Open(dir)
 	if err != nil {
@@ -103,6 +103,14 @@ func NewBuffer(dir, name string, create bool, indentchar string, hl hl.Highlight
 		return nil, fmt.Errorf("Not a directory: %s", dir)
 	}
 
+	b.Props = map[string]string{}
+	b.Props["indentchar"] = indentchar
+	b.Props["font"] = "main"
+	b.Props["indent"] = "on"
+	b.Props["tab"] = "8"
+	b.Props["encoding"] = EncodingUTF8
+	b.Props["eol"] = EolLF
+
 	if name[0] != '+' {
 		flag := ReloadFlag(0)
 		if create {
@@ -114,12 +122,6 @@ func NewBuffer(dir, name string, create bool, indentchar string, hl hl.Highlight
 		}
 	}
 
-	b.Props = map[string]string{}
-	b.Props["indentchar"] = indentchar
-	b.Props["font"] = "main"
-	b.Props["indent"] = "on"
-	b.Props["tab"] = "8"
-
 	b.EditMarkNext = true
 	b.EditMark = true
 
@@ -170,16 +172,52 @@ func (b *Buffer) Reload(flags ReloadFlag) error {
 		if fi.IsDir() {
 			return b.reloadDir(infile)
 		}
-		if fi.Size() > 500*1024*1024 {
-			return fmt.Errorf("Refusing to open files larger than 500MB")
-		}
 
-		bytes, err := ioutil.ReadAll(infile)
-		if err != nil {
-			return err
+		// large files are stored as UTF-8 if they don't need to be
+		// converted, read-only files are used in place: other files could be
+		// truncated while they are mmapped, which would crash us.
+		var bytes []byte
+		var pt *pieceTable
+		if config.LargeFileSize > 0 && fi.Size() >= int64(config.LargeFileSize) {
+			if fi.Mode().Perm()&0222 == 0 {
+				pt, err = mapPieceTable(infile, int(fi.Size()))
+			} else {
+				bytes, err = ioutil.ReadAll(infile)
+				pt = newPieceTable(bytes)
+			}
+			if err != nil {
+				return err
+			}
+			if !plainText(pt.orig) {
+				if pt.mapped {
+					// the file is read again below, the mapping must not
+					// be used once pt is dropped
+					pt.unmap()
+				} else {
+					bytes = pt.orig
+				}
+				pt = nil
+			} else {
+				bytes = pt.orig
+			}
 		}
-		if isBinary(bytes) {
-			return fmt.Errorf("Can not open binary file")
+
+		var text []rune
+		encoding, eol := EncodingUTF8, EolLF
+		if pt == nil {
+			if fi.Size() > 500*1024*1024 {
+				return fmt.Errorf("Refusing to open files larger than 500MB that aren't UTF-8 with LF line endings")
+			}
+			if bytes == nil {
+				bytes, err = ioutil.ReadAll(infile)
+				if err != nil {
+					return err
+				}
+			}
+			text, encoding, eol, err = decodeText(bytes)
+			if err != nil {
+				return err
+			}
 		}
 
 		restoreCurline := ""
@@ -201,7 +239,19 @@ func (b *Buffer) Reload(flags ReloadFlag) error {
 			}
 		}
 
-		b.ReplaceFull([]rune(string(bytes)))
+		if pt != nil {
+			// highlighting would have to scan the whole file
+			b.Hl = hl.NilHighlighter
+			b.replaceStorage(pt)
+		} else if _, ok := b.text.(*pieceTable); ok {
+			gb := newGapBuffer()
+			gb.Replace(0, 0, text)
+			b.replaceStorage(gb)
+		} else {
+			b.ReplaceFull(text)
+		}
+		b.Props["encoding"] = encoding
+		b.Props["eol"] = eol
 
 		if restoreCurline != "" {
 			s1 := b.Tonl(b.sels[0].S-1, -1)
@@ -214,15 +264,19 @@ func (b *Buffer) Reload(flags ReloadFlag) error {
 		s1 := sha1.Sum(bytes)
 		b.onDiskChecksum = &s1
 		b.Modified = false
-		if len(b.ul.lst) == 1 {
+		b.ChangedOnDisk = false
+		if b.ul.seq <= 1 {
 			b.ul.Reset()
-		} else {
-			b.ul.lst[b.ul.cur-1].solid = false
+		} else if ui := b.ul.PeekUndo(); ui != nil {
+			ui.solid = false
 		}
 		//b.ul.Reset()
 		b.ul.SetSaved()
+		if b.ul.seq == 0 {
+			b.loadUndo(s1)
+		}
 
-		if len(b.buf)-b.gapsz < 1*1024*1024 {
+		if b.Size() < 1*1024*1024 {
 			str := string(b.SelectionRunes(util.Sel{0, b.Size()}))
 			b.Words = util.Dedup(nonwdRe.Split(str, -1))
 			b.WordsUpdate = time.Now()
@@ -231,7 +285,7 @@ func (b *Buffer) Reload(flags ReloadFlag) error {
 		if create {
 			// doesn't exist, mark as modified
 			b.Modified = true
-			b.ul.nilIsSaved = false
+			b.ul.root.saved = false
 			b.modTime = time.Now()
 		} else {
 			return fmt.Errorf("File doesn't exist: %s", path)
@@ -301,6 +355,26 @@ func (b *Buffer) ReplaceFull(text []rune) {
 	b.restoreSels(saveSels)
 }
 
+// replaceStorage replaces the text of the buffer with the contents of st,
+// undo information is discarded.
+func (b *Buffer) replaceStorage(st storage) {
+	saveSels := b.saveSels()
+	b.wrlock()
+	b.Modified = true
+	if b.cl.tracking {
+		// too big to be sent as a change
+		b.cl.overflow, b.cl.changes = true, nil
+	}
+	b.text = st
+	b.ul.Reset()
+	if b.Hl != nil {
+		b.Hl.Alter(-1)
+	}
+	b.RevCount++
+	b.unlock()
+	b.restoreSels(saveSels)
+}
+
 // Replaces text between sel.S and sel.E with text, updates sels AND sel accordingly
 // After the replacement the highlighter is restarted
 func (b *Buffer) Replace(text []rune, sel *util.Sel, solid bool, eventChan chan string, origin util.EventOrigin) {
@@ -358,7 +432,8 @@ func (b *Buffer) generateEvent(text []rune, sel util.Sel, eventChan chan string,
 	}
 }
 
-// Undo last change. Redoes last undo if redo == true
+// Undo last change. Redoes last undo if redo == true, following the most
+// recently visited branch of the undo tree.
 func (b *Buffer) Undo(sel *util.Sel, redo bool) {
 	if !b.Editable {
 		return
@@ -369,7 +444,7 @@ func (b *Buffer) Undo(sel *util.Sel, redo bool) {
 	for {
 		var ui *undoInfo
 		if redo {
-			ui = b.ul.PeekUndo()
+			ui = b.ul.PeekRedo()
 			if (ui != nil) && ui.solid && !first {
 				return
 			}
@@ -384,36 +459,7 @@ func (b *Buffer) Undo(sel *util.Sel, redo bool) {
 
 		first = false
 
-		b.wrlock()
-
-		var us undoSel
-		var text []rune
-		if redo {
-			us = ui.before
-			text = []rune(ui.after.text)
-		} else {
-			us = ui.after
-			text = []rune(ui.before.text)
-		}
-		ws := util.Sel{us.S, us.E}
-		b.replaceIntl(text, &ws)
-		b.updateSels(&ws, len(text))
-
-		b.unlock()
-
-		sel.S = ws.S
-		sel.E = ws.S + len(text)
-
-		mui := ui
-		if !redo {
-			mui = b.ul.PeekUndo()
-		}
-
-		if mui == nil {
-			b.Modified = !b.ul.nilIsSaved
-		} else {
-			b.Modified = !mui.saved
-		}
+		b.applyUndo(ui, sel, redo)
 
 		if !redo {
 			if ui.solid {
@@ -470,20 +516,15 @@ func (b *Buffer) unlock() {
 func (b *Buffer) replaceIntl(text []rune, sel *util.Sel) {
 	regionSize := sel.E - sel.S
 
+	if b.cl.tracking {
+		b.recordChange(text, *sel)
+	}
+
 	if sel.S != sel.E {
 		b.updateSels(sel, -regionSize)
-		b.MoveGap(sel.S)
-		b.gapsz += regionSize // this effectively deletes the current selection
-	} else {
-		b.MoveGap(sel.S)
 	}
 
-	b.IncGap(len(text))
-	for i, r := range text {
-		b.buf[b.gap+i] = r
-	}
-	b.gap += len(text)
-	b.gapsz -= len(text)
+	b.text.Replace(sel.S, sel.E, text)
 	if b.Hl != nil {
 		b.Hl.Alter(sel.S - 1)
 	}
@@ -547,86 +588,14 @@ func (b *Buffer) updateSels(sel *util.Sel, delta int) {
 	}
 }
 
-// Increases the size of the gap to fit at least delta more items
-func (b *Buffer) IncGap(delta int) {
-	if b.gapsz > delta+1 {
-		return
-	}
-
-	ngapsz := (delta/SLOP + 1) * SLOP
-
-	nbuf := make([]rune, len(b.buf)-b.gapsz+ngapsz)
-
-	copy(nbuf, b.buf[:b.gap])
-	copy(nbuf[b.gap+ngapsz:], b.buf[b.gap+b.gapsz:])
-
-	b.buf = nbuf
-	b.gapsz = ngapsz
-}
-
-// Displaces gap to start at point p
-func (b *Buffer) MoveGap(p int) {
-	pp := b.phisical(p)
-	if pp > len(b.buf) {
-		panic(fmt.Errorf("MoveGap point out of range: %d", pp))
-	}
-
-	if pp < b.gap {
-		if b.gap-pp > 0 {
-			//size =  b.gap - pp
-			//memmove(buffer->buf + pp + buffer->gapsz, buffer->buf + pp, sizeof(my_glyph_info_t) * size);
-			copy(b.buf[pp+b.gapsz:], b.buf[pp:b.gap])
-		}
-		b.gap = pp
-	} else if pp > b.gap {
-		if pp-b.gap-b.gapsz > 0 {
-			//size = pp - b.gap - b.gapsz
-			//memmove(buffer->buf + buffer->gap, buffer->buf + buffer->gap + buffer->gapsz, sizeof(my_glyph_info_t) * size);
-			copy(b.buf[b.gap:], b.buf[b.gap+b.gapsz:pp])
-		}
-		b.gap = pp - b.gapsz
-	}
-}
-
-func (b *Buffer) phisical(p int) int {
-	if p < b.gap {
-		return p
-	} else {
-		return p + b.gapsz
-	}
-}
-
 func (b *Buffer) At(p int) rune {
-	pp := b.phisical(p)
-	if (pp < 0) || (pp >= len(b.buf)) {
-		return 0
-	}
-	return b.buf[pp]
+	return b.text.At(p)
 }
 
 // Returns the specified selection as two slices. The slices are to be treated as contiguous and may be empty
 func (b *Buffer) Selection(sel util.Sel) ([]rune, []rune) {
 	b.FixSel(&sel)
-	ps := b.phisical(sel.S)
-	pe := b.phisical(sel.E)
-
-	if ps < 0 {
-		ps = 0
-	}
-	if pe > len(b.buf) {
-		pe = len(b.buf)
-	}
-
-	if (ps < b.gap) && (pe >= b.gap) {
-		//println(len(b.buf), b.gap, b.gapsz, ps, pe)
-		return b.buf[ps:b.gap], b.buf[b.gap+b.gapsz : pe]
-	} else {
-		if pe <= ps {
-			return []rune{}, []rune{}
-		} else {
-			return b.buf[ps:pe], []rune{}
-		}
-	}
+	return b.text.Selection(sel.S, sel.E)
 }
 
 // Returns the specified selection as single slice of ColorRunes (will allocate)
@@ -639,33 +608,15 @@ func (b *Buffer) SelectionRunes(sel util.Sel) []rune {
 }
 
 func (b *Buffer) ByteOffset(p int) int {
-	n := 0
-	ba, bb := b.Selection(util.Sel{0, p})
-	for _, bcur := range [][]rune{ba, bb} {
-		for _, ch := range bcur {
-			switch {
-			case ch <= 0x7f:
-				n++
-			case ch <= 0x7FF:
-				n += 2
-			case ch <= 0xFFFF:
-				n += 3
-			case ch <= 0x10FFFF:
-				n += 4
-			}
-		}
-	}
-	return n
+	return b.text.ByteOffset(p)
 }
 
 func (b *Buffer) Size() int {
-	return len(b.buf) - b.gapsz
+	return b.text.Size()
 }
 
-// Moves to the beginning or end of a line
 func (b *Buffer) Tonl(start int, dir int) int {
 	sz := b.Size()
-	ba, bb := b.Selection(util.Sel{0, sz})
 
 	i := start
 	if i < 0 {
@@ -675,15 +626,7 @@ func (b *Buffer) Tonl(start int, dir int) int {
 		i = sz - 1
 	}
 	for ; (i >= 0) && (i < sz); i += dir {
-		var c rune
-
-		if i < len(ba) {
-			c = ba[i]
-		} else {
-			c = bb[i-len(ba)]
-		}
-
-		if c == '\n' {
+		if b.text.At(i) == '\n' {
 			return i + 1
 		}
 	}
@@ -825,6 +768,21 @@ func (b *Buffer) Path() string {
 	return filepath.Join(b.Dir, b.Name)
 }
 
+// Rename changes the path of the buffer to newName, relative to the current
+// directory of the buffer. The buffer is marked as modified if the path
+// changed.
+func (b *Buffer) Rename(newName string) {
+	abspath := util.ResolvePath(b.Dir, newName)
+	oldName := b.Name
+	oldDir := b.Dir
+	b.Name = filepath.Base(abspath)
+	b.Dir = filepath.Dir(abspath)
+	if newName[len(newName)-1] == '/' {
+		b.Name += "/"
+	}
+	b.Modified = (oldName != b.Name) || (oldDir != b.Dir)
+}
+
 func (b *Buffer) FixSel(sel *util.Sel) {
 	if sel.S < 0 {
 		sel.S = 0
@@ -839,6 +797,10 @@ func (b *Buffer) FixSel(sel *util.Sel) {
 }
 
 func (b *Buffer) UpdateWords() {
+	if _, ok := b.text.(*pieceTable); ok {
+		// too large
+		return
+	}
 	ba, bb := b.Selection(util.Sel{0, b.Size()})
 	sa := string(ba)
 	sb := string(bb)
@@ -849,22 +811,104 @@ func (b *Buffer) UpdateWords() {
 	b.WordsUpdate = time.Now()
 }
 
+// Put saves the buffer to disk. The contents are written to a temporary
+// file which is then renamed over the original, so that the original is
+// never left truncated. Symlinks are followed, permissions and ownership
+// of the original are preserved. Files with multiple hard links, and files
+// in directories we can't write to, are instead overwritten in place.
+// The text is written with the encoding and line endings of the "encoding"
+// and "eol" properties.
 func (b *Buffer) Put() error {
-	out, err := os.OpenFile(filepath.Join(b.Dir, b.Name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
-	if err != nil {
-		return err
+	// encoding first so that nothing is written if the text can't be
+	// represented in the encoding of the file
+	chunks := [][]byte{encodingBOM(b.Props["encoding"])}
+	pt, _ := b.text.(*pieceTable)
+	if pt != nil && (b.Props["encoding"] == EncodingUTF8 || b.Props["encoding"] == EncodingUTF8BOM) && b.Props["eol"] == EolLF {
+		chunks = append(chunks, pt.chunks()...)
+	} else {
+		pt = nil
+		ba, bb := b.Selection(util.Sel{0, b.Size()})
+		for _, runes := range [][]rune{ba, bb} {
+			x, err := encodeText(runes, b.Props["encoding"], b.Props["eol"])
+			if err != nil {
+				return err
+			}
+			chunks = append(chunks, x)
+		}
 	}
-	defer out.Close()
 
-	ba, bb := b.Selection(util.Sel{0, b.Size()})
+	path, fi := saveTarget(filepath.Join(b.Dir, b.Name))
+
+	inplace := false
+	if fi != nil {
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+			inplace = true
+		}
+	}
+
+	var out *os.File
+	var err error
+	if !inplace {
+		perm := os.FileMode(0666)
+		if fi != nil {
+			perm = fi.Mode().Perm()
+		}
+		out, err = createTemp(path, perm)
+		if os.IsPermission(err) && fi != nil {
+			inplace = true
+		} else if err != nil {
+			return err
+		} else if fi != nil && !canReplace(path, out.Name(), fi) {
+			// writing in place fails if the file isn't writable, like it
+			// would without the temporary file
+			out.Close()
+			os.Remove(out.Name())
+			out = nil
+			inplace = true
+		}
+	}
+	if inplace {
+		if ptext, ok := b.text.(*pieceTable); ok && ptext.mapped {
+			// the text could be in the file we are about to overwrite
+			b.wrlock()
+			b.text = ptext.copy()
+			b.unlock()
+			if pt != nil {
+				pt = b.text.(*pieceTable)
+				chunks = append(chunks[:1], pt.chunks()...)
+			}
+		}
+		out, err = os.OpenFile(path, os.O_WRONLY, 0666)
+		if err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if out != nil {
+			out.Close()
+			if !inplace {
+				os.Remove(out.Name())
+			}
+		}
+	}()
+
+	if fi != nil {
+		if err := backup(path, inplace); err != nil {
+			return err
+		}
+		if inplace {
+			if err := out.Truncate(0); err != nil {
+				return err
+			}
+		}
+	}
 
 	b.UpdateWords()
 
 	bout := bufio.NewWriter(out)
 	h := sha1.New()
 
-	for _, runes := range [][]rune{ba, bb} {
-		x := []byte(string(runes))
+	for _, x := range chunks {
 		_, err = bout.Write(x)
 		if err != nil {
 			return err
@@ -876,9 +920,29 @@ func (b *Buffer) Put() error {
 	if err != nil {
 		return err
 	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if !inplace && fi != nil {
+		if err := preserveMode(out.Name(), fi); err != nil {
+			return err
+		}
+	}
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+	if !inplace {
+		if err := os.Rename(out.Name(), path); err != nil {
+			return err
+		}
+		syncDir(filepath.Dir(path))
+	}
+	out = nil
 	b.Modified = false
+	b.ChangedOnDisk = false
 
-	fi, err := os.Stat(filepath.Join(b.Dir, b.Name))
+	fi, err = os.Stat(filepath.Join(b.Dir, b.Name))
 	if err != nil {
 		return err
 	}
@@ -888,16 +952,17 @@ func (b *Buffer) Put() error {
 	h.Sum(hbytes[:0])
 	b.onDiskChecksum = &hbytes
 	b.ul.SetSaved()
+	b.SaveUndo()
 
 	return nil
 }
 
 func (b *Buffer) HasUndo() bool {
-	return b.ul.cur > 0
+	return b.ul.cur != b.ul.root
 }
 
 func (b *Buffer) HasRedo() bool {
-	return b.ul.cur < len(b.ul.lst)
+	return b.ul.cur.redo != nil
 }
 
 func (b *Buffer) ReaderFrom(s, e int) io.RuneReader {
@@ -922,36 +987,21 @@ func (rr *runeReader) ReadRune() (r rune, size int, err error) {
 	}
 }
 
+// GetLine returns the text of the line containing i up to i (starting with
+// the newline that precedes it), the line number and the column of i
 func (b *Buffer) GetLine(i int, utf16col bool) (string, int, int) {
 	if i > b.Size() {
 		println("GetLine Error:", i, b.Size())
 		return "", 0, 0
 	}
-	ba, bb := b.Selection(util.Sel{0, b.Size()})
-	if i < len(ba) {
-		last, n, c := countNl(ba[:i], utf16col)
-		if last < 0 {
-			last = 0
-		}
-		return string(b.SelectionRunes(util.Sel{last, i})), n + 1, c
-	} else {
-		di := i - len(ba)
-		lasta, na, offa := countNl(ba, utf16col)
-		lastb, nb, offb := countNl(bb[:di], utf16col)
-		if nb == 0 {
-			if lasta < 0 {
-				lasta = 0
-			}
-			return string(b.SelectionRunes(util.Sel{lasta, i})), na + 1, offa + offb
-		} else {
-			if lastb < 0 {
-				lastb = lasta
-			} else {
-				lastb += len(ba)
-			}
-			return string(b.SelectionRunes(util.Sel{lastb, i})), na + nb + 1, offb
-		}
+	ls := b.Tonl(i-1, -1)
+	n := b.text.CountNl(ls)
+	if ls > 0 {
+		ls--
 	}
+	line := b.SelectionRunes(util.Sel{ls, i})
+	_, _, c := countNl(line, utf16col)
+	return string(line), n + 1, c
 }
 
 func (b *Buffer) CanSave() bool {
@@ -977,6 +1027,25 @@ func (b *Buffer) CanSave() bool {
 	}
 }
 
+// IgnoreDiskChanges makes the current contents of the file on disk the
+// version the buffer will overwrite without CanSave complaining.
+func (b *Buffer) IgnoreDiskChanges() error {
+	path := filepath.Join(b.Dir, b.Name)
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	b.modTime = fi.ModTime()
+	s1 := sha1.Sum(bytes)
+	b.onDiskChecksum = &s1
+	b.ChangedOnDisk = false
+	return nil
+}
+
 func countNl(rs []rune, utf16col bool) (int, int, int) {
 	count := 0
 	off := 0
@@ -1022,7 +1091,7 @@ func sizeOfRune(r rune) int {
 }
 
 func (b *Buffer) UndoWhere() int {
-	return b.ul.cur
+	return b.ul.cur.id
 }
 
 func (b *Buffer) Sels() []*util.Sel {
@@ -1033,6 +1102,13 @@ func (b *Buffer) IsDir() bool {
 	return b.Name[len(b.Name)-1] == '/'
 }
 
+// IsLarge returns true if the buffer is a large file stored in a piece
+// table, which isn't highlighted
+func (b *Buffer) IsLarge() bool {
+	_, ok := b.text.(*pieceTable)
+	return ok
+}
+
 func (b *Buffer) UndoReset() {
 	b.ul.Reset()
 }
@@ -1151,37 +1227,41 @@ func (b *Buffer) restoreSels(ssels savedSels) {
 }
 
 func (b *Buffer) FlushUndo() {
-	b.ul.cur = 0
-	b.ul.lst = b.ul.lst[0:0]
+	b.ul.Reset()
 }
 
 func (b *Buffer) LastTypePos() int {
-	j := -1
+	j := b.ul.root
 
-	for i := b.ul.cur - 1; i >= 0; i-- {
-		if j < 0 {
-			j = i
+	for n := b.ul.cur; n != b.ul.root; n = n.parent {
+		if j == b.ul.root {
+			j = n
 		}
 
-		if b.ul.lst[j].ts.Sub(b.ul.lst[i].ts) > 10*time.Second {
+		if j.ts.Sub(n.ts) > 10*time.Second {
 			break
 		}
 
-		j = i
+		j = n
 	}
 
-	if j < 0 {
+	if j == b.ul.root {
 		if b.EditableStart < 0 {
 			return 0
 		}
 		return b.EditableStart
 	}
 
-	start := b.ul.lst[j].before.S
+	path := []*undoNode{}
+	for n := b.ul.cur; n != j; n = n.parent {
+		path = append(path, n)
+	}
 
-	for i := j + 1; i < b.ul.cur; i++ {
-		if start == b.ul.lst[i].before.E {
-			start = b.ul.lst[i].before.S
+	start := j.before.S
+
+	for i := len(path) - 1; i >= 0; i-- {
+		if start == path[i].before.E {
+			start = path[i].before.S
 		}
 	}
 
@@ -1192,15 +1272,13 @@ func (b *Buffer) LastTypePos() int {
 }
 
 func (buf *Buffer) BytesSize() (r BufferSize) {
-	r.GapUsed = uintptr((cap(buf.buf) - buf.gapsz) * 6)
-	r.GapGap = uintptr(buf.gapsz * 6)
+	r.GapUsed, r.GapGap = buf.text.BytesSize()
 	for i := range buf.Words {
 		r.Words += uintptr(len(buf.Words[i]))
 	}
-	r.Undo = uintptr(cap(buf.ul.lst) * (8 + (8 * 3) + (8 * 3) + 16 + 2))
-	for i := range buf.ul.lst {
-		r.Undo += uintptr(len(buf.ul.lst[i].before.text) + len(buf.ul.lst[i].after.text))
-	}
+	buf.ul.walk(func(n *undoNode, depth int) {
+		r.Undo += uintptr((8 + (8 * 3) + (8 * 3) + 16 + 2) + (8 * 6) + len(n.before.text) + len(n.after.text))
+	})
 	return
 }
 
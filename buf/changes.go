@@ -0,0 +1,123 @@
+package buf
+
+import (
+	"github.com/aarzilli/yacco/util"
+)
+
+// Change describes a single replacement of text in the buffer. The range
+// is expressed as line and column of the buffer contents before the
+// change, columns are counted in UTF-16 code units (which is what language
+// servers expect).
+type Change struct {
+	Rev               int // value of RevCount after the change
+	StartLn, StartCol int
+	EndLn, EndCol     int
+	Text              string
+}
+
+// maximum number of characters of inserted text kept in the change log,
+// after that the changes are discarded and consumers have to resynchronize
+// using the full text.
+const maxChangeLogText = 1 << 20
+
+type changeLog struct {
+	tracking bool
+	overflow bool
+	changes  []Change
+	textsz   int
+
+	// start of a line and its line number, text before it hasn't changed
+	// since it was calculated
+	lnpos, ln int
+}
+
+// TrackChanges starts recording changes made to the buffer, see ChangesSince.
+func (b *Buffer) TrackChanges() {
+	b.wrlock()
+	defer b.unlock()
+	b.cl = changeLog{tracking: true}
+}
+
+// UntrackChanges stops recording changes and discards recorded changes.
+func (b *Buffer) UntrackChanges() {
+	b.wrlock()
+	defer b.unlock()
+	b.cl = changeLog{}
+}
+
+// ChangesSince returns the changes made after revision rev and discards
+// all recorded changes. The second return value is false if the changes
+// are not available, either because tracking wasn't enabled at rev or
+// because too many changes were made since.
+func (b *Buffer) ChangesSince(rev int) ([]Change, bool) {
+	b.wrlock()
+	defer b.unlock()
+	cl := &b.cl
+	if !cl.tracking {
+		return nil, false
+	}
+	changes, overflow := cl.changes, cl.overflow
+	cl.changes, cl.textsz, cl.overflow = nil, 0, false
+	if overflow {
+		return nil, false
+	}
+
+	i := 0
+	for i < len(changes) && changes[i].Rev <= rev {
+		i++
+	}
+	changes = changes[i:]
+	if len(changes) == 0 {
+		return nil, rev == b.RevCount
+	}
+	return changes, changes[0].Rev == rev+1 && changes[len(changes)-1].Rev == b.RevCount
+}
+
+// recordChange adds the replacement of sel with text to the change log, must
+// be called before the buffer is modified.
+func (b *Buffer) recordChange(text []rune, sel util.Sel) {
+	cl := &b.cl
+	if cl.overflow {
+		return
+	}
+	cl.textsz += len(text)
+	if cl.textsz > maxChangeLogText {
+		cl.overflow = true
+		cl.changes = nil
+		return
+	}
+
+	if cl.lnpos > sel.S {
+		cl.lnpos, cl.ln = 0, 0
+	}
+	for i := cl.lnpos; i < sel.S; i++ {
+		if b.At(i) == '\n' {
+			cl.ln++
+			cl.lnpos = i + 1
+		}
+	}
+
+	ch := Change{Rev: b.RevCount + 1, StartLn: cl.ln, EndLn: cl.ln, Text: string(text)}
+	ch.StartCol = b.utf16Len(cl.lnpos, sel.S)
+	endlnpos := cl.lnpos
+	for i := sel.S; i < sel.E; i++ {
+		if b.At(i) == '\n' {
+			ch.EndLn++
+			endlnpos = i + 1
+		}
+	}
+	ch.EndCol = b.utf16Len(endlnpos, sel.E)
+	cl.changes = append(cl.changes, ch)
+}
+
+func (b *Buffer) utf16Len(start, end int) int {
+	n := 0
+	for i := start; i < end; i++ {
+		if b.At(i) > 0xffff {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
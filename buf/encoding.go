@@ -0,0 +1,241 @@
+package buf
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Encodings of files, stored in the "encoding" property of buffers.
+// UTF-16 files are always written with a byte order mark.
+const (
+	EncodingUTF8        = "utf-8"
+	EncodingUTF8BOM     = "utf-8-bom"
+	EncodingUTF16LE     = "utf-16le"
+	EncodingUTF16BE     = "utf-16be"
+	EncodingLatin1      = "latin1"
+	EncodingWindows1252 = "windows-1252"
+)
+
+// Line endings of files, stored in the "eol" property of buffers.
+const (
+	EolLF   = "lf"
+	EolCRLF = "crlf"
+)
+
+var Encodings = []string{EncodingUTF8, EncodingUTF8BOM, EncodingUTF16LE, EncodingUTF16BE, EncodingLatin1, EncodingWindows1252}
+
+var (
+	bomUTF8    = []byte{0xef, 0xbb, 0xbf}
+	bomUTF16LE = []byte{0xff, 0xfe}
+	bomUTF16BE = []byte{0xfe, 0xff}
+)
+
+// Characters of windows-1252 between 0x80 and 0x9f, the rest is the same as
+// latin1. Unassigned bytes are mapped to the corresponding control
+// characters.
+var windows1252 = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8d, 'Ž', 0x8f,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9d, 'ž', 'Ÿ',
+}
+
+func validEncoding(encoding string) bool {
+	for _, e := range Encodings {
+		if e == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeText detects the encoding and line endings of the contents of a
+// file and converts it to text with LF line endings.
+func decodeText(in []byte) (text []rune, encoding, eol string, err error) {
+	var s string
+	switch {
+	case bytes.HasPrefix(in, bomUTF8):
+		encoding = EncodingUTF8BOM
+		s = string(in[len(bomUTF8):])
+	case bytes.HasPrefix(in, bomUTF16LE):
+		encoding = EncodingUTF16LE
+		s = decodeUTF16(in[len(bomUTF16LE):], false)
+	case bytes.HasPrefix(in, bomUTF16BE):
+		encoding = EncodingUTF16BE
+		s = decodeUTF16(in[len(bomUTF16BE):], true)
+	default:
+		if isBinary(in) {
+			return nil, "", "", fmt.Errorf("Can not open binary file")
+		}
+		if utf8.Valid(in) {
+			encoding = EncodingUTF8
+			s = string(in)
+		} else {
+			encoding, s = decodeLegacy(in)
+		}
+	}
+
+	// files with mixed line endings are left alone
+	eol = EolLF
+	if ncrlf := strings.Count(s, "\r\n"); ncrlf > 0 && ncrlf == strings.Count(s, "\n") {
+		eol = EolCRLF
+		s = strings.Replace(s, "\r\n", "\n", -1)
+	}
+
+	return []rune(s), encoding, eol, nil
+}
+
+func allCRLF(in []byte) bool {
+	ncrlf := bytes.Count(in, []byte("\r\n"))
+	return ncrlf > 0 && ncrlf == bytes.Count(in, []byte("\n"))
+}
+
+// plainText returns true if in can be used as the text of a buffer without
+// conversion: UTF-8 without byte order mark and with LF line endings.
+func plainText(in []byte) bool {
+	return !bytes.HasPrefix(in, bomUTF8) && !bytes.HasPrefix(in, bomUTF16LE) && !bytes.HasPrefix(in, bomUTF16BE) && !isBinary(in) && utf8.Valid(in) && !allCRLF(in)
+}
+
+func decodeUTF16(in []byte, bigEndian bool) string {
+	u := make([]uint16, 0, len(in)/2)
+	for i := 0; i+1 < len(in); i += 2 {
+		if bigEndian {
+			u = append(u, uint16(in[i])<<8|uint16(in[i+1]))
+		} else {
+			u = append(u, uint16(in[i+1])<<8|uint16(in[i]))
+		}
+	}
+	r := utf16.Decode(u)
+	if len(in)%2 != 0 {
+		r = append(r, utf8.RuneError)
+	}
+	return string(r)
+}
+
+// decodeLegacy decodes text that isn't valid UTF-8 as windows-1252 if it
+// uses any of the characters it adds to latin1, as latin1 otherwise.
+func decodeLegacy(in []byte) (string, string) {
+	encoding := EncodingLatin1
+	r := make([]rune, len(in))
+	for i, c := range in {
+		if c >= 0x80 && c < 0xa0 {
+			encoding = EncodingWindows1252
+		}
+		r[i] = rune(c)
+	}
+	if encoding == EncodingWindows1252 {
+		for i, c := range in {
+			if c >= 0x80 && c < 0xa0 {
+				r[i] = windows1252[c-0x80]
+			}
+		}
+	}
+	return encoding, string(r)
+}
+
+// encodingBOM returns the byte order mark that is written at the start of
+// files with the specified encoding.
+func encodingBOM(encoding string) []byte {
+	switch encoding {
+	case EncodingUTF8BOM:
+		return bomUTF8
+	case EncodingUTF16LE:
+		return bomUTF16LE
+	case EncodingUTF16BE:
+		return bomUTF16BE
+	}
+	return nil
+}
+
+// encodeText converts text to the specified encoding and line endings.
+func encodeText(text []rune, encoding, eol string) ([]byte, error) {
+	if eol == EolCRLF {
+		n := 0
+		for _, ch := range text {
+			if ch == '\n' {
+				n++
+			}
+		}
+		if n > 0 {
+			crlf := make([]rune, 0, len(text)+n)
+			for _, ch := range text {
+				if ch == '\n' {
+					crlf = append(crlf, '\r')
+				}
+				crlf = append(crlf, ch)
+			}
+			text = crlf
+		}
+	} else if eol != "" && eol != EolLF {
+		return nil, fmt.Errorf("Unknown line ending: %s", eol)
+	}
+
+	switch encoding {
+	case "", EncodingUTF8, EncodingUTF8BOM:
+		return []byte(string(text)), nil
+
+	case EncodingUTF16LE, EncodingUTF16BE:
+		u := utf16.Encode(text)
+		out := make([]byte, 2*len(u))
+		for i, c := range u {
+			if encoding == EncodingUTF16BE {
+				out[2*i], out[2*i+1] = byte(c>>8), byte(c)
+			} else {
+				out[2*i], out[2*i+1] = byte(c), byte(c>>8)
+			}
+		}
+		return out, nil
+
+	case EncodingLatin1, EncodingWindows1252:
+		out := make([]byte, len(text))
+		for i, ch := range text {
+			c, ok := encodeLegacy(ch, encoding)
+			if !ok {
+				return nil, fmt.Errorf("Character %q can not be represented in %s", ch, encoding)
+			}
+			out[i] = c
+		}
+		return out, nil
+	}
+
+	return nil, fmt.Errorf("Unknown encoding: %s", encoding)
+}
+
+func encodeLegacy(ch rune, encoding string) (byte, bool) {
+	if encoding == EncodingWindows1252 {
+		if ch >= 0x80 && ch < 0xa0 {
+			// only the unassigned bytes map to control characters
+			return byte(ch), windows1252[ch-0x80] == ch
+		}
+		for i, c := range windows1252 {
+			if c == ch {
+				return byte(0x80 + i), true
+			}
+		}
+	}
+	if ch < 0x100 {
+		return byte(ch), true
+	}
+	return 0, false
+}
+
+// SetEncoding changes the encoding and line endings used to save the
+// buffer, empty arguments leave the corresponding property unchanged.
+func (b *Buffer) SetEncoding(encoding, eol string) error {
+	if encoding != "" && !validEncoding(encoding) {
+		return fmt.Errorf("Unknown encoding: %s", encoding)
+	}
+	if eol != "" && eol != EolLF && eol != EolCRLF {
+		return fmt.Errorf("Unknown line ending: %s", eol)
+	}
+	if encoding != "" && encoding != b.Props["encoding"] {
+		b.Props["encoding"] = encoding
+		b.Modified = true
+	}
+	if eol != "" && eol != b.Props["eol"] {
+		b.Props["eol"] = eol
+		b.Modified = true
+	}
+	return nil
+}
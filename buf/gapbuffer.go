@@ -0,0 +1,145 @@
+package buf
+
+import (
+	"fmt"
+)
+
+const SLOP = 128
+
+// gapBuffer stores the text as a slice of runes with a gap, of size gapsz
+// starting at gap, where the next insertion will happen.
+type gapBuffer struct {
+	buf        []rune
+	gap, gapsz int
+}
+
+func newGapBuffer() *gapBuffer {
+	return &gapBuffer{
+		buf:   make([]rune, SLOP),
+		gap:   0,
+		gapsz: SLOP,
+	}
+}
+
+func (gb *gapBuffer) Replace(s, e int, text []rune) {
+	gb.MoveGap(s)
+	gb.gapsz += e - s // this effectively deletes the current selection
+
+	gb.IncGap(len(text))
+	for i, r := range text {
+		gb.buf[gb.gap+i] = r
+	}
+	gb.gap += len(text)
+	gb.gapsz -= len(text)
+}
+
+// Increases the size of the gap to fit at least delta more items
+func (gb *gapBuffer) IncGap(delta int) {
+	if gb.gapsz > delta+1 {
+		return
+	}
+
+	ngapsz := (delta/SLOP + 1) * SLOP
+
+	nbuf := make([]rune, len(gb.buf)-gb.gapsz+ngapsz)
+
+	copy(nbuf, gb.buf[:gb.gap])
+	copy(nbuf[gb.gap+ngapsz:], gb.buf[gb.gap+gb.gapsz:])
+
+	gb.buf = nbuf
+	gb.gapsz = ngapsz
+}
+
+// Displaces gap to start at point p
+func (gb *gapBuffer) MoveGap(p int) {
+	pp := gb.phisical(p)
+	if pp > len(gb.buf) {
+		panic(fmt.Errorf("MoveGap point out of range: %d", pp))
+	}
+
+	if pp < gb.gap {
+		if gb.gap-pp > 0 {
+			//size =  gb.gap - pp
+			//memmove(buffer->buf + pp + buffer->gapsz, buffer->buf + pp, sizeof(my_glyph_info_t) * size);
+			copy(gb.buf[pp+gb.gapsz:], gb.buf[pp:gb.gap])
+		}
+		gb.gap = pp
+	} else if pp > gb.gap {
+		if pp-gb.gap-gb.gapsz > 0 {
+			//size = pp - gb.gap - gb.gapsz
+			//memmove(buffer->buf + buffer->gap, buffer->buf + buffer->gap + buffer->gapsz, sizeof(my_glyph_info_t) * size);
+			copy(gb.buf[gb.gap:], gb.buf[gb.gap+gb.gapsz:pp])
+		}
+		gb.gap = pp - gb.gapsz
+	}
+}
+
+func (gb *gapBuffer) phisical(p int) int {
+	if p < gb.gap {
+		return p
+	} else {
+		return p + gb.gapsz
+	}
+}
+
+func (gb *gapBuffer) At(p int) rune {
+	pp := gb.phisical(p)
+	if (pp < 0) || (pp >= len(gb.buf)) {
+		return 0
+	}
+	return gb.buf[pp]
+}
+
+func (gb *gapBuffer) Selection(s, e int) ([]rune, []rune) {
+	ps := gb.phisical(s)
+	pe := gb.phisical(e)
+
+	if ps < 0 {
+		ps = 0
+	}
+	if pe > len(gb.buf) {
+		pe = len(gb.buf)
+	}
+
+	if (ps < gb.gap) && (pe >= gb.gap) {
+		return gb.buf[ps:gb.gap], gb.buf[gb.gap+gb.gapsz : pe]
+	} else {
+		if pe <= ps {
+			return []rune{}, []rune{}
+		} else {
+			return gb.buf[ps:pe], []rune{}
+		}
+	}
+}
+
+func (gb *gapBuffer) CountNl(p int) int {
+	n := 0
+	ba, bb := gb.Selection(0, p)
+	for _, bcur := range [][]rune{ba, bb} {
+		for _, ch := range bcur {
+			if ch == '\n' {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func (gb *gapBuffer) ByteOffset(p int) int {
+	n := 0
+	ba, bb := gb.Selection(0, p)
+	for _, bcur := range [][]rune{ba, bb} {
+		for _, ch := range bcur {
+			n += sizeOfRune(ch)
+		}
+	}
+	return n
+}
+
+func (gb *gapBuffer) Size() int {
+	return len(gb.buf) - gb.gapsz
+}
+
+func (gb *gapBuffer) BytesSize() (used, free uintptr) {
+	return uintptr((cap(gb.buf) - gb.gapsz) * 6), uintptr(gb.gapsz * 6)
+}
@@ -0,0 +1,338 @@
+package buf
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"syscall"
+	"unicode/utf8"
+)
+
+// Maximum size in bytes of the pieces the original file is split into,
+// limits the cost of accessing a character in the middle of a piece
+// containing non-ASCII text.
+const pieceChunkSize = 16 * 1024
+
+// pieceTable stores the text as a sequence of pieces of UTF-8 text, each
+// one either a part of the original contents of the file (usually mmapped)
+// or of the text inserted since.
+type pieceTable struct {
+	orig   []byte
+	add    []byte
+	pieces []piece
+	size   int  // in runes
+	mapped bool // orig is mmapped
+
+	// position of the last character accessed by At, to make sequential
+	// access fast in pieces with non-ASCII characters
+	curMu                   sync.Mutex
+	curPiece, curRune, curB int
+}
+
+type piece struct {
+	add   bool // text is in add instead of orig
+	off   int  // offset in bytes
+	len   int  // length in bytes
+	runes int  // length in runes
+	start int  // position of the first character in the text
+	ascii bool
+}
+
+// newPieceTable returns a piece table containing orig, which must be valid
+// UTF-8 and is never modified.
+func newPieceTable(orig []byte) *pieceTable {
+	pt := &pieceTable{orig: orig, curPiece: -1}
+	for off := 0; off < len(orig); {
+		end := off + pieceChunkSize
+		if end >= len(orig) {
+			end = len(orig)
+		} else {
+			for end > off && !utf8.RuneStart(orig[end]) {
+				end--
+			}
+		}
+		pt.pieces = append(pt.pieces, makePiece(false, orig[off:end], off))
+		off = end
+	}
+	pt.updateStarts(0)
+	return pt
+}
+
+// mapPieceTable returns a piece table over the mmapped contents of f,
+// which must be size bytes long.
+func mapPieceTable(f *os.File, size int) (*pieceTable, error) {
+	orig, err := syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+	pt := newPieceTable(orig)
+	pt.mapped = true
+	runtime.SetFinalizer(pt, func(pt *pieceTable) {
+		syscall.Munmap(pt.orig)
+	})
+	return pt, nil
+}
+
+// unmap releases the mmapped contents of pt, which can not be used after
+func (pt *pieceTable) unmap() {
+	runtime.SetFinalizer(pt, nil)
+	syscall.Munmap(pt.orig)
+	pt.orig, pt.pieces, pt.size = nil, nil, 0
+}
+
+func makePiece(add bool, text []byte, off int) piece {
+	p := piece{add: add, off: off, len: len(text), ascii: true}
+	for _, c := range text {
+		if c >= utf8.RuneSelf {
+			p.ascii = false
+			break
+		}
+	}
+	if p.ascii {
+		p.runes = len(text)
+	} else {
+		p.runes = utf8.RuneCount(text)
+	}
+	return p
+}
+
+func (pt *pieceTable) data(p *piece) []byte {
+	if p.add {
+		return pt.add[p.off : p.off+p.len]
+	}
+	return pt.orig[p.off : p.off+p.len]
+}
+
+// updateStarts recalculates the start of pieces after the i-th
+func (pt *pieceTable) updateStarts(i int) {
+	start := 0
+	if i > 0 {
+		start = pt.pieces[i-1].start + pt.pieces[i-1].runes
+	}
+	for ; i < len(pt.pieces); i++ {
+		pt.pieces[i].start = start
+		start += pt.pieces[i].runes
+	}
+	pt.size = start
+}
+
+// find returns the index of the piece containing p
+func (pt *pieceTable) find(p int) int {
+	return sort.Search(len(pt.pieces), func(i int) bool {
+		return pt.pieces[i].start+pt.pieces[i].runes > p
+	})
+}
+
+// byteOffset returns the offset in bytes of the n-th character of the
+// i-th piece. Must be called with curMu held.
+func (pt *pieceTable) byteOffset(i, n int) int {
+	p := &pt.pieces[i]
+	if p.ascii {
+		return n
+	}
+	d := pt.data(p)
+	r, b := 0, 0
+	if pt.curPiece == i && pt.curRune <= n {
+		r, b = pt.curRune, pt.curB
+	} else if pt.curPiece == i && pt.curRune-n < n {
+		r, b = pt.curRune, pt.curB
+		for r > n {
+			_, sz := utf8.DecodeLastRune(d[:b])
+			b -= sz
+			r--
+		}
+	}
+	for r < n {
+		_, sz := utf8.DecodeRune(d[b:])
+		b += sz
+		r++
+	}
+	pt.curPiece, pt.curRune, pt.curB = i, r, b
+	return b
+}
+
+func (pt *pieceTable) Size() int {
+	return pt.size
+}
+
+func (pt *pieceTable) At(p int) rune {
+	if p < 0 || p >= pt.size {
+		return 0
+	}
+	pt.curMu.Lock()
+	defer pt.curMu.Unlock()
+	i := pt.curPiece
+	if i < 0 || i >= len(pt.pieces) || p < pt.pieces[i].start || p >= pt.pieces[i].start+pt.pieces[i].runes {
+		i = pt.find(p)
+	}
+	pc := &pt.pieces[i]
+	d := pt.data(pc)
+	if pc.ascii {
+		pt.curPiece = i
+		return rune(d[p-pc.start])
+	}
+	r, _ := utf8.DecodeRune(d[pt.byteOffset(i, p-pc.start):])
+	return r
+}
+
+func (pt *pieceTable) Selection(s, e int) ([]rune, []rune) {
+	if s < 0 {
+		s = 0
+	}
+	if e > pt.size {
+		e = pt.size
+	}
+	if e <= s {
+		return []rune{}, []rune{}
+	}
+	r := make([]rune, 0, e-s)
+	pt.curMu.Lock()
+	defer pt.curMu.Unlock()
+	for i := pt.find(s); i < len(pt.pieces) && pt.pieces[i].start < e; i++ {
+		pc := &pt.pieces[i]
+		d := pt.data(pc)
+		ls, le := 0, pc.runes
+		if s > pc.start {
+			ls = s - pc.start
+			d = d[pt.byteOffset(i, ls):]
+		}
+		if e < pc.start+pc.runes {
+			le = e - pc.start
+		}
+		for j := ls; j < le; j++ {
+			ch, sz := utf8.DecodeRune(d)
+			r = append(r, ch)
+			d = d[sz:]
+		}
+	}
+	return r, []rune{}
+}
+
+// split makes p the start of a piece and returns its index. Must be
+// called with curMu held.
+func (pt *pieceTable) split(p int) int {
+	if p >= pt.size {
+		return len(pt.pieces)
+	}
+	i := pt.find(p)
+	pc := pt.pieces[i]
+	if pc.start == p {
+		return i
+	}
+	b := pt.byteOffset(i, p-pc.start)
+	first := pc
+	first.len, first.runes = b, p-pc.start
+	second := pc
+	second.off, second.len, second.runes, second.start = pc.off+b, pc.len-b, pc.runes-first.runes, p
+	if !pc.ascii {
+		first = makePiece(pc.add, pt.data(&first), first.off)
+		first.start = pc.start
+		second = makePiece(pc.add, pt.data(&second), second.off)
+		second.start = p
+	}
+	pt.pieces = append(pt.pieces, piece{})
+	copy(pt.pieces[i+2:], pt.pieces[i+1:])
+	pt.pieces[i], pt.pieces[i+1] = first, second
+	pt.curPiece = -1
+	return i + 1
+}
+
+func (pt *pieceTable) Replace(s, e int, text []rune) {
+	pt.curMu.Lock()
+	defer pt.curMu.Unlock()
+
+	i := pt.split(s)
+	j := pt.split(e)
+
+	pt.pieces = append(pt.pieces[:i], pt.pieces[j:]...)
+
+	if len(text) > 0 {
+		off := len(pt.add)
+		pt.add = append(pt.add, string(text)...)
+		np := makePiece(true, pt.add[off:], off)
+		if i > 0 && pt.pieces[i-1].add && pt.pieces[i-1].off+pt.pieces[i-1].len == off {
+			// continues the previous insertion
+			prev := &pt.pieces[i-1]
+			prev.len += np.len
+			prev.runes += np.runes
+			prev.ascii = prev.ascii && np.ascii
+		} else {
+			pt.pieces = append(pt.pieces, piece{})
+			copy(pt.pieces[i+1:], pt.pieces[i:])
+			pt.pieces[i] = np
+		}
+	}
+
+	if i > 0 {
+		i--
+	}
+	pt.updateStarts(i)
+	pt.curPiece = -1
+}
+
+func (pt *pieceTable) ByteOffset(p int) int {
+	if p <= 0 {
+		return 0
+	}
+	if p >= pt.size {
+		p = pt.size
+	}
+	pt.curMu.Lock()
+	defer pt.curMu.Unlock()
+	n := 0
+	i := 0
+	for ; i < len(pt.pieces) && pt.pieces[i].start+pt.pieces[i].runes <= p; i++ {
+		n += pt.pieces[i].len
+	}
+	if i < len(pt.pieces) && p > pt.pieces[i].start {
+		n += pt.byteOffset(i, p-pt.pieces[i].start)
+	}
+	return n
+}
+
+func (pt *pieceTable) CountNl(p int) int {
+	if p >= pt.size {
+		p = pt.size
+	}
+	pt.curMu.Lock()
+	defer pt.curMu.Unlock()
+	n := 0
+	for i := 0; i < len(pt.pieces) && pt.pieces[i].start < p; i++ {
+		d := pt.data(&pt.pieces[i])
+		if p < pt.pieces[i].start+pt.pieces[i].runes {
+			d = d[:pt.byteOffset(i, p-pt.pieces[i].start)]
+		}
+		n += bytes.Count(d, []byte{'\n'})
+	}
+	return n
+}
+
+func (pt *pieceTable) BytesSize() (used, free uintptr) {
+	const pieceSize = 6 * 8
+	return uintptr(len(pt.orig) + len(pt.add) + len(pt.pieces)*pieceSize), uintptr(cap(pt.add) - len(pt.add) + (cap(pt.pieces)-len(pt.pieces))*pieceSize)
+}
+
+// copy returns a piece table with the same text that doesn't use the
+// original contents.
+func (pt *pieceTable) copy() *pieceTable {
+	n := 0
+	for i := range pt.pieces {
+		n += pt.pieces[i].len
+	}
+	text := make([]byte, 0, n)
+	for _, chunk := range pt.chunks() {
+		text = append(text, chunk...)
+	}
+	return newPieceTable(text)
+}
+
+// chunks returns the UTF-8 text of every piece.
+func (pt *pieceTable) chunks() [][]byte {
+	r := make([][]byte, len(pt.pieces))
+	for i := range pt.pieces {
+		r[i] = pt.data(&pt.pieces[i])
+	}
+	return r
+}
@@ -0,0 +1,130 @@
+package buf
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/aarzilli/yacco/config"
+)
+
+// saveTarget returns the file that should be replaced when saving to path,
+// following symlinks, and its current file info (nil if it doesn't exist).
+func saveTarget(path string) (string, os.FileInfo) {
+	for i := 0; i < 255; i++ {
+		lfi, err := os.Lstat(path)
+		if err != nil || lfi.Mode()&os.ModeSymlink == 0 {
+			break
+		}
+		dest, err := os.Readlink(path)
+		if err != nil {
+			break
+		}
+		if !filepath.IsAbs(dest) {
+			dest = filepath.Join(filepath.Dir(path), dest)
+		}
+		path = dest
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return path, nil
+	}
+	return path, fi
+}
+
+// createTemp creates a new file in the same directory as path, it will be
+// renamed to path once written.
+func createTemp(path string, perm os.FileMode) (*os.File, error) {
+	dir, base := filepath.Split(path)
+	for i := 0; ; i++ {
+		name := filepath.Join(dir, fmt.Sprintf(".%s.%d.%d~", base, os.Getpid(), i))
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+		if os.IsExist(err) && i < 100 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// access(2) mode checking for write permission
+const accessWrite = 0x2
+
+// canReplace returns true if path (described by fi) can be replaced by tmp,
+// a new file in the same directory: path must be writable and tmp is given
+// its owner and group. Otherwise replacing path would let the user write a
+// file they can't write or change its owner.
+func canReplace(path, tmp string, fi os.FileInfo) bool {
+	if syscall.Access(path, accessWrite) != nil {
+		return false
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		// changing the owner is only possible for root, changing the group
+		// only to groups the user belongs to
+		if os.Chown(tmp, int(st.Uid), int(st.Gid)) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// preserveMode copies the permissions of fi to the file at path, it must
+// be called after writing it, since writing can clear setuid and setgid.
+func preserveMode(path string, fi os.FileInfo) error {
+	return os.Chmod(path, fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+}
+
+// backupName returns the name of the backup copy of path, as configured
+// by config.Backup, or the empty string if backups are disabled.
+func backupName(path string) string {
+	switch config.Backup {
+	case config.BackupTilde:
+		return path + "~"
+	case config.BackupTimestamp:
+		return path + "." + time.Now().Format("20060102-150405") + "~"
+	}
+	return ""
+}
+
+// backup keeps the current contents of path as a backup copy. If the
+// original file will be replaced by rename a hard link is enough,
+// otherwise the contents are copied.
+func backup(path string, inplace bool) error {
+	name := backupName(path)
+	if name == "" {
+		return nil
+	}
+	os.Remove(name)
+	if !inplace && os.Link(path, name) == nil {
+		return nil
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not create backup: %v", err)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("could not create backup: %v", err)
+	}
+	_, err = io.Copy(out, in)
+	if err1 := out.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(name)
+		return fmt.Errorf("could not create backup: %v", err)
+	}
+	return nil
+}
+
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
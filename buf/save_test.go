@@ -0,0 +1,277 @@
+package buf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aarzilli/yacco/config"
+	"github.com/aarzilli/yacco/hl"
+	"github.com/aarzilli/yacco/util"
+)
+
+func putTest(t *testing.T, dir, name, text string) {
+	t.Helper()
+	b, err := NewBuffer(dir, name, true, "\t", hl.NilHighlighter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Replace([]rune(text), &util.Sel{0, b.Size()}, true, nil, 0)
+	if err := b.Put(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkFile(t *testing.T, path, tgt string) {
+	t.Helper()
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != tgt {
+		t.Errorf("wrong contents of %s: %q (expected %q)", path, string(bs), tgt)
+	}
+}
+
+func TestPut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yacco-put")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(old string) { config.Backup = old }(config.Backup)
+	config.Backup = config.BackupTilde
+
+	// permissions are preserved
+	script := filepath.Join(dir, "script.sh")
+	ioutil.WriteFile(script, []byte("old\n"), 0700)
+	os.Chmod(script, 0751)
+	putTest(t, dir, "script.sh", "new\n")
+	checkFile(t, script, "new\n")
+	checkFile(t, script+"~", "old\n")
+	if fi, _ := os.Stat(script); fi.Mode().Perm() != 0751 {
+		t.Errorf("wrong permissions %v", fi.Mode())
+	}
+
+	// symlinks are followed
+	os.Symlink("script.sh", filepath.Join(dir, "link"))
+	putTest(t, dir, "link", "linked\n")
+	checkFile(t, script, "linked\n")
+	if fi, _ := os.Lstat(filepath.Join(dir, "link")); fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("symlink replaced")
+	}
+
+	// hard links are written in place
+	os.Link(script, filepath.Join(dir, "hard"))
+	putTest(t, dir, "hard", "hard\n")
+	checkFile(t, script, "hard\n")
+	checkFile(t, filepath.Join(dir, "hard~"), "linked\n")
+
+	// new files, no temporary files are left behind
+	config.Backup = config.BackupNone
+	putTest(t, dir, "new.txt", "a\n")
+	checkFile(t, filepath.Join(dir, "new.txt"), "a\n")
+	fis, _ := ioutil.ReadDir(dir)
+	names := []string{}
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	if len(names) != 6 {
+		t.Errorf("unexpected files: %v", names)
+	}
+
+	// read-only files aren't replaced (root can write them anyway)
+	if os.Getuid() != 0 {
+		ro := filepath.Join(dir, "ro.txt")
+		ioutil.WriteFile(ro, []byte("old\n"), 0444)
+		b, err := NewBuffer(dir, "ro.txt", false, "\t", hl.NilHighlighter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Replace([]rune("new\n"), &util.Sel{0, b.Size()}, true, nil, 0)
+		if err := b.Put(); !os.IsPermission(err) {
+			t.Errorf("read-only file saved: %v", err)
+		}
+		checkFile(t, ro, "old\n")
+	}
+}
+
+func TestEncodingRoundtrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yacco-encoding")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		contents, text, encoding, eol string
+	}{
+		{"plain\nfile\n", "plain\nfile\n", EncodingUTF8, EolLF},
+		{"dos\r\nfile\r\n", "dos\nfile\n", EncodingUTF8, EolCRLF},
+		{"mixed\r\nfile\n", "mixed\r\nfile\n", EncodingUTF8, EolLF},
+		{"\xef\xbb\xbfbom è\n", "bom è\n", EncodingUTF8BOM, EolLF},
+		{"\xff\xfeu\x00t\x00f\x00\r\x00\n\x00", "utf\n", EncodingUTF16LE, EolCRLF},
+		{"\xfe\xff\x00u\x00t\x00f\x00\n", "utf\n", EncodingUTF16BE, EolLF},
+		{"caff\xe8\n", "caffè\n", EncodingLatin1, EolLF},
+		{"\x93quoted\x94 \x80\n", "“quoted” €\n", EncodingWindows1252, EolLF},
+	}
+
+	for i, tc := range tests {
+		path := filepath.Join(dir, "file")
+		ioutil.WriteFile(path, []byte(tc.contents), 0666)
+		b, err := NewBuffer(dir, "file", false, "\t", hl.NilHighlighter)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if text := string(b.SelectionRunes(util.Sel{0, b.Size()})); text != tc.text {
+			t.Errorf("%d: wrong text %q (expected %q)", i, text, tc.text)
+		}
+		if b.Props["encoding"] != tc.encoding || b.Props["eol"] != tc.eol {
+			t.Errorf("%d: wrong encoding %s %s (expected %s %s)", i, b.Props["encoding"], b.Props["eol"], tc.encoding, tc.eol)
+		}
+		if err := b.Put(); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		checkFile(t, path, tc.contents)
+		if !b.CanSave() {
+			t.Errorf("%d: checksum mismatch after Put", i)
+		}
+	}
+
+	// conversion
+	path := filepath.Join(dir, "conv")
+	ioutil.WriteFile(path, []byte("caff\xe8\n"), 0666)
+	b, err := NewBuffer(dir, "conv", false, "\t", hl.NilHighlighter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetEncoding(EncodingUTF8, EolCRLF); err != nil {
+		t.Fatal(err)
+	}
+	if !b.Modified {
+		t.Errorf("buffer not modified after conversion")
+	}
+	b.Replace([]rune("€\n"), &util.Sel{b.Size(), b.Size()}, true, nil, 0)
+	if err := b.Put(); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, path, "caffè\r\n€\r\n")
+
+	if err := b.SetEncoding(EncodingLatin1, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(); err == nil {
+		t.Errorf("no error saving € as latin1")
+	}
+	checkFile(t, path, "caffè\r\n€\r\n")
+
+	if err := b.SetEncoding("ebcdic", ""); err == nil {
+		t.Errorf("no error for unknown encoding")
+	}
+}
+
+func TestIgnoreDiskChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yacco-ondisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	ioutil.WriteFile(path, []byte("old\n"), 0666)
+	b, err := NewBuffer(dir, "file", false, "\t", hl.NilHighlighter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(path, []byte("changed\n"), 0666)
+	os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if b.CanSave() {
+		t.Fatalf("change on disk not detected")
+	}
+	b.ChangedOnDisk = true
+	if err := b.IgnoreDiskChanges(); err != nil {
+		t.Fatal(err)
+	}
+	if !b.CanSave() || b.ChangedOnDisk {
+		t.Errorf("change on disk not ignored")
+	}
+}
+
+func TestPersistentUndo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yacco-undo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(old bool, olddir string) { config.PersistentUndo, UndoDir = old, olddir }(config.PersistentUndo, UndoDir)
+	config.PersistentUndo = true
+	UndoDir = filepath.Join(dir, "undo")
+
+	text := func(b *Buffer) string {
+		return string(b.SelectionRunes(util.Sel{0, b.Size()}))
+	}
+
+	path := filepath.Join(dir, "file")
+	ioutil.WriteFile(path, []byte("one\n"), 0666)
+	b, err := NewBuffer(dir, "file", false, "\t", hl.NilHighlighter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Replace([]rune("two\n"), &util.Sel{b.Size(), b.Size()}, true, nil, 0)
+	if err := b.Put(); err != nil {
+		t.Fatal(err)
+	}
+	b.Replace([]rune("three\n"), &util.Sel{b.Size(), b.Size()}, true, nil, 0)
+	b.SaveUndo()
+
+	// unsaved changes can be redone
+	b, err = NewBuffer(dir, "file", false, "\t", hl.NilHighlighter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text(b) != "one\ntwo\n" || b.Modified {
+		t.Fatalf("wrong text after reopening %q %v", text(b), b.Modified)
+	}
+	sel := util.Sel{0, 0}
+	b.Undo(&sel, false)
+	if text(b) != "one\n" || !b.Modified {
+		t.Fatalf("wrong text after undo %q %v", text(b), b.Modified)
+	}
+	b.Undo(&sel, true)
+	b.Undo(&sel, true)
+	if text(b) != "one\ntwo\nthree\n" || !b.Modified {
+		t.Fatalf("wrong text after redo %q %v", text(b), b.Modified)
+	}
+
+	// branches of the undo tree are saved
+	b.Undo(&sel, false)
+	b.Replace([]rune("four\n"), &util.Sel{b.Size(), b.Size()}, true, nil, 0)
+	b.SaveUndo()
+	b, err = NewBuffer(dir, "file", false, "\t", hl.NilHighlighter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Undo(&sel, true)
+	if text(b) != "one\ntwo\nfour\n" {
+		t.Fatalf("wrong text after redo of branch %q", text(b))
+	}
+	b.UndoBranch(-1, &sel)
+	if text(b) != "one\ntwo\nthree\n" {
+		t.Fatalf("wrong text after switching branch %q", text(b))
+	}
+
+	// changes on disk invalidate the history
+	b.SaveUndo()
+	ioutil.WriteFile(path, []byte("one\ntwo\nfour\n"), 0666)
+	b, err = NewBuffer(dir, "file", false, "\t", hl.NilHighlighter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.HasUndo() || b.HasRedo() {
+		t.Errorf("undo history loaded for a changed file")
+	}
+}
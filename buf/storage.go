@@ -0,0 +1,25 @@
+package buf
+
+// storage holds the text of a buffer. Positions are expressed in runes.
+type storage interface {
+	Size() int
+	// At returns the character at p or 0 if p is out of range
+	At(p int) rune
+	// Selection returns the text between s and e as two slices to be
+	// treated as contiguous. The slices must not be modified and are only
+	// valid until the next call to Replace.
+	Selection(s, e int) ([]rune, []rune)
+	// Replace replaces the text between s and e with text
+	Replace(s, e int, text []rune)
+	// CountNl returns the number of newlines before p
+	CountNl(p int) int
+	// ByteOffset returns the length of the UTF-8 encoding of the text
+	// before p
+	ByteOffset(p int) int
+	// BytesSize returns the memory used to store the text and the memory
+	// reserved for future insertions
+	BytesSize() (used, free uintptr)
+}
+
+var _ storage = &gapBuffer{}
+var _ storage = &pieceTable{}
@@ -0,0 +1,277 @@
+package buf
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/aarzilli/yacco/config"
+	"github.com/aarzilli/yacco/hl"
+	"github.com/aarzilli/yacco/util"
+)
+
+func storageText(st storage) string {
+	ba, bb := st.Selection(0, st.Size())
+	return string(ba) + string(bb)
+}
+
+func checkStorage(t *testing.T, descr string, st storage, tgt []rune) {
+	t.Helper()
+	if st.Size() != len(tgt) {
+		t.Fatalf("%s: wrong size %d (expected %d)", descr, st.Size(), len(tgt))
+	}
+	if s := storageText(st); s != string(tgt) {
+		t.Fatalf("%s: wrong text %q (expected %q)", descr, s, string(tgt))
+	}
+	for i := range tgt {
+		if ch := st.At(i); ch != tgt[i] {
+			t.Fatalf("%s: wrong character at %d %q (expected %q)", descr, i, ch, tgt[i])
+		}
+	}
+	for i := len(tgt) - 1; i >= 0; i -= 7 {
+		if ch := st.At(i); ch != tgt[i] {
+			t.Fatalf("%s: wrong character at %d going backwards %q (expected %q)", descr, i, ch, tgt[i])
+		}
+	}
+	if st.At(len(tgt)) != 0 || st.At(-1) != 0 {
+		t.Fatalf("%s: out of range access", descr)
+	}
+	for _, p := range []int{0, len(tgt) / 3, len(tgt)} {
+		if n, tn := st.ByteOffset(p), len(string(tgt[:p])); n != tn {
+			t.Fatalf("%s: wrong byte offset of %d %d (expected %d)", descr, p, n, tn)
+		}
+		if n, tn := st.CountNl(p), strings.Count(string(tgt[:p]), "\n"); n != tn {
+			t.Fatalf("%s: wrong number of newlines before %d %d (expected %d)", descr, p, n, tn)
+		}
+	}
+}
+
+func TestPieceTable(t *testing.T) {
+	words := []string{"a", "bc", "def\n", "è", "àò ", "日本語", "\n", "𝄞x", ""}
+	rnd := rand.New(rand.NewSource(0))
+	randText := func(n int) string {
+		var s []byte
+		for i := 0; i < n; i++ {
+			s = append(s, words[rnd.Intn(len(words))]...)
+		}
+		return string(s)
+	}
+
+	orig := randText(2000)
+	pt := newPieceTable([]byte(orig))
+	gb := newGapBuffer()
+	gb.Replace(0, 0, []rune(orig))
+	tgt := []rune(orig)
+	checkStorage(t, "initial", pt, tgt)
+
+	for i := 0; i < 500; i++ {
+		s := rnd.Intn(len(tgt) + 1)
+		e := s + rnd.Intn(len(tgt)-s+1)/10
+		text := []rune(randText(rnd.Intn(4)))
+		if rnd.Intn(3) == 0 && i > 0 {
+			// typing
+			text = []rune(words[rnd.Intn(len(words))])
+		}
+		pt.Replace(s, e, text)
+		gb.Replace(s, e, text)
+		tgt = append(append(append([]rune{}, tgt[:s]...), text...), tgt[e:]...)
+		checkStorage(t, "piece table", pt, tgt)
+		checkStorage(t, "gap buffer", gb, tgt)
+
+		s = rnd.Intn(len(tgt) + 1)
+		e = s + rnd.Intn(len(tgt)-s+1)
+		ba, bb := pt.Selection(s, e)
+		if string(ba)+string(bb) != string(tgt[s:e]) {
+			t.Fatalf("wrong selection %d %d", s, e)
+		}
+	}
+}
+
+func TestLargeFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yacco-large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(old int) { config.LargeFileSize = old }(config.LargeFileSize)
+	config.LargeFileSize = 10
+
+	path := filepath.Join(dir, "large")
+	ioutil.WriteFile(path, []byte("first line\nsecond line è\n"), 0666)
+	b, err := NewBuffer(dir, "large", false, "\t", hl.NilHighlighter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pt, ok := b.text.(*pieceTable); !ok || pt.mapped || !b.IsLarge() {
+		t.Fatalf("large writable file not loaded in a piece table in memory")
+	}
+	if ln, n, c := b.GetLine(15, false); ln != "\nseco" || n != 2 || c != 4 {
+		t.Fatalf("wrong GetLine result %q %d %d", ln, n, c)
+	}
+	b.Replace([]rune("third line\n"), &util.Sel{b.Size(), b.Size()}, true, nil, 0)
+	b.Replace([]rune("1st"), &util.Sel{0, 5}, true, nil, 0)
+	if err := b.Put(); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, path, "1st line\nsecond line è\nthird line\n")
+
+	// converted files are loaded in memory
+	ioutil.WriteFile(path, []byte("first line\r\nsecond line\r\n"), 0666)
+	if err := b.Reload(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.text.(*pieceTable); ok {
+		t.Fatalf("CRLF file loaded in a piece table")
+	}
+	if b.IsLarge() {
+		t.Fatalf("CRLF file reported as large")
+	}
+	if text := string(b.SelectionRunes(util.Sel{0, b.Size()})); text != "first line\nsecond line\n" {
+		t.Errorf("wrong text %q", text)
+	}
+
+	// overwriting the mmapped file in place
+	ioutil.WriteFile(path, []byte("first line\nsecond line\n"), 0666)
+	if err := b.Reload(0); err != nil {
+		t.Fatal(err)
+	}
+	os.Link(path, filepath.Join(dir, "link"))
+	b.Replace([]rune("third line\n"), &util.Sel{b.Size(), b.Size()}, true, nil, 0)
+	if err := b.Put(); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, path, "first line\nsecond line\nthird line\n")
+	if text := string(b.SelectionRunes(util.Sel{0, b.Size()})); text != "first line\nsecond line\nthird line\n" {
+		t.Errorf("wrong text after in place save %q", text)
+	}
+
+	// read-only files are mmapped
+	os.Chmod(path, 0444)
+	if err := b.Reload(0); err != nil {
+		t.Fatal(err)
+	}
+	if pt, ok := b.text.(*pieceTable); !ok || !pt.mapped {
+		t.Fatalf("large read-only file not mmapped")
+	}
+	if ln, n, c := b.GetLine(b.Size(), false); ln != "\n" || n != 4 || c != 0 {
+		t.Fatalf("wrong GetLine result at end of file %q %d %d", ln, n, c)
+	}
+
+	// read-only files that must be converted are read again after the
+	// mapping is released
+	os.Chmod(path, 0666)
+	ioutil.WriteFile(path, []byte("first line\r\nsecond line\r\n"), 0666)
+	os.Chmod(path, 0444)
+	if err := b.Reload(0); err != nil {
+		t.Fatal(err)
+	}
+	runtime.GC()
+	if _, ok := b.text.(*pieceTable); ok {
+		t.Fatalf("read-only CRLF file loaded in a piece table")
+	}
+	if text := string(b.SelectionRunes(util.Sel{0, b.Size()})); text != "first line\nsecond line\n" || b.Props["eol"] != EolCRLF {
+		t.Errorf("wrong text %q %q", text, b.Props["eol"])
+	}
+}
+
+// benchText returns about 64MB of text, mostly ASCII
+func benchText() []byte {
+	line := []byte("2006-01-02 15:04:05 INFO the quick brown fox jumps over the lazy dog, perché è così\n")
+	return bytes.Repeat(line, 64*1024*1024/len(line))
+}
+
+func benchStorages(b *testing.B, f func(b *testing.B, st storage)) {
+	text := benchText()
+	b.Run("GapBuffer", func(b *testing.B) {
+		gb := newGapBuffer()
+		gb.Replace(0, 0, []rune(string(text)))
+		f(b, gb)
+	})
+	b.Run("PieceTable", func(b *testing.B) {
+		f(b, newPieceTable(text))
+	})
+}
+
+func BenchmarkStorageLoad(b *testing.B) {
+	text := benchText()
+	heapUsed := func() uint64 {
+		runtime.GC()
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		return ms.HeapAlloc
+	}
+	b.Run("GapBuffer", func(b *testing.B) {
+		var st storage
+		before := heapUsed()
+		for i := 0; i < b.N; i++ {
+			gb := newGapBuffer()
+			gb.Replace(0, 0, []rune(string(text)))
+			st = gb
+		}
+		b.ReportMetric(float64(heapUsed()-before)/float64(len(text)), "heap-bytes/byte")
+		runtime.KeepAlive(st)
+	})
+	b.Run("PieceTable", func(b *testing.B) {
+		var st storage
+		before := heapUsed()
+		for i := 0; i < b.N; i++ {
+			// the text itself would be mmapped
+			st = newPieceTable(text)
+		}
+		b.ReportMetric(float64(heapUsed()-before)/float64(len(text)), "heap-bytes/byte")
+		runtime.KeepAlive(st)
+	})
+}
+
+func BenchmarkStorageTyping(b *testing.B) {
+	benchStorages(b, func(b *testing.B, st storage) {
+		rnd := rand.New(rand.NewSource(0))
+		for i := 0; i < b.N; i++ {
+			// a few characters at a random position, as if typed
+			p := rnd.Intn(st.Size())
+			for j := 0; j < 10; j++ {
+				st.Replace(p+j, p+j, []rune{'x'})
+			}
+		}
+	})
+}
+
+func BenchmarkStorageDelete(b *testing.B) {
+	benchStorages(b, func(b *testing.B, st storage) {
+		rnd := rand.New(rand.NewSource(0))
+		for i := 0; i < b.N; i++ {
+			p := rnd.Intn(st.Size() - 100)
+			st.Replace(p, p+100, nil)
+		}
+	})
+}
+
+func BenchmarkStorageSequentialAt(b *testing.B) {
+	benchStorages(b, func(b *testing.B, st storage) {
+		p := 0
+		for i := 0; i < b.N; i++ {
+			st.At(p)
+			p++
+			if p >= st.Size() {
+				p = 0
+			}
+		}
+	})
+}
+
+func BenchmarkStorageSelection(b *testing.B) {
+	benchStorages(b, func(b *testing.B, st storage) {
+		rnd := rand.New(rand.NewSource(0))
+		for i := 0; i < b.N; i++ {
+			// a screenful of text
+			p := rnd.Intn(st.Size() - 10000)
+			st.Selection(p, p+10000)
+		}
+	})
+}
@@ -3,6 +3,7 @@ package buf
 import (
 	"bytes"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/aarzilli/yacco/util"
@@ -22,14 +23,33 @@ type undoInfo struct {
 	solid  bool
 }
 
+// undoNode is a change in the undo tree, it transforms the text of its
+// parent into the text of the node. The root doesn't contain any change.
+type undoNode struct {
+	undoInfo
+	id       int
+	parent   *undoNode
+	children []*undoNode // in creation order
+	redo     *undoNode   // child redone by Redo, the most recently visited
+}
+
+// undoList is the undo tree of a buffer, cur is the node corresponding to
+// the current text of the buffer, undoing a change moves it to its parent.
+// Making a change after an undo adds a new branch to the tree.
 type undoList struct {
-	cur        int
-	lst        []undoInfo
-	nilIsSaved bool
+	root *undoNode
+	cur  *undoNode
+	seq  int // id of the last node added, the number of nodes in the tree
 }
 
 var TYPING_INTERVAL = time.Duration(2 * time.Second)
 
+func newUndoList() undoList {
+	root := &undoNode{}
+	root.saved = true
+	return undoList{root: root, cur: root}
+}
+
 func (us *undoSel) IsEmpty() bool {
 	return len(us.text) == 0
 }
@@ -45,103 +65,343 @@ func (us *undoSel) Concat(usb undoSel) {
 
 // add one
 func (ul *undoList) Add(ui undoInfo) {
-	var prevui *undoInfo = nil
-	if ul.cur > 0 {
-		prevui = &ul.lst[ul.cur-1]
-	}
-
-	if ul.cur < len(ul.lst) {
-		ul.lst = ul.lst[:ul.cur]
-	}
+	prevui := ul.PeekUndo()
 
-	if (prevui != nil) && prevui.before.IsEmpty() && ui.before.IsEmpty() && (len(ui.after.text) == 1) && (ui.after.text != " ") && prevui.after.Precedes(ui.after) && (time.Since(prevui.ts) < TYPING_INTERVAL) {
+	if (prevui != nil) && (len(ul.cur.children) == 0) && prevui.before.IsEmpty() && ui.before.IsEmpty() && (len(ui.after.text) == 1) && (ui.after.text != " ") && prevui.after.Precedes(ui.after) && (time.Since(prevui.ts) < TYPING_INTERVAL) {
 		prevui.after.Concat(ui.after)
 		prevui.ts = time.Now()
 	} else {
 		ui.ts = time.Now()
-		if ul.cur >= len(ul.lst) {
-			ul.lst = append(ul.lst, ui)
-		} else {
-			ul.lst[ul.cur] = ui
-		}
-		ul.cur++
+		ul.seq++
+		n := &undoNode{undoInfo: ui, id: ul.seq, parent: ul.cur}
+		ul.cur.children = append(ul.cur.children, n)
+		ul.cur.redo = n
+		ul.cur = n
 	}
 }
 
 // remove one, return it
 func (ul *undoList) Undo() *undoInfo {
-	if ul.cur <= 0 {
+	if ul.cur == ul.root {
 		return nil
 	}
 
-	ul.cur--
-	return &ul.lst[ul.cur]
+	ui := &ul.cur.undoInfo
+	ul.cur = ul.cur.parent
+	return ui
 }
 
 func (ul *undoList) PeekUndo() *undoInfo {
-	if ul.cur <= 0 {
+	if ul.cur == ul.root {
 		return nil
 	}
 
-	return &ul.lst[ul.cur-1]
+	return &ul.cur.undoInfo
 }
 
 // retrieves redo information, returns it
 func (ul *undoList) Redo() *undoInfo {
-	if ul.cur >= len(ul.lst) {
+	if ul.cur.redo == nil {
 		return nil
 	}
 
-	r := &ul.lst[ul.cur]
-	ul.cur++
-	return r
+	ul.cur = ul.cur.redo
+	return &ul.cur.undoInfo
 }
 
-// marks first as saved, removes every other saved mark
+func (ul *undoList) PeekRedo() *undoInfo {
+	if ul.cur.redo == nil {
+		return nil
+	}
+
+	return &ul.cur.redo.undoInfo
+}
+
+// marks current node as saved, removes every other saved mark
 func (ul *undoList) SetSaved() {
-	ul.nilIsSaved = false
-	for _, uit := range ul.lst {
-		uit.saved = false
+	ul.walk(func(n *undoNode, depth int) {
+		n.saved = false
+	})
+	ul.cur.saved = true
+}
+
+// returns true if the current node is saved
+func (ul *undoList) IsSaved() bool {
+	return ul.cur.saved
+}
+
+// Reset empties the tree, the text without changes is saved if it was
+// before.
+func (ul *undoList) Reset() {
+	saved := ul.root.saved
+	*ul = newUndoList()
+	ul.root.saved = saved
+}
+
+// walk calls f on every node of the tree, depth first, children in
+// creation order.
+func (ul *undoList) walk(f func(n *undoNode, depth int)) {
+	var walk func(n *undoNode, depth int)
+	walk = func(n *undoNode, depth int) {
+		f(n, depth)
+		for _, child := range n.children {
+			walk(child, depth+1)
+		}
 	}
-	if ul.cur > 0 {
-		ul.lst[ul.cur-1].saved = true
-	} else {
-		ul.nilIsSaved = true
+	walk(ul.root, 0)
+}
+
+func (ul *undoList) find(id int) *undoNode {
+	var r *undoNode
+	ul.walk(func(n *undoNode, depth int) {
+		if n.id == id {
+			r = n
+		}
+	})
+	return r
+}
+
+// isHead returns true if n is the first change of a group of changes that
+// are undone together.
+func (n *undoNode) isHead() bool {
+	return n.parent == nil || n.parent.parent == nil || n.solid
+}
+
+// groupEnd returns the last change of the group started by n, the text
+// after applying it is a state that can be reached with Undo and Redo.
+func (n *undoNode) groupEnd() *undoNode {
+	for {
+		var next *undoNode
+		if n.redo != nil && !n.redo.isHead() {
+			next = n.redo
+		} else {
+			for _, child := range n.children {
+				if !child.isHead() {
+					next = child
+				}
+			}
+		}
+		if next == nil {
+			return n
+		}
+		n = next
 	}
 }
 
-// returns true if topmost undoInfo is saved
-func (ul *undoList) IsSaved() bool {
-	if ul.cur > 0 {
-		return ul.lst[ul.cur-1].saved
+// groupHead returns the first change of the group containing n.
+func (n *undoNode) groupHead() *undoNode {
+	for !n.isHead() {
+		n = n.parent
+	}
+	return n
+}
+
+// headChildren returns the groups of changes that can be applied after n.
+func (n *undoNode) headChildren() []*undoNode {
+	r := []*undoNode{}
+	for _, child := range n.children {
+		if child.isHead() {
+			r = append(r, child)
+		}
+	}
+	return r
+}
+
+// applyUndo applies ui to the text, undoing it or redoing it.
+func (b *Buffer) applyUndo(ui *undoInfo, sel *util.Sel, redo bool) {
+	b.wrlock()
+
+	var us undoSel
+	var text []rune
+	if redo {
+		us = ui.before
+		text = []rune(ui.after.text)
 	} else {
-		return false
+		us = ui.after
+		text = []rune(ui.before.text)
 	}
+	ws := util.Sel{us.S, us.E}
+	b.replaceIntl(text, &ws)
+	b.updateSels(&ws, len(text))
+
+	b.unlock()
+
+	sel.S = ws.S
+	sel.E = ws.S + len(text)
+
+	b.Modified = !b.ul.cur.saved
 }
 
-func (ul *undoList) Reset() {
-	ul.lst = []undoInfo{}
-	ul.cur = 0
+// gotoUndo changes the text of the buffer to the state of the tree node
+// tgt, undoing changes up to the closest common ancestor with the current
+// node and redoing them from there.
+func (b *Buffer) gotoUndo(tgt *undoNode, sel *util.Sel) {
+	onPath := map[*undoNode]bool{}
+	for n := tgt; n != nil; n = n.parent {
+		onPath[n] = true
+	}
+	for !onPath[b.ul.cur] {
+		b.applyUndo(b.ul.Undo(), sel, false)
+	}
+	path := []*undoNode{}
+	for n := tgt; n != b.ul.cur; n = n.parent {
+		path = append(path, n)
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		path[i].parent.redo = path[i]
+		b.applyUndo(b.ul.Redo(), sel, true)
+	}
+}
+
+// UndoState describes a state of the text in the undo tree
+type UndoState struct {
+	Id      int
+	Depth   int
+	Ts      time.Time // time of the last change, zero for the unchanged text
+	Descr   string
+	Current bool
+	Saved   bool
+}
+
+// UndoStates returns the states of the text that can be reached through
+// the undo tree, depth first. Changes made by a single command are a
+// single state.
+func (b *Buffer) UndoStates() []UndoState {
+	r := []UndoState{}
+	cur := b.ul.cur.groupHead()
+	var walk func(n *undoNode, depth int)
+	walk = func(n *undoNode, depth int) {
+		end := n.groupEnd()
+		s := UndoState{Id: n.id, Depth: depth, Current: n == cur, Saved: end.saved}
+		if n != b.ul.root {
+			s.Ts = end.ts
+			s.Descr = n.describe()
+		}
+		r = append(r, s)
+		for _, child := range end.headChildren() {
+			walk(child, depth+1)
+		}
+	}
+	walk(b.ul.root, 0)
+	return r
+}
+
+// describe returns a short description of the change
+func (n *undoNode) describe() string {
+	short := func(s string) string {
+		const max = 20
+		s = strings.Replace(s, "\n", "↵", -1)
+		if r := []rune(s); len(r) > max {
+			s = string(r[:max]) + "…"
+		}
+		return fmt.Sprintf("%q", s)
+	}
+	var descr string
+	switch {
+	case n.before.S == n.before.E:
+		descr = "ins " + short(n.after.text)
+	case n.after.S == n.after.E:
+		descr = "del " + short(n.before.text)
+	default:
+		descr = "replace " + short(n.before.text) + " → " + short(n.after.text)
+	}
+	if end := n.groupEnd(); end != n {
+		descr += " …"
+	}
+	return descr
+}
+
+// UndoToState changes the text to the state of the undo tree with the
+// specified id, as returned by UndoStates.
+func (b *Buffer) UndoToState(id int, sel *util.Sel) error {
+	if !b.Editable {
+		return nil
+	}
+	n := b.ul.find(id)
+	if n == nil || !n.isHead() {
+		return fmt.Errorf("No undo state #%d", id)
+	}
+	b.gotoUndo(n.groupEnd(), sel)
+	return nil
+}
+
+// UndoToTime changes the text to the state of the undo tree that was
+// current d before (or after, if d is positive) the last change of the
+// current state. States that aren't on the current branch are considered.
+func (b *Buffer) UndoToTime(d time.Duration, sel *util.Sel) {
+	if !b.Editable {
+		return
+	}
+	ref := b.ul.cur.ts
+	if b.ul.cur == b.ul.root {
+		if d < 0 {
+			return
+		}
+		ref = time.Now()
+		// the first change is the oldest
+		for _, child := range b.ul.root.children {
+			if ref.After(child.ts) {
+				ref = child.ts
+			}
+		}
+	}
+	tgtTime := ref.Add(d)
+
+	tgt := b.ul.root
+	b.ul.walk(func(n *undoNode, depth int) {
+		if n == b.ul.root || !n.isHead() {
+			return
+		}
+		end := n.groupEnd()
+		if !end.ts.After(tgtTime) && (tgt == b.ul.root || end.ts.After(tgt.ts)) {
+			tgt = end
+		}
+	})
+	b.gotoUndo(tgt, sel)
+}
+
+// UndoBranch switches the text to the next (or previous, if dir is
+// negative) sibling branch of the current state in the undo tree.
+func (b *Buffer) UndoBranch(dir int, sel *util.Sel) bool {
+	if !b.Editable || b.ul.cur == b.ul.root {
+		return false
+	}
+	head := b.ul.cur.groupHead()
+	siblings := head.parent.headChildren()
+	for i := range siblings {
+		if siblings[i] != head {
+			continue
+		}
+		if i+dir < 0 || i+dir >= len(siblings) {
+			return false
+		}
+		b.gotoUndo(siblings[i+dir].groupEnd(), sel)
+		return true
+	}
+	return false
 }
 
 func (buf *Buffer) DescribeUndo() string {
 	var w bytes.Buffer
 
-	if buf.ul.nilIsSaved {
+	if buf.ul.root.saved {
 		fmt.Fprintf(&w, "nil is saved\n")
 	}
-	fmt.Fprintf(&w, "cur %d\n", buf.ul.cur)
+	fmt.Fprintf(&w, "cur %d\n", buf.ul.cur.id)
 
-	for i := range buf.ul.lst {
-		ui := &buf.ul.lst[i]
+	buf.ul.walk(func(n *undoNode, depth int) {
+		if n == buf.ul.root {
+			return
+		}
+		ui := &n.undoInfo
 
-		if i == buf.ul.cur {
+		if n == buf.ul.cur {
 			fmt.Fprintf(&w, "* ")
 		} else {
 			fmt.Fprintf(&w, "  ")
 		}
 
-		fmt.Fprintf(&w, "%d rev:%d %v ", i, ui.rev, ui.ts)
+		fmt.Fprintf(&w, "%s%d parent:%d rev:%d %v ", strings.Repeat(" ", depth-1), n.id, n.parent.id, ui.rev, ui.ts)
 
 		if ui.saved {
 			fmt.Fprintf(&w, "saved ")
@@ -161,7 +421,7 @@ func (buf *Buffer) DescribeUndo() string {
 		default:
 			fmt.Fprintf(&w, "replace(%d-%d) %q -> %q\n", before.S, before.E, before.text, after.text)
 		}
-	}
+	})
 
 	return w.String()
 }
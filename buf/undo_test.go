@@ -0,0 +1,110 @@
+package buf
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aarzilli/yacco/hl"
+	"github.com/aarzilli/yacco/util"
+)
+
+func TestUndoTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yacco-undotree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := NewBuffer(dir, "file", true, "\t", hl.NilHighlighter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := func() string {
+		return string(b.SelectionRunes(util.Sel{0, b.Size()}))
+	}
+	check := func(descr, tgt string) {
+		t.Helper()
+		if s := text(); s != tgt {
+			t.Fatalf("%s: wrong text %q (expected %q)", descr, s, tgt)
+		}
+	}
+	appendText := func(s string, solid bool) {
+		b.Replace([]rune(s), &util.Sel{b.Size(), b.Size()}, solid, nil, 0)
+	}
+
+	sel := util.Sel{0, 0}
+	appendText("one ", true)
+	appendText("two ", true)
+	b.Undo(&sel, false)
+	appendText("three ", true)
+	check("after branching", "one three ")
+
+	b.Undo(&sel, false)
+	b.Undo(&sel, true)
+	check("redo follows the most recent branch", "one three ")
+
+	if !b.UndoBranch(-1, &sel) {
+		t.Fatalf("could not switch to previous branch")
+	}
+	check("previous branch", "one two ")
+	if b.UndoBranch(-1, &sel) {
+		t.Fatalf("switched before the first branch")
+	}
+	b.Undo(&sel, false)
+	b.Undo(&sel, true)
+	check("redo follows the visited branch", "one two ")
+	b.UndoBranch(1, &sel)
+	check("next branch", "one three ")
+
+	// changes made by a single command are a single state
+	appendText("four ", true)
+	appendText("five ", false)
+	b.Undo(&sel, false)
+	check("undo of a group", "one three ")
+	b.Undo(&sel, true)
+	check("redo of a group", "one three four five ")
+
+	states := b.UndoStates()
+	if len(states) != 5 {
+		t.Fatalf("wrong number of states %#v", states)
+	}
+	tgt := []struct {
+		depth   int
+		current bool
+	}{{0, false}, {1, false}, {2, false}, {2, false}, {3, true}}
+	for i := range tgt {
+		if states[i].Depth != tgt[i].depth || states[i].Current != tgt[i].current {
+			t.Errorf("wrong state %d %#v", i, states[i])
+		}
+	}
+	if err := b.UndoToState(states[2].Id, &sel); err != nil {
+		t.Fatal(err)
+	}
+	check("undo to state", "one two ")
+	if err := b.UndoToState(-1, &sel); err == nil {
+		t.Errorf("no error for unknown state")
+	}
+
+	// time jumps, the oldest change is one hour old
+	now := time.Now()
+	for i, d := range []time.Duration{60, 50, 40, 30, 30} {
+		b.ul.walk(func(n *undoNode, depth int) {
+			if n.id == i+1 {
+				n.ts = now.Add(-d * time.Minute)
+			}
+		})
+	}
+	b.UndoToTime(15*time.Minute, &sel)
+	check("redo 15m", "one three ")
+	b.UndoToTime(-5*time.Minute, &sel)
+	check("undo 5m", "one two ")
+	b.UndoToTime(-time.Hour, &sel)
+	check("undo 1h", "")
+	b.UndoToTime(time.Hour, &sel)
+	check("redo 1h", "one three four five ")
+	if b.Modified != true {
+		t.Errorf("buffer not modified")
+	}
+}
@@ -0,0 +1,163 @@
+package buf
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aarzilli/yacco/config"
+	"github.com/aarzilli/yacco/util"
+)
+
+// Undo histories with more text than this are not saved
+const maxUndoFileText = 64 * 1024 * 1024
+
+// undoFile is the undo tree of a file saved to disk, valid as long as the
+// contents of the file have checksum Checksum.
+type undoFile struct {
+	Path     string
+	Checksum string
+	Cur      int // id of the saved version of the file, 0 for the root
+	Entries  []undoFileEntry
+}
+
+// undoFileEntry is a node of the undo tree, parents come before their
+// children. Histories saved before undo trees were introduced have no Id
+// and Parent and are a single branch.
+type undoFileEntry struct {
+	Id, Parent       int
+	BeforeS, BeforeE int
+	BeforeText       string
+	AfterS, AfterE   int
+	AfterText        string
+	Ts               time.Time
+	Solid            bool
+}
+
+var UndoDir = filepath.Join(os.Getenv("HOME"), ".config/yacco/undo")
+
+func undoFilePath(path string) string {
+	h := sha1.Sum([]byte(path))
+	return filepath.Join(UndoDir, hex.EncodeToString(h[:]))
+}
+
+// SaveUndo saves the undo history of the buffer to UndoDir, if
+// config.PersistentUndo is set. The history is saved starting from the
+// version of the file on disk, unsaved changes can be redone after the file
+// is loaded again.
+func (b *Buffer) SaveUndo() error {
+	if !config.PersistentUndo || b.Name == "" || b.Name[0] == '+' || b.IsDir() || b.onDiskChecksum == nil {
+		return nil
+	}
+	path := undoFilePath(b.Path())
+
+	var saved *undoNode
+	b.ul.walk(func(n *undoNode, depth int) {
+		if n.saved {
+			saved = n
+		}
+	})
+	if saved == nil || b.ul.seq == 0 {
+		// nothing to save, or the history doesn't contain the version of
+		// the file on disk
+		os.Remove(path)
+		return nil
+	}
+
+	uf := undoFile{Path: b.Path(), Checksum: hex.EncodeToString(b.onDiskChecksum[:])}
+	ids := map[*undoNode]int{b.ul.root: 0}
+	sz := 0
+	b.ul.walk(func(n *undoNode, depth int) {
+		if n == b.ul.root {
+			return
+		}
+		ids[n] = len(uf.Entries) + 1
+		sz += len(n.before.text) + len(n.after.text)
+		uf.Entries = append(uf.Entries, undoFileEntry{
+			Id: ids[n], Parent: ids[n.parent],
+			BeforeS: n.before.S, BeforeE: n.before.E, BeforeText: n.before.text,
+			AfterS: n.after.S, AfterE: n.after.E, AfterText: n.after.text,
+			Ts: n.ts, Solid: n.solid,
+		})
+	})
+	uf.Cur = ids[saved]
+	if sz > maxUndoFileText {
+		os.Remove(path)
+		return nil
+	}
+
+	bs, err := json.Marshal(&uf)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(UndoDir, 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadUndo restores the undo history saved by SaveUndo if the file on disk
+// didn't change since.
+func (b *Buffer) loadUndo(checksum [sha1.Size]byte) {
+	if !config.PersistentUndo {
+		return
+	}
+	bs, err := ioutil.ReadFile(undoFilePath(b.Path()))
+	if err != nil {
+		return
+	}
+	var uf undoFile
+	if err := json.Unmarshal(bs, &uf); err != nil {
+		return
+	}
+	if uf.Path != b.Path() || uf.Checksum != hex.EncodeToString(checksum[:]) {
+		return
+	}
+
+	ul := newUndoList()
+	nodes := []*undoNode{ul.root}
+	for i, e := range uf.Entries {
+		if e.Id == 0 {
+			e.Id, e.Parent = i+1, i
+		}
+		if e.Id != len(nodes) || e.Parent < 0 || e.Parent >= len(nodes) {
+			return
+		}
+		parent := nodes[e.Parent]
+		n := &undoNode{
+			undoInfo: undoInfo{
+				rev:    -1,
+				before: undoSel{util.Sel{e.BeforeS, e.BeforeE}, e.BeforeText},
+				after:  undoSel{util.Sel{e.AfterS, e.AfterE}, e.AfterText},
+				ts:     e.Ts,
+				solid:  e.Solid,
+			},
+			id:     e.Id,
+			parent: parent,
+		}
+		parent.children = append(parent.children, n)
+		parent.redo = n
+		nodes = append(nodes, n)
+	}
+	if uf.Cur < 0 || uf.Cur >= len(nodes) {
+		return
+	}
+
+	// the text is the saved version, redo follows the branch leading to it
+	ul.cur = nodes[uf.Cur]
+	for n := ul.cur; n.parent != nil; n = n.parent {
+		n.parent.redo = n
+	}
+	ul.seq = len(nodes) - 1
+	b.ul = ul
+	b.ul.SetSaved()
+}
@@ -23,6 +23,8 @@ type Popup struct {
 	B         *image.RGBA
 	Dir       string
 	start     func(*Popup, ExecContext) (bool, string)
+	after     func(*Popup, ExecContext)
+	selected  util.Sel // highlighted text
 	ed        *Editor
 	autocompl bool
 }
@@ -32,6 +34,7 @@ type popupFlags uint8
 const (
 	popupAlignLeft popupFlags = iota
 	popupAutocompl
+	popupBeside // to the right of the completion popup
 )
 
 var tooltipContents string
@@ -40,6 +43,7 @@ var complPrefixSuffix string
 
 func init() {
 	Compl.start = complStart
+	Compl.after = complAfter
 	Tooltip.start = tooltipStart
 }
 
@@ -67,6 +71,10 @@ func (p *Popup) prepare(str string) (image.Rectangle, *image.RGBA) {
 		p.B = image.NewRGBA(image.Rectangle{image.Point{0, 0}, image.Point{config.ComplMaxX, config.ComplMaxY}})
 	}
 	fr := popupFrame(p.B, p.B.Bounds())
+	if p.selected.S != p.selected.E {
+		fr.Colors[1] = []image.Uniform{fr.Colors[0][1], fr.Colors[0][0]}
+		fr.Sel = p.selected
+	}
 	limit := fr.Insert([]rune(str), nil)
 	fr.Redraw(false, nil)
 
@@ -118,6 +126,11 @@ func shouldHideTooltip() bool {
 
 func HideCompl(hideTooltip bool) bool {
 	didhide := false
+	if lspCompl.active && Compl.Visible {
+		// the tooltip is showing the documentation of the selected completion
+		lspCompl.active = false
+		hideTooltip = true
+	}
 	if Tooltip.Visible && (hideTooltip || shouldHideTooltip()) {
 		Tooltip.Visible = false
 		select {
@@ -156,10 +169,16 @@ func getPrefixSuffix(compls []string, word string) (has bool, prefixSuffix strin
 const completeUsingLspServer = false // delay too long
 
 func complStart(p *Popup, ec ExecContext) (bool, string) {
+	p.selected = util.Sel{}
 	if ec.buf == nil {
 		HideCompl(false)
 		return false, ""
 	}
+	if lspCompl.active {
+		if ok, txt := lspComplText(p, ec); ok {
+			return true, txt
+		}
+	}
 	if (ec.ed != nil) && ec.ed.noAutocompl {
 		HideCompl(false)
 		return false, ""
@@ -202,7 +221,11 @@ func complStart(p *Popup, ec ExecContext) (bool, string) {
 	var wdPrefixSuffix string
 	if completeUsingLspServer && fpwd != "" && strings.Contains(fpwd, ".") { // intentional, so that '.' is considered a valid character and also because autocompletion requests are too slow
 		if srv, lspb := lsp.BufferToLsp(Wnd.tagbuf.Dir, ec.buf, ec.fr.Sel, true, Warn, defaultLookForLsp); srv != nil {
-			wdCompls, wdPrefixSuffix = srv.Complete(lspb)
+			var lspCompls []lsp.Completion
+			lspCompls, wdPrefixSuffix = srv.Complete(lspb)
+			for _, c := range lspCompls {
+				wdCompls = append(wdCompls, c.Edit.NewText)
+			}
 			hasWd = len(wdCompls) > 0
 		}
 	}
@@ -225,6 +248,20 @@ func complStart(p *Popup, ec ExecContext) (bool, string) {
 	hasTempl, templPrefixSuffix := getPrefixSuffix(templCompl, templwd)
 	compls = append(compls, templCompl...)
 
+	var hasHist bool
+	var histPrefixSuffix string
+	if templwd != "" && ec.ed != nil && ec.buf == ec.ed.bodybuf && ec.buf.Props["history"] == "1" {
+		var histCompl []string
+		// the directory of the buffer isn't updated when the shell changes
+		// directory, win sets histdir instead
+		dir := ec.buf.Props["histdir"]
+		if dir == "" {
+			dir = ec.buf.Dir
+		}
+		histCompl, hasHist, histPrefixSuffix = getHistoryCompls(templwd, dir)
+		compls = append(compls, histCompl...)
+	}
+
 	if len(compls) <= 0 {
 		HideCompl(false)
 		return false, ""
@@ -251,6 +288,14 @@ func complStart(p *Popup, ec ExecContext) (bool, string) {
 			complPrefixSuffix = commonPrefix2(complPrefixSuffix, templPrefixSuffix)
 		}
 	}
+	if hasHist {
+		if !initialized {
+			initialized = true
+			complPrefixSuffix = histPrefixSuffix
+		} else {
+			complPrefixSuffix = commonPrefix2(complPrefixSuffix, histPrefixSuffix)
+		}
+	}
 
 	cmax := 10
 	if cmax > len(compls) {
@@ -292,6 +337,9 @@ func (p *Popup) Start(ec ExecContext, flags popupFlags) {
 	if flags&popupAlignLeft != 0 {
 		p0.X = ec.fr.R.Min.X
 	}
+	if flags&popupBeside != 0 {
+		p0 = image.Point{Compl.R.Max.X, Compl.R.Min.Y - 4}
+	}
 	p0 = p0.Add(image.Point{2, 4})
 	p.R = p.R.Add(p0)
 	p.Visible = true
@@ -310,6 +358,10 @@ func (p *Popup) Start(ec ExecContext, flags popupFlags) {
 	case sideChan <- fn:
 	default:
 	}
+
+	if p.after != nil {
+		p.after(p, ec)
+	}
 }
 
 var fsComplRunning = map[string]bool{}
@@ -441,6 +493,69 @@ func getWordCompls(wd string) []string {
 	return r
 }
 
+// HISTORY_RELOAD_INTERVAL is the minimum interval between two reads of the
+// history file by the autocompletion
+const HISTORY_RELOAD_INTERVAL = time.Second
+
+var winHistory = &util.History{Path: util.HistoryPath()}
+
+// winHistoryCache are the commands of winHistory returned by winHistoryCmds
+// for dir, valid until the history changes.
+var winHistoryCache struct {
+	dir    string
+	rev    int
+	loaded time.Time
+	cmds   []string
+}
+
+// winHistoryCmds returns the distinct commands executed by win, most recent
+// first, the ones executed in dir before all others.
+func winHistoryCmds(dir string) []string {
+	c := &winHistoryCache
+	if time.Since(c.loaded) >= HISTORY_RELOAD_INTERVAL {
+		c.loaded = time.Now()
+		winHistory.Load()
+	}
+	if c.cmds != nil && c.dir == dir && c.rev == winHistory.Rev {
+		return c.cmds
+	}
+	c.dir, c.rev, c.cmds = dir, winHistory.Rev, []string{}
+	seen := map[string]bool{}
+	for _, es := range [][]util.HistoryEntry{winHistory.Commands(dir, "", -1), winHistory.Commands("", "", -1)} {
+		for _, e := range es {
+			if !seen[e.Cmd] {
+				seen[e.Cmd] = true
+				c.cmds = append(c.cmds, e.Cmd)
+			}
+		}
+	}
+	return c.cmds
+}
+
+// getHistoryCompls returns the commands executed by win that complete the
+// end of line, starting at the beginning of the line or after a space (we
+// don't know where the prompt ends). Commands executed in dir come first.
+func getHistoryCompls(line, dir string) (compls []string, has bool, prefixSuffix string) {
+	starts := []int{0}
+	for i := range line {
+		if line[i] == ' ' && i+3 <= len(line) {
+			starts = append(starts, i+1)
+		}
+	}
+
+	rests := []string{}
+	for _, cmd := range winHistoryCmds(filepath.Clean(dir)) {
+		for _, k := range starts {
+			if strings.HasPrefix(cmd, line[k:]) && cmd != line[k:] {
+				compls = append(compls, cmd)
+				rests = append(rests, cmd[len(line)-k:])
+				break
+			}
+		}
+	}
+	return compls, len(compls) > 0, commonPrefix(rests)
+}
+
 func complFilter(prefix string, set []string, out *[]string) {
 	for _, cur := range set {
 		if strings.HasPrefix(cur, prefix) && (cur != prefix) {
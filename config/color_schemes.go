@@ -13,6 +13,11 @@ type ColorScheme struct {
 	VertBorder image.Uniform
 	Scrollbar  image.Uniform
 
+	// EditorPlain contains the background color, the color of plain text
+	// and the color of every hl.RegionMatchType: strings, comments,
+	// headers, keywords, numbers, builtins and the semantic tokens reported
+	// by language servers (functions, types, variables and parameters).
+	// Missing text colors are drawn with the color of plain text.
 	EditorPlain []image.Uniform
 	EditorSel1  []image.Uniform
 	EditorSel2  []image.Uniform
@@ -20,6 +25,12 @@ type ColorScheme struct {
 
 	EditorMatchingParenthesis []image.Uniform
 
+	EditorDiagnostics []image.Uniform // underline colors for errors, warnings, informations and hints
+
+	// Ansi contains the 16 colors of terminal output (see util.AnsiColor),
+	// the first one is never used.
+	Ansi []image.Uniform
+
 	Compl []image.Uniform
 
 	TagPlain []image.Uniform
@@ -82,6 +93,24 @@ func mix(color1 color.RGBA, color3 color.RGBA) image.Uniform {
 }
 
 var blahcol = c(0x78, 0x00, 0x3e)
+var acmekeyword = c(0x55, 0x00, 0x55)
+var acmenumber = c(0x88, 0x44, 0x00)
+var acmefunction = c(0x00, 0x44, 0x66)
+var acmeparameter = c(0x44, 0x44, 0x00)
+
+// DefaultDiagnostics is used by color schemes that do not specify EditorDiagnostics
+var DefaultDiagnostics = []image.Uniform{*DRed, c(0xff, 0x88, 0x00), *DGreyblue, *DPurpleblue}
+
+// DefaultAnsi is used by color schemes that do not specify Ansi, DarkAnsi
+// by the ones with a dark background.
+var DefaultAnsi = []image.Uniform{
+	*image.Black, c(0xaa, 0x00, 0x00), c(0x00, 0x77, 0x00), c(0x88, 0x66, 0x00), c(0x00, 0x00, 0xbb), c(0x88, 0x00, 0x88), c(0x00, 0x77, 0x88), c(0x66, 0x66, 0x66),
+	c(0x77, 0x77, 0x77), c(0xdd, 0x00, 0x00), c(0x00, 0x99, 0x00), c(0xaa, 0x77, 0x00), c(0x33, 0x55, 0xff), c(0xbb, 0x00, 0xbb), c(0x00, 0x99, 0xaa), *image.Black,
+}
+var DarkAnsi = []image.Uniform{
+	*image.Black, c(0xdd, 0x55, 0x55), c(0x55, 0xbb, 0x55), c(0xcc, 0xaa, 0x44), c(0x66, 0x88, 0xee), c(0xbb, 0x66, 0xbb), c(0x44, 0xaa, 0xbb), c(0xbb, 0xbb, 0xbb),
+	c(0x88, 0x88, 0x88), c(0xff, 0x77, 0x77), c(0x77, 0xee, 0x77), c(0xff, 0xdd, 0x66), c(0x88, 0xaa, 0xff), c(0xee, 0x88, 0xee), c(0x66, 0xdd, 0xee), *image.White,
+}
 
 var AcmeColorScheme = ColorScheme{
 	WindowBG: *image.White,
@@ -89,13 +118,15 @@ var AcmeColorScheme = ColorScheme{
 	TopBorder: *image.Black, VertBorder: *image.Black,
 	Scrollbar: *image.NewUniform(color.RGBA{153, 153, 76, 0xff}),
 
-	EditorPlain: []image.Uniform{yellowbg, *image.Black, darkergreen, *DDarkblue},
+	EditorPlain: []image.Uniform{yellowbg, *image.Black, darkergreen, *DDarkblue, *image.Black, acmekeyword, acmenumber, *DGreyblue, acmefunction, *DGreyblue, *image.Black, acmeparameter},
 	EditorSel1:  []image.Uniform{*DDarkyellow, *image.Black, darkergreen, *DDarkblue},
 	EditorSel2:  []image.Uniform{col2sel, yellowbg},
 	EditorSel3:  []image.Uniform{col3sel, yellowbg},
 
 	EditorMatchingParenthesis: []image.Uniform{*image.Black, yellowbg},
 
+	EditorDiagnostics: []image.Uniform{col2sel, c(0xcc, 0x66, 0x00), *DGreyblue, *DPurpleblue},
+
 	Compl: []image.Uniform{bluebg, *image.Black},
 
 	TagPlain:               []image.Uniform{bluebg, *image.Black},
@@ -122,13 +153,15 @@ var AcmeEveningColorScheme = ColorScheme{
 	TopBorder: *image.Black, VertBorder: *image.Black,
 	Scrollbar: *image.NewUniform(color.RGBA{153, 153, 76, 0xff}),
 
-	EditorPlain: []image.Uniform{*image.Black, *image.White, *DGreygreen, *DPalegreyblue},
+	EditorPlain: []image.Uniform{*image.Black, *image.White, *DGreygreen, *DPalegreyblue, *image.White, cc(0xe0c080), cc(0xd08770), *DPalegreen, *DPalebluegreen, *DPalegreen, *image.White, cc(0xd0c0a0)},
 	EditorSel1:  []image.Uniform{yellowsilver, *image.Black},
 	EditorSel2:  []image.Uniform{redsilver, *image.Black},
 	EditorSel3:  []image.Uniform{greensilver, *image.Black},
 
 	EditorMatchingParenthesis: []image.Uniform{*image.White, *image.Black},
 
+	Ansi: DarkAnsi,
+
 	TagPlain: []image.Uniform{stratostundora, *image.White},
 	TagSel1:  []image.Uniform{*DPurpleblue, *image.Black},
 	TagSel2:  []image.Uniform{*DPurpleblue, *image.Black},
@@ -157,6 +190,8 @@ var AcmeEvening2ColorScheme = ColorScheme{
 
 	EditorMatchingParenthesis: []image.Uniform{*image.White, *image.Black},
 
+	Ansi: DarkAnsi,
+
 	TagPlain: []image.Uniform{stratostundora, *image.White},
 	TagSel1:  []image.Uniform{*DPurpleblue, *image.Black},
 	TagSel2:  []image.Uniform{*DPurpleblue, *image.Black},
@@ -189,6 +224,8 @@ var AcmeMidnightColorScheme = ColorScheme{
 
 	EditorMatchingParenthesis: []image.Uniform{*harlequin, *image.Black},
 
+	Ansi: DarkAnsi,
+
 	TagPlain: []image.Uniform{darkbluegray, *harlequin},
 	TagSel1:  []image.Uniform{*DPurpleblue, *image.Black},
 	TagSel2:  []image.Uniform{*DPurpleblue, *image.Black},
@@ -246,13 +283,15 @@ var ZenburnColorScheme = ColorScheme{
 	TopBorder: zbbord, VertBorder: zbbord,
 	Scrollbar: zbbord,
 
-	EditorPlain: []image.Uniform{zbedbg, zbedfg, darkergreen, bluebg},
+	EditorPlain: []image.Uniform{zbedbg, zbedfg, darkergreen, bluebg, zbedfg, cc(0xf0dfaf), cc(0x8cd0d3), cc(0x7cb8bb), cc(0x93e0e3), cc(0x7cb8bb), zbedfg, cc(0xdcdccc)},
 	EditorSel1:  []image.Uniform{*image.NewUniform(color.RGBA{0x8a, 0x77, 0x6a, 0xFF}), *image.NewUniform(color.RGBA{0x22, 0x22, 0x22, 0xFF}), darkergreen, *DDarkblue},
 	EditorSel2:  []image.Uniform{redsilver, zbedbg},
 	EditorSel3:  []image.Uniform{greensilver, zbedbg},
 
 	EditorMatchingParenthesis: []image.Uniform{zbedfg, zbedbg},
 
+	Ansi: DarkAnsi,
+
 	Compl: []image.Uniform{zbtagbg, zbtagfg},
 
 	TagPlain: []image.Uniform{zbtagbg, zbtagfg},
@@ -272,6 +311,10 @@ var atombg = c(40, 44, 52)
 var atomcmtfg = c(92, 99, 112)
 var atomstrfg = c(152, 195, 121)
 var atomnormfg = c(206, 209, 214)
+var atomheaderfg = c(97, 175, 239)
+var atomkeywordfg = c(198, 120, 221)
+var atomnumberfg = c(209, 154, 102)
+var atombuiltinfg = c(86, 182, 194)
 var atomtagbg = c(0xaa, 0xaa, 0xaa)
 var atomtagfg = c(0x00, 0x00, 0x00)
 var atomwinbg = c(45, 45, 45)
@@ -284,13 +327,15 @@ var AtomColorScheme = ColorScheme{
 	TopBorder: atomtagfg, VertBorder: atomnormfg,
 	Scrollbar: atomselbg,
 
-	EditorPlain: []image.Uniform{atombg, atomnormfg, atomstrfg, atomcmtfg},
+	EditorPlain: []image.Uniform{atombg, atomnormfg, atomstrfg, atomcmtfg, atomheaderfg, atomkeywordfg, atomnumberfg, atombuiltinfg, atomheaderfg, c(229, 192, 123), c(224, 108, 117), c(171, 178, 191)},
 	EditorSel1:  []image.Uniform{atomselbg, atomnormfg, atomstrfg, atomcmtfg},
 	EditorSel2:  []image.Uniform{atomselbg, atomnormfg},
 	EditorSel3:  []image.Uniform{atomselbg, atomnormfg},
 
 	EditorMatchingParenthesis: []image.Uniform{atomnormfg, atombg, atombg, atombg},
 
+	Ansi: DarkAnsi,
+
 	Compl: []image.Uniform{atomtagbg, atomtagfg},
 
 	TagPlain: []image.Uniform{atomtagbg, atomtagfg},
@@ -364,6 +409,8 @@ var C4ColorScheme = ColorScheme{
 
 	EditorMatchingParenthesis: []image.Uniform{c4normfg, c4bg, c4bg, c4bg},
 
+	Ansi: DarkAnsi,
+
 	Compl: []image.Uniform{c4normfg, c4bg},
 
 	TagPlain: []image.Uniform{c4tagbg, c4tagfg},
@@ -489,7 +536,7 @@ var GruvboxColorScheme = ColorScheme{
 	TopBorder: *image.Black, VertBorder: cc(0xa89984),
 	Scrollbar: cc(0x928374),
 
-	EditorPlain: []image.Uniform{cc(0xfbf1c7), cc(0x282828), cc(0xcc241d), cc(0x458588), cc(0xd654d0e)},
+	EditorPlain: []image.Uniform{cc(0xfbf1c7), cc(0x282828), cc(0xcc241d), cc(0x458588), cc(0xd654d0e), cc(0x9d0006), cc(0x8f3f71), cc(0xb57614), cc(0x79740e), cc(0xb57614), cc(0x282828), cc(0x076678)},
 	EditorSel1:  []image.Uniform{cc(0x076678), cc(0xfbf1c7), cc(0xfbf1c7), cc(0xfbf1c7)},
 	EditorSel2:  []image.Uniform{cc(0x79740e), cc(0xfbf1c7), cc(0xfbf1c7), cc(0xfbf1c7)},
 	EditorSel3:  []image.Uniform{cc(0x9d0006), cc(0xfbf1c7), cc(0xfbf1c7), cc(0xfbf1c7)},
@@ -517,7 +564,7 @@ var EveColorScheme = ColorScheme{
 	TopBorder: *image.Black, VertBorder: *image.Black,
 	Scrollbar: cc(0xced1d7),
 
-	EditorPlain: []image.Uniform{cc(0xebeef5), *image.Black, cc(0x53A053), cc(0x5D5D5F), cc(0x437aed)},
+	EditorPlain: []image.Uniform{cc(0xebeef5), *image.Black, cc(0x53A053), cc(0x5D5D5F), cc(0x437aed), cc(0xa626a4), cc(0x986801), cc(0x0184bc), cc(0x4078f2), cc(0xc18401), *image.Black, cc(0xe45649)},
 	EditorSel1:  []image.Uniform{cc(0xceddf6), *image.Black, cc(0x53A053), cc(0x5D5D5F)},
 	EditorSel2:  []image.Uniform{cc(0x00BEC4), cc(0xebeef5)},
 	EditorSel3:  []image.Uniform{cc(0x00BEC4), cc(0xebeef5)},
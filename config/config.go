@@ -33,6 +33,26 @@ var HideHidden = true
 
 var FontSizeChange = 0
 
+// Backup copies of files kept by Put
+const (
+	BackupNone      = "none"
+	BackupTilde     = "tilde"     // file~
+	BackupTimestamp = "timestamp" // file.YYYYMMDD-HHMMSS~
+)
+
+var Backup = BackupNone
+
+// Save undo history of files to ~/.config/yacco/undo/
+var PersistentUndo = false
+
+// Files at least this large (in bytes) are used in place, through mmap,
+// instead of being loaded in memory. Zero disables.
+var LargeFileSize = 32 * 1024 * 1024
+
+// Maximum output (in bytes) of a job shown in +Errors, the rest is saved to
+// a temporary file. Zero disables.
+var JobOutputLimit = 1024 * 1024
+
 var Templates []string
 
 var wordWrap = make(map[string]struct{})
@@ -42,6 +62,30 @@ const DefaultLookFileExt = ",c,cc,cpp,h,py,txt,pl,tcl,java,js,html,go,clj,jsp"
 var LoadRules = []util.LoadRule{}
 var SaveRules = []util.SaveRule{}
 
+// EditPrograms are the named Edit programs defined in the Edit section
+var EditPrograms = map[string]string{}
+
+var LspRules = []util.LspRule{
+	mustLspRule("go", `\.go$`, "gopls serve"),
+}
+
+func mustLspRule(lang, nameRe, cmd string) util.LspRule {
+	rule, err := util.NewLspRule(lang, nameRe, cmd, "")
+	if err != nil {
+		panic(err)
+	}
+	return rule
+}
+
+var cRegions = []hl.RegionMatch{
+	hl.StringRegion("\"", "\"", '\\'),
+	hl.StringRegion("'", "'", '\\'),
+	hl.CommentRegion("/*", "*/", 0),
+	hl.CommentRegion("//", "\n", 0),
+}
+
+const cNumberRe = `(?:0[xX][0-9a-fA-F']+|0[bB][01']+|[0-9][0-9']*(?:\.[0-9]*)?(?:[eE][+-]?[0-9]+)?)[uUlLfF]*`
+
 var LanguageRules = []hl.LanguageRules{
 	// Go
 	hl.LanguageRules{
@@ -54,17 +98,55 @@ var LanguageRules = []hl.LanguageRules{
 			hl.CommentRegion("//", "\n", 0),
 			hl.RegexpRegion(`^(func|type)\s+(\([^\)]+\)\s+)?`, `\W`, 0, hl.RMT_HEADER),
 		},
+		Keywords: []string{
+			"break", "case", "chan", "const", "continue", "default", "defer", "else", "fallthrough", "for", "func", "go", "goto", "if", "import", "interface", "map", "package", "range", "return", "select", "struct", "switch", "type", "var",
+		},
+		Builtins: []string{
+			"any", "bool", "byte", "comparable", "complex64", "complex128", "error", "float32", "float64", "int", "int8", "int16", "int32", "int64", "rune", "string", "uint", "uint8", "uint16", "uint32", "uint64", "uintptr",
+			"true", "false", "iota", "nil",
+			"append", "cap", "clear", "close", "complex", "copy", "delete", "imag", "len", "make", "max", "min", "new", "panic", "print", "println", "real", "recover",
+		},
+		NumberRe: `(?:0[xX][0-9a-fA-F_]*(?:\.[0-9a-fA-F_]*)?(?:[pP][+-]?[0-9_]+)?|0[bB][01_]+|0[oO][0-7_]+|[0-9][0-9_]*(?:\.[0-9_]*)?(?:[eE][+-]?[0-9_]+)?)i?`,
 	},
 
-	// C / C++ / Java / js / HolyC
+	// C / C++ / HolyC
 	hl.LanguageRules{
-		NameRe: `\.(?:c|java|cpp|h|js|HC|HH)$`,
-		RegionMatches: []hl.RegionMatch{
-			hl.StringRegion("\"", "\"", '\\'),
-			hl.StringRegion("'", "'", '\\'),
-			hl.CommentRegion("/*", "*/", 0),
-			hl.CommentRegion("//", "\n", 0),
+		NameRe:        `\.(?:c|cpp|h|HC|HH)$`,
+		RegionMatches: cRegions,
+		Keywords: []string{
+			"auto", "break", "case", "catch", "class", "const", "constexpr", "continue", "default", "delete", "do", "else", "enum", "explicit", "extern", "for", "friend", "goto", "if", "inline", "namespace", "new", "operator", "private", "protected", "public", "register", "return", "sizeof", "static", "struct", "switch", "template", "this", "throw", "try", "typedef", "typename", "union", "using", "virtual", "volatile", "while",
 		},
+		Builtins: []string{
+			"bool", "char", "double", "float", "int", "long", "short", "signed", "unsigned", "void", "size_t", "ssize_t", "int8_t", "int16_t", "int32_t", "int64_t", "uint8_t", "uint16_t", "uint32_t", "uint64_t", "NULL", "nullptr", "true", "false",
+			"U0", "I8", "I16", "I32", "I64", "U8", "U16", "U32", "U64", "F64", "Bool", "TRUE", "FALSE",
+		},
+		NumberRe: cNumberRe,
+	},
+
+	// Java
+	hl.LanguageRules{
+		NameRe:        `\.java$`,
+		RegionMatches: cRegions,
+		Keywords: []string{
+			"abstract", "assert", "break", "case", "catch", "class", "continue", "default", "do", "else", "enum", "extends", "final", "finally", "for", "if", "implements", "import", "instanceof", "interface", "native", "new", "package", "private", "protected", "public", "return", "static", "super", "switch", "synchronized", "this", "throw", "throws", "transient", "try", "var", "volatile", "while",
+		},
+		Builtins: []string{
+			"boolean", "byte", "char", "double", "float", "int", "long", "short", "void", "null", "true", "false", "Object", "String",
+		},
+		NumberRe: cNumberRe,
+	},
+
+	// Javascript
+	hl.LanguageRules{
+		NameRe:        `\.js$`,
+		RegionMatches: cRegions,
+		Keywords: []string{
+			"async", "await", "break", "case", "catch", "class", "const", "continue", "debugger", "default", "delete", "do", "else", "export", "extends", "finally", "for", "function", "if", "import", "in", "instanceof", "let", "new", "of", "return", "super", "switch", "this", "throw", "try", "typeof", "var", "void", "while", "with", "yield",
+		},
+		Builtins: []string{
+			"null", "undefined", "true", "false", "NaN", "Infinity", "Array", "Object", "String", "Number", "Boolean", "Promise", "Map", "Set", "JSON", "Math", "console",
+		},
+		NumberRe: cNumberRe,
 	},
 
 	// Python
@@ -76,6 +158,14 @@ var LanguageRules = []hl.LanguageRules{
 			hl.StringRegion("'", "'", '\\'),
 			hl.CommentRegion("#", "\n", 0),
 		},
+		Keywords: []string{
+			"and", "as", "assert", "async", "await", "break", "class", "continue", "def", "del", "elif", "else", "except", "finally", "for", "from", "global", "if", "import", "in", "is", "lambda", "nonlocal", "not", "or", "pass", "raise", "return", "try", "while", "with", "yield",
+		},
+		Builtins: []string{
+			"None", "True", "False", "self",
+			"abs", "all", "any", "bool", "bytes", "dict", "dir", "enumerate", "filter", "float", "getattr", "hasattr", "int", "isinstance", "len", "list", "map", "max", "min", "object", "open", "print", "range", "repr", "reversed", "set", "sorted", "str", "sum", "super", "tuple", "type", "zip",
+		},
+		NumberRe: `(?:0[xX][0-9a-fA-F_]+|0[oO][0-7_]+|0[bB][01_]+|[0-9][0-9_]*(?:\.[0-9_]*)?(?:[eE][+-]?[0-9_]+)?)[jJ]?`,
 	},
 
 	// Lua
@@ -86,6 +176,14 @@ var LanguageRules = []hl.LanguageRules{
 			hl.StringRegion("'", "'", '\\'),
 			hl.CommentRegion("--", "\n", 0),
 		},
+		Keywords: []string{
+			"and", "break", "do", "else", "elseif", "end", "for", "function", "goto", "if", "in", "local", "not", "or", "repeat", "return", "then", "until", "while",
+		},
+		Builtins: []string{
+			"nil", "true", "false", "self",
+			"assert", "error", "ipairs", "next", "pairs", "pcall", "print", "require", "select", "setmetatable", "getmetatable", "tonumber", "tostring", "type", "unpack",
+		},
+		NumberRe: `0[xX][0-9a-fA-F]+|[0-9]+(?:\.[0-9]*)?(?:[eE][+-]?[0-9]+)?`,
 	},
 
 	// Diff, prr
@@ -104,9 +202,18 @@ var LanguageRules = []hl.LanguageRules{
 			hl.StringRegion("\"", "\"", '\\'),
 			hl.CommentRegion("(*", "*)", 0),
 		},
+		Builtins: []string{
+			"If", "Which", "Switch", "Module", "Block", "With", "Do", "For", "While", "Table", "Return", "Function", "Map", "Apply", "Select", "Print",
+			"True", "False", "Null", "None", "All", "Automatic",
+		},
+		NumberRe: `[0-9]+(?:\.[0-9]*)?(?:\*\^-?[0-9]+)?`,
 	},
 }
 
+// Highlighting rules compiled in, rules read from the configuration file
+// are appended to them.
+var builtinLanguageRules = LanguageRules[:len(LanguageRules):len(LanguageRules)]
+
 func SaveRuleFor(path string) *util.SaveRule {
 	for i := range SaveRules {
 		if strings.HasSuffix(path, SaveRules[i].Ext) {
@@ -116,6 +223,15 @@ func SaveRuleFor(path string) *util.SaveRule {
 	return nil
 }
 
+func LspRuleFor(path string) *util.LspRule {
+	for i := range LspRules {
+		if LspRules[i].Match(path) {
+			return &LspRules[i]
+		}
+	}
+	return nil
+}
+
 func ShouldWordWrap(name string) bool {
 	ext := filepath.Ext(name)
 	if len(ext) < 2 {
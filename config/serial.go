@@ -2,14 +2,17 @@ package config
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/aarzilli/yacco/hl"
 	"github.com/aarzilli/yacco/iniparse"
 	"github.com/aarzilli/yacco/util"
 	"golang.org/x/image/font"
@@ -27,11 +30,18 @@ type configObj struct {
 		StartupWidth       int
 		StartupHeight      int
 		WordWrap           string
+		Backup             string
+		LargeFileSize      int // in megabytes
+		JobOutputLimit     int // in kilobytes
+		PersistentUndo     bool
 	}
 	Fonts       map[string]*configFont
 	Load        *configLoadRules
 	Save        *configSaveRules
+	Lsp         *configLspRules
+	Highlight   map[string]*configHighlight
 	KeyBindings *configKeys
+	Edit        *configEditPrograms
 }
 
 var admissibleFonts = []string{"Main", "Tag", "Alt", "Compl"}
@@ -53,10 +63,22 @@ type configSaveRules struct {
 	saveRules []util.SaveRule
 }
 
+type configLspRules struct {
+	lspRules []util.LspRule
+}
+
+type configHighlight struct {
+	rules hl.LanguageRules
+}
+
 type configKeys struct {
 	keys map[string]string
 }
 
+type configEditPrograms struct {
+	programs map[string]string
+}
+
 func fontFromConf(font configFont, Fonts map[string]*configFont) font.Face {
 	if font.CopyFrom != "" {
 		otherFont := Fonts[font.CopyFrom]
@@ -88,6 +110,8 @@ func LoadConfiguration(path string) {
 
 	co.Core.LookFileExt = DefaultLookFileExt
 	co.Core.LookFileDepth = -1
+	co.Core.LargeFileSize = -1
+	co.Core.JobOutputLimit = -1
 
 	u := newUnmarshaller(path)
 
@@ -124,12 +148,19 @@ func LoadConfiguration(path string) {
 	if co.Save != nil {
 		SaveRules = co.Save.saveRules
 	}
+	if co.Lsp != nil {
+		LspRules = co.Lsp.lspRules
+	}
+	setHighlightRules(co.Highlight)
 
 	if co.KeyBindings != nil {
 		for k, v := range co.KeyBindings.keys {
 			KeyBindings[k] = v
 		}
 	}
+	if co.Edit != nil {
+		EditPrograms = co.Edit.programs
+	}
 
 	MainFontSize = co.Fonts["Main"].Pixel
 	MainFont = fontFromConf(*co.Fonts["Main"], co.Fonts)
@@ -141,6 +172,21 @@ func LoadConfiguration(path string) {
 	HideHidden = co.Core.HideHidden
 	StartupWidth = co.Core.StartupWidth
 	StartupHeight = co.Core.StartupHeight
+	PersistentUndo = co.Core.PersistentUndo
+	switch co.Core.Backup {
+	case "", BackupNone:
+		Backup = BackupNone
+	case BackupTilde, BackupTimestamp:
+		Backup = co.Core.Backup
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown value for Core.Backup %q (must be none, tilde or timestamp)\n", co.Core.Backup)
+	}
+	if co.Core.LargeFileSize >= 0 {
+		LargeFileSize = co.Core.LargeFileSize * 1024 * 1024
+	}
+	if co.Core.JobOutputLimit >= 0 {
+		JobOutputLimit = co.Core.JobOutputLimit * 1024
+	}
 	for _, ext := range strings.Split(co.Core.WordWrap, ",") {
 		wordWrap[ext] = struct{}{}
 	}
@@ -185,12 +231,55 @@ func ReloadFonts(path string) {
 	ComplFont = fontFromConf(*co.Fonts["Compl"], co.Fonts)
 }
 
+// ReloadHighlighting reads the Highlight sections of the configuration
+// file again, replacing the highlighting rules read at startup.
+func ReloadHighlighting(path string) error {
+	var co configObj
+
+	if path == "" {
+		path = filepath.Join(os.Getenv("HOME"), ".config/yacco/rc")
+	}
+
+	u := newUnmarshaller(path)
+
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Could not read configuration file: %v", err)
+	}
+
+	err = u.Unmarshal(bs, &co)
+	if err != nil {
+		return fmt.Errorf("Could not parse configuration file: %v", err)
+	}
+
+	setHighlightRules(co.Highlight)
+	return nil
+}
+
+// setHighlightRules adds the rules read from the configuration file to
+// the builtin rules, they take precedence over the builtin ones.
+func setHighlightRules(m map[string]*configHighlight) {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	LanguageRules = builtinLanguageRules
+	for _, name := range names {
+		LanguageRules = append(LanguageRules, m[name].rules)
+	}
+}
+
 func newUnmarshaller(path string) *iniparse.Unmarshaller {
 	u := iniparse.NewUnmarshaller()
 	u.Path = path
 	u.AddSpecialUnmarshaller("load", loadRulesParser)
 	u.AddSpecialUnmarshaller("save", saveRulesParser)
+	u.AddSpecialUnmarshaller("lsp", lspRulesParser)
+	u.AddSpecialUnmarshaller("highlight", highlightParser)
 	u.AddSpecialUnmarshaller("keybindings", loadKeysParser)
+	u.AddSpecialUnmarshaller("edit", editProgramsParser)
 	return u
 }
 
@@ -255,6 +344,142 @@ func saveRulesParser(path string, lineno int, lines []string) (interface{}, erro
 	return r, nil
 }
 
+func lspRulesParser(path string, lineno int, lines []string) (interface{}, error) {
+	r := &configLspRules{make([]util.LspRule, 0, len(lines))}
+	for i := range lines {
+		line := strings.TrimSpace(lines[i])
+		if line == "" {
+			continue
+		}
+		if line[0] == ';' || line[0] == '#' {
+			continue
+		}
+		v := strings.Split(line, "\t")
+		if len(v) != 3 && len(v) != 4 {
+			return nil, fmt.Errorf("%s:%d: Malformed line", path, lineno+i)
+		}
+		options := ""
+		if len(v) == 4 {
+			if !json.Valid([]byte(v[3])) {
+				return nil, fmt.Errorf("%s:%d: Malformed initialization options (not JSON)", path, lineno+i)
+			}
+			options = v[3]
+		}
+		rule, err := util.NewLspRule(v[0], v[1], v[2], options)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: Malformed regular expression: %v", path, lineno+i, err)
+		}
+		r.lspRules = append(r.lspRules, rule)
+	}
+	return r, nil
+}
+
+func highlightParser(path string, lineno int, lines []string) (interface{}, error) {
+	r := &configHighlight{}
+	for i := range lines {
+		line := strings.TrimSpace(lines[i])
+		if line == "" {
+			continue
+		}
+		if line[0] == ';' || line[0] == '#' {
+			continue
+		}
+		v := strings.Split(line, "\t")
+		malformed := fmt.Errorf("%s:%d: Malformed %s line", path, lineno+i, v[0])
+
+		switch v[0] {
+		case "NameRe", "Number":
+			if len(v) != 2 {
+				return nil, malformed
+			}
+			if _, err := regexp.Compile(v[1]); err != nil {
+				return nil, fmt.Errorf("%s:%d: Malformed regular expression: %v", path, lineno+i, err)
+			}
+			if v[0] == "NameRe" {
+				r.rules.NameRe = v[1]
+			} else {
+				r.rules.NumberRe = v[1]
+			}
+
+		case "String", "Comment":
+			if len(v) != 3 && len(v) != 4 {
+				return nil, malformed
+			}
+			escape, ok := highlightEscape(v, 3)
+			if !ok {
+				return nil, malformed
+			}
+			if v[0] == "String" {
+				r.rules.RegionMatches = append(r.rules.RegionMatches, hl.StringRegion(unescapeDelim(v[1]), unescapeDelim(v[2]), escape))
+			} else {
+				r.rules.RegionMatches = append(r.rules.RegionMatches, hl.CommentRegion(unescapeDelim(v[1]), unescapeDelim(v[2]), escape))
+			}
+
+		case "Region":
+			if len(v) != 4 && len(v) != 5 {
+				return nil, malformed
+			}
+			typ, ok := map[string]hl.RegionMatchType{"string": hl.RMT_STRING, "comment": hl.RMT_COMMENT, "header": hl.RMT_HEADER}[v[3]]
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: Unknown region type %q", path, lineno+i, v[3])
+			}
+			escape, ok := highlightEscape(v, 4)
+			if !ok {
+				return nil, malformed
+			}
+			rm, err := regexpRegion(v[1], v[2], escape, typ)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: Malformed regular expression: %v", path, lineno+i, err)
+			}
+			r.rules.RegionMatches = append(r.rules.RegionMatches, rm)
+
+		case "Keywords", "Builtins":
+			if len(v) != 2 {
+				return nil, malformed
+			}
+			if v[0] == "Keywords" {
+				r.rules.Keywords = append(r.rules.Keywords, strings.Fields(v[1])...)
+			} else {
+				r.rules.Builtins = append(r.rules.Builtins, strings.Fields(v[1])...)
+			}
+
+		default:
+			return nil, fmt.Errorf("%s:%d: Unknown highlighting rule %q", path, lineno+i, v[0])
+		}
+	}
+	if r.rules.NameRe == "" {
+		return nil, fmt.Errorf("%s:%d: Missing NameRe", path, lineno)
+	}
+	return r, nil
+}
+
+// highlightEscape returns the escape character in the optional field idx
+// of a highlighting rule.
+func highlightEscape(v []string, idx int) (rune, bool) {
+	if len(v) <= idx {
+		return 0, true
+	}
+	escape := []rune(unescapeDelim(v[idx]))
+	if len(escape) != 1 {
+		return 0, false
+	}
+	return escape[0], true
+}
+
+// unescapeDelim replaces \n, \t and \\ in a region delimiter.
+func unescapeDelim(s string) string {
+	return strings.NewReplacer(`\n`, "\n", `\t`, "\t", `\\`, `\`).Replace(s)
+}
+
+func regexpRegion(start, end string, escape rune, typ hl.RegionMatchType) (rm hl.RegionMatch, err error) {
+	defer func() {
+		if ierr := recover(); ierr != nil {
+			err = ierr.(error)
+		}
+	}()
+	return hl.RegexpRegion(start, end, escape, typ), nil
+}
+
 func loadKeysParser(path string, lineno int, lines []string) (interface{}, error) {
 	r := &configKeys{map[string]string{}}
 	lastkey := ""
@@ -280,6 +505,40 @@ func loadKeysParser(path string, lineno int, lines []string) (interface{}, error
 	return r, nil
 }
 
+// editProgramsParser reads named Edit programs, one per line with the name
+// and the program separated by a tab. Lines starting with a tab continue
+// the previous program.
+func editProgramsParser(path string, lineno int, lines []string) (interface{}, error) {
+	r := &configEditPrograms{map[string]string{}}
+	last := ""
+	for i := range lines {
+		line := strings.TrimRight(lines[i], " \t")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if line[0] == ';' || line[0] == '#' {
+			continue
+		}
+		v := strings.SplitN(line, "\t", 2)
+		if len(v) != 2 {
+			return nil, fmt.Errorf("%s:%d: Malformed line (wrong number of fields)", path, lineno+i)
+		}
+		if v[0] == "" {
+			if last == "" {
+				return nil, fmt.Errorf("%s:%d: Continuation line without a program", path, lineno+i)
+			}
+			r.programs[last] += "\n" + v[1]
+			continue
+		}
+		if !util.IsEditProgramName(v[0]) {
+			return nil, fmt.Errorf("%s:%d: Invalid program name %q", path, lineno+i, v[0])
+		}
+		r.programs[v[0]] = v[1]
+		last = v[0]
+	}
+	return r, nil
+}
+
 func templatesFile() string {
 	return filepath.Join(os.Getenv("HOME"), ".config/yacco/templates")
 }
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/aarzilli/yacco/hl"
+	"github.com/aarzilli/yacco/iniparse"
+	"github.com/aarzilli/yacco/util"
+)
+
+const highlightConf = `[Highlight "Rust"]
+NameRe	\.rs$
+String	"	"	\\
+Comment	//	\n
+Region	^fn\s+	\W	header
+Keywords	fn let
+Keywords	mut
+Number	[0-9]+
+`
+
+func TestHighlightParser(t *testing.T) {
+	var co configObj
+	u := iniparse.NewUnmarshaller()
+	u.AddSpecialUnmarshaller("highlight", highlightParser)
+	if err := u.Unmarshal([]byte(highlightConf), &co); err != nil {
+		t.Fatal(err)
+	}
+	rules := co.Highlight["Rust"].rules
+	if rules.NameRe != `\.rs$` || rules.NumberRe != "[0-9]+" {
+		t.Errorf("wrong rules: %#v", rules)
+	}
+	if len(rules.Keywords) != 3 || rules.Keywords[2] != "mut" {
+		t.Errorf("wrong keywords: %v", rules.Keywords)
+	}
+	if len(rules.RegionMatches) != 3 {
+		t.Fatalf("wrong number of regions: %d", len(rules.RegionMatches))
+	}
+	if rm := rules.RegionMatches[0]; string(rm.StartDelim) != `"` || rm.Escape != '\\' || rm.Type != hl.RMT_STRING {
+		t.Errorf("wrong string region: %#v", rm)
+	}
+	if rm := rules.RegionMatches[1]; string(rm.EndDelim) != "\n" || rm.Escape != 0 || rm.Type != hl.RMT_COMMENT {
+		t.Errorf("wrong comment region: %#v", rm)
+	}
+	if rm := rules.RegionMatches[2]; rm.StartRegexp == nil || rm.Type != hl.RMT_HEADER {
+		t.Errorf("wrong header region: %#v", rm)
+	}
+
+	setHighlightRules(co.Highlight)
+	defer setHighlightRules(nil)
+	if len(LanguageRules) != len(builtinLanguageRules)+1 {
+		t.Errorf("rules not added")
+	}
+	if _, ok := hl.New(LanguageRules, "main.rs").(*hl.Syncs); !ok {
+		t.Errorf("no highlighter for main.rs")
+	}
+
+	for _, bad := range []string{
+		"[Highlight \"x\"]\nString\t\"\n",
+		"[Highlight \"x\"]\nNameRe\tx\nRegion\t(\t\\n\tstring\n",
+		"[Highlight \"x\"]\nNameRe\tx\nRegion\ta\t\\n\tkeyword\n",
+		"[Highlight \"x\"]\nString\t\"\t\"\n",
+	} {
+		if err := u.Unmarshal([]byte(bad), &co); err == nil {
+			t.Errorf("no error for %q", bad)
+		}
+	}
+}
+
+func TestEditProgramsParser(t *testing.T) {
+	var co configObj
+	u := iniparse.NewUnmarshaller()
+	u.AddSpecialUnmarshaller("edit", editProgramsParser)
+	conf := "[Edit]\n# comment\nswap\ts/$1/$2/g\nblock\t{\n\t\ta/x/\n\t}\n"
+	if err := u.Unmarshal([]byte(conf), &co); err != nil {
+		t.Fatal(err)
+	}
+	if pgm := co.Edit.programs["swap"]; pgm != "s/$1/$2/g" {
+		t.Errorf("wrong program %q", pgm)
+	}
+	if pgm := co.Edit.programs["block"]; pgm != "{\n\ta/x/\n}" {
+		t.Errorf("wrong program %q", pgm)
+	}
+	if err := u.Unmarshal([]byte("[Edit]\n\tcontinued\n"), &co); err == nil {
+		t.Errorf("no error for continuation line without a program")
+	}
+	if err := u.Unmarshal([]byte("[Edit]\nmy.prog\ta/x/\n"), &co); err == nil {
+		t.Errorf("no error for invalid program name")
+	}
+}
+
+func TestLspRulesParser(t *testing.T) {
+	r, err := lspRulesParser("rc", 1, []string{"c\t\\.(c|h)$\tclangd", "py\t\\.py$\tpylsp\t{\"x\":1}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(old []util.LspRule) { LspRules = old }(LspRules)
+	LspRules = r.(*configLspRules).lspRules
+
+	// rules are matched concurrently by the language server goroutines
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rule := LspRuleFor("/src/main.h"); rule == nil || rule.Lang != "c" {
+				t.Errorf("wrong rule for main.h: %v", rule)
+			}
+			if rule := LspRuleFor("/src/main.py"); rule == nil || rule.Options != `{"x":1}` {
+				t.Errorf("wrong rule for main.py: %v", rule)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := lspRulesParser("rc", 1, []string{"c\t(\tclangd"}); err == nil {
+		t.Errorf("no error for malformed regular expression")
+	}
+}
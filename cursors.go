@@ -0,0 +1,153 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/aarzilli/yacco/edit"
+	"github.com/aarzilli/yacco/util"
+
+	"golang.org/x/mobile/event/key"
+	"golang.org/x/mobile/event/mouse"
+)
+
+// SetCursors replaces the additional cursors of the editor, they are kept
+// sorted, without duplicates and up to date with changes to the buffer like
+// the main selection.
+func (e *Editor) SetCursors(sels []util.Sel) {
+	fr := &e.sfr.Fr
+	for i := range fr.Cursors {
+		e.bodybuf.RmSel(&fr.Cursors[i])
+	}
+
+	cursors := make([]util.Sel, 0, len(sels))
+	for _, sel := range sels {
+		if sel != fr.Sel && !(sel.S < fr.Sel.E && fr.Sel.S < sel.E) {
+			cursors = append(cursors, sel)
+		}
+	}
+	sort.Slice(cursors, func(i, j int) bool {
+		if cursors[i].S == cursors[j].S {
+			return cursors[i].E < cursors[j].E
+		}
+		return cursors[i].S < cursors[j].S
+	})
+	dst := 0
+	for _, sel := range cursors {
+		if dst > 0 && sel.S < cursors[dst-1].E {
+			// overlapping cursors are merged
+			if sel.E > cursors[dst-1].E {
+				cursors[dst-1].E = sel.E
+			}
+			continue
+		}
+		if dst > 0 && sel == cursors[dst-1] {
+			continue
+		}
+		cursors[dst] = sel
+		dst++
+	}
+	cursors = cursors[:dst]
+
+	if len(cursors) == 0 {
+		cursors = nil
+	}
+	fr.Cursors = cursors
+	for i := range fr.Cursors {
+		e.bodybuf.AddSel(&fr.Cursors[i])
+	}
+}
+
+// eachCursor calls f once for every cursor of the frame of ec, with the
+// cursor as ec.fr.Sel. Only the first call has first set, changes made by
+// the others must not be solid so that they are undone together.
+func eachCursor(ec ExecContext, f func(ec ExecContext, first bool)) {
+	ed, fr := ec.ed, ec.fr
+	if ed == nil || fr != &ed.sfr.Fr || len(fr.Cursors) == 0 {
+		f(ec, true)
+		return
+	}
+
+	br := ec.br
+	ec.br = func() {}
+	ec.norefresh = true
+	for i := -1; i < len(fr.Cursors); i++ {
+		// the main selection is swapped with the cursor, so that both are
+		// still updated by the buffer
+		if i >= 0 {
+			fr.Sel, fr.Cursors[i] = fr.Cursors[i], fr.Sel
+		}
+		f(ec, i < 0)
+		if i >= 0 {
+			fr.Sel, fr.Cursors[i] = fr.Cursors[i], fr.Sel
+		}
+	}
+	ed.SetCursors(append([]util.Sel{}, fr.Cursors...))
+	if br != nil {
+		br()
+	}
+}
+
+// eachCursorCmd executes fcmd, a command bound to a key, for every cursor
+// if it only runs Edit programs.
+func eachCursorCmd(ec ExecContext, fcmd CompiledCmd) {
+	if ec.ed == nil || len(ec.ed.sfr.Fr.Cursors) == 0 || !editOnlyCmd(fcmd.Str) {
+		fcmd.F(ec)
+		return
+	}
+	eachCursor(ec, func(ec ExecContext, first bool) {
+		if !first {
+			ec.buf.EditMark = false
+		}
+		fcmd.F(ec)
+		ec.buf.EditMark = ec.buf.EditMarkNext
+	})
+}
+
+// collapseCursors removes the additional cursors of ed, returns false if
+// there weren't any.
+func collapseCursors(ed *Editor) bool {
+	if ed == nil || len(ed.sfr.Fr.Cursors) == 0 {
+		return false
+	}
+	ed.SetCursors(nil)
+	ed.BufferRefresh()
+	return true
+}
+
+// execEditPgm executes an Edit program on the selection of ec, if the
+// program selects more than one region with a x or y loop they become the
+// cursors of the editor.
+func execEditPgm(ec ExecContext, pgm *edit.Cmd, trace bool) {
+	ectx := makeEditContext(ec.buf, ec.dir, &ec.fr.Sel, ec.eventChan, ec.ed, trace)
+	multi := ec.ed != nil && ec.fr == &ec.ed.sfr.Fr
+	var cursors []util.Sel
+	if multi {
+		ectx.Cursors = &cursors
+	}
+	pgm.Exec(ectx)
+	if multi && len(cursors) > 0 {
+		ec.fr.SelColor = 0
+		ec.fr.Sel = cursors[0]
+		ec.ed.SetCursors(cursors[1:])
+	}
+}
+
+// addCursorClick handles control+shift+left click on the body of an
+// editor, the current selection becomes an additional cursor and the click
+// (or drag) sets the main selection as usual.
+func addCursorClick(lp LogicalPos, e util.MouseDownEvent, events <-chan util.EventOrRunnable) bool {
+	const mods = key.ModControl | key.ModShift
+	if e.Which != mouse.ButtonLeft || e.Count != 1 || e.Modifiers&mods != mods || lp.ed == nil || lp.sfr != &lp.ed.sfr {
+		return false
+	}
+	fr := &lp.sfr.Fr
+	cursors := append([]util.Sel{fr.Sel}, fr.Cursors...)
+	e.Modifiers &^= key.ModShift // shift+click would extend the selection
+	lp.sfr.OnClick(e, events)
+	lp.ed.SetCursors(cursors)
+	activeSel.Set(lp)
+	activeEditor = lp.ed
+	activeCol = nil
+	lp.ed.BufferRefresh()
+	return true
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/aarzilli/yacco/buf"
+	"github.com/aarzilli/yacco/lsp"
+	"github.com/aarzilli/yacco/textframe"
+	"github.com/aarzilli/yacco/util"
+)
+
+const diagnosticsBufferName = "+Diagnostics"
+
+// Underlines for the diagnostics of each buffer, the selections are added
+// to the buffer so that they follow the edits until the language server
+// publishes new diagnostics.
+var diagUnderlines = map[*buf.Buffer][]textframe.Underline{}
+
+func lspDiagnosticsChanged(path string) {
+	// must not block the goroutine reading from the language server, the
+	// main goroutine could be waiting for a response
+	go func() {
+		sideChan <- func() {
+			refreshDiagnostics(path)
+		}
+	}()
+}
+
+// bufferDiagnostics returns the underlines for the diagnostics of b,
+// calculating them if necessary.
+func bufferDiagnostics(b *buf.Buffer) []textframe.Underline {
+	if uls, ok := diagUnderlines[b]; ok {
+		return uls
+	}
+	diags := lsp.Diagnostics(b.Path())
+	if len(diags) == 0 || b.IsDir() {
+		return nil
+	}
+
+	utf16pos := utf16PosFunc(b)
+
+	uls := make([]textframe.Underline, len(diags))
+	for i, d := range diags {
+		uls[i].S = utf16pos(d.Range.Start.Line, d.Range.Start.Character)
+		uls[i].E = utf16pos(d.Range.End.Line, d.Range.End.Character)
+		if uls[i].E <= uls[i].S {
+			// make empty ranges visible
+			uls[i].E = uls[i].S + 1
+			if uls[i].E > b.Size() {
+				uls[i].S, uls[i].E = b.Size()-1, b.Size()
+			}
+		}
+		uls[i].Color = int(d.Severity) - 1
+		if uls[i].Color < 0 {
+			uls[i].Color = 0
+		}
+	}
+	for i := range uls {
+		b.AddSel(&uls[i].Sel)
+	}
+	diagUnderlines[b] = uls
+	return uls
+}
+
+// utf16PosFunc returns a function converting lines and UTF-16 columns,
+// as used by language servers, to positions in b. It is faster than
+// b.UTF16Pos when many conversions are needed.
+func utf16PosFunc(b *buf.Buffer) func(ln, col int) int {
+	// start of every line, so that we don't have to scan the buffer once
+	// for every position
+	lines := []int{0}
+	for i := 0; i < b.Size(); i++ {
+		if b.At(i) == '\n' {
+			lines = append(lines, i+1)
+		}
+	}
+	return func(ln, col int) int {
+		if ln >= len(lines) {
+			return b.Size()
+		}
+		i := lines[ln]
+		for ; i < b.Size() && col > 0; i++ {
+			if b.At(i) == '\n' {
+				break
+			}
+			if b.At(i) > 0xffff {
+				col -= 2
+			} else {
+				col--
+			}
+		}
+		return i
+	}
+}
+
+func forgetDiagnostics(b *buf.Buffer) {
+	for i := range diagUnderlines[b] {
+		b.RmSel(&diagUnderlines[b][i].Sel)
+	}
+	delete(diagUnderlines, b)
+}
+
+func refreshDiagnostics(path string) {
+	done := map[*buf.Buffer]bool{}
+	for _, col := range Wnd.cols.cols {
+		for _, ed := range col.editors {
+			if ed.bodybuf.Path() != path {
+				continue
+			}
+			if !done[ed.bodybuf] {
+				forgetDiagnostics(ed.bodybuf)
+				done[ed.bodybuf] = true
+			}
+			ed.sfr.Fr.SetUnderlines(bufferDiagnostics(ed.bodybuf))
+			ed.BufferRefresh()
+		}
+	}
+
+	if ed, err := EditFind(Wnd.tagbuf.Dir, diagnosticsBufferName, false, false); err == nil && ed != nil {
+		showDiagnostics(ed)
+	}
+}
+
+func showDiagnostics(ed *Editor) {
+	ed.sfr.Fr.Sel = util.Sel{0, ed.bodybuf.Size()}
+	ed.bodybuf.Replace([]rune(lsp.FormatDiagnostics()), &ed.sfr.Fr.Sel, true, nil, 0)
+	ed.sfr.Fr.Sel = util.Sel{0, 0}
+	ed.bodybuf.Modified = false
+	ed.BufferRefresh()
+}
+
+func DiagnosticsCmd(ec ExecContext, arg string) {
+	ed, err := EditFind(Wnd.tagbuf.Dir, diagnosticsBufferName, false, true)
+	if err != nil {
+		Warn(err.Error())
+		return
+	}
+	showDiagnostics(ed)
+
+	// NextError will start from the first diagnostic
+	lastLoadSel.ed = ed
+	lastLoadSel.zeroxEd = ed
+	lastLoadSel.path = filepath.Join(ed.bodybuf.Dir, ed.bodybuf.Name)
+	lastLoadSel.p = -1
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/aarzilli/yacco/buf"
+)
+
+const diskWatchInterval = 1 * time.Second
+
+// Directories of open files watched with inotify, indexed by watch
+// descriptor. Only accessed from the main goroutine.
+var diskWatches = map[int]string{}
+
+var diskWatchFd = -1
+
+// diskWatch watches the directories containing open files and reloads
+// files changed by other programs. Directories are watched instead of
+// files so that changes made by renaming a new file over the old one are
+// noticed.
+func diskWatch() {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return
+	}
+	sideChan <- func() {
+		diskWatchFd = fd
+		updateDiskWatches()
+	}
+
+	go func() {
+		for {
+			time.Sleep(diskWatchInterval)
+			sideChan <- updateDiskWatches
+		}
+	}()
+
+	var rdbuf [syscall.SizeofInotifyEvent * 256]byte
+	for {
+		n, err := syscall.Read(fd, rdbuf[:])
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return
+		}
+		type change struct {
+			wd   int
+			name string
+		}
+		changes := []change{}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&rdbuf[off]))
+			nameb := rdbuf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+			name := string(nameb)
+			for i := range nameb {
+				if nameb[i] == 0 {
+					name = string(nameb[:i])
+					break
+				}
+			}
+			if ev.Mask&(syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO) != 0 && name != "" {
+				changes = append(changes, change{int(ev.Wd), name})
+			}
+		}
+		if len(changes) == 0 {
+			continue
+		}
+		sideChan <- func() {
+			done := map[string]bool{}
+			for _, c := range changes {
+				dir, ok := diskWatches[c.wd]
+				if !ok {
+					continue
+				}
+				path := filepath.Join(dir, c.name)
+				if !done[path] {
+					done[path] = true
+					fileChangedOnDisk(path)
+				}
+			}
+		}
+	}
+}
+
+// updateDiskWatches adds watches for the directories of newly opened files
+// and removes the ones that are no longer needed.
+func updateDiskWatches() {
+	if diskWatchFd < 0 {
+		return
+	}
+	dirs := map[string]bool{}
+	for _, col := range Wnd.cols.cols {
+		for _, ed := range col.editors {
+			if !diskWatchable(ed.bodybuf) {
+				continue
+			}
+			dirs[ed.bodybuf.Dir] = true
+		}
+	}
+
+	for wd, dir := range diskWatches {
+		if !dirs[dir] {
+			syscall.InotifyRmWatch(diskWatchFd, uint32(wd))
+			delete(diskWatches, wd)
+		}
+		delete(dirs, dir)
+	}
+
+	for dir := range dirs {
+		wd, err := syscall.InotifyAddWatch(diskWatchFd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO)
+		if err != nil {
+			continue
+		}
+		diskWatches[wd] = dir
+	}
+}
+
+func diskWatchable(b *buf.Buffer) bool {
+	return b.Name != "" && !fakebuf(b.Name) && !b.IsDir()
+}
+
+// fileChangedOnDisk reloads buffers showing path if they don't have unsaved
+// changes, otherwise marks their tag with the possible choices.
+func fileChangedOnDisk(path string) {
+	seen := map[*buf.Buffer]bool{}
+	for _, col := range Wnd.cols.cols {
+		for _, ed := range col.editors {
+			b := ed.bodybuf
+			if seen[b] || !diskWatchable(b) || b.Path() != path {
+				continue
+			}
+			seen[b] = true
+			if b.CanSave() {
+				// not changed, or changed by us
+				continue
+			}
+			if b.Modified {
+				b.ChangedOnDisk = true
+			} else if err := b.Reload(0); err != nil {
+				Warn(fmt.Sprintf("Couldn't reload %s: %v", b.ShortName(), err))
+				b.ChangedOnDisk = true
+			}
+			refreshBufferEditors(b)
+		}
+	}
+}
+
+func refreshBufferEditors(b *buf.Buffer) {
+	for _, col := range Wnd.cols.cols {
+		for _, ed := range col.editors {
+			if ed.bodybuf == b {
+				ed.FixTop()
+				ed.TagRefresh()
+				ed.BufferRefresh()
+			}
+		}
+	}
+}
+
+func ReloadCmd(ec ExecContext, arg string) {
+	exitConfirmed = false
+	if ec.ed == nil || !diskWatchable(ec.ed.bodybuf) {
+		return
+	}
+	Log(ec.ed.edid, LOP_GET, ec.ed.bodybuf)
+	if err := ec.ed.bodybuf.Reload(0); err != nil {
+		Warn("Reload: " + err.Error())
+		return
+	}
+	refreshBufferEditors(ec.ed.bodybuf)
+}
+
+func KeepCmd(ec ExecContext, arg string) {
+	exitConfirmed = false
+	if ec.ed == nil || !diskWatchable(ec.ed.bodybuf) {
+		return
+	}
+	if err := ec.ed.bodybuf.IgnoreDiskChanges(); err != nil {
+		Warn("Keep: " + err.Error())
+		return
+	}
+	refreshBufferEditors(ec.ed.bodybuf)
+}
@@ -54,6 +54,7 @@ func DumpTo(dumpDest string) bool {
 	}
 	defer fh.Close()
 	enc := json.NewEncoder(fh)
+	saveAllUndo()
 	dw := Wnd.Dump()
 	err = enc.Encode(dw)
 	if err != nil {
@@ -63,6 +64,16 @@ func DumpTo(dumpDest string) bool {
 	return true
 }
 
+// saveAllUndo saves the undo history of all open files, see
+// buf.Buffer.SaveUndo.
+func saveAllUndo() {
+	for _, col := range Wnd.cols.cols {
+		for _, ed := range col.editors {
+			ed.bodybuf.SaveUndo()
+		}
+	}
+}
+
 func LoadFrom(dumpDest string) bool {
 	fh, err := os.Open(dumpDest)
 	if err != nil {
@@ -6,6 +6,8 @@ import (
 	"io"
 	"io/ioutil"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/aarzilli/yacco/buf"
@@ -72,24 +74,14 @@ func eqcmdfn(c *Cmd, ec *EditContext) {
 	*ec.atsel = c.rangeaddr.Eval(ec.Buf, *ec.atsel)
 	ec.tracecmd(*ec.atsel, c)
 
-	var charpos bool
-
-	switch c.bodytxt {
+	switch strings.TrimSpace(c.bodytxt) {
 	case "#":
-		charpos = true
-	case "":
-		charpos = false
-	default:
-		Warnfn("Wrong argument to =")
-	}
-
-	if charpos {
 		if ec.atsel.S == ec.atsel.E {
 			Warnfn(fmt.Sprintf("%s:#%d\n", ec.Buf.Path(), ec.atsel.S))
 		} else {
 			Warnfn(fmt.Sprintf("%s:#%d,#%d\n", ec.Buf.Path(), ec.atsel.S, ec.atsel.E))
 		}
-	} else {
+	case "":
 		_, sln, _ := ec.Buf.GetLine(ec.atsel.S, false)
 		_, eln, _ := ec.Buf.GetLine(ec.atsel.E, false)
 		if ec.atsel.S == ec.atsel.E {
@@ -97,6 +89,17 @@ func eqcmdfn(c *Cmd, ec *EditContext) {
 		} else {
 			Warnfn(fmt.Sprintf("%s:%d,%d\n", ec.Buf.Path(), sln, eln))
 		}
+	case "+":
+		// line and column, columns start at 1 like in compiler errors
+		_, sln, scol := ec.Buf.GetLine(ec.atsel.S, false)
+		_, eln, ecol := ec.Buf.GetLine(ec.atsel.E, false)
+		if ec.atsel.S == ec.atsel.E {
+			Warnfn(fmt.Sprintf("%s:%d:%d\n", ec.Buf.Path(), sln, scol+1))
+		} else {
+			Warnfn(fmt.Sprintf("%s:%d:%d,%d:%d\n", ec.Buf.Path(), sln, scol+1, eln, ecol+1))
+		}
+	default:
+		Warnfn("Wrong argument to =")
 	}
 }
 
@@ -128,7 +131,7 @@ func scmdfn(c *Cmd, ec *EditContext) {
 		sel = util.Sel{loc[0], loc[1]}
 		allWhitespace := false
 		if globalrepl || (c.numarg == nmatch) {
-			realSubs := resolveBackreferences(subs, ec.Buf, loc)
+			realSubs := resolveBackreferences(subs, ec.Buf, loc, re)
 			ec.tracemore("replace", sel, realSubs)
 			ec.replace(realSubs, &sel, first)
 			allWhitespace = isWhitespace(realSubs)
@@ -169,7 +172,9 @@ func isWhitespace(r []rune) bool {
 	return true
 }
 
-func resolveBackreferences(subs []rune, b *buf.Buffer, loc []int) []rune {
+// resolveBackreferences replaces \0 through \9 and \{name} in subs with
+// the corresponding groups of the match of re at loc.
+func resolveBackreferences(subs []rune, b *buf.Buffer, loc []int, re *regexp.Regex) []rune {
 	var r []rune = nil
 	initR := func(src int) {
 		r = make([]rune, src, len(subs))
@@ -192,6 +197,21 @@ func resolveBackreferences(subs []rune, b *buf.Buffer, loc []int) []rune {
 				n := int(subs[src+1] - '0')
 				replace(src, n)
 				src++
+			case '{':
+				end := src + 2
+				for end < len(subs) && subs[end] != '}' {
+					end++
+				}
+				if end >= len(subs) {
+					panic(fmt.Errorf("Unterminated backreference"))
+				}
+				name := string(subs[src+2 : end])
+				n := re.SubexpIndex(name)
+				if n < 0 {
+					panic(fmt.Errorf("Nonexistent backreference %s", name))
+				}
+				replace(src, n)
+				src = end
 			default:
 				if r == nil {
 					initR(src)
@@ -236,7 +256,11 @@ func xycmdfn(c *Cmd, ec *EditContext, inv bool) {
 		ec.tracemore("match at", util.Sel{loc[0], loc[1]})
 		subec := ec.subec(ec.Buf, &cursel)
 		subec.stash = &stash
+		subec.inloop = true
 		c.body.fn(c.body, &subec)
+		if c.body.cmdch == ' ' {
+			subec.addCursor(cursel)
+		}
 		rngsel.S = loc[1]
 		count++
 		if count > LOOP_LIMIT {
@@ -314,6 +338,7 @@ func kcmdfn(c *Cmd, ec *EditContext) {
 	if ec.Sel != nil {
 		*ec.Sel = *ec.atsel
 	}
+	ec.addCursor(*ec.atsel)
 }
 
 func Mcmdfn(c *Cmd, ec *EditContext) {
@@ -465,6 +490,92 @@ func wcmdfn(c *Cmd, ec *EditContext) {
 	}
 }
 
+// menuLine returns the line describing b printed by the f and n commands,
+// in the same format as sam's menu: an apostrophe if the buffer is
+// modified, a plus because every buffer has a window and a period for the
+// current buffer.
+func menuLine(b *buf.Buffer, current bool) string {
+	mod, cur := ' ', ' '
+	if b.Modified {
+		mod = '\''
+	}
+	if current {
+		cur = '.'
+	}
+	return fmt.Sprintf("%c+%c %s\n", mod, cur, b.Path())
+}
+
+func fcmdfn(c *Cmd, ec *EditContext) {
+	ec.tracecmd(c)
+	name := strings.TrimSpace(c.bodytxt)
+	if name != "" && util.ResolvePath(ec.Buf.Dir, name) != ec.Buf.Path() {
+		ec.Buf.Rename(name)
+	}
+	Warnfn(menuLine(ec.Buf, true))
+}
+
+func ncmdfn(c *Cmd, ec *EditContext) {
+	ec.tracecmd(c)
+	buffers := ec.BufMan.List()
+	sort.Slice(buffers, func(i, j int) bool { return buffers[i].Buffer.Path() < buffers[j].Buffer.Path() })
+	var out []byte
+	for i := range buffers {
+		out = append(out, menuLine(buffers[i].Buffer, buffers[i].Buffer == ec.Buf)...)
+	}
+	Warnfn(string(out))
+}
+
+// ucmdfn undoes the last n changes to the buffer (one if n is missing),
+// redoes them if n is negative.
+func ucmdfn(c *Cmd, ec *EditContext) {
+	ec.tracecmd(c)
+	n := 1
+	if arg := strings.TrimSpace(c.bodytxt); arg != "" {
+		var err error
+		n, err = strconv.Atoi(arg)
+		if err != nil {
+			panic(fmt.Errorf("Wrong argument to u: %s", arg))
+		}
+	}
+	if ec.stash != nil {
+		panic(fmt.Errorf("u can not be used inside loops and blocks"))
+	}
+	redo := n < 0
+	if redo {
+		n = -n
+	}
+	for i := 0; i < n; i++ {
+		if (!redo && !ec.Buf.HasUndo()) || (redo && !ec.Buf.HasRedo()) {
+			break
+		}
+		ec.Buf.Undo(ec.atsel, redo)
+	}
+}
+
+// qrefused is the buffer that q refused to close, because it had unsaved
+// changes, and its revision: q closes it if it wasn't changed since.
+var qrefused struct {
+	b   *buf.Buffer
+	rev int
+}
+
+// qcmdfn closes the buffer, if it has unsaved changes only the second time
+// q is executed on it.
+func qcmdfn(c *Cmd, ec *EditContext) {
+	ec.tracecmd(c)
+	if ec.stash != nil {
+		panic(fmt.Errorf("q can not be used inside loops and blocks"))
+	}
+	b := ec.Buf
+	if b.Modified && (qrefused.b != b || qrefused.rev != b.RevCount) {
+		qrefused.b, qrefused.rev = b, b.RevCount
+		Warnfn(fmt.Sprintf("File %s has unsaved changes\n", b.ShortName()))
+		return
+	}
+	qrefused.b = nil
+	ec.BufMan.Close(b)
+}
+
 func XYcmdfn(inv bool, c *Cmd, ec *EditContext) {
 	buffers := ec.BufMan.List()
 
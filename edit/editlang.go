@@ -39,8 +39,13 @@ type EditContext struct {
 	BufMan    BufferManaging
 	Trace     bool
 
-	stash *[]buf.ReplaceOp
-	depth int
+	// If not nil the selections made by x and y loops, with k or with no
+	// command, are appended to Cursors
+	Cursors *[]util.Sel
+
+	stash  *[]buf.ReplaceOp
+	depth  int
+	inloop bool // executing the body of a x or y loop over Buf
 }
 
 type BufferManagingEntry struct {
@@ -153,7 +158,9 @@ func (ec *EditContext) subec(buf *buf.Buffer, atsel *util.Sel) EditContext {
 			EventChan: ec.EventChan,
 			BufMan:    ec.BufMan,
 			Trace:     ec.Trace,
+			Cursors:   ec.Cursors,
 			depth:     ec.depth + 1,
+			inloop:    ec.inloop,
 		}
 	} else {
 		return EditContext{
@@ -168,6 +175,13 @@ func (ec *EditContext) subec(buf *buf.Buffer, atsel *util.Sel) EditContext {
 	}
 }
 
+// addCursor records sel as one of the selections made by a x or y loop
+func (ec *EditContext) addCursor(sel util.Sel) {
+	if ec.inloop && ec.Cursors != nil {
+		*ec.Cursors = append(*ec.Cursors, sel)
+	}
+}
+
 func (ec *EditContext) dir() string {
 	if ec.Dir != "" {
 		return ec.Dir
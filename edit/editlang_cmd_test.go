@@ -1,7 +1,11 @@
 package edit
 
 import (
+	"fmt"
 	"testing"
+
+	"github.com/aarzilli/yacco/buf"
+	"github.com/aarzilli/yacco/util"
 )
 
 func TestSStuck(t *testing.T) {
@@ -41,6 +45,12 @@ func TestSWithBackrefEdit(t *testing.T) {
 	testEdit(t, "<01 12 23 34 45 56 67 78 89 9A AB BC CD DE EF\n>", `s/(\S\S)/0x\1/`, "<0x01 0x12 0x23 0x34 0x45 0x56 0x67 0x78 0x89 0x9A 0xAB 0xBC 0xCD 0xDE 0xEF\n>")
 }
 
+func TestSWithNamedBackrefEdit(t *testing.T) {
+	testEdit(t, "<a=1, b=2\n>", `s/(?<key>\w+)=(?<val>\w+)/\{val}=\{key}/`, "<1=a, 2=b\n>")
+	testEdit(t, "<foo() foo bar()\n>", `s/\w+(?=\()/f/`, "<f() foo f()\n>")
+	testEdit(t, "<xx xxxx x\n>", `s/x{2}/y/`, "<y yy x\n>")
+}
+
 func TestXWithIEdit(t *testing.T) {
 	testEdit(t, "<01 12 23 34 45 56 67 78 89 9A AB BC CD DE EF\n>", `x/\S\S/i/0x/`, "<0x01 0x12 0x23 0x34 0x45 0x56 0x67 0x78 0x89 0x9A 0xAB 0xBC 0xCD 0xDE 0xEF\n>")
 	testEdit(t, "<01 12 23 34 45 56 67 78 89 9A AB BC CD DE EF\n>", `x/\S\S/a/,/`, "<01, 12, 23, 34, 45, 56, 67, 78, 89, 9A, AB, BC, CD, DE, EF,\n>")
@@ -83,3 +93,169 @@ g/CN/ s1/./\0C/
 	testEdit(t, `<NBCCNBBBCBHCB>`, code, "<NBBBCNCCNBBNBNBBCHBHHBCHB>")
 	testEdit(t, `<NBBBCNCCNBBNBNBBCHBHHBCHB>`, code, "<NBBNBNBBCCNBCNCCNBBNBBNBBBNBBNBBCBHCBHHNHCBBCBHCB>")
 }
+
+func TestXCursors(t *testing.T) {
+	b, _ := buf.NewBuffer("/", "+Tag", true, " ", nil)
+	b.Replace([]rune("bip bop bappa bump"), &util.Sel{0, 0}, true, nil, util.EO_MOUSE)
+
+	for _, tc := range []struct {
+		pgm string
+		tgt []util.Sel
+	}{
+		{`,x/b\w+/`, []util.Sel{{0, 3}, {4, 7}, {8, 13}, {14, 18}}},
+		{`,x/b\w+/ k`, []util.Sel{{0, 3}, {4, 7}, {8, 13}, {14, 18}}},
+		{`,x/b\w+/ -#0`, []util.Sel{{0, 0}, {4, 4}, {8, 8}, {14, 14}}},
+		{`,x/b\w+/ g/a/ k`, []util.Sel{{8, 13}}},
+		{`,x/b\w+/ v/b/ k`, nil},
+		{`,y/ / k`, []util.Sel{{0, 3}, {4, 7}, {8, 13}}},
+	} {
+		sel := util.Sel{0, 0}
+		var cursors []util.Sel
+		Edit(tc.pgm, EditContext{Buf: b, Sel: &sel, Cursors: &cursors})
+		if fmt.Sprint(cursors) != fmt.Sprint(tc.tgt) {
+			t.Errorf("%s: wrong cursors %v (expected %v)", tc.pgm, cursors, tc.tgt)
+		}
+	}
+}
+
+type testBufMan struct {
+	buffers []*buf.Buffer
+	closed  []*buf.Buffer
+}
+
+func (bm *testBufMan) Open(name string) *buf.Buffer { return nil }
+func (bm *testBufMan) Close(b *buf.Buffer)          { bm.closed = append(bm.closed, b) }
+func (bm *testBufMan) RefreshBuffer(b *buf.Buffer)  {}
+
+func (bm *testBufMan) List() []BufferManagingEntry {
+	r := []BufferManagingEntry{}
+	for _, b := range bm.buffers {
+		r = append(r, BufferManagingEntry{Buffer: b, Sel: &util.Sel{0, 0}})
+	}
+	return r
+}
+
+func testEditOutput(t *testing.T, pgm string, ec EditContext, tgt string) {
+	t.Helper()
+	out := ""
+	Warnfn = func(s string) {
+		out += s
+	}
+	Edit(pgm, ec)
+	if out != tgt {
+		t.Errorf("%s: wrong output %q (expected %q)", pgm, out, tgt)
+	}
+}
+
+func TestUEdit(t *testing.T) {
+	b, _ := buf.NewBuffer("/", "+Tag", true, " ", nil)
+	sel := util.Sel{0, 0}
+	ec := EditContext{Buf: b, Sel: &sel}
+	text := func() string {
+		return string(b.SelectionRunes(util.Sel{0, b.Size()}))
+	}
+
+	Edit(`$a/one /`, ec)
+	Edit(`$a/two /`, ec)
+	Edit(`$a/three /`, ec)
+	Edit(`u`, ec)
+	if text() != "one two " {
+		t.Fatalf("wrong text after u %q", text())
+	}
+	Edit(`u 2`, ec)
+	if text() != "" {
+		t.Fatalf("wrong text after u 2 %q", text())
+	}
+	Edit(`u -2`, ec)
+	if text() != "one two " {
+		t.Fatalf("wrong text after u -2 %q", text())
+	}
+	Edit(`u 10`, ec)
+	if text() != "" {
+		t.Fatalf("wrong text after u 10 %q", text())
+	}
+}
+
+func TestFNEdit(t *testing.T) {
+	b1, _ := buf.NewBuffer("/tmp", "a.txt", true, " ", nil)
+	b2, _ := buf.NewBuffer("/tmp", "b.txt", true, " ", nil)
+	b1.Modified, b2.Modified = false, true
+	sel := util.Sel{0, 0}
+	ec := EditContext{Buf: b1, Sel: &sel, BufMan: &testBufMan{buffers: []*buf.Buffer{b2, b1}}}
+
+	testEditOutput(t, `f`, ec, " +. /tmp/a.txt\n")
+	testEditOutput(t, `n`, ec, " +. /tmp/a.txt\n'+  /tmp/b.txt\n")
+	testEditOutput(t, `f c.txt`, ec, "'+. /tmp/c.txt\n")
+	if b1.Name != "c.txt" || b1.Dir != "/tmp" || !b1.Modified {
+		t.Errorf("buffer not renamed %s %s %v", b1.Dir, b1.Name, b1.Modified)
+	}
+}
+
+func TestQEdit(t *testing.T) {
+	b1, _ := buf.NewBuffer("/tmp", "a.txt", true, " ", nil)
+	b2, _ := buf.NewBuffer("/tmp", "b.txt", true, " ", nil)
+	bm := &testBufMan{buffers: []*buf.Buffer{b1, b2}}
+	sel := util.Sel{0, 0}
+
+	b1.Modified = false
+	testEditOutput(t, `q`, EditContext{Buf: b1, Sel: &sel, BufMan: bm}, "")
+	if len(bm.closed) != 1 || bm.closed[0] != b1 {
+		t.Fatalf("unmodified buffer not closed %v", bm.closed)
+	}
+
+	// modified buffers are closed by the second q, if they didn't change
+	ec := EditContext{Buf: b2, Sel: &sel, BufMan: bm}
+	b2.Replace([]rune("x"), &util.Sel{0, 0}, true, nil, util.EO_MOUSE)
+	testEditOutput(t, `q`, ec, "File /tmp/b.txt has unsaved changes\n")
+	b2.Replace([]rune("y"), &util.Sel{0, 0}, true, nil, util.EO_MOUSE)
+	testEditOutput(t, `q`, ec, "File /tmp/b.txt has unsaved changes\n")
+	if len(bm.closed) != 1 {
+		t.Fatalf("modified buffer closed %v", bm.closed)
+	}
+	testEditOutput(t, `q`, ec, "")
+	if len(bm.closed) != 2 || bm.closed[1] != b2 {
+		t.Fatalf("modified buffer not closed after confirmation %v", bm.closed)
+	}
+}
+
+func TestEqEdit(t *testing.T) {
+	b, _ := buf.NewBuffer("/tmp", "a.txt", true, " ", nil)
+	b.Replace([]rune("uno\ndue\ntre\n"), &util.Sel{0, 0}, true, nil, util.EO_MOUSE)
+	sel := util.Sel{5, 5}
+	ec := EditContext{Buf: b, Sel: &sel}
+
+	testEditOutput(t, `=`, ec, "/tmp/a.txt:2\n")
+	testEditOutput(t, `=#`, ec, "/tmp/a.txt:#5\n")
+	testEditOutput(t, `=+`, ec, "/tmp/a.txt:2:2\n")
+	testEditOutput(t, `2,3=+`, ec, "/tmp/a.txt:2:1,4:1\n")
+	testEditOutput(t, `=x`, ec, "Wrong argument to =")
+}
+
+func TestNamedPrograms(t *testing.T) {
+	defer func(old map[string]string) { Programs = old }(Programs)
+	Programs = map[string]string{}
+	Define("swap", `s/$1/$2/g`)
+	Define("wrap", `,x/$1/ { i/$2/ a/$2/ }`)
+	Define("all", `c/$*/`)
+
+	testEdit(t, "<a b a\n>", `:swap a c`, "<c b c\n>")
+	testEdit(t, "<a b a\n>", `:wrap a "|"`, "<|a| b |a|\n>")
+	testEdit(t, "<x>", `:all one "two three"`, "one two three<>")
+
+	if pgm := Expand(`:swap "a b" $`); pgm != `s/a b/$/g` {
+		t.Errorf("wrong expansion %q", pgm)
+	}
+	if pgm := Expand(`s/a/b/`); pgm != `s/a/b/` {
+		t.Errorf("wrong expansion %q", pgm)
+	}
+	for _, bad := range []string{`:swap a`, `:unknown`} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("no error expanding %s", bad)
+				}
+			}()
+			Expand(bad)
+		}()
+	}
+}
@@ -50,6 +50,10 @@ var commands = map[rune]cmdDef{
 	'e': cmdDef{restargs: true, fn: func(c *Cmd, ec *EditContext) { extreplcmdfn(true, c, ec) }},
 	'r': cmdDef{restargs: true, fn: func(c *Cmd, ec *EditContext) { extreplcmdfn(false, c, ec) }},
 	'w': cmdDef{restargs: true, fn: wcmdfn},
+	'f': cmdDef{restargs: true, fn: fcmdfn},
+	'n': cmdDef{fn: ncmdfn},
+	'u': cmdDef{restargs: true, fn: ucmdfn},
+	'q': cmdDef{fn: qcmdfn},
 
 	'X': cmdDef{txtargs: 1, bodyarg: true, rca1: true, fn: func(c *Cmd, ec *EditContext) { XYcmdfn(false, c, ec) }},
 	'Y': cmdDef{txtargs: 1, bodyarg: true, rca1: true, fn: func(c *Cmd, ec *EditContext) { XYcmdfn(true, c, ec) }},
@@ -58,6 +62,9 @@ var commands = map[rune]cmdDef{
 type addrTok string
 
 func Parse(pgm []rune) *Cmd {
+	if IsProgramCall(string(pgm)) {
+		pgm = []rune(Expand(string(pgm)))
+	}
 	r, rest := parseEx(pgm, false)
 parseLoop:
 	for len(rest) > 0 {
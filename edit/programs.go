@@ -0,0 +1,74 @@
+package edit
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aarzilli/yacco/util"
+)
+
+// Programs are the named Edit programs, defined in the Edit section of the
+// configuration file or with the Def command and executed with
+// Edit :name args...
+var Programs = map[string]string{}
+
+// Define adds (or replaces) the named program name.
+func Define(name, pgm string) {
+	if !IsProgramName(name) {
+		panic(fmt.Errorf("Invalid program name %q", name))
+	}
+	Programs[name] = pgm
+}
+
+// IsProgramName returns true if name can be the name of a program.
+func IsProgramName(name string) bool {
+	return util.IsEditProgramName(name)
+}
+
+// IsProgramCall returns true if pgm executes a named program.
+func IsProgramCall(pgm string) bool {
+	pgm = strings.TrimSpace(pgm)
+	return len(pgm) > 0 && pgm[0] == ':'
+}
+
+// Expand returns pgm unchanged, unless it executes a named program
+// (":name args..."), in which case it returns the text of the program with
+// $1 through $9 replaced by the corresponding argument and $* by all the
+// arguments, separated by spaces. Arguments can be quoted.
+func Expand(pgm string) string {
+	if !IsProgramCall(pgm) {
+		return pgm
+	}
+	v := strings.SplitN(strings.TrimSpace(pgm)[1:], " ", 2)
+	body, ok := Programs[v[0]]
+	if !ok {
+		panic(fmt.Errorf("Unknown Edit program %q", v[0]))
+	}
+	var args []string
+	if len(v) > 1 {
+		args = util.QuotedSplit(v[1])
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(body); i++ {
+		if body[i] != '$' || i+1 >= len(body) {
+			out.WriteByte(body[i])
+			continue
+		}
+		switch ch := body[i+1]; {
+		case ch >= '1' && ch <= '9':
+			n := int(ch - '1')
+			if n >= len(args) {
+				panic(fmt.Errorf("Missing argument $%c to Edit program %q", ch, v[0]))
+			}
+			out.WriteString(args[n])
+			i++
+		case ch == '*':
+			out.WriteString(strings.Join(args, " "))
+			i++
+		default:
+			out.WriteByte(body[i])
+		}
+	}
+	return out.String()
+}
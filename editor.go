@@ -15,6 +15,7 @@ import (
 	"github.com/aarzilli/yacco/config"
 	"github.com/aarzilli/yacco/edutil"
 	"github.com/aarzilli/yacco/hl"
+	"github.com/aarzilli/yacco/lsp"
 	"github.com/aarzilli/yacco/textframe"
 	"github.com/aarzilli/yacco/util"
 )
@@ -102,6 +103,9 @@ func NewEditor(bodybuf *buf.Buffer) *Editor {
 			ExpandSelection: edutil.MakeExpandSelectionFn(e.bodybuf),
 			VisibleTick:     false,
 			Colors:          editorColors,
+			UnderlineColors: diagnosticColors,
+			Underlines:      bufferDiagnostics(bodybuf),
+			AnsiColors:      ansiColors,
 		},
 	}
 	e.otherSel = make([]util.Sel, NUM_OTHER_SEL)
@@ -233,9 +237,27 @@ func (e *Editor) Close() {
 	for i := range e.otherSel {
 		e.bodybuf.RmSel(&e.otherSel[i])
 	}
+	e.SetCursors(nil)
+	if !e.bufferShown() {
+		forgetDiagnostics(e.bodybuf)
+		lsp.DidClose(e.bodybuf)
+		e.bodybuf.SaveUndo()
+	}
 	debug.FreeOSMemory()
 }
 
+// bufferShown returns true if another editor is showing the body buffer of e.
+func (e *Editor) bufferShown() bool {
+	for _, col := range Wnd.cols.cols {
+		for _, ed := range col.editors {
+			if ed != e && !ed.closed && ed.bodybuf == e.bodybuf {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (e *Editor) MinHeight() int {
 	return TagHeight(&e.tagfr) + 2
 }
@@ -314,6 +336,9 @@ func (e *Editor) GenTag() bool {
 	if e.bodybuf.IsDir() {
 		t += " Get"
 	}
+	if e.bodybuf.ChangedOnDisk {
+		t += " Reload Keep DiskDiff"
+	}
 
 	t += " | " + usertext
 
@@ -339,6 +364,9 @@ func (e *Editor) GenTag() bool {
 	return true
 }
 
+// More characters than can fit in an editor
+const maxVisibleRunes = 1 << 20
+
 func (e *Editor) refreshIntl(full bool) {
 	/*Fast Path if
 	- full is not set
@@ -355,7 +383,13 @@ func (e *Editor) refreshIntl(full bool) {
 	e.sfr.Set(e.otherSel[OS_TOP].E, e.bodybuf.Size())
 	e.bodybuf.Rdlock()
 	defer e.bodybuf.Rdunlock()
-	e.sfr.Fr.Insert(e.bodybuf.Selection(util.Sel{e.otherSel[OS_TOP].E, e.bodybuf.Size()}))
+	// the frame stops at the bottom of the visible area, passing it the
+	// rest of the buffer would copy large files unnecessarily
+	end := e.bodybuf.Size()
+	if end-e.otherSel[OS_TOP].E > maxVisibleRunes {
+		end = e.otherSel[OS_TOP].E + maxVisibleRunes
+	}
+	e.sfr.Fr.Insert(e.bodybuf.Selection(util.Sel{e.otherSel[OS_TOP].E, end}))
 
 	e.refreshOpt.revCount = e.bodybuf.RevCount
 
@@ -18,6 +18,7 @@ import (
 	"github.com/aarzilli/yacco/clipboard"
 	"github.com/aarzilli/yacco/config"
 	"github.com/aarzilli/yacco/edit"
+	"github.com/aarzilli/yacco/hl"
 	"github.com/aarzilli/yacco/lsp"
 	"github.com/aarzilli/yacco/modal"
 	"github.com/aarzilli/yacco/textframe"
@@ -75,12 +76,12 @@ func init() {
 	cmds["Paste"] = Cmd{"Clipboard", "[primary|indent]\t", PasteCmd}
 	cmds["Put"] = Cmd{"Files", "", PutCmd}
 	cmds["Putall"] = Cmd{"Files", "", PutallCmd}
-	cmds["Redo"] = Cmd{"Editing", "", RedoCmd}
+	cmds["Redo"] = Cmd{"Editing", "[<duration>]\tRedoes the last undone change, or goes forward in time by <duration> through the undo tree", RedoCmd}
 	cmds["Send"] = Cmd{"Misc", "", SendCmd}
 	cmds["Snarf"] = Cmd{"Clipboard", "Same as Copy", func(ec ExecContext, arg string) { CopyCmd(ec, arg, false) }}
 	cmds["Copy"] = Cmd{"Clipboard", "Copies current selection, or between mark and cursor if the selection is empty", func(ec ExecContext, arg string) { CopyCmd(ec, arg, false) }}
 	cmds["Sort"] = Cmd{"Frames and Columns", "Duplicates current frame", SortCmd}
-	cmds["Undo"] = Cmd{"Editing", "", UndoCmd}
+	cmds["Undo"] = Cmd{"Editing", "[<duration>|#<n>|tree]\tUndoes the last change, goes back in time by <duration> or to state <n> of the undo tree, tree shows the undo tree in +Undo", UndoCmd}
 	cmds["Zerox"] = Cmd{"Frames and Columns", "Duplicates current frame", ZeroxCmd}
 	cmds["|"] = Cmd{"Jobs", "<ext. cmd.>\tRuns selection through <ext. cmd.> replaces with output", PipeCmd}
 	cmds["<"] = Cmd{"Jobs", "<ext. cmd.>\tRuns selection through <ext. cmd.>", PipeInCmd}
@@ -88,7 +89,8 @@ func init() {
 
 	// New
 	cmds["Cd"] = Cmd{"Jobs", "<dir>\t", CdCmd}
-	cmds["Jobs"] = Cmd{"Jobs", "Lists currently running jobs", JobsCmd}
+	cmds["Jobs"] = Cmd{"Jobs", "[<id>]\tLists running and recently finished jobs (or shows the output of the finished job specified)", JobsCmd}
+	cmds["Rerun"] = Cmd{"Jobs", "[<id>]\tRuns the last finished job (or the one specified) again", RerunCmd}
 	cmds["Look!Again"] = Cmd{"", "", LookAgainCmd}
 	cmds["Look!Quit"] = Cmd{"", "", func(ec ExecContext, arg string) { SpecialSendCmd(ec, "!Quit") }}
 	cmds["Look!Prev"] = Cmd{"", "", func(ec ExecContext, arg string) { SpecialSendCmd(ec, "!Prev") }}
@@ -96,6 +98,10 @@ func init() {
 	cmds["Getall"] = Cmd{"Files", "", GetallCmd}
 	cmds["Rename"] = Cmd{"Frames and Columns", "<name>\t", RenameCmd}
 	cmds["Rehash"] = Cmd{"Misc", "Recalculates completions", RehashCmd}
+	cmds["Encoding"] = Cmd{"Files", "[<encoding>] [lf|crlf]\tChanges the encoding and line endings used to save the file, without arguments shows the current ones", EncodingCmd}
+	cmds["Reload"] = Cmd{"Files", "Discards unsaved changes and reloads a file that was changed on disk", ReloadCmd}
+	cmds["Keep"] = Cmd{"Files", "Keeps unsaved changes to a file that was changed on disk, the next Put will overwrite it", KeepCmd}
+	cmds["Rehighlight"] = Cmd{"Misc", "Reloads the syntax highlighting rules from the configuration file", RehighlightCmd}
 	cmds["Do"] = Cmd{"Misc", "<…>\tExecutes sequence of commands, one per line", DoCmd}
 	cmds["Load"] = Cmd{"Session", "[<name>]\tLoads session from <name> (omit for a list of sessions)", LoadCmd}
 	cmds["Builtin"] = Cmd{"Misc", "<…>\tRuns command as builtin (skip attached processes)", BuiltinCmd}
@@ -108,7 +114,12 @@ func init() {
 	cmds["Tooltip"] = Cmd{"Misc", "<cmd>\tExecutes a command and shows the result in a tooltip, if the output starts with the BEL character the tooltip will behave as autocompletion", TooltipCmd}
 	cmds["NextError"] = Cmd{"Misc", "Tries to load the file specified in the next line of the last editor where a load operation was executed", NextErrorCmd}
 	cmds["Lsp"] = Cmd{"Misc", "Language server management", LspCmd}
+	cmds["Nextbranch"] = Cmd{"Editing", "Switches to the next branch of the undo tree", func(ec ExecContext, arg string) { UndoBranchCmd(ec, +1) }}
+	cmds["Prevbranch"] = Cmd{"Editing", "Switches to the previous branch of the undo tree", func(ec ExecContext, arg string) { UndoBranchCmd(ec, -1) }}
+	cmds["Outline"] = Cmd{"Misc", "Shows the outline of the current file in +Outline, right click on an entry to select it", OutlineCmd}
+	cmds["Diagnostics"] = Cmd{"Misc", "Shows diagnostics reported by language servers, use NextError to go through them", DiagnosticsCmd}
 	cmds["Prepare"] = Cmd{"", "", PrepareCmd}
+	cmds["Def"] = Cmd{"Editing", "[<name> [<program>]]\tDefines a named Edit program, executed with Edit :<name> [<args>...], without a program shows its definition", DefCmd}
 
 	// Not actually commands
 	cmds["LookFile"] = Cmd{"Frames and Columns", "", nil}
@@ -141,9 +152,12 @@ func HelpCmd(ec ExecContext, arg string) {
 	Insert before
 <addr>d
 	Delete addr
+u [<n>]
+	Undo the last <n> changes (one by default), redo them if <n> is negative
 
 <addr>s[<num>]/<regexp>/<text>/[g]
 	Replace all instances of <regexp> with <text>. If <num> is specified replaces only <num>-th occourence of <regexp>
+	\0 through \9 and \{name} in <text> are replaced with the corresponding group of <regexp>
 
 <addr>m<addr>
 	Move from one address to another
@@ -153,7 +167,11 @@ func HelpCmd(ec ExecContext, arg string) {
 <addr>p
 	Print contents of address
 <addr>=
-	Print current line/column
+	Print line address of <addr>
+<addr>=#
+	Print character address of <addr>
+<addr>=+
+	Print line and column of <addr>
 	
 <addr>x/<regexp>/<command>
 	Executes command for every match of <regexp>
@@ -173,10 +191,17 @@ func HelpCmd(ec ExecContext, arg string) {
 	Executes external or internal command
 
 <addr>k
-	Saves address as current selection
+	Saves address as current selection. Inside x and y loops every address
+	saved (or every match, if x and y have no command) becomes a cursor
 
 <addr>B<glob expr>
 	Open specified files
+f [<name>]
+	Set the file name and print the file's menu line
+n
+	Print the menu line of every open file
+q
+	Close the file, if it has unsaved changes q must be executed twice
 	
 == Addresses ==
 The initial <addr> can always be omitted, if it is it will default to "."
@@ -194,6 +219,13 @@ $			the point after the last character
 /@regexp/
 ?@regexp?	just like /regexp/ and ?regexp? but suppresses errors
 
+Regular expressions support, besides the usual syntax:
+x{n}, x{n,}, x{n,m}	counted repetition (x{n,m}? is non-greedy)
+(?P<name>re)
+(?<name>re)		named group
+(?=re), (?!re)		lookahead, negated lookahead
+(?<=re), (?<!re)	lookbehind, negated lookbehind
+
 Compound Addresses
 a1+a2		address a2 evaluated starting at the end of a1
 a1-a2		address a2 evaluated looking in the reverse direction starting at the beginning of a1
@@ -203,6 +235,15 @@ a1;a2		like a1,a2 but with a2 evaluated after a1
 For + and - if a2 is missing it defaults to "1", if a1 is missing it defaults to ".".
 For , and ; if a2 is missing it defaults to "$", if a1 is missing it defaults to "0".
 The address "," represents the whole file.
+
+== Named programs ==
+Edit programs can be named in the Edit section of the configuration file
+(the name and the program separated by a tab, lines starting with a tab
+continue the previous program) or with Def <name> <program>.
+
+Edit :name [<args>...]
+	Executes the named program, $1 through $9 in the program are replaced
+	by the corresponding argument and $* by all of them
 `)
 
 	case "Keybindings":
@@ -576,7 +617,7 @@ func editCmd(ec ExecContext, arg string, trace bool) {
 	if (ec.buf == nil) || (ec.fr == nil) || (ec.br == nil) {
 		edit.Edit(arg, makeEditContext(nil, "", nil, nil, nil, trace))
 	} else {
-		edit.Edit(arg, makeEditContext(ec.buf, ec.dir, &ec.fr.Sel, ec.eventChan, ec.ed, trace))
+		execEditPgm(ec, edit.Parse([]rune(arg)), trace)
 		if !ec.norefresh {
 			ec.br()
 		}
@@ -597,6 +638,7 @@ func ExitCmd(ec ExecContext, arg string) {
 	}
 
 	if (n == 0) || exitConfirmed {
+		saveAllUndo()
 		FsQuit()
 	} else {
 		exitConfirmed = true
@@ -605,7 +647,44 @@ func ExitCmd(ec ExecContext, arg string) {
 }
 
 func JobsCmd(ec ExecContext, arg string) {
-	UpdateJobs(true)
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		UpdateJobs(true)
+		return
+	}
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		Warn("Jobs: wrong argument " + arg)
+		return
+	}
+	job := findJobHistory(n)
+	if job == nil {
+		Warn(fmt.Sprintf("Jobs: no finished job %d", n))
+		return
+	}
+	jobOutput(job)
+}
+
+func RerunCmd(ec ExecContext, arg string) {
+	exitConfirmed = false
+	arg = strings.TrimSpace(arg)
+	n := 0
+	if arg != "" {
+		var err error
+		n, err = strconv.Atoi(arg)
+		if err != nil {
+			Warn("Rerun: wrong argument " + arg)
+			return
+		}
+	}
+	job := findJobHistory(n)
+	if job == nil {
+		Warn("Rerun: no finished job to run")
+		return
+	}
+	if err := jobRerun(job); err != nil {
+		Warn("Rerun: " + err.Error())
+	}
 }
 
 func KillCmd(ec ExecContext, arg string) {
@@ -850,6 +929,7 @@ func PutCmd(ec ExecContext, arg string) {
 			return
 		}
 	}
+	lspFormatBeforePut(ec.ed)
 	Log(ec.ed.edid, LOP_PUT, ec.ed.bodybuf)
 	err := ec.ed.bodybuf.Put()
 	if err != nil {
@@ -877,6 +957,7 @@ func PutallCmd(ec ExecContext, arg string) {
 	for _, col := range Wnd.cols.cols {
 		for _, ed := range col.editors {
 			if !fakebuf(ed.bodybuf.Name) && ed.bodybuf.Modified {
+				lspFormatBeforePut(ed)
 				err := ed.bodybuf.Put()
 				if err != nil {
 					t += ed.bodybuf.ShortName() + ": " + err.Error() + "\n"
@@ -903,11 +984,29 @@ func PutallCmd(ec ExecContext, arg string) {
 }
 
 func registerSaveRule(path string, triggeredSaveRules map[string][]string) {
-	if sr := config.SaveRuleFor(path); sr != nil {
+	if sr := config.SaveRuleFor(path); sr != nil && sr.Cmd != util.LspFormatSaveRule {
 		triggeredSaveRules[sr.Cmd] = append(triggeredSaveRules[sr.Cmd], path)
 	}
 }
 
+// lspFormatBeforePut formats the buffer of ed with its language server, if
+// a save rule asks for it.
+func lspFormatBeforePut(ed *Editor) {
+	if sr := config.SaveRuleFor(ed.bodybuf.Path()); sr == nil || sr.Cmd != util.LspFormatSaveRule {
+		return
+	}
+	srv, lspb := lsp.BufferToLsp(Wnd.tagbuf.Dir, ed.bodybuf, util.Sel{0, 0}, true, Warn, defaultLookForLsp)
+	if srv == nil {
+		return
+	}
+	tdes, err := srv.Format(lspb, lspFormattingOptions(ed), false)
+	if err != nil {
+		Warn(fmt.Sprintf("Put: Couldn't format %s: %v", ed.bodybuf.ShortName(), err))
+		return
+	}
+	executeLspTextEdits(tdes)
+}
+
 func runSaveRules(triggeredSaveRules map[string][]string) {
 	for srcmd, files := range triggeredSaveRules {
 		NewJob(Wnd.tagbuf.Dir, fmt.Sprintf("%s %s", srcmd, strings.Join(files, " ")), "", &ExecContext{}, false, false, nil)
@@ -940,15 +1039,26 @@ func GetallCmd(ec ExecContext, arg string) {
 
 func RedoCmd(ec ExecContext, arg string) {
 	exitConfirmed = false
+	ec = undoTreeRedirect(ec)
 	if ec.ed == nil {
 		return
 	}
 	ec.ed.confirmDel = false
 	ec.ed.confirmSave = false
-	ec.buf.Undo(&ec.fr.Sel, true)
+	if arg = strings.TrimSpace(arg); arg != "" {
+		d, err := time.ParseDuration(arg)
+		if err != nil {
+			Warn("Redo: wrong argument: " + arg)
+			return
+		}
+		ec.buf.UndoToTime(d, &ec.fr.Sel)
+	} else {
+		ec.buf.Undo(&ec.fr.Sel, true)
+	}
 	if !ec.norefresh {
 		ec.br()
 	}
+	updateUndoTree()
 }
 
 func SendCmd(ec ExecContext, arg string) {
@@ -989,15 +1099,56 @@ func SortCmd(ec ExecContext, arg string) {
 
 func UndoCmd(ec ExecContext, arg string) {
 	exitConfirmed = false
+	ec = undoTreeRedirect(ec)
+	if (ec.ed == nil) || (ec.buf == nil) {
+		return
+	}
+	ec.ed.confirmDel = false
+	ec.ed.confirmSave = false
+	switch arg = strings.TrimSpace(arg); {
+	case arg == "":
+		ec.buf.Undo(&ec.fr.Sel, false)
+	case arg == "tree":
+		showUndoTree(ec.ed)
+		return
+	case arg[0] == '#':
+		n, err := strconv.Atoi(arg[1:])
+		if err == nil {
+			err = ec.buf.UndoToState(n, &ec.fr.Sel)
+		}
+		if err != nil {
+			Warn("Undo: wrong argument: " + arg)
+			return
+		}
+	default:
+		d, err := time.ParseDuration(arg)
+		if err != nil {
+			Warn("Undo: wrong argument: " + arg)
+			return
+		}
+		ec.buf.UndoToTime(-d, &ec.fr.Sel)
+	}
+	if ec.br != nil && !ec.norefresh {
+		ec.br()
+	}
+	updateUndoTree()
+}
+
+func UndoBranchCmd(ec ExecContext, dir int) {
+	exitConfirmed = false
+	ec = undoTreeRedirect(ec)
 	if (ec.ed == nil) || (ec.buf == nil) {
 		return
 	}
 	ec.ed.confirmDel = false
 	ec.ed.confirmSave = false
-	ec.buf.Undo(&ec.fr.Sel, false)
+	if !ec.buf.UndoBranch(dir, &ec.fr.Sel) {
+		return
+	}
 	if ec.br != nil && !ec.norefresh {
 		ec.br()
 	}
+	updateUndoTree()
 }
 
 func ZeroxCmd(ec ExecContext, arg string) {
@@ -1217,7 +1368,7 @@ func maybeAddSelExtension(k, cmdstr string) {
 
 	_, arg, cmdname, isintl := IntlCmd(cmdstr)
 
-	if !isintl || (cmdname != "Edit") {
+	if !isintl || (cmdname != "Edit") || edit.IsProgramCall(arg) {
 		return
 	}
 
@@ -1243,6 +1394,13 @@ func CompileCmd(cmdstr string) CompiledCmd {
 			ExtExec(ec, cmdstr, false)
 		}}
 	} else if cmdname == "Edit" {
+		if edit.IsProgramCall(arg) {
+			// named programs can be redefined, expand them when executed
+			return CompiledCmd{cmdstr, func(ec ExecContext) {
+				defer execGuard()
+				editPgmToFunc(edit.Parse([]rune(arg)))(ec)
+			}}
+		}
 		pgm := edit.Parse([]rune(arg))
 		return CompiledCmd{cmdstr, editPgmToFunc(pgm)}
 	} else if cmdname == "Do" {
@@ -1270,6 +1428,26 @@ func CompileCmd(cmdstr string) CompiledCmd {
 	}
 }
 
+// editOnlyCmd returns true if cmdstr is an Edit command or a Do command
+// executing only Edit commands.
+func editOnlyCmd(cmdstr string) bool {
+	_, arg, cmdname, isintl := IntlCmd(cmdstr)
+	switch {
+	case !isintl:
+		return false
+	case cmdname == "Edit":
+		return true
+	case cmdname == "Do":
+		for _, cmd := range strings.Split(arg, "\n") {
+			if !editOnlyCmd(cmd) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
 func editPgmToFunc(pgm *edit.Cmd) func(ec ExecContext) {
 	return func(ec ExecContext) {
 		defer execGuard()
@@ -1278,7 +1456,7 @@ func editPgmToFunc(pgm *edit.Cmd) func(ec ExecContext) {
 			return
 		}
 
-		pgm.Exec(makeEditContext(ec.buf, ec.dir, &ec.fr.Sel, ec.eventChan, ec.ed, false))
+		execEditPgm(ec, pgm, false)
 		if !ec.norefresh {
 			ec.br()
 		}
@@ -1300,16 +1478,7 @@ func RenameCmd(ec ExecContext, arg string) {
 		ec.ed.confirmSave = false
 	}
 
-	newName := strings.TrimSpace(arg)
-	abspath := util.ResolvePath(ec.buf.Dir, newName)
-	oldName := ec.buf.Name
-	ec.buf.Name = filepath.Base(abspath)
-	oldDir := ec.buf.Dir
-	ec.buf.Dir = filepath.Dir(abspath)
-	if newName[len(newName)-1] == '/' {
-		ec.buf.Name += "/"
-	}
-	ec.buf.Modified = (oldName != ec.buf.Name) || (oldDir != ec.buf.Dir)
+	ec.buf.Rename(strings.TrimSpace(arg))
 	if !ec.norefresh {
 		ec.br()
 	}
@@ -1327,6 +1496,56 @@ func RehashCmd(ec ExecContext, arg string) {
 	}
 }
 
+func RehighlightCmd(ec ExecContext, arg string) {
+	if err := config.ReloadHighlighting(*configFlag); err != nil {
+		Warn("Rehighlight: " + err.Error())
+		return
+	}
+	for _, col := range Wnd.cols.cols {
+		for _, ed := range col.editors {
+			if _, isfixed := ed.bodybuf.Hl.(*hl.Fixed); isfixed || ed.bodybuf.IsLarge() {
+				continue
+			}
+			ed.bodybuf.Hl = hl.New(config.LanguageRules, ed.bodybuf.Name)
+			delete(semanticTokensRequests, ed.bodybuf)
+			ed.BufferRefresh()
+		}
+	}
+}
+
+func EncodingCmd(ec ExecContext, arg string) {
+	if ec.ed == nil || fakebuf(ec.ed.bodybuf.Name) {
+		return
+	}
+	b := ec.ed.bodybuf
+	args := strings.Fields(arg)
+	if len(args) == 0 {
+		cmds := []string{}
+		for _, encoding := range buf.Encodings {
+			cmds = append(cmds, "Encoding "+encoding)
+		}
+		cmds = append(cmds, "Encoding "+buf.EolLF, "Encoding "+buf.EolCRLF)
+		Warn(fmt.Sprintf("%s: %s %s\n%s\n", b.ShortName(), b.Props["encoding"], b.Props["eol"], strings.Join(cmds, "\n")))
+		return
+	}
+
+	encoding, eol := "", ""
+	for _, a := range args {
+		switch strings.ToLower(a) {
+		case buf.EolLF, buf.EolCRLF:
+			eol = strings.ToLower(a)
+		default:
+			encoding = strings.ToLower(a)
+		}
+	}
+	if err := b.SetEncoding(encoding, eol); err != nil {
+		Warn("Encoding: " + err.Error())
+		return
+	}
+	ec.ed.TagRefresh()
+	ec.ed.BufferRefresh()
+}
+
 func ThemeCmd(ec ExecContext, arg string) {
 	if arg == "" {
 		var colorSchemes = map[*config.ColorScheme]string{}
@@ -1372,7 +1591,8 @@ Debug trace
 	Enables/disables trace on Edit errors
 	
 Debug compile <command>
-	Compiles Edit command, shows the result of the compilation
+	Compiles Edit command, shows the result of the compilation and the
+	expansion of named programs
 	
 Debug memory
 	Prints a summary of memory usage
@@ -1413,7 +1633,11 @@ Debug load
 			return
 		}
 		pgm := edit.Parse([]rune(v[1]))
-		Warn(pgm.String(true))
+		if edit.IsProgramCall(v[1]) {
+			Warn(edit.Expand(v[1]) + "\n" + pgm.String(true))
+		} else {
+			Warn(pgm.String(true))
+		}
 	case "memory":
 		debug.FreeOSMemory()
 		var buf bytes.Buffer
@@ -1440,6 +1664,42 @@ Debug load
 	}
 }
 
+func DefCmd(ec ExecContext, arg string) {
+	exitConfirmed = false
+	if ec.ed != nil {
+		ec.ed.confirmDel = false
+		ec.ed.confirmSave = false
+	}
+
+	v := strings.SplitN(strings.TrimSpace(arg), " ", 2)
+	switch {
+	case v[0] == "":
+		names := make([]string, 0, len(edit.Programs))
+		for name := range edit.Programs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var out strings.Builder
+		for _, name := range names {
+			fmt.Fprintf(&out, "%s\t%s\n", name, edit.Programs[name])
+		}
+		Warn(out.String())
+	case len(v) == 1:
+		pgm, ok := edit.Programs[v[0]]
+		if !ok {
+			Warn("Def: unknown program " + v[0])
+			return
+		}
+		Warn(fmt.Sprintf("%s\t%s\n", v[0], pgm))
+	default:
+		if !edit.IsProgramName(v[0]) {
+			Warn("Def: invalid program name " + v[0])
+			return
+		}
+		edit.Define(v[0], strings.TrimSpace(v[1]))
+	}
+}
+
 func MarkCmd(ec ExecContext, arg string) {
 	if ec.ed == nil {
 		return
@@ -1567,13 +1827,28 @@ func LspCmd(ec ExecContext, arg string) {
 	This help message
 
 Lsp restart
-	Restarts LSP server
+	Restarts LSP servers for the current directory
 
 Lsp log
 	Shows LSP log
 
 Lsp refs
 	Shows all references
+
+Lsp def, Lsp impl, Lsp typedef
+	Opens the definition, implementation or type definition of the symbol
+	under the cursor, multiple results are shown in +Lsp
+
+Lsp callers, Lsp callees
+	Shows the functions calling or called by the function under the cursor
+
+Lsp format
+	Formats the selection, or the whole file if nothing is selected.
+	To format files when they are saved use "Lsp format" as the command of
+	a save rule
+
+Diagnostics
+	Shows all diagnostics in +Diagnostics, NextError will go through them
 `)
 		return
 	}
@@ -1611,6 +1886,29 @@ Lsp refs
 				Warnfull("+Lsp", s, true, false)
 			}
 		}()
+	case "def", "impl", "typedef", "callers", "callees":
+		go func() {
+			locs, err := srv.Lookup(lspb, arg)
+			sideChan <- func() {
+				switch {
+				case err != nil:
+					Warn(err.Error())
+				case len(locs) == 0:
+					Warn("Lsp " + arg + ": nothing found")
+				case len(locs) == 1:
+					Load(ec, 0, false, []rune(locs[0]))
+				default:
+					Warnfull("+Lsp", strings.Join(locs, "\n"), true, false)
+				}
+			}
+		}()
+	case "format":
+		tdes, err := srv.Format(lspb, lspFormattingOptions(ec.ed), ec.ed.sfr.Fr.Sel.S != ec.ed.sfr.Fr.Sel.E)
+		if err != nil {
+			Warn("Lsp format: " + err.Error())
+			return
+		}
+		executeLspTextEdits(tdes)
 	case "rename":
 		tdes := srv.Rename(lspb, rest)
 		executeLspTextEdits(tdes)
@@ -1647,12 +1945,24 @@ func executeLspTextEdits(tdes []lsp.TextDocumentEdit) {
 		}
 	}
 	for path, es := range edits {
+		sort.SliceStable(es, func(i, j int) bool { return es[i].Sel.S < es[j].Sel.S })
 		ed, _ := EditFind(".", path, false, false)
 		ed.bodybuf.ReplaceAll(es, ed.eventChan, util.EO_MOUSE)
 		ed.BufferRefresh()
 	}
 }
 
+func lspFormattingOptions(ed *Editor) lsp.FormattingOptions {
+	if indent := ed.bodybuf.Props["indentchar"]; indent != "" && indent != "\t" {
+		return lsp.FormattingOptions{TabSize: float64(len(indent)), InsertSpaces: true}
+	}
+	tabWidth := ed.sfr.Fr.TabWidth
+	if tabWidth <= 0 {
+		tabWidth = 8
+	}
+	return lsp.FormattingOptions{TabSize: float64(tabWidth)}
+}
+
 func PrepareCmd(ec ExecContext, arg string) {
 	if ec.ed == nil {
 		return
@@ -3,59 +3,151 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/aarzilli/yacco/util"
 )
 
-var history = []string{}
+// history of executed commands, shared with all other instances of win
+// and with yacco's autocompletion
+var history = &util.History{Path: util.HistoryPath()}
 
-const MAX_HISTORY_LEN = 500
+const DEFAULT_HISTORY_LIST = 10
 
-func historyAppend(command string) {
-	if command == "\n" {
-		return
+// commands are not saved to the history if the environment variable
+// yaccohistory is set to off
+var historyEnabled = os.Getenv("yaccohistory") != "off"
+
+// atShellPrompt returns true if the shell (pid) is reading a command: lines
+// read by other programs (REPLs, ssh, sudo...) or with echo disabled
+// (passwords) must not be saved to the history.
+func atShellPrompt(pty *os.File, pid int) bool {
+	if TcGetPGrp(pty) != pid {
+		return false
 	}
-	command = strings.TrimSpace(command)
-	history = append(history, command)
-	if len(history) > MAX_HISTORY_LEN {
-		copy(history, history[1:])
-		history = history[:len(history)-1]
+	tios, err := TcGetAttr(pty)
+	if err != nil {
+		return false
 	}
+	// line editors like readline disable both ECHO and ICANON and echo
+	// the input themselves
+	return tios.IsLFlag(ECHO) || !tios.IsLFlag(ICANON)
 }
 
-func historyCmd(cmd string) string {
-	vcmd := strings.SplitN(cmd, " ", 2)
-	if len(vcmd) <= 1 {
-		return historyNum(10)
+func historyAppend(dir, command string) {
+	command = strings.Replace(command, "\x16", "", -1) // remove ^V added by cookTabs
+	if err := history.Append(dir, command); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing history: %v\n", err)
 	}
+}
 
-	if n, err := strconv.ParseInt(vcmd[1], 10, 32); err == nil {
-		return historyNum(int(n))
+// shellDir returns the working directory of the foreground process of the
+// pty (or of the process with the specified pid if there isn't one).
+func shellDir(pty *os.File, pid int) string {
+	if pgrp := TcGetPGrp(pty); pgrp > 0 {
+		pid = pgrp
+	}
+	if dir, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid)); err == nil {
+		return dir
 	}
+	dir, _ := os.Getwd()
+	return dir
+}
 
-	return historySearch(vcmd[1])
+// HISTDIR_INTERVAL is the minimum interval between two checks of the
+// directory of the shell while the program is producing output
+const HISTDIR_INTERVAL = time.Second
+
+// histDir keeps the histdir property of the buffer updated with the
+// directory of the shell, yacco's autocompletion uses it to find the
+// commands executed in the current directory.
+type histDir struct {
+	dir  string
+	last time.Time
 }
 
-func historyNum(n int) string {
-	r := bytes.NewBuffer([]byte{})
-	r.Write([]byte{'\n'})
-	start := len(history) - n
-	if start < 0 {
-		start = 0
+// update checks the directory of the shell, if HISTDIR_INTERVAL elapsed
+// since the last check (reset last to check again immediately).
+func (hd *histDir) update(pty *os.File, pid int, buf *util.BufferConn) {
+	if time.Since(hd.last) < HISTDIR_INTERVAL {
+		return
 	}
-	for i := start; i < len(history); i++ {
-		fmt.Fprintf(r, " %s\n", history[i])
+	hd.last = time.Now()
+	dir := shellDir(pty, pid)
+	if dir == hd.dir || strings.Contains(dir, "\n") {
+		return
 	}
-	return r.String()
+	hd.dir = dir
+	_, err := buf.PropFd.Write([]byte("histdir=" + dir))
+	util.Allergic3(debug, err, isDelSeen())
 }
 
-func historySearch(needle string) string {
-	r := bytes.NewBuffer([]byte{})
-	r.Write([]byte{'\n'})
-	for i := range history {
-		if strings.Index(history[i], needle) >= 0 {
-			fmt.Fprintf(r, " %s\n", history[i])
+// historyCmd executes a history command, dir is the current directory of
+// the shell:
+//
+//	"		last commands executed in dir
+//	" N		last N commands executed in dir
+//	" text		commands executed in dir containing text
+//	"" ...		same as above but for commands executed in any directory
+//	"! [text]	most recent command (containing text) to put at the prompt
+//
+// If recall is true r is the command to put at the prompt (empty if none
+// was found), otherwise it is the text to append to the body.
+func historyCmd(cmd, dir string) (r string, recall bool) {
+	if err := history.Load(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading history: %v\n", err)
+	}
+
+	cmd = strings.TrimSpace(cmd[1:])
+	switch {
+	case strings.HasPrefix(cmd, "!"):
+		needle := strings.TrimSpace(cmd[1:])
+		es := history.Commands(dir, needle, 1)
+		if len(es) == 0 {
+			es = history.Commands("", needle, 1)
+		}
+		if len(es) == 0 {
+			return "", true
+		}
+		return es[0].Cmd, true
+	case strings.HasPrefix(cmd, "\""):
+		cmd = strings.TrimSpace(cmd[1:])
+		dir = ""
+	}
+
+	n, needle := DEFAULT_HISTORY_LIST, ""
+	if cmd != "" {
+		if x, err := strconv.ParseInt(cmd, 10, 32); err == nil {
+			n = int(x)
+		} else {
+			n, needle = -1, cmd
+		}
+	}
+
+	es := history.Commands(dir, needle, n)
+
+	r2 := bytes.NewBuffer([]byte{})
+	r2.Write([]byte{'\n'})
+	for i := len(es) - 1; i >= 0; i-- {
+		if dir == "" {
+			fmt.Fprintf(r2, " %s # %s\n", es[i].Cmd, es[i].Dir)
+		} else {
+			fmt.Fprintf(r2, " %s\n", es[i].Cmd)
 		}
 	}
-	return r.String()
+	return r2.String(), false
+}
+
+// historyRecall replaces the text at the prompt with command
+func historyRecall(command string, buf *util.BufferConn) {
+	addr, err := buf.ReadAddr()
+	util.Allergic3(debug, err, isDelSeen())
+	fmt.Fprintf(buf.AddrFd, "#%d,$", addr[0])
+	_, err = buf.XDataFd.Write([]byte(command))
+	util.Allergic3(debug, err, isDelSeen())
+	fmt.Fprintf(buf.AddrFd, "#%d", addr[0])
+	updateDot("$", buf)
 }
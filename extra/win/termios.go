@@ -10,6 +10,8 @@ import "C"
 import (
 	"errors"
 	"os"
+	"syscall"
+	"unsafe"
 )
 
 const (
@@ -168,6 +170,15 @@ type winSize struct {
 	xpixel, ypixel uint16
 }
 
+func TcSetWinSize(file *os.File, rows, cols int) error {
+	ws := winSize{uint16(rows), uint16(cols), 0, 0}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
 func TcSetAttr(file *os.File, when SetWhen, tios *Termios) (err error) {
 	state, errno := C.tcsetattr(C.int(file.Fd()), C.int(when), &tios.ios)
 	if state < 0 {
@@ -0,0 +1,681 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/aarzilli/yacco/util"
+)
+
+const (
+	VT_NORMAL = iota
+	VT_ESCAPE
+	VT_ESCAPE_INTERMEDIATE
+	VT_CSI
+	VT_OSC
+	VT_OSC_ESCAPE
+)
+
+const MAX_VT_PARAM = 9999
+
+type vtCell struct {
+	r     rune
+	color uint8
+}
+
+// vtScreen is the screen of a VT100/xterm terminal, it is used while a
+// program is using the alternate screen. All methods are safe to call
+// concurrently.
+type vtScreen struct {
+	mu sync.Mutex
+
+	w, h     int
+	cells    [][]vtCell
+	x, y     int
+	top, bot int // scroll region, bot is excluded
+	wrapnext bool
+	sgr      sgrState
+	saved    struct {
+		x, y int
+		sgr  sgrState
+	}
+
+	graphics  bool // DEC special graphics character set
+	appCursor bool // cursor keys send application sequences
+	autowrap  bool
+	origin    bool
+
+	changed bool
+	reply   []byte // answers to queries, to send back to the program
+
+	state   int
+	seq     []byte
+	utf8buf []byte
+}
+
+func newVtScreen(w, h int) *vtScreen {
+	vt := &vtScreen{autowrap: true}
+	vt.resize(w, h)
+	return vt
+}
+
+func (vt *vtScreen) blank() vtCell {
+	return vtCell{' ', util.AnsiColor(0, vt.sgr.bg)}
+}
+
+// Resize changes the size of the screen, keeping its contents.
+func (vt *vtScreen) Resize(w, h int) {
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+	vt.resize(w, h)
+}
+
+func (vt *vtScreen) resize(w, h int) {
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	cells := make([][]vtCell, h)
+	for y := range cells {
+		cells[y] = make([]vtCell, w)
+		for x := range cells[y] {
+			if y < len(vt.cells) && x < len(vt.cells[y]) {
+				cells[y][x] = vt.cells[y][x]
+			} else {
+				cells[y][x] = vtCell{' ', util.AnsiColor(0, 0)}
+			}
+		}
+	}
+	vt.w, vt.h, vt.cells = w, h, cells
+	vt.top, vt.bot = 0, h
+	vt.clampCursor()
+	vt.changed = true
+}
+
+// Feed processes a byte of output of the program, it returns true when the
+// program leaves the alternate screen.
+func (vt *vtScreen) Feed(ch byte) bool {
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+
+	switch vt.state {
+	case VT_NORMAL:
+		switch {
+		case ch == 0x1b:
+			vt.seq = vt.seq[:0]
+			vt.state = VT_ESCAPE
+		case ch < 0x20 || ch == 0x7f:
+			vt.control(ch)
+		default:
+			vt.utf8buf = append(vt.utf8buf, ch)
+			if utf8.FullRune(vt.utf8buf) {
+				r, _ := utf8.DecodeRune(vt.utf8buf)
+				vt.utf8buf = vt.utf8buf[:0]
+				vt.put(r)
+			}
+		}
+
+	case VT_ESCAPE:
+		switch {
+		case ch == '[':
+			vt.state = VT_CSI
+		case ch == ']':
+			vt.state = VT_OSC
+		case ch >= 0x20 && ch <= 0x2f:
+			vt.seq = append(vt.seq, ch)
+			vt.state = VT_ESCAPE_INTERMEDIATE
+		default:
+			vt.state = VT_NORMAL
+			vt.escape(ch)
+		}
+
+	case VT_ESCAPE_INTERMEDIATE:
+		vt.state = VT_NORMAL
+		if vt.seq[0] == '(' {
+			vt.graphics = ch == '0'
+		}
+
+	case VT_CSI:
+		if ch >= 0x40 && ch <= 0x7e {
+			vt.state = VT_NORMAL
+			return vt.csi(ch)
+		}
+		vt.seq = append(vt.seq, ch)
+
+	case VT_OSC:
+		switch ch {
+		case 0x07:
+			vt.state = VT_NORMAL
+		case 0x1b:
+			vt.state = VT_OSC_ESCAPE
+		}
+
+	case VT_OSC_ESCAPE:
+		// string terminator
+		vt.state = VT_NORMAL
+	}
+	return false
+}
+
+func (vt *vtScreen) control(ch byte) {
+	switch ch {
+	case 0x08:
+		if vt.x > 0 {
+			vt.x--
+		}
+		vt.wrapnext = false
+	case 0x09:
+		vt.x = (vt.x/8 + 1) * 8
+		if vt.x >= vt.w {
+			vt.x = vt.w - 1
+		}
+	case 0x0a, 0x0b, 0x0c:
+		vt.index()
+	case 0x0d:
+		vt.x = 0
+		vt.wrapnext = false
+	}
+}
+
+var decGraphics = map[rune]rune{
+	'`': '◆', 'a': '▒', 'f': '°', 'g': '±', 'j': '┘', 'k': '┐', 'l': '┌', 'm': '└', 'n': '┼',
+	'o': '⎺', 'p': '⎻', 'q': '─', 'r': '⎼', 's': '⎽', 't': '├', 'u': '┤', 'v': '┴', 'w': '┬',
+	'x': '│', 'y': '≤', 'z': '≥', '{': 'π', '|': '≠', '}': '£', '~': '·',
+}
+
+func (vt *vtScreen) put(r rune) {
+	if vt.graphics {
+		if gr, ok := decGraphics[r]; ok {
+			r = gr
+		}
+	}
+	if vt.wrapnext {
+		vt.x = 0
+		vt.index()
+	}
+	vt.cells[vt.y][vt.x] = vtCell{r, vt.sgr.color()}
+	vt.changed = true
+	if vt.x+1 < vt.w {
+		vt.x++
+	} else {
+		vt.wrapnext = vt.autowrap
+	}
+}
+
+// index moves the cursor down one line, scrolling the scroll region if the
+// cursor is on its last line
+func (vt *vtScreen) index() {
+	vt.wrapnext = false
+	if vt.y == vt.bot-1 {
+		vt.scrollUp(vt.top, vt.bot, 1)
+	} else if vt.y < vt.h-1 {
+		vt.y++
+	}
+}
+
+func (vt *vtScreen) reverseIndex() {
+	vt.wrapnext = false
+	if vt.y == vt.top {
+		vt.scrollDown(vt.top, vt.bot, 1)
+	} else if vt.y > 0 {
+		vt.y--
+	}
+}
+
+// scrollUp moves lines top+n to bot up by n lines
+func (vt *vtScreen) scrollUp(top, bot, n int) {
+	if n > bot-top {
+		n = bot - top
+	}
+	for y := top; y < bot; y++ {
+		if y+n < bot {
+			copy(vt.cells[y], vt.cells[y+n])
+		} else {
+			vt.clear(y, 0, vt.w)
+		}
+	}
+	vt.changed = true
+}
+
+// scrollDown moves lines top to bot-n down by n lines
+func (vt *vtScreen) scrollDown(top, bot, n int) {
+	if n > bot-top {
+		n = bot - top
+	}
+	for y := bot - 1; y >= top; y-- {
+		if y-n >= top {
+			copy(vt.cells[y], vt.cells[y-n])
+		} else {
+			vt.clear(y, 0, vt.w)
+		}
+	}
+	vt.changed = true
+}
+
+// clear erases the characters of line y from s to e
+func (vt *vtScreen) clear(y, s, e int) {
+	if e > vt.w {
+		e = vt.w
+	}
+	for x := s; x < e; x++ {
+		vt.cells[y][x] = vt.blank()
+	}
+	vt.changed = true
+}
+
+// moveTo moves the cursor to line y (relative to the scroll region in
+// origin mode) and column x
+func (vt *vtScreen) moveTo(y, x int) {
+	if vt.origin {
+		y += vt.top
+		if y >= vt.bot {
+			y = vt.bot - 1
+		}
+	}
+	vt.x, vt.y = x, y
+	vt.clampCursor()
+}
+
+func (vt *vtScreen) clampCursor() {
+	x, y := vt.x, vt.y
+	if y < 0 {
+		y = 0
+	}
+	if y >= vt.h {
+		y = vt.h - 1
+	}
+	if x < 0 {
+		x = 0
+	}
+	if x >= vt.w {
+		x = vt.w - 1
+	}
+	vt.x, vt.y = x, y
+	vt.wrapnext = false
+}
+
+func (vt *vtScreen) save() {
+	vt.saved.x, vt.saved.y, vt.saved.sgr = vt.x, vt.y, vt.sgr
+}
+
+func (vt *vtScreen) restore() {
+	vt.x, vt.y, vt.sgr = vt.saved.x, vt.saved.y, vt.saved.sgr
+	vt.clampCursor()
+}
+
+func (vt *vtScreen) escape(ch byte) {
+	switch ch {
+	case '7':
+		vt.save()
+	case '8':
+		vt.restore()
+	case 'D':
+		vt.index()
+	case 'E':
+		vt.x = 0
+		vt.index()
+	case 'M':
+		vt.reverseIndex()
+	case 'c':
+		vt.sgr = sgrState{}
+		vt.graphics, vt.appCursor, vt.autowrap, vt.origin = false, false, true, false
+		vt.top, vt.bot = 0, vt.h
+		for y := range vt.cells {
+			vt.clear(y, 0, vt.w)
+		}
+		vt.moveTo(0, 0)
+	}
+}
+
+func (vt *vtScreen) csi(final byte) (left bool) {
+	var private byte
+	params := string(vt.seq)
+	if len(params) > 0 && strings.IndexByte("?<=>", params[0]) >= 0 {
+		private = params[0]
+		params = params[1:]
+	}
+	args, ok := vtParams(params)
+	if !ok {
+		// malformed sequence
+		return false
+	}
+	arg := func(i, def int) int {
+		if i >= len(args) || args[i] == 0 {
+			return def
+		}
+		return args[i]
+	}
+	n := arg(0, 1)
+
+	switch final {
+	case '@':
+		if n > vt.w-vt.x {
+			n = vt.w - vt.x
+		}
+		line := vt.cells[vt.y]
+		copy(line[vt.x+n:], line[vt.x:])
+		vt.clear(vt.y, vt.x, vt.x+n)
+	case 'A':
+		top := 0
+		if vt.y >= vt.top {
+			top = vt.top
+		}
+		vt.y -= n
+		if vt.y < top {
+			vt.y = top
+		}
+		vt.wrapnext = false
+	case 'B', 'e':
+		bot := vt.h
+		if vt.y < vt.bot {
+			bot = vt.bot
+		}
+		vt.y += n
+		if vt.y >= bot {
+			vt.y = bot - 1
+		}
+		vt.wrapnext = false
+	case 'C', 'a':
+		vt.x += n
+		if vt.x >= vt.w {
+			vt.x = vt.w - 1
+		}
+		vt.wrapnext = false
+	case 'D':
+		vt.x -= n
+		if vt.x < 0 {
+			vt.x = 0
+		}
+		vt.wrapnext = false
+	case 'E':
+		vt.x = 0
+		vt.csiMove(n)
+	case 'F':
+		vt.x = 0
+		vt.csiMove(-n)
+	case 'G', '`':
+		vt.x = n - 1
+		if vt.x >= vt.w {
+			vt.x = vt.w - 1
+		}
+		vt.wrapnext = false
+	case 'H', 'f':
+		vt.moveTo(arg(0, 1)-1, arg(1, 1)-1)
+	case 'd':
+		vt.moveTo(n-1, vt.x)
+	case 'J':
+		switch arg(0, 0) {
+		case 0:
+			vt.clear(vt.y, vt.x, vt.w)
+			for y := vt.y + 1; y < vt.h; y++ {
+				vt.clear(y, 0, vt.w)
+			}
+		case 1:
+			for y := 0; y < vt.y; y++ {
+				vt.clear(y, 0, vt.w)
+			}
+			vt.clear(vt.y, 0, vt.x+1)
+		default:
+			for y := 0; y < vt.h; y++ {
+				vt.clear(y, 0, vt.w)
+			}
+		}
+	case 'K':
+		switch arg(0, 0) {
+		case 0:
+			vt.clear(vt.y, vt.x, vt.w)
+		case 1:
+			vt.clear(vt.y, 0, vt.x+1)
+		default:
+			vt.clear(vt.y, 0, vt.w)
+		}
+	case 'L':
+		if vt.y >= vt.top && vt.y < vt.bot {
+			vt.scrollDown(vt.y, vt.bot, n)
+		}
+	case 'M':
+		if vt.y >= vt.top && vt.y < vt.bot {
+			vt.scrollUp(vt.y, vt.bot, n)
+		}
+	case 'P':
+		if n > vt.w-vt.x {
+			n = vt.w - vt.x
+		}
+		line := vt.cells[vt.y]
+		copy(line[vt.x:], line[vt.x+n:])
+		vt.clear(vt.y, vt.w-n, vt.w)
+	case 'X':
+		vt.clear(vt.y, vt.x, vt.x+n)
+	case 'S':
+		if private == 0 {
+			vt.scrollUp(vt.top, vt.bot, n)
+		}
+	case 'T':
+		if private == 0 {
+			vt.scrollDown(vt.top, vt.bot, n)
+		}
+	case 'm':
+		if private == 0 {
+			vt.sgr.apply(params)
+		}
+	case 'r':
+		if private == 0 {
+			top, bot := arg(0, 1)-1, arg(1, vt.h)
+			if bot > vt.h {
+				bot = vt.h
+			}
+			if top >= 0 && top < bot-1 {
+				vt.top, vt.bot = top, bot
+				vt.moveTo(0, 0)
+			}
+		}
+	case 's':
+		if private == 0 {
+			vt.save()
+		}
+	case 'u':
+		if private == 0 {
+			vt.restore()
+		}
+	case 'h', 'l':
+		if private != '?' {
+			break
+		}
+		set := final == 'h'
+		for _, mode := range args {
+			switch mode {
+			case 1:
+				vt.appCursor = set
+			case 6:
+				vt.origin = set
+				vt.moveTo(0, 0)
+			case 7:
+				vt.autowrap = set
+			case 47, 1047, 1049:
+				if !set {
+					left = true
+				}
+			}
+		}
+	case 'n':
+		switch arg(0, 0) {
+		case 5:
+			vt.reply = append(vt.reply, "\x1b[0n"...)
+		case 6:
+			y := vt.y
+			if vt.origin {
+				y -= vt.top
+			}
+			vt.reply = append(vt.reply, fmt.Sprintf("\x1b[%d;%dR", y+1, vt.x+1)...)
+		}
+	case 'c':
+		switch private {
+		case 0:
+			vt.reply = append(vt.reply, "\x1b[?6c"...)
+		case '>':
+			vt.reply = append(vt.reply, "\x1b[>0;0;0c"...)
+		}
+	}
+	return left
+}
+
+// vtParams parses the parameters of a CSI sequence, which must be decimal
+// numbers separated by ';'. Missing parameters are returned as 0, the value
+// of parameters is limited to MAX_VT_PARAM.
+func vtParams(params string) ([]int, bool) {
+	args := []int{}
+	for _, s := range strings.Split(params, ";") {
+		n := 0
+		for _, ch := range []byte(s) {
+			if ch < '0' || ch > '9' {
+				return nil, false
+			}
+			if n < MAX_VT_PARAM {
+				n = n*10 + int(ch-'0')
+			}
+		}
+		if n > MAX_VT_PARAM {
+			n = MAX_VT_PARAM
+		}
+		args = append(args, n)
+	}
+	return args, true
+}
+
+// csiMove moves the cursor n lines down (up if n is negative) without
+// leaving the scroll region.
+func (vt *vtScreen) csiMove(n int) {
+	top, bot := 0, vt.h
+	if vt.y >= vt.top && vt.y < vt.bot {
+		top, bot = vt.top, vt.bot
+	}
+	vt.y += n
+	if vt.y < top {
+		vt.y = top
+	}
+	if vt.y >= bot {
+		vt.y = bot - 1
+	}
+	vt.wrapnext = false
+}
+
+// Render returns the contents of the screen, one line for each line of the
+// screen, the color of each byte of the text (nil if there are no colors)
+// and the position of the cursor in characters. It returns a nil text if
+// the screen didn't change since the last call.
+func (vt *vtScreen) Render() (text []byte, color []uint8, cursor int) {
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+	if !vt.changed {
+		return nil, nil, 0
+	}
+	vt.changed = false
+
+	plain := util.AnsiColor(0, 0)
+	colored := false
+	text = make([]byte, 0, (vt.w+1)*vt.h)
+	color = make([]uint8, 0, (vt.w+1)*vt.h)
+	bs := make([]byte, utf8.UTFMax)
+	for y := range vt.cells {
+		for _, c := range vt.cells[y] {
+			n := utf8.EncodeRune(bs, c.r)
+			text = append(text, bs[:n]...)
+			for i := 0; i < n; i++ {
+				color = append(color, c.color)
+			}
+			colored = colored || c.color != plain
+		}
+		text = append(text, '\n')
+		color = append(color, plain)
+	}
+	if !colored {
+		color = nil
+	}
+	return text, color, vt.y*(vt.w+1) + vt.x
+}
+
+// TakeReply returns the answers to the queries of the program received so
+// far.
+func (vt *vtScreen) TakeReply() []byte {
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+	r := vt.reply
+	vt.reply = nil
+	return r
+}
+
+var vtKeys = map[string]string{
+	"return":      "\r",
+	"tab":         "\t",
+	"shift+tab":   "\x1b[Z",
+	"backspace":   "\x7f",
+	"escape":      "\x1b",
+	"space":       " ",
+	"insert":      "\x1b[2~",
+	"delete":      "\x1b[3~",
+	"prior":       "\x1b[5~",
+	"next":        "\x1b[6~",
+	"home":        "\x1b[H",
+	"end":         "\x1b[F",
+	"up_arrow":    "\x1b[A",
+	"down_arrow":  "\x1b[B",
+	"right_arrow": "\x1b[C",
+	"left_arrow":  "\x1b[D",
+
+	// util.KeyEvent numbers function keys starting from 0
+	"f0": "\x1bOP", "f1": "\x1bOQ", "f2": "\x1bOR", "f3": "\x1bOS",
+	"f4": "\x1b[15~", "f5": "\x1b[17~", "f6": "\x1b[18~", "f7": "\x1b[19~",
+	"f8": "\x1b[20~", "f9": "\x1b[21~", "f10": "\x1b[23~", "f11": "\x1b[24~",
+}
+
+// Key returns the bytes sent by the terminal for a key, described as a
+// character or with the name returned by util.KeyEvent.
+func (vt *vtScreen) Key(k string) []byte {
+	if utf8.RuneCountInString(k) == 1 {
+		return []byte(k)
+	}
+
+	alt := false
+	if strings.HasPrefix(k, "alt+") {
+		alt = true
+		k = k[len("alt+"):]
+	}
+
+	var r []byte
+	if strings.HasPrefix(k, "control+") && utf8.RuneCountInString(k) == len("control+")+1 {
+		ch := k[len(k)-1]
+		switch {
+		case ch >= 'a' && ch <= 'z':
+			r = []byte{ch - 'a' + 1}
+		case ch >= '@' && ch <= '_':
+			r = []byte{ch - '@'}
+		case ch == ' ':
+			r = []byte{0}
+		default:
+			return nil
+		}
+	} else if k == "control+space" {
+		r = []byte{0}
+	} else if s, ok := vtKeys[k]; ok {
+		vt.mu.Lock()
+		appCursor := vt.appCursor
+		vt.mu.Unlock()
+		if appCursor && len(s) == 3 && s[1] == '[' && strings.IndexByte("ABCDHF", s[2]) >= 0 {
+			s = "\x1bO" + s[2:]
+		}
+		r = []byte(s)
+	} else if utf8.RuneCountInString(k) == 1 {
+		r = []byte(k)
+	} else {
+		return nil
+	}
+
+	if alt {
+		r = append([]byte{0x1b}, r...)
+	}
+	return r
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aarzilli/yacco/util"
+)
+
+func vtFeed(vt *vtScreen, s string) (left bool) {
+	for i := 0; i < len(s); i++ {
+		if vt.Feed(s[i]) {
+			left = true
+		}
+	}
+	return left
+}
+
+// vtCheck checks the lines of the screen (without trailing spaces) and the
+// position of the cursor
+func vtCheck(t *testing.T, vt *vtScreen, tgt []string, x, y int) {
+	t.Helper()
+	vt.changed = true
+	text, _, cursor := vt.Render()
+	lines := strings.Split(strings.TrimSuffix(string(text), "\n"), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], " ")
+	}
+	if strings.Join(lines, "|") != strings.Join(tgt, "|") {
+		t.Fatalf("wrong screen:\n%q\nexpected:\n%q", lines, tgt)
+	}
+	if cursor != y*(vt.w+1)+x {
+		t.Fatalf("wrong cursor %d (expected %d,%d)", cursor, x, y)
+	}
+}
+
+func TestVtText(t *testing.T) {
+	vt := newVtScreen(10, 4)
+	vtFeed(vt, "hello\r\nworld")
+	vtCheck(t, vt, []string{"hello", "world", "", ""}, 5, 1)
+
+	// autowrap
+	vtFeed(vt, "\r\n0123456789ab")
+	vtCheck(t, vt, []string{"hello", "world", "0123456789", "ab"}, 2, 3)
+
+	// scrolling at the bottom of the screen
+	vtFeed(vt, "\r\nlast")
+	vtCheck(t, vt, []string{"world", "0123456789", "ab", "last"}, 4, 3)
+
+	if text, _, _ := vt.Render(); text != nil {
+		t.Fatalf("unchanged screen rendered again")
+	}
+}
+
+func TestVtCursorAndErase(t *testing.T) {
+	vt := newVtScreen(10, 4)
+	vtFeed(vt, "abcdef\r\nghijkl\x1b[1;3H\x1b[K")
+	vtCheck(t, vt, []string{"ab", "ghijkl", "", ""}, 2, 0)
+
+	vtFeed(vt, "\x1b[B\x1b[2C\x1b[1K")
+	vtCheck(t, vt, []string{"ab", "     l", "", ""}, 4, 1)
+
+	vtFeed(vt, "\x1b[1;2H\x1b[2@")
+	vtCheck(t, vt, []string{"a  b", "     l", "", ""}, 1, 0)
+
+	vtFeed(vt, "\x1b[2P")
+	vtCheck(t, vt, []string{"ab", "     l", "", ""}, 1, 0)
+
+	vtFeed(vt, "\x1b[2J\x1b[4;10Hx")
+	vtCheck(t, vt, []string{"", "", "", "         x"}, 9, 3)
+}
+
+func TestVtScrollRegion(t *testing.T) {
+	vt := newVtScreen(10, 5)
+	vtFeed(vt, "1\r\n2\r\n3\r\n4\r\n5")
+
+	vtFeed(vt, "\x1b[2;4r")
+	if vt.top != 1 || vt.bot != 4 {
+		t.Fatalf("wrong scroll region %d %d", vt.top, vt.bot)
+	}
+	vtCheck(t, vt, []string{"1", "2", "3", "4", "5"}, 0, 0)
+
+	vtFeed(vt, "\x1b[4;1H\n")
+	vtCheck(t, vt, []string{"1", "3", "4", "", "5"}, 0, 3)
+
+	vtFeed(vt, "\x1b[2;1H\x1bM")
+	vtCheck(t, vt, []string{"1", "", "3", "4", "5"}, 0, 1)
+
+	vtFeed(vt, "\x1b[L")
+	vtCheck(t, vt, []string{"1", "", "", "3", "5"}, 0, 1)
+
+	vtFeed(vt, "\x1b[2M")
+	vtCheck(t, vt, []string{"1", "3", "", "", "5"}, 0, 1)
+
+	// origin mode
+	vtFeed(vt, "\x1b[?6h\x1b[1;1Hx\x1b[9;1Hy")
+	vtCheck(t, vt, []string{"1", "x", "", "y", "5"}, 1, 3)
+}
+
+func TestVtMalformed(t *testing.T) {
+	vt := newVtScreen(10, 4)
+	vtFeed(vt, "ab")
+	for _, seq := range []string{"\x1b[-5r", "\x1b[-3@", "\x1b[-3P", "\x1b[-3L", "\x1b[-3M", "\x1b[-2J", "\x1b[5;-1H", "\x1b[1;-1r", "\x1b[+3A", "\x1b[ 2q"} {
+		vtFeed(vt, seq)
+		if vt.top != 0 || vt.bot != 4 {
+			t.Fatalf("scroll region changed by %q: %d %d", seq, vt.top, vt.bot)
+		}
+	}
+	vtCheck(t, vt, []string{"ab", "", "", ""}, 2, 0)
+
+	vtFeed(vt, "\x1b[99999999999999999999999B\x1b[99999999999999999999C\x1b[99999999999999@x")
+	vtCheck(t, vt, []string{"ab", "", "", "         x"}, 9, 3)
+
+	vtFeed(vt, "\x1b[0;0r\r\n\n\n\x1b[99999L\x1b[99999P\x1b[99999X")
+	vtCheck(t, vt, []string{"ab", "", "", ""}, 0, 3)
+}
+
+func TestVtReplies(t *testing.T) {
+	vt := newVtScreen(10, 4)
+	vtFeed(vt, "\x1b[2;3H\x1b[6n\x1b[5n")
+	if r := string(vt.TakeReply()); r != "\x1b[2;3R\x1b[0n" {
+		t.Fatalf("wrong reply %q", r)
+	}
+	if r := vt.TakeReply(); len(r) != 0 {
+		t.Fatalf("reply returned twice %q", r)
+	}
+}
+
+func TestVtLeave(t *testing.T) {
+	vt := newVtScreen(10, 4)
+	if vtFeed(vt, "\x1b[?25lhello\x1b[?25h") {
+		t.Fatalf("alternate screen left too early")
+	}
+	if !vtFeed(vt, "\x1b[?1049l") {
+		t.Fatalf("alternate screen not left")
+	}
+}
+
+func TestVtColors(t *testing.T) {
+	vt := newVtScreen(4, 1)
+	vtFeed(vt, "a\x1b[1;31mb\x1b[0mc")
+	_, color, _ := vt.Render()
+	plain := util.AnsiColor(0, 0)
+	if len(color) != 5 || color[0] != plain || color[1] != util.AnsiColor(9, 0) || color[2] != plain {
+		t.Fatalf("wrong colors %v", color)
+	}
+
+	vt = newVtScreen(4, 1)
+	vtFeed(vt, "abc")
+	if _, color, _ := vt.Render(); color != nil {
+		t.Fatalf("colors returned for plain text %v", color)
+	}
+}
+
+func TestVtKeys(t *testing.T) {
+	vt := newVtScreen(10, 4)
+	for _, tc := range []struct{ k, tgt string }{
+		{"x", "x"},
+		{"è", "è"},
+		{"return", "\r"},
+		{"up_arrow", "\x1b[A"},
+		{"control+c", "\x03"},
+		{"alt+x", "\x1bx"},
+		{"alt+left_arrow", "\x1b\x1b[D"},
+		{"f0", "\x1bOP"},
+		{"unknown_key", ""},
+	} {
+		if r := string(vt.Key(tc.k)); r != tc.tgt {
+			t.Errorf("wrong sequence for %q: %q (expected %q)", tc.k, r, tc.tgt)
+		}
+	}
+	vtFeed(vt, "\x1b[?1h")
+	if r := string(vt.Key("up_arrow")); r != "\x1bOA" {
+		t.Errorf("wrong sequence in application cursor mode %q", r)
+	}
+}
+
+func TestSgrApply(t *testing.T) {
+	for _, tc := range []struct {
+		params string
+		tgt    uint8
+	}{
+		{"", util.AnsiColor(0, 0)},
+		{"31", util.AnsiColor(1, 0)},
+		{"1;31", util.AnsiColor(9, 0)},
+		{"31;1;22", util.AnsiColor(1, 0)},
+		{"94;42", util.AnsiColor(12, 2)},
+		{"38;5;12;48;5;4", util.AnsiColor(12, 4)},
+		{"38;5;200", util.AnsiColor(0, 0)},
+		{"38;2;1;2;3;32", util.AnsiColor(2, 0)},
+		{"31;41;39;49", util.AnsiColor(0, 0)},
+		{"-5;x;31", util.AnsiColor(1, 0)},
+	} {
+		var st sgrState
+		st.apply(tc.params)
+		if c := st.color(); c != tc.tgt {
+			t.Errorf("wrong color for %q: %#x (expected %#x)", tc.params, c, tc.tgt)
+		}
+	}
+}
@@ -9,14 +9,16 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
-	"unsafe"
+	"unicode/utf8"
 
 	"github.com/aarzilli/yacco/util"
 	"github.com/kr/pty"
+	"github.com/lionkov/go9p/p/clnt"
 )
 
 const FLOAT_START_WINDOW_MS = 100
@@ -41,7 +43,8 @@ const (
 )
 
 type AppendMsg struct {
-	s []byte
+	s     []byte
+	color []uint8 // color of every byte of s, nil if s is plain text
 }
 
 type DeleteAddrMsg struct {
@@ -79,30 +82,151 @@ type FuncMsg struct {
 	fn func(buf *util.BufferConn)
 }
 
+// HistoryMsg is a history command (see historyCmd)
+type HistoryMsg struct {
+	cmd string
+}
+
+// AltScreenMsg is sent when the program switches to the alternate screen
+// (vt is its screen) and when it leaves it (vt is nil)
+type AltScreenMsg struct {
+	vt *vtScreen
+}
+
+// ScreenMsg is sent when the alternate screen may need to be redrawn
+type ScreenMsg struct {
+}
+
+// ScreenSizeMsg is sent periodically while the alternate screen is used
+type ScreenSizeMsg struct {
+}
+
+// KeyMsg is a key typed while the alternate screen is used
+type KeyMsg struct {
+	k string
+}
+
+// sgrState is the graphic rendition set by SGR escape sequences
+type sgrState struct {
+	fg, bg int
+	bold   bool
+}
+
+// apply changes the state as specified by the parameters of a SGR escape
+// sequence. Only the first 16 colors of 256 colors sequences are supported
+// and bright backgrounds are drawn like normal ones.
+func (st *sgrState) apply(params string) {
+	v := strings.Split(params, ";")
+	for i := 0; i < len(v); i++ {
+		n, _ := strconv.Atoi(v[i])
+		switch {
+		case n == 0:
+			*st = sgrState{}
+		case n == 1:
+			st.bold = true
+		case n == 22:
+			st.bold = false
+		case n >= 30 && n <= 37:
+			st.fg = n - 30
+		case n == 39:
+			st.fg = 0
+		case n >= 40 && n <= 47:
+			st.bg = n - 40
+		case n == 49:
+			st.bg = 0
+		case n >= 90 && n <= 97:
+			st.fg = n - 90 + 8
+		case n >= 100 && n <= 107:
+			st.bg = n - 100
+		case n == 38 || n == 48:
+			c := -1
+			if i+2 < len(v) && v[i+1] == "5" {
+				c, _ = strconv.Atoi(v[i+2])
+				i += 2
+			} else if i+4 < len(v) && v[i+1] == "2" {
+				i += 4
+			}
+			if c >= 0 && c < 16 {
+				if n == 38 {
+					st.fg = c
+				} else {
+					st.bg = c & 0x07
+				}
+			}
+		}
+	}
+}
+
+// color returns the color index of text written with the current state,
+// bold text is drawn with the bright version of its color.
+func (st *sgrState) color() uint8 {
+	fg := st.fg
+	if st.bold && fg >= 1 && fg <= 7 {
+		fg += 8
+	}
+	return util.AnsiColor(fg, st.bg)
+}
+
 func outputReader(controlChan chan<- interface{}, stdout io.Reader, outputReaderDone chan struct{}) {
 	bufout := bufio.NewReaderSize(stdout, 32*1024)
 	escseq := []byte{}
 	athome := false
 	state := ANSI_NORMAL
 	s := []byte{}
+	var sgr sgrState
+	color := sgr.color()
+	cs := []uint8{} // color of every byte of s
+	var vt *vtScreen
+
+	appendMsg := func() AppendMsg {
+		for _, c := range cs {
+			if c != util.AnsiColor(0, 0) {
+				return AppendMsg{s, cs}
+			}
+		}
+		return AppendMsg{s, nil}
+	}
+
 	for {
 		if bufout.Buffered() == 0 {
-			if debug {
-				log.Printf("flushing1 <%s>\n", s)
+			if vt != nil {
+				controlChan <- ScreenMsg{}
+			} else {
+				if debug {
+					log.Printf("flushing1 <%s>\n", s)
+				}
+				// the read could have ended in the middle of a character,
+				// keep it for the next message
+				n := fullRunes(s)
+				rest, restcs := s[n:], cs[n:]
+				s, cs = s[:n], cs[:n]
+				controlChan <- appendMsg()
+				s = append(make([]byte, 0, len(s)+len(rest)), rest...)
+				cs = append(make([]uint8, 0, len(cs)+len(restcs)), restcs...)
 			}
-			controlChan <- AppendMsg{s}
-			s = make([]byte, 0, len(s))
 		}
 		ch, err := bufout.ReadByte()
 		if err != nil {
 			if debug {
 				fmt.Println("Exit output reader with error: " + err.Error())
 			}
-			controlChan <- AppendMsg{s}
+			if vt != nil {
+				controlChan <- AltScreenMsg{nil}
+			}
+			controlChan <- appendMsg()
 			close(outputReaderDone)
 			return
 		}
 
+		if vt != nil {
+			if vt.Feed(ch) {
+				controlChan <- ScreenMsg{}
+				controlChan <- AltScreenMsg{nil}
+				vt = nil
+			}
+			continue
+		}
+
 	reprocess:
 		switch state {
 		case ANSI_NORMAL:
@@ -110,14 +234,16 @@ func outputReader(controlChan chan<- interface{}, stdout io.Reader, outputReader
 			case 0x0d:
 				state = ANSI_0D
 			case 0x08:
-				controlChan <- AppendMsg{s}
+				controlChan <- appendMsg()
 				controlChan <- DeleteAddrMsg{"-#1"}
 				s = []byte{}
+				cs = []uint8{}
 			case 0x1b:
 				escseq = []byte{}
 				state = ANSI_ESCAPE
 			default:
 				s = append(s, ch)
+				cs = append(cs, color)
 				if ch == '\n' {
 					if debug {
 						log.Printf("flushing2 <%s>\n", s)
@@ -130,13 +256,14 @@ func outputReader(controlChan chan<- interface{}, stdout io.Reader, outputReader
 
 		case ANSI_ESCAPE:
 			escseq = append(escseq, ch)
-			switch ch {
-			case ']':
+			switch {
+			case ch == ']':
 				state = ANSI_ESCAPE_OSC
-			case '[':
-				fallthrough
-			default:
+			case ch == '[' || (ch >= 0x20 && ch <= 0x2f):
 				state = ANSI_ESCAPE_CSI
+			default:
+				// two characters escape sequence
+				state = ANSI_NORMAL
 			}
 
 		case ANSI_ESCAPE_CSI:
@@ -152,8 +279,9 @@ func outputReader(controlChan chan<- interface{}, stdout io.Reader, outputReader
 					if debug {
 						fmt.Printf("Requesting screen clear %v\n", []byte(escseq))
 					}
-					controlChan <- AppendMsg{s}
+					controlChan <- appendMsg()
 					s = []byte{}
+					cs = []uint8{}
 
 					switch arg {
 					case 0: // nothing or 0: clear cursor to end of screen
@@ -170,10 +298,26 @@ func outputReader(controlChan chan<- interface{}, stdout io.Reader, outputReader
 					if debug {
 						fmt.Println("Requesting back to home")
 					}
-					controlChan <- AppendMsg{s}
+					controlChan <- appendMsg()
 					s = []byte{}
+					cs = []uint8{}
 					athome = true
 					state = ANSI_AFTER_HOME
+
+				case 'm':
+					if escseq[0] == '[' {
+						sgr.apply(string(escseq[1 : len(escseq)-1]))
+						color = sgr.color()
+					}
+
+				case 'h':
+					if isAltScreen(escseq) {
+						controlChan <- appendMsg()
+						s = []byte{}
+						cs = []uint8{}
+						vt = newVtScreen(80, 24)
+						controlChan <- AltScreenMsg{vt}
+					}
 				}
 			}
 
@@ -189,8 +333,12 @@ func outputReader(controlChan chan<- interface{}, stdout io.Reader, outputReader
 
 		case ANSI_ESCAPE_OSC:
 			escseq = append(escseq, ch)
-			if len(escseq) > 2 && (ch == 0x07) { /* ding! */
+			if len(escseq) > 2 && (ch == 0x07 || ch == 0x1b) { /* ding! */
 				state = ANSI_NORMAL
+				if ch == 0x1b {
+					// string terminator, ESC \
+					state = ANSI_ESCAPE
+				}
 				switch escseq[1] {
 				case ';':
 					label := string(escseq[2 : len(escseq)-1])
@@ -201,6 +349,7 @@ func outputReader(controlChan chan<- interface{}, stdout io.Reader, outputReader
 						controlChan <- NameMsg{label[:i]}
 					}
 				}
+				escseq = []byte{}
 			}
 
 		case ANSI_0D:
@@ -208,6 +357,7 @@ func outputReader(controlChan chan<- interface{}, stdout io.Reader, outputReader
 			switch ch {
 			case 0x0a:
 				s = append(s, ch)
+				cs = append(cs, color)
 				/*controlChan <- AppendMsg{s, false}
 				s = []byte{}*/
 
@@ -215,7 +365,7 @@ func outputReader(controlChan chan<- interface{}, stdout io.Reader, outputReader
 				if debug {
 					fmt.Printf("Requesting line delete <%s>\n", s)
 				}
-				controlChan <- AppendMsg{s}
+				controlChan <- appendMsg()
 				controlChan <- DeleteAddrMsg{"-+"}
 				goto reprocess
 			}
@@ -226,7 +376,22 @@ func outputReader(controlChan chan<- interface{}, stdout io.Reader, outputReader
 		fmt.Println("output reader finished")
 	}
 
-	controlChan <- AppendMsg{s}
+	controlChan <- appendMsg()
+}
+
+// isAltScreen returns true if the CSI escape sequence escseq switches to the
+// alternate screen
+func isAltScreen(escseq []byte) bool {
+	if len(escseq) < 3 || escseq[0] != '[' || escseq[1] != '?' {
+		return false
+	}
+	for _, mode := range strings.Split(string(escseq[2:len(escseq)-1]), ";") {
+		switch mode {
+		case "47", "1047", "1049":
+			return true
+		}
+	}
+	return false
 }
 
 var signalCommands = map[string]syscall.Signal{
@@ -279,7 +444,10 @@ func eventReader(controlChan chan<- interface{}, eventfd io.ReadWriter, addrfd i
 		switch er.Type() {
 		case util.ET_TAGEXEC, util.ET_BODYEXEC:
 			arg, _ := er.Text(addrfd, addrfd, xdatafd)
-			if er.BuiltIn() {
+			if er.Type() == util.ET_BODYEXEC && er.Origin() == util.EO_KBD {
+				// sent by yacco for every key while the send-keys property is set
+				controlChan <- KeyMsg{arg}
+			} else if er.BuiltIn() {
 				if arg == "Del" {
 					atomic.StoreInt32(delSeen, 1)
 				}
@@ -363,8 +531,7 @@ func winInternalCommand(cmd string, controlChan chan<- interface{}) bool {
 	}
 
 	if strings.Index(cmd, "\"") == 0 {
-		r := historyCmd(cmd)
-		controlChan <- AppendMsg{[]byte(r)}
+		controlChan <- HistoryMsg{cmd}
 		return true
 	}
 
@@ -425,6 +592,68 @@ func updateAddr(prompt []byte, buf *util.BufferConn) {
 	}
 }
 
+// fullRunes returns the length of the prefix of s that doesn't end with an
+// incomplete UTF-8 sequence.
+func fullRunes(s []byte) int {
+	for i := len(s) - 1; i >= 0 && i >= len(s)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(s[i]) {
+			if !utf8.FullRune(s[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(s)
+}
+
+// mixColors returns text s, with the color of each of its bytes, in the
+// format of the color file.
+func mixColors(s []byte, color []uint8) []byte {
+	r := make([]byte, 0, len(s)+len(s)/2)
+	for i := 0; i < len(s); {
+		_, sz := utf8.DecodeRune(s[i:])
+		r = append(r, color[i])
+		r = append(r, s[i:i+sz]...)
+		i += sz
+	}
+	return r
+}
+
+// writeScreen writes text to f a few lines at a time, so that characters
+// are never split between two writes. If color isn't nil f must be the
+// color file.
+func writeScreen(f *clnt.File, text []byte, color []uint8) {
+	const chunkSize = 4096
+	for len(text) > 0 {
+		n := 0
+		for n < len(text) && n < chunkSize {
+			nl := bytes.IndexByte(text[n:], '\n')
+			if nl < 0 {
+				n = len(text)
+				break
+			}
+			n += nl + 1
+		}
+		var err error
+		if color != nil {
+			_, err = f.Writen(mixColors(text[:n], color[:n]), 0)
+			color = color[n:]
+		} else {
+			_, err = f.Writen(text[:n], 0)
+		}
+		util.Allergic3(debug, err, isDelSeen())
+		text = text[n:]
+	}
+}
+
+// plainColors appends n default colors to color
+func plainColors(color []uint8, n int) []uint8 {
+	for i := 0; i < n; i++ {
+		color = append(color, util.AnsiColor(0, 0))
+	}
+	return color
+}
+
 func controlFunc(cmd *exec.Cmd, pty *os.File, buf *util.BufferConn, controlChan chan interface{}, controlFuncDone chan<- struct{}) {
 	buf.AddrFd.Write([]byte("$"))
 
@@ -433,26 +662,90 @@ func controlFunc(cmd *exec.Cmd, pty *os.File, buf *util.BufferConn, controlChan
 	updCount := 0
 	var oldPrompt []byte = nil
 	bodyBuf := make([]byte, 0, 2048)
+	var bodyColor []uint8 // color of every byte of bodyBuf, nil if it is plain text
 
-	flushBodyBuf := func() {
-		_, err := buf.BodyFd.Writen(bodyBuf, 0)
+	writeBody := func(s []byte, color []uint8) {
+		var err error
+		if color != nil {
+			_, err = buf.ColorFd.Writen(mixColors(s, color), 0)
+		} else {
+			_, err = buf.BodyFd.Writen(s, 0)
+		}
 		util.Allergic3(debug, err, isDelSeen())
+	}
+
+	flushBodyBuf := func() {
+		writeBody(bodyBuf, bodyColor)
 		bodyBuf = bodyBuf[0:0]
+		bodyColor = nil
 	}
 
-	maybeWriteBody := func(s []byte) {
+	maybeWriteBody := func(s []byte, color []uint8) {
 		if !floating {
-			_, err := buf.BodyFd.Writen(s, 0)
-			util.Allergic3(debug, err, isDelSeen())
+			writeBody(s, color)
 			return
 		}
 
+		if color != nil && bodyColor == nil {
+			bodyColor = plainColors(make([]uint8, 0, cap(bodyBuf)), len(bodyBuf))
+		}
 		bodyBuf = append(bodyBuf, s...)
+		if bodyColor != nil {
+			if color == nil {
+				color = plainColors(nil, len(s))
+			}
+			bodyColor = append(bodyColor, color...)
+		}
 		if len(bodyBuf) > 1024 {
 			flushBodyBuf()
 		}
 	}
 
+	var vt *vtScreen // screen of the program using the alternate screen
+	screenStart := 0 // position of the screen in the body
+	screenW, screenH := 0, 0
+
+	resizeScreen := func() {
+		props, err := buf.ReadProps()
+		util.Allergic3(debug, err, isDelSeen())
+		var w, h int
+		if _, err := fmt.Sscanf(props["screen"], "%dx%d", &w, &h); err != nil {
+			return
+		}
+		w-- // leave space for the newline
+		if w == screenW && h == screenH {
+			return
+		}
+		screenW, screenH = w, h
+		vt.Resize(w, h)
+		TcSetWinSize(pty, h, w)
+	}
+
+	drawScreen := func() {
+		text, color, cursor := vt.Render()
+		if text != nil {
+			fmt.Fprintf(buf.AddrFd, "#%d,$", screenStart)
+			if color != nil {
+				buf.XDataFd.Write([]byte{0})
+				writeScreen(buf.ColorFd, text, color)
+			} else {
+				writeScreen(buf.XDataFd, text, nil)
+			}
+			updateDot(fmt.Sprintf("#%d", screenStart+cursor), buf)
+		}
+		if reply := vt.TakeReply(); len(reply) > 0 {
+			pty.Write(reply)
+		}
+	}
+
+	checkScreenSize := func() {
+		go func() {
+			defer func() { recover() }()
+			time.Sleep(500 * time.Millisecond)
+			controlChan <- ScreenSizeMsg{}
+		}()
+	}
+
 	anchorDown := func() {
 		//println("Anchoring down", time.Now().Unix())
 		flushBodyBuf()
@@ -461,6 +754,8 @@ func controlFunc(cmd *exec.Cmd, pty *os.File, buf *util.BufferConn, controlChan
 	}
 
 	shuttingDown := false
+	var hd histDir
+	hd.update(pty, cmd.Process.Pid, buf)
 
 	for imsg := range controlChan {
 		if shuttingDown {
@@ -476,7 +771,8 @@ func controlFunc(cmd *exec.Cmd, pty *os.File, buf *util.BufferConn, controlChan
 			if !floating {
 				oldPrompt = getPrompt(-1, false, buf)
 			}
-			maybeWriteBody(msg.s)
+			maybeWriteBody(msg.s, msg.color)
+			hd.update(pty, cmd.Process.Pid, buf)
 			if !floating {
 				if time.Since(lastUpdate) > time.Millisecond*FLOAT_START_WINDOW_MS {
 					updCount = 0
@@ -495,6 +791,10 @@ func controlFunc(cmd *exec.Cmd, pty *os.File, buf *util.BufferConn, controlChan
 			lastUpdate = time.Now()
 
 		case UserAppendMsg:
+			if vt != nil {
+				pty.Write(msg.s)
+				break
+			}
 			if floating {
 				anchorDown()
 			}
@@ -527,6 +827,9 @@ func controlFunc(cmd *exec.Cmd, pty *os.File, buf *util.BufferConn, controlChan
 			updateDot(msg.addr, buf)
 
 		case ExecUserMsg:
+			if vt != nil {
+				break
+			}
 			if floating {
 				anchorDown()
 			}
@@ -540,8 +843,13 @@ func controlFunc(cmd *exec.Cmd, pty *os.File, buf *util.BufferConn, controlChan
 			if debug {
 				fmt.Printf("Sending: <%s>\n", command)
 			}
-			historyAppend(string(command))
+			if historyEnabled && atShellPrompt(pty, cmd.Process.Pid) {
+				historyAppend(shellDir(pty, cmd.Process.Pid), string(command))
+			}
 			pty.Write(command)
+			// the command could change directory, check as soon as it
+			// produces some output
+			hd.last = time.Time{}
 
 		case SignalMsg:
 			if floating {
@@ -594,6 +902,60 @@ func controlFunc(cmd *exec.Cmd, pty *os.File, buf *util.BufferConn, controlChan
 
 		case FuncMsg:
 			msg.fn(buf)
+
+		case HistoryMsg:
+			if floating {
+				anchorDown()
+			}
+			r, recall := historyCmd(msg.cmd, shellDir(pty, cmd.Process.Pid))
+			if !recall {
+				oldPrompt = getPrompt(-1, false, buf)
+				writeBody([]byte(r), nil)
+				updateAddr(oldPrompt, buf)
+			} else if r != "" {
+				historyRecall(r, buf)
+			}
+
+		case AltScreenMsg:
+			if floating {
+				anchorDown()
+			}
+			if msg.vt != nil {
+				vt = msg.vt
+				_, err := buf.AddrFd.Write([]byte("$"))
+				util.Allergic3(debug, err, isDelSeen())
+				addr, err := buf.ReadAddr()
+				util.Allergic3(debug, err, isDelSeen())
+				screenStart = addr[0]
+				buf.PropFd.Write([]byte("send-keys=1"))
+				screenW, screenH = 0, 0
+				resizeScreen()
+				checkScreenSize()
+			} else if vt != nil {
+				vt = nil
+				fmt.Fprintf(buf.AddrFd, "#%d,$", screenStart)
+				buf.XDataFd.Write([]byte{0})
+				buf.PropFd.Write([]byte("send-keys=0"))
+				TcSetWinSize(pty, 2048, 2048)
+				updateAddr([]byte{}, buf)
+			}
+
+		case ScreenMsg:
+			if vt != nil {
+				drawScreen()
+			}
+
+		case ScreenSizeMsg:
+			if vt != nil {
+				resizeScreen()
+				drawScreen()
+				checkScreenSize()
+			}
+
+		case KeyMsg:
+			if vt != nil {
+				pty.Write(vt.Key(msg.k))
+			}
 		}
 	}
 
@@ -616,8 +978,7 @@ func run(c *exec.Cmd) *os.File {
 	err = TcSetAttr(pty, TCSANOW, termios)
 	util.Allergic3(debug, err, isDelSeen())
 
-	ws := winSize{2048, 2048, 0, 0}
-	syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+	TcSetWinSize(tty, 2048, 2048)
 
 	c.Stdout = tty
 	c.Stdin = tty
@@ -677,6 +1038,8 @@ func main() {
 
 	_, err = buf.PropFd.Write([]byte("indent=off"))
 	util.Allergic3(debug, err, isDelSeen())
+	_, err = buf.PropFd.Write([]byte("history=1"))
+	util.Allergic3(debug, err, isDelSeen())
 
 	os.Setenv("bi", buf.Id)
 
@@ -708,7 +1071,7 @@ func main() {
 		cmd = exec.Command(shell)
 	}
 
-	os.Setenv("TERM", "ansi")
+	os.Setenv("TERM", "xterm")
 	os.Setenv("PAGER", "")
 	os.Setenv("EDITOR", "E")
 	os.Setenv("VISUAL", "")
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"testing/iotest"
+	"unicode/utf8"
+)
+
+func TestOutputReaderSplitRunes(t *testing.T) {
+	const text = "àè \x1b[31mcolored ⌘\x1b[0m\n日本語"
+	controlChan := make(chan interface{}, 1024)
+	done := make(chan struct{})
+	outputReader(controlChan, iotest.OneByteReader(strings.NewReader(text)), done)
+	close(controlChan)
+
+	r := []byte{}
+	for msg := range controlChan {
+		m, ok := msg.(AppendMsg)
+		if !ok {
+			continue
+		}
+		if !utf8.Valid(m.s) {
+			t.Fatalf("message ends in the middle of a character %q", m.s)
+		}
+		if m.color != nil && len(m.color) != len(m.s) {
+			t.Fatalf("wrong number of colors for %q: %d", m.s, len(m.color))
+		}
+		r = append(r, m.s...)
+	}
+	if string(r) != "àè colored ⌘\n日本語" {
+		t.Fatalf("wrong output %q", r)
+	}
+}
+
+func TestFullRunes(t *testing.T) {
+	for _, tc := range []struct {
+		s   string
+		tgt int
+	}{
+		{"", 0},
+		{"abc", 3},
+		{"aè", 3},
+		{"a\xc3", 1},
+		{"a\xe6\x97", 1},
+		{"\xe6\x97\xa5", 3},
+		{"a\x80\x80\x80\x80", 5},
+	} {
+		if n := fullRunes([]byte(tc.s)); n != tc.tgt {
+			t.Errorf("wrong result for %q: %d (expected %d)", tc.s, n, tc.tgt)
+		}
+	}
+}
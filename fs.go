@@ -712,7 +712,7 @@ func writeColorFn(i int, data []byte, off int64) syscall.Errno {
 			fhl = hl.NewFixed(start)
 			ec.buf.Hl = fhl
 		}
-		fhl.Append(color)
+		fhl.Set(start, color)
 	}
 
 	return 0
@@ -916,6 +916,7 @@ func readPropFn(i int, off int64) ([]byte, syscall.Errno) {
 	defer ec.buf.Rdunlock()
 
 	s := "AutoDumpPath=" + AutoDumpPath + "\n"
+	s += fmt.Sprintf("screen=%dx%d\n", ec.fr.Columns(), ec.fr.LineNo())
 
 	for k, v := range ec.buf.Props {
 		s += k + "=" + v + "\n"
@@ -942,6 +943,20 @@ func writePropFn(i int, data []byte, off int64) syscall.Errno {
 			} else if (v[0] == "font") && ((v[1] == "+") || (v[1] == "-")) {
 				done <- writeMainPropInternal(data)
 				return
+			} else if (v[0] == "encoding") || (v[0] == "eol") {
+				encoding, eol := "", ""
+				if v[0] == "encoding" {
+					encoding = strings.TrimSpace(v[1])
+				} else {
+					eol = strings.TrimSpace(v[1])
+				}
+				if err := ec.buf.SetEncoding(encoding, eol); err != nil {
+					done <- syscall.EINVAL
+					return
+				}
+				if ec.ed != nil {
+					ec.ed.TagRefresh()
+				}
 			} else {
 				ec.buf.Props[v[0]] = v[1]
 			}
@@ -1197,6 +1212,9 @@ func releaseEventsFn(i int) {
 		}
 		close(ec.ed.eventChan)
 		ec.ed.eventChan = nil
+		// the program that asked for all keys (win in the alternate
+		// screen) is gone
+		delete(ec.ed.bodybuf.Props, "send-keys")
 	}
 }
 
@@ -16,6 +16,7 @@ type Highlighter interface {
 var _ Highlighter = &nilHighlighter{}
 var _ Highlighter = &Syncs{}
 var _ Highlighter = &Fixed{}
+var _ Highlighter = &Overlay{}
 
 // Implementation of Highlihgter that does nothing
 type nilHighlighter struct {
@@ -46,6 +47,7 @@ func (hl *nilHighlighter) Toregend(start int, buf yregexp.Matchable) int {
 // Implementation of Highlighter based on synchronization points
 type Syncs struct {
 	matches  []RegionMatch
+	tokens   *tokenRules
 	syncs    []sync
 	tempSync sync
 }
@@ -57,18 +59,23 @@ type sync struct {
 
 func New(rules []LanguageRules, name string) Highlighter {
 	var matches []RegionMatch = nil
+	var tokens *tokenRules = nil
 	for i := range rules {
 		if rules[i].re == nil {
 			rules[i].re = regexp.MustCompile(rules[i].NameRe)
 		}
 		if rules[i].re.MatchString(name) {
+			if rules[i].tokens == nil {
+				rules[i].tokens = compileTokenRules(&rules[i])
+			}
 			matches = rules[i].RegionMatches
+			tokens = rules[i].tokens
 		}
 	}
-	if matches == nil {
+	if matches == nil && tokens.empty() {
 		return NilHighlighter
 	}
-	return &Syncs{matches: matches, tempSync: sync{0, 0}, syncs: []sync{{0, 0}}}
+	return &Syncs{matches: matches, tokens: tokens, tempSync: sync{0, 0}, syncs: []sync{{0, 0}}}
 }
 
 func (syncs *Syncs) find(idx int) int {
@@ -166,6 +173,7 @@ func (syncs *Syncs) syncFor(start int) (sy sync, atend bool) {
 
 func (syncs *Syncs) Highlight(start, end int, buf yregexp.Matchable, outbuf []uint8) []uint8 {
 	sy, atend := syncs.syncFor(start)
+	base := len(outbuf)
 
 coloringLoop:
 	for {
@@ -189,6 +197,8 @@ coloringLoop:
 		}
 	}
 
+	syncs.tokens.apply(start, buf, outbuf[base:])
+
 	return outbuf
 }
 
@@ -255,12 +265,13 @@ func (fhl *Fixed) Toregend(start int, buf yregexp.Matchable) int {
 	return -1
 }
 
+// Alter discards the colors after idx, the character at idx didn't change.
 func (fhl *Fixed) Alter(idx int) {
-	if idx < 0 {
-		idx = 0
+	if idx < -1 {
+		idx = -1
 	}
-	if idx < len(fhl.color) {
-		fhl.color = fhl.color[:idx]
+	if idx+1 < len(fhl.color) {
+		fhl.color = fhl.color[:idx+1]
 	}
 	return
 }
@@ -268,3 +279,15 @@ func (fhl *Fixed) Alter(idx int) {
 func (fhl *Fixed) Append(color []uint8) {
 	fhl.color = append(fhl.color, color...)
 }
+
+// Set sets the colors of the characters starting at start, characters
+// before start that don't have a color use the default color.
+func (fhl *Fixed) Set(start int, color []uint8) {
+	if start < len(fhl.color) {
+		fhl.color = fhl.color[:start]
+	}
+	for len(fhl.color) < start {
+		fhl.color = append(fhl.color, 1)
+	}
+	fhl.color = append(fhl.color, color...)
+}
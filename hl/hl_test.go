@@ -11,6 +11,7 @@ import (
 	"github.com/aarzilli/yacco/buf"
 	"github.com/aarzilli/yacco/config"
 	"github.com/aarzilli/yacco/hl"
+	"github.com/aarzilli/yacco/util"
 )
 
 var pgmGo = []rune(`
@@ -128,10 +129,6 @@ func testHighlightingEx(t *testing.T, b *buf.Buffer, cs []uint8, start int) {
 			lastnl = i
 		}
 		c := color[i-start]
-		if c == 4 {
-			// when this thing was saved we didn't have category 4
-			c = 1
-		}
 		if c != uint8(cs[i]&COLORMASK) {
 			s := []rune{}
 			out := []uint8{}
@@ -194,12 +191,119 @@ type Something struct { }
 `)
 
 var funcGoC = []uint8{1,
-	1, 1, 1, 1, 1, 4, 4, 4, 4, 4, 4, 4, 4, 4, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
-	1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 4, 4, 4, 4, 4, 4, 4, 4, 4, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
-	1, 1, 1, 1, 1, 4, 4, 4, 4, 4, 4, 4, 4, 4, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+	5, 5, 5, 5, 1, 4, 4, 4, 4, 4, 4, 4, 4, 4, 1, 1, 1, 1, 1, 1, 7, 7, 7, 1, 1,
+	5, 5, 5, 5, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 4, 4, 4, 4, 4, 4, 4, 4, 4, 1, 1, 1, 1, 1, 1, 7, 7, 7, 1, 1,
+	5, 5, 5, 5, 1, 4, 4, 4, 4, 4, 4, 4, 4, 4, 1, 5, 5, 5, 5, 5, 5, 1, 1, 1, 1, 1,
 }
 
 func TestGoFunc(t *testing.T) {
 	b := loadBuf("func.go", funcGo)
 	testHighlighting(t, b, funcGoC)
 }
+
+var tokensGo = []rune(`
+for i := range 0x1F + 1.5e3 + x2 {
+	n := len(s.len) // if
+	return nil, "if"
+}
+`)
+
+var tokensGoC = `
+5551111115555516666111666661111111
+1111117771111111133333
+15555551777112222
+1
+`
+
+func TestGoTokens(t *testing.T) {
+	b := loadBuf("tokens.go", tokensGo)
+	for start := 0; start < b.Size(); start++ {
+		colors := b.Highlight(start, b.Size())
+		out := make([]rune, len(colors))
+		for i := range colors {
+			if tokensGo[start+i] == '\n' {
+				out[i] = '\n'
+			} else {
+				out[i] = rune('0' + colors[i])
+			}
+		}
+		if string(out) != tokensGoC[start:] {
+			t.Fatalf("mismatch at start %d:\n%s\nexpected:\n%s", start, string(out), tokensGoC[start:])
+		}
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	b := loadBuf("overlay.go", []rune("x := f(\"y\") + y"))
+	o := hl.NewOverlay(b.Hl)
+	b.Hl = o
+	o.SetTokens([]hl.Token{{0, 1, hl.RMT_VARIABLE}, {5, 6, hl.RMT_FUNCTION}, {7, 10, hl.RMT_VARIABLE}, {14, 15, hl.RMT_VARIABLE}})
+
+	colorString := func() string {
+		colors := b.Highlight(0, b.Size())
+		out := make([]byte, len(colors))
+		for i := range colors {
+			out[i] = "0123456789abcdef"[colors[i]]
+		}
+		return string(out)
+	}
+
+	// tokens don't replace the color of strings
+	if s := colorString(); s != "a1111812221111a" {
+		t.Errorf("wrong colors %s", s)
+	}
+
+	// editing the buffer discards the tokens after the edit
+	b.Replace([]rune("g"), &util.Sel{5, 6}, true, nil, 0)
+	if s := colorString(); s != "a11111122211111" {
+		t.Errorf("wrong colors after edit %s", s)
+	}
+}
+
+func TestFixedSet(t *testing.T) {
+	b := loadBuf("+Win", []rune("ab"))
+	fhl := hl.NewFixed(b.Size())
+	b.Hl = fhl
+
+	colorString := func() string {
+		colors := b.Highlight(0, b.Size())
+		out := make([]byte, len(colors))
+		for i := range colors {
+			out[i] = "0123456789abcdef"[colors[i]&0x0f]
+		}
+		return string(out)
+	}
+
+	start := b.Size()
+	b.Replace([]rune("cd\n"), &util.Sel{start, start}, true, nil, 0)
+	fhl.Set(start, []uint8{2, 3, 1})
+	if s := colorString(); s != "11231" {
+		t.Errorf("wrong colors %s", s)
+	}
+
+	// text without colors is appended after the last colored character
+	b.Replace([]rune("ef"), &util.Sel{b.Size(), b.Size()}, true, nil, 0)
+	start = b.Size()
+	b.Replace([]rune("g"), &util.Sel{start, start}, true, nil, 0)
+	fhl.Set(start, []uint8{util.AnsiColor(4, 0)})
+	if s := colorString(); s != "11231114" {
+		t.Errorf("wrong colors after plain text %s", s)
+	}
+
+	// colored text written in more than one chunk keeps all its colors
+	b = loadBuf("+Win", []rune{})
+	fhl = hl.NewFixed(0)
+	b.Hl = fhl
+	red := util.AnsiColor(1, 0)
+	for _, chunk := range []string{"abc", "def"} {
+		start := b.Size()
+		b.Replace([]rune(chunk), &util.Sel{start, start}, true, nil, 0)
+		fhl.Set(start, []uint8{red, red, red})
+	}
+	colors := b.Highlight(0, b.Size())
+	for i := range colors {
+		if colors[i] != red {
+			t.Fatalf("wrong colors for chunks %v", colors)
+		}
+	}
+}
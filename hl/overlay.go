@@ -0,0 +1,63 @@
+package hl
+
+import (
+	"sort"
+
+	yregexp "github.com/aarzilli/yacco/regexp"
+)
+
+// Implementation of Highlighter that colors tokens, for example the
+// semantic tokens returned by a language server, on top of the colors of
+// another Highlighter. Tokens only replace the colors of plain text,
+// keywords, numbers and builtins, never the colors of regions.
+type Overlay struct {
+	Base   Highlighter
+	tokens []Token
+}
+
+// Token is a colored interval of the buffer.
+type Token struct {
+	S, E  int
+	Color RegionMatchType
+}
+
+func NewOverlay(base Highlighter) *Overlay {
+	return &Overlay{Base: base}
+}
+
+// SetTokens replaces the tokens of the overlay, tokens must be sorted and
+// must not overlap.
+func (o *Overlay) SetTokens(tokens []Token) {
+	o.tokens = tokens
+}
+
+func (o *Overlay) Highlight(start, end int, buf yregexp.Matchable, outbuf []uint8) []uint8 {
+	base := len(outbuf)
+	outbuf = o.Base.Highlight(start, end, buf, outbuf)
+	colors := outbuf[base:]
+
+	i := sort.Search(len(o.tokens), func(i int) bool { return o.tokens[i].E > start })
+	for ; i < len(o.tokens) && o.tokens[i].S < end; i++ {
+		t := o.tokens[i]
+		for j := t.S; j < t.E && j < end; j++ {
+			if j < start || j-start >= len(colors) {
+				continue
+			}
+			if c := RegionMatchType(colors[j-start]); c == 1 || c >= RMT_KEYWORD {
+				colors[j-start] = uint8(t.Color)
+			}
+		}
+	}
+	return outbuf
+}
+
+func (o *Overlay) Toregend(start int, buf yregexp.Matchable) int {
+	return o.Base.Toregend(start, buf)
+}
+
+// Alter discards all tokens after idx, their position is no longer valid.
+func (o *Overlay) Alter(idx int) {
+	o.Base.Alter(idx)
+	i := sort.Search(len(o.tokens), func(i int) bool { return o.tokens[i].E > idx })
+	o.tokens = o.tokens[:i]
+}
@@ -12,12 +12,25 @@ const (
 	RMT_STRING RegionMatchType = iota + 2
 	RMT_COMMENT
 	RMT_HEADER
+	RMT_KEYWORD
+	RMT_NUMBER
+	RMT_BUILTIN
+	RMT_FUNCTION
+	RMT_TYPE
+	RMT_VARIABLE
+	RMT_PARAMETER
 )
 
 type LanguageRules struct {
 	NameRe        string
 	re            *regexp.Regexp
 	RegionMatches []RegionMatch
+
+	// Token rules, applied to the text outside of regions
+	Keywords []string // colored as RMT_KEYWORD
+	Builtins []string // names of builtin functions, types and constants, colored as RMT_BUILTIN
+	NumberRe string   // numeric literals, colored as RMT_NUMBER
+	tokens   *tokenRules
 }
 
 // RegionMatch describes a syntax highlighting rule
@@ -0,0 +1,138 @@
+package hl
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	yregexp "github.com/aarzilli/yacco/regexp"
+)
+
+// Longest word that will be considered for keyword, builtin and number
+// highlighting.
+const maxTokenLen = 64
+
+// Compiled token rules of a language
+type tokenRules struct {
+	keywords map[string]bool
+	builtins map[string]bool
+	number   *regexp.Regexp
+}
+
+func compileTokenRules(rules *LanguageRules) *tokenRules {
+	tr := &tokenRules{}
+	if len(rules.Keywords) > 0 {
+		tr.keywords = make(map[string]bool, len(rules.Keywords))
+		for _, kw := range rules.Keywords {
+			tr.keywords[kw] = true
+		}
+	}
+	if len(rules.Builtins) > 0 {
+		tr.builtins = make(map[string]bool, len(rules.Builtins))
+		for _, name := range rules.Builtins {
+			tr.builtins[name] = true
+		}
+	}
+	if rules.NumberRe != "" {
+		tr.number = regexp.MustCompile(`^(?:` + rules.NumberRe + `)`)
+	}
+	return tr
+}
+
+func (tr *tokenRules) empty() bool {
+	return tr == nil || (tr.keywords == nil && tr.builtins == nil && tr.number == nil)
+}
+
+func isWordChar(ch rune) bool {
+	return ch == '_' || unicode.IsLetter(ch) || unicode.IsDigit(ch)
+}
+
+// apply colors keywords, builtins and numbers in colors, which contains
+// the colors of the characters of buf starting at start. Only characters
+// colored as plain text are changed.
+func (tr *tokenRules) apply(start int, buf yregexp.Matchable, colors []uint8) {
+	if tr.empty() {
+		return
+	}
+	end := start + len(colors)
+
+	// the token containing start could begin before it, for example a
+	// number with a decimal point
+	i := start
+	for i > 0 && start-i < maxTokenLen && (isWordChar(buf.At(i-1)) || buf.At(i-1) == '.') {
+		i--
+	}
+
+	for i < end {
+		if (i >= start && colors[i-start] != 1) || !isWordChar(buf.At(i)) {
+			i++
+			continue
+		}
+
+		ws, we := i, i
+		for we < buf.Size() && we-ws <= maxTokenLen && isWordChar(buf.At(we)) {
+			we++
+		}
+
+		color, n := tr.classify(ws, we, buf)
+		if color != 0 {
+			for j := ws; j < ws+n && j < end; j++ {
+				if j >= start && colors[j-start] == 1 {
+					colors[j-start] = uint8(color)
+				}
+			}
+		}
+
+		i = we
+		if ws+n > i {
+			i = ws + n
+		}
+	}
+}
+
+// classify returns the color of the word between ws and we and the number
+// of characters it applies to, which can be more than the length of the
+// word for numbers.
+func (tr *tokenRules) classify(ws, we int, buf yregexp.Matchable) (RegionMatchType, int) {
+	if we-ws > maxTokenLen {
+		return 0, we - ws
+	}
+
+	if unicode.IsDigit(buf.At(ws)) {
+		if tr.number == nil {
+			return 0, we - ws
+		}
+		var s strings.Builder
+		for i := ws; i < buf.Size() && i-ws < maxTokenLen; i++ {
+			ch := buf.At(i)
+			if unicode.IsSpace(ch) {
+				break
+			}
+			s.WriteRune(ch)
+		}
+		str := s.String()
+		loc := tr.number.FindStringIndex(str)
+		if loc == nil || loc[1] == 0 {
+			return 0, we - ws
+		}
+		return RMT_NUMBER, utf8.RuneCountInString(str[:loc[1]])
+	}
+
+	if ws > 0 && buf.At(ws-1) == '.' {
+		// names of fields and methods
+		return 0, we - ws
+	}
+
+	word := make([]rune, 0, we-ws)
+	for i := ws; i < we; i++ {
+		word = append(word, buf.At(i))
+	}
+	switch {
+	case tr.keywords[string(word)]:
+		return RMT_KEYWORD, we - ws
+	case tr.builtins[string(word)]:
+		return RMT_BUILTIN, we - ws
+	}
+	return 0, we - ws
+}
@@ -33,6 +33,8 @@ EnableHighlighting=true
 HideHidden=true
 ServeTCP=false
 QuoteHack=false
+Backup=none
+PersistentUndo=false
 
 [Fonts "Main"]
 Pixel=16
@@ -78,6 +80,10 @@ CopyFrom=Main
 [Save]
 .go	Gosave
 
+[Lsp]
+### language	file regexp	server command line	initialization options (optional, JSON)
+go	\.go$	gopls serve
+
 [Keybindings]
 control+\`	Mark
 control+p	Savepos
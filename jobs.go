@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -11,24 +12,47 @@ import (
 	"sync"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aarzilli/yacco/buf"
+	"github.com/aarzilli/yacco/config"
 	"github.com/aarzilli/yacco/util"
 )
 
 type jobrec struct {
-	descr string
-	//ec *ExecContext
+	descr      string
+	ec         *ExecContext
 	cmd        *exec.Cmd
 	outstr     string
 	writeToBuf bool
 
-	startTime time.Time
+	// needed to run the command again
+	wd, input string
+	canRerun  bool
+
+	startTime, endTime time.Time
+	exitCode           int
+	id                 int // identifies the job in jobHistory
+
+	outputMu sync.Mutex
+	output   []byte // last MAX_JOB_OUTPUT bytes of output
+
+	out *jobWriter // output shown in +Errors
 
 	done chan bool
 }
 
+const MAX_JOB_HISTORY = 20
+const MAX_JOB_OUTPUT = 64 * 1024
+
+// Output of jobs is sent to +Errors every JOB_OUTPUT_INTERVAL, if more than
+// JOB_MAX_PENDING bytes accumulate in the meantime the job is throttled
+const JOB_OUTPUT_INTERVAL = 100 * time.Millisecond
+const JOB_MAX_PENDING = 256 * 1024
+
 var jobs = []*jobrec{}
+var jobHistory = []*jobrec{} // finished jobs, most recent last
+var jobHistoryId = 0
 var jobsMutex = sync.Mutex{}
 
 func removeEmpty(v []string) []string {
@@ -53,7 +77,10 @@ func NewJob(wd, cmd, input string, ec *ExecContext, writeToBuf, istooltip bool,
 	job.startTime = time.Now()
 
 	job.writeToBuf = writeToBuf
-	//job.ec = ec
+	job.ec = ec
+	job.wd = wd
+	job.input = input
+	job.canRerun = !istooltip && resultChan == nil
 	job.done = make(chan bool, 10)
 
 	isec := false
@@ -108,6 +135,7 @@ func NewJob(wd, cmd, input string, ec *ExecContext, writeToBuf, istooltip bool,
 	}
 
 	job.cmd.Dir = wd
+	job.out = newJobWriter(wd)
 	job.cmd.SysProcAttr = &syscall.SysProcAttr{Pgid: 0, Setpgid: true}
 
 	stdout, err := job.cmd.StdoutPipe()
@@ -127,6 +155,7 @@ func NewJob(wd, cmd, input string, ec *ExecContext, writeToBuf, istooltip bool,
 
 	err = job.cmd.Start()
 	if err != nil {
+		job.out.Close()
 		if isec && (os.IsNotExist(err) || os.IsPermission(err)) {
 			return
 		}
@@ -160,32 +189,16 @@ func NewJob(wd, cmd, input string, ec *ExecContext, writeToBuf, istooltip bool,
 			}
 			bs := string(bsr)
 			job.outstr = bs
+			job.record(bsr)
 		} else {
-			bsr := make([]byte, 32*1024)
-			for {
-				n, err := stdout.Read(bsr)
-				if n > 0 {
-					bs := string(bsr[:n])
-					sideChan <- WarnMsg(job.cmd.Dir, bs, true)
-				}
-				if err != nil {
-					break
-				}
-			}
+			job.readOutput(stdout)
 		}
 	}()
 
 	go func() {
 		defer func() { job.done <- true }()
 		defer stderr.Close()
-		bsr, err := ioutil.ReadAll(stderr)
-		if err != nil {
-			return
-		}
-		bs := string(bsr)
-		if bs != "" {
-			sideChan <- WarnMsg(job.cmd.Dir, bs, true)
-		}
+		job.readOutput(stderr)
 	}()
 
 	go func() {
@@ -209,7 +222,11 @@ func NewJob(wd, cmd, input string, ec *ExecContext, writeToBuf, istooltip bool,
 
 		doneSomething := false
 
+		job.out.Close()
+
 		err := job.cmd.Wait()
+		job.endTime = time.Now()
+		job.exitCode = job.cmd.ProcessState.ExitCode()
 		if err != nil {
 			sideChan <- WarnMsg(job.cmd.Dir, "Error executing command: "+job.descr+"\n", false)
 			doneSomething = true
@@ -230,6 +247,16 @@ func NewJob(wd, cmd, input string, ec *ExecContext, writeToBuf, istooltip bool,
 
 		jobsMutex.Lock()
 		jobs[idx] = nil
+		if job.canRerun {
+			jobHistoryId++
+			job.id = jobHistoryId
+			jobHistory = append(jobHistory, job)
+			if len(jobHistory) > MAX_JOB_HISTORY {
+				copy(jobHistory, jobHistory[1:])
+				jobHistory[len(jobHistory)-1] = nil
+				jobHistory = jobHistory[:len(jobHistory)-1]
+			}
+		}
 		jobsMutex.Unlock()
 
 		sideChan <- func() {
@@ -238,17 +265,7 @@ func NewJob(wd, cmd, input string, ec *ExecContext, writeToBuf, istooltip bool,
 
 		if !doneSomething && ec != nil && ec.buf != nil && ec.ed != nil && ec.buf.IsDir() {
 			sideChan <- func() {
-				found := false
-			editor_search:
-				for i := range Wnd.cols.cols {
-					for j := range Wnd.cols.cols[i].editors {
-						if Wnd.cols.cols[i].editors[j] == ec.ed {
-							found = true
-							break editor_search
-						}
-					}
-				}
-				if found {
+				if editorIsOpen(ec.ed) {
 					ec.ed.readDir()
 					ec.ed.BufferRefresh()
 				}
@@ -257,6 +274,235 @@ func NewJob(wd, cmd, input string, ec *ExecContext, writeToBuf, istooltip bool,
 	}()
 }
 
+// readOutput copies the output of the job from rd to +Errors
+func (job *jobrec) readOutput(rd io.Reader) {
+	bsr := make([]byte, 32*1024)
+	for {
+		n, err := rd.Read(bsr)
+		if n > 0 {
+			job.record(bsr[:n])
+			job.out.Write(bsr[:n])
+		}
+		if err != nil {
+			break
+		}
+	}
+}
+
+// record saves s as output of the job
+func (job *jobrec) record(s []byte) {
+	job.outputMu.Lock()
+	defer job.outputMu.Unlock()
+	job.output = append(job.output, s...)
+	if len(job.output) > MAX_JOB_OUTPUT {
+		job.output = append(job.output[:0], job.output[len(job.output)-MAX_JOB_OUTPUT:]...)
+	}
+}
+
+// status describes how the job terminated
+func (job *jobrec) status() string {
+	switch job.exitCode {
+	case 0:
+		return "ok"
+	case -1:
+		return "killed"
+	default:
+		return fmt.Sprintf("exit %d", job.exitCode)
+	}
+}
+
+func editorIsOpen(ed *Editor) bool {
+	for i := range Wnd.cols.cols {
+		for j := range Wnd.cols.cols[i].editors {
+			if Wnd.cols.cols[i].editors[j] == ed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// findJobHistory returns the finished job with the specified id, or the
+// last one if id is 0
+func findJobHistory(id int) *jobrec {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	for i := len(jobHistory) - 1; i >= 0; i-- {
+		if id == 0 || jobHistory[i].id == id {
+			return jobHistory[i]
+		}
+	}
+	return nil
+}
+
+// jobRerun runs a finished job again, in the same directory and, if it is
+// still open, for the same editor. Jobs that read or replaced the selection
+// (|, < and >) use the current selection and can't be run again once their
+// editor is closed.
+func jobRerun(job *jobrec) error {
+	ec, input := job.ec, job.input
+	usesSel := job.writeToBuf || job.input != ""
+	if ec == nil || (ec.ed != nil && !editorIsOpen(ec.ed)) {
+		if usesSel {
+			return fmt.Errorf("the window of job %d was closed", job.id)
+		}
+		ec = &ExecContext{}
+	}
+	if usesSel {
+		if ec.ed == nil || ec.fr == nil {
+			return fmt.Errorf("job %d has no selection to use", job.id)
+		}
+		if job.input != "" {
+			input = string(ec.ed.bodybuf.SelectionRunes(ec.fr.Sel))
+		}
+	}
+	NewJob(job.wd, job.descr, input, ec, job.writeToBuf, false, nil)
+	return nil
+}
+
+// jobOutput shows the recorded output of a finished job
+func jobOutput(job *jobrec) {
+	job.outputMu.Lock()
+	t := fmt.Sprintf("%s\n%s %s in %s\n\n%s", job.descr, job.status(), job.endTime.Sub(job.startTime).Round(time.Millisecond), util.ShortPath(job.wd, false), job.output)
+	job.outputMu.Unlock()
+	Warnfull(filepath.Join(job.wd, "+Output"), t, true, false)
+}
+
+// jobWriter batches the output of a job, sending it to +Errors every
+// JOB_OUTPUT_INTERVAL. Writes block while too much output is waiting to be
+// sent, output after config.JobOutputLimit bytes goes to a temporary file.
+type jobWriter struct {
+	dir string
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	pending   []byte
+	written   int      // bytes sent to +Errors
+	spill     *os.File // output after config.JobOutputLimit
+	spilled   int
+	throttled bool
+
+	stop, stopped chan struct{}
+}
+
+func newJobWriter(dir string) *jobWriter {
+	w := &jobWriter{dir: dir, stop: make(chan struct{}), stopped: make(chan struct{})}
+	w.cond = sync.NewCond(&w.mu)
+	go w.run()
+	return w
+}
+
+func (w *jobWriter) Write(p []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if limit := config.JobOutputLimit; limit > 0 && w.written+len(w.pending)+len(p) > limit {
+		n := limit - w.written - len(w.pending)
+		if n < 0 {
+			n = 0
+		}
+		for n > 0 && !utf8.RuneStart(p[n]) {
+			n--
+		}
+		w.pending = append(w.pending, p[:n]...)
+		w.spillWrite(p[n:])
+		return
+	}
+
+	for len(w.pending) >= JOB_MAX_PENDING {
+		w.setThrottled(true)
+		w.cond.Wait()
+	}
+	w.setThrottled(false)
+	w.pending = append(w.pending, p...)
+}
+
+func (w *jobWriter) spillWrite(p []byte) {
+	if w.spill == nil && w.spilled == 0 {
+		spill, err := ioutil.TempFile("", "yacco-job")
+		if err == nil {
+			w.spill = spill
+		}
+	}
+	if w.spill != nil {
+		w.spill.Write(p)
+	}
+	w.spilled += len(p)
+}
+
+// setThrottled changes the throttled flag, updating the list of jobs
+func (w *jobWriter) setThrottled(throttled bool) {
+	if w.throttled == throttled {
+		return
+	}
+	w.throttled = throttled
+	select {
+	case sideChan <- func() { UpdateJobs(false) }:
+	default:
+	}
+}
+
+// Status returns a description of the output of the job for the list of
+// jobs
+func (w *jobWriter) Status() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	r := ""
+	if w.throttled {
+		r += " [throttled]"
+	}
+	if w.spilled > 0 {
+		r += fmt.Sprintf(" [truncated %d bytes]", w.spilled)
+	}
+	return r
+}
+
+func (w *jobWriter) run() {
+	t := time.NewTicker(JOB_OUTPUT_INTERVAL)
+	defer t.Stop()
+	defer close(w.stopped)
+	for {
+		select {
+		case <-t.C:
+			w.flush()
+		case <-w.stop:
+			w.flush()
+			w.mu.Lock()
+			if w.spill != nil {
+				w.spill.Close()
+			}
+			spilled := w.spilled
+			w.mu.Unlock()
+			if spilled > 0 {
+				msg := fmt.Sprintf("\n[truncated %d bytes]\n", spilled)
+				if w.spill != nil {
+					msg = fmt.Sprintf("\n[truncated %d bytes, saved to %s]\n", spilled, w.spill.Name())
+				}
+				sideChan <- WarnMsg(w.dir, msg, false)
+			}
+			return
+		}
+	}
+}
+
+func (w *jobWriter) flush() {
+	w.mu.Lock()
+	s := w.pending
+	w.pending = nil
+	w.written += len(s)
+	w.cond.Broadcast()
+	w.mu.Unlock()
+	if len(s) > 0 {
+		sideChan <- WarnMsg(w.dir, string(s), true)
+	}
+}
+
+// Close sends all the remaining output to +Errors
+func (w *jobWriter) Close() {
+	close(w.stop)
+	<-w.stopped
+}
+
 func easyCommand(cmd string) bool {
 	for _, c := range cmd {
 		switch c {
@@ -310,9 +556,16 @@ func UpdateJobs(create bool) {
 		if job == nil {
 			continue
 		}
-		t += fmt.Sprintf("[ Kill %d ] %s\n", i, job.descr)
+		t += fmt.Sprintf("[ Kill %d ] %s%s\n", i, job.descr, job.out.Status())
 		n++
 	}
+	if len(jobHistory) > 0 {
+		t += "\nFinished:\n"
+	}
+	for i := len(jobHistory) - 1; i >= 0; i-- {
+		job := jobHistory[i]
+		t += fmt.Sprintf("[ Rerun %d ] %s %s %s: %s\n", job.id, job.status(), job.endTime.Sub(job.startTime).Round(100*time.Millisecond), util.ShortPath(job.wd, false), job.descr)
+	}
 	jobsMutex.Unlock()
 
 	Wnd.GenTag()
@@ -328,7 +581,7 @@ func UpdateJobs(create bool) {
 	ed.bodybuf.Replace([]rune(t), &ed.sfr.Fr.Sel, true, nil, 0)
 
 	if create {
-		ed.tagbuf.Replace([]rune("Kill"), &util.Sel{ed.tagbuf.EditableStart, ed.tagbuf.Size()}, true, nil, 0)
+		ed.tagbuf.Replace([]rune("Kill Rerun"), &util.Sel{ed.tagbuf.EditableStart, ed.tagbuf.Size()}, true, nil, 0)
 	}
 	ed.BufferRefresh()
 }
@@ -42,6 +42,10 @@ func LoadInit() {
 		}
 		LoadRules = append(LoadRules, LoadRule{ForDir: bufRe == nil, BufRe: bufRe, Re: regexp.Compile(rule.Re, true, false), Action: rule.Action, PathPattern: rule.BufRe, Pattern: rule.Re})
 	}
+	edit.Programs = map[string]string{}
+	for name, pgm := range config.EditPrograms {
+		edit.Define(name, pgm)
+	}
 	if config.StartupWidth == 0 {
 		config.StartupWidth = config.MainFontSize * 40
 	}
@@ -74,6 +78,9 @@ func Load(ec ExecContext, origin int, othered bool, loadStr []rune) {
 	if ec.buf == nil {
 		return
 	}
+	if loadStr == nil && (outlineLoad(ec, origin, othered) || undoTreeLoad(ec, origin, othered)) {
+		return
+	}
 	for i, rule := range LoadRules {
 		path := filepath.Join(ec.buf.Dir, ec.buf.Name)
 		if rule.ForDir {
@@ -151,11 +158,13 @@ func Load(ec ExecContext, origin int, othered bool, loadStr []rune) {
 	}
 }
 
-func expandMatches(str string, matches []string) string {
+// expandMatches replaces $0 through $9 and ${name} in str with the
+// corresponding match, $l0 and $l{name} with the lowercase version.
+func expandMatches(str string, matches []string, names []string) string {
 	out := []byte{}
 	sub := false
 	tolower := false
-	for i := range str {
+	for i := 0; i < len(str); i++ {
 		if !sub {
 			if str[i] == '$' {
 				tolower = false
@@ -164,26 +173,35 @@ func expandMatches(str string, matches []string) string {
 				out = append(out, str[i])
 			}
 		} else {
+			d := -1
 			if str[i] == 'l' {
 				tolower = true
+				continue
 			} else if (str[i] >= '0') && (str[i] <= '9') {
-				d := int(str[i] - '0')
-				if d >= len(matches) {
-					out = append(out, '$')
-					out = append(out, str[i])
-				} else {
-					if tolower {
-						out = append(out, strings.ToLower(matches[d])...)
-					} else {
-						out = append(out, matches[d]...)
+				d = int(str[i] - '0')
+			} else if end := strings.IndexByte(str[i:], '}'); str[i] == '{' && end > 0 {
+				for j := range names {
+					if names[j] != "" && names[j] == str[i+1:i+end] {
+						d = j
+						i += end
+						break
 					}
 				}
-				sub = false
-			} else {
+			}
+			if d < 0 || d >= len(matches) {
 				out = append(out, '$')
+				if tolower {
+					out = append(out, 'l')
+				}
 				out = append(out, str[i])
-				sub = false
+			} else {
+				if tolower {
+					out = append(out, strings.ToLower(matches[d])...)
+				} else {
+					out = append(out, matches[d]...)
+				}
 			}
+			sub = false
 		}
 	}
 	return string(out)
@@ -200,7 +218,7 @@ func (rule *LoadRule) Exec(ec ExecContext, matches []string, s, e int, othered,
 
 	switch rule.Action[0] {
 	case 'X':
-		expaction := expandMatches(action, matches)
+		expaction := expandMatches(action, matches, rule.Re.SubexpNames())
 		if doselect {
 			ec.fr.Sel = util.Sel{s, e}
 			ec.fr.SelColor = 2
@@ -218,11 +236,11 @@ func (rule *LoadRule) Exec(ec ExecContext, matches []string, s, e int, othered,
 		return true
 	case 'L':
 		v := strings.SplitN(action, ":", 2)
-		name := expandMatches(v[0], matches)
+		name := expandMatches(v[0], matches, rule.Re.SubexpNames())
 
 		addrExpr := ""
 		if len(v) > 1 {
-			addrExpr = expandMatches(v[1], matches)
+			addrExpr = expandMatches(v[1], matches, rule.Re.SubexpNames())
 		}
 		var newed *Editor
 		if name != "" {
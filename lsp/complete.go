@@ -0,0 +1,324 @@
+package lsp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
+)
+
+// Completion is a completion proposed by the language server.
+type Completion struct {
+	Label           string
+	Filter          string // text to compare with what the user typed
+	Kind            string
+	Detail          string
+	Doc             string
+	Edit            TextEdit   // replaces the word being completed
+	AdditionalEdits []TextEdit // unrelated edits, for example adding an import
+	resolved        bool
+	item            CompletionItem
+}
+
+var completionKindToString = map[CompletionItemKind]string{
+	MethodCompletion:        "method",
+	FunctionCompletion:      "func",
+	ConstructorCompletion:   "constructor",
+	FieldCompletion:         "field",
+	VariableCompletion:      "var",
+	ClassCompletion:         "class",
+	InterfaceCompletion:     "interface",
+	ModuleCompletion:        "module",
+	PropertyCompletion:      "property",
+	EnumCompletion:          "enum",
+	KeywordCompletion:       "keyword",
+	SnippetCompletion:       "snippet",
+	FileCompletion:          "file",
+	EnumMemberCompletion:    "enum member",
+	ConstantCompletion:      "const",
+	StructCompletion:        "struct",
+	TypeParameterCompletion: "type parameter",
+}
+
+// Complete returns the completions for the word at a and the longest
+// prefix common to all of them that can be inserted at a.
+func (srv *LspSrv) Complete(a LspBufferPos) ([]Completion, string) {
+	srv.Changed(a)
+
+	first := true
+	insertPrefix := ""
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(60*time.Second))
+	defer cancel()
+
+	tp := a.tdpp()
+
+	var raw json.RawMessage
+	if err := srv.conn.Call(ctx, "textDocument/completion", tp, &raw); err != nil {
+		lspLog(fmt.Sprintf("completion error: %v\n", err))
+		return nil, ""
+	}
+	var cmpl CompletionList
+	if raw = bytes.TrimSpace(raw); len(raw) > 0 && raw[0] == '[' {
+		json.Unmarshal(raw, &cmpl.Items)
+	} else {
+		json.Unmarshal(raw, &cmpl)
+	}
+
+	r := make([]Completion, 0, len(cmpl.Items))
+	for _, cmplItem := range cmpl.Items {
+		edit := completionEdit(&cmplItem, a)
+		if edit.Range.Start.Line != edit.Range.End.Line {
+			continue
+		}
+		if edit.Range.Start.Line != a.Ln {
+			continue
+		}
+
+		nt := utf16.Encode([]rune(edit.NewText))
+		commonidx := a.Col - edit.Range.Start.Character
+		if commonidx < 0 || commonidx > len(nt) {
+			continue
+		}
+
+		if !issfx(nt[:commonidx], a.line) {
+			continue
+		}
+
+		nt = nt[commonidx:]
+
+		c := Completion{Label: cmplItem.Label, Kind: completionKindToString[cmplItem.Kind], Edit: edit}
+		c.setItem(&cmplItem)
+		r = append(r, c)
+		if first {
+			first = false
+			insertPrefix = string(utf16.Decode(nt))
+		} else {
+			insertPrefix = commonPrefix2(insertPrefix, string(utf16.Decode(nt)))
+		}
+	}
+
+	return r, insertPrefix
+}
+
+// completionEdit returns the edit to apply for item, if the server didn't
+// specify one the word before the cursor is replaced.
+func completionEdit(item *CompletionItem, a LspBufferPos) TextEdit {
+	var edit TextEdit
+	if item.TextEdit != nil {
+		edit = *item.TextEdit
+	} else {
+		edit.NewText = item.InsertText
+		if edit.NewText == "" {
+			edit.NewText = item.Label
+		}
+		start := len(a.line)
+		for start > 0 && isIdentChar(rune(a.line[start-1])) {
+			start--
+		}
+		edit.Range.Start = Position{a.Ln, a.Col - (len(a.line) - start)}
+		edit.Range.End = Position{a.Ln, a.Col}
+	}
+	if item.InsertTextFormat == SnippetTextFormat {
+		edit.NewText = expandSnippet(edit.NewText)
+	}
+	return edit
+}
+
+func isIdentChar(ch rune) bool {
+	return ch == '_' || unicode.IsLetter(ch) || unicode.IsDigit(ch)
+}
+
+func (c *Completion) setItem(item *CompletionItem) {
+	c.item = *item
+	c.Filter = item.FilterText
+	if c.Filter == "" {
+		c.Filter = item.Label
+	}
+	c.Detail = item.Detail
+	c.Doc = docString(item.Documentation)
+	c.AdditionalEdits = item.AdditionalTextEdits
+}
+
+// NeedsResolve returns true if Resolve would ask the server for more
+// information about c.
+func (srv *LspSrv) NeedsResolve(c *Completion) bool {
+	return !c.resolved && srv.Capabilities.CompletionProvider != nil && srv.Capabilities.CompletionProvider.ResolveProvider
+}
+
+// Resolve asks the server for the documentation and additional edits of c,
+// if they weren't already sent with the completion list.
+func (srv *LspSrv) Resolve(c *Completion) {
+	if !srv.NeedsResolve(c) {
+		return
+	}
+	c.resolved = true
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(5*time.Second))
+	defer cancel()
+
+	var item CompletionItem
+	if err := srv.conn.Call(ctx, "completionItem/resolve", &c.item, &item); err != nil {
+		lspLog(fmt.Sprintf("completion resolve error: %v\n", err))
+		return
+	}
+	if item.Detail == "" {
+		item.Detail = c.Detail
+	}
+	if item.Documentation == nil {
+		item.Documentation = c.Doc
+	}
+	if item.AdditionalTextEdits == nil {
+		item.AdditionalTextEdits = c.AdditionalEdits
+	}
+	c.setItem(&item)
+}
+
+// Description returns the kind, detail and documentation of c, to be shown
+// next to the completion list.
+func (c *Completion) Description() string {
+	var out strings.Builder
+	if c.Kind != "" {
+		out.WriteString(c.Kind)
+		out.WriteString(" ")
+	}
+	out.WriteString(c.Label)
+	if c.Detail != "" {
+		out.WriteString("\n")
+		out.WriteString(c.Detail)
+	}
+	if c.Doc != "" {
+		out.WriteString("\n\n")
+		out.WriteString(truncateLines(c.Doc, descriptionLen))
+	}
+	return out.String()
+}
+
+const descriptionLen = 10
+
+func truncateLines(s string, n int) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	if len(lines) > n {
+		lines = append(lines[:n], "...")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// docString converts a documentation field, which could be either a string
+// or a MarkupContent, to a string.
+func docString(doc interface{}) string {
+	switch doc := doc.(type) {
+	case string:
+		return doc
+	case map[string]interface{}:
+		s, _ := doc["value"].(string)
+		return s
+	}
+	return ""
+}
+
+// expandSnippet converts a snippet to plain text, placeholders are
+// replaced by their default value and tabstops are removed.
+func expandSnippet(snippet string) string {
+	var out strings.Builder
+	rs := []rune(snippet)
+	depth := 0
+	for i := 0; i < len(rs); i++ {
+		switch {
+		case rs[i] == '\\' && i+1 < len(rs):
+			i++
+			out.WriteRune(rs[i])
+		case rs[i] == '$' && i+1 < len(rs) && rs[i+1] >= '0' && rs[i+1] <= '9':
+			for i+1 < len(rs) && rs[i+1] >= '0' && rs[i+1] <= '9' {
+				i++
+			}
+		case rs[i] == '$' && i+1 < len(rs) && rs[i+1] == '{':
+			i += 2
+			for i < len(rs) && rs[i] >= '0' && rs[i] <= '9' {
+				i++
+			}
+			if i < len(rs) && rs[i] == ':' {
+				depth++
+			} else if i < len(rs) && rs[i] == '}' {
+				// empty tabstop
+			} else {
+				i--
+				depth++
+			}
+		case rs[i] == '}' && depth > 0:
+			depth--
+		default:
+			out.WriteRune(rs[i])
+		}
+	}
+	return out.String()
+}
+
+// SignatureHelp returns a description of the signature of the function
+// being called at a, with the active parameter on its own line.
+func (srv *LspSrv) SignatureHelp(a LspBufferPos) string {
+	if srv.Capabilities.SignatureHelpProvider == nil {
+		return ""
+	}
+	srv.Changed(a)
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(5*time.Second))
+	defer cancel()
+
+	var sign SignatureHelp
+	if err := srv.conn.Call(ctx, "textDocument/signatureHelp", a.tdpp(), &sign); err != nil {
+		lspLog(fmt.Sprintf("signature help error: %v\n", err))
+		return ""
+	}
+	if len(sign.Signatures) == 0 {
+		return ""
+	}
+	active := int(sign.ActiveSignature)
+	if active < 0 || active >= len(sign.Signatures) {
+		active = 0
+	}
+	si := sign.Signatures[active]
+
+	var out strings.Builder
+	out.WriteString(si.Label)
+	if p := int(sign.ActiveParameter); p >= 0 && p < len(si.Parameters) {
+		if label := parameterLabel(si.Label, si.Parameters[p].Label); label != "" {
+			out.WriteString("\n\t")
+			out.WriteString(label)
+		}
+		if doc := docString(si.Parameters[p].Documentation); doc != "" {
+			out.WriteString(" ")
+			out.WriteString(strings.Join(strings.Fields(doc), " "))
+		}
+	}
+	if doc := docString(si.Documentation); doc != "" {
+		out.WriteString("\n\n")
+		out.WriteString(truncateLines(doc, descriptionLen))
+	}
+	return out.String()
+}
+
+// parameterLabel returns the label of a parameter, which can be either a
+// string or a pair of UTF-16 offsets into the label of the signature.
+func parameterLabel(signature string, label interface{}) string {
+	switch label := label.(type) {
+	case string:
+		return label
+	case []interface{}:
+		if len(label) != 2 {
+			return ""
+		}
+		start, ok1 := label[0].(float64)
+		end, ok2 := label[1].(float64)
+		s := utf16.Encode([]rune(signature))
+		if !ok1 || !ok2 || start < 0 || start > end || int(end) > len(s) {
+			return ""
+		}
+		return string(utf16.Decode(s[int(start):int(end)]))
+	}
+	return ""
+}
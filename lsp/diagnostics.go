@@ -0,0 +1,110 @@
+package lsp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type fileDiagnostics struct {
+	srv   *LspSrv
+	diags []Diagnostic
+}
+
+var diagnostics = map[string]fileDiagnostics{}
+var diagMu sync.Mutex
+
+// DiagnosticsChanged, if not nil, is called every time the diagnostics
+// for path change. It is called from the goroutine reading messages from
+// the language server.
+var DiagnosticsChanged func(path string)
+
+var severityToString = map[DiagnosticSeverity]string{
+	SeverityError:       "error",
+	SeverityWarning:     "warning",
+	SeverityInformation: "info",
+	SeverityHint:        "hint",
+}
+
+func setDiagnostics(srv *LspSrv, path string, diags []Diagnostic) {
+	sort.SliceStable(diags, func(i, j int) bool {
+		a, b := diags[i].Range.Start, diags[j].Range.Start
+		if a.Line == b.Line {
+			return a.Character < b.Character
+		}
+		return a.Line < b.Line
+	})
+
+	diagMu.Lock()
+	_, had := diagnostics[path]
+	if len(diags) == 0 {
+		delete(diagnostics, path)
+	} else {
+		diagnostics[path] = fileDiagnostics{srv, diags}
+	}
+	diagMu.Unlock()
+
+	if (had || len(diags) > 0) && DiagnosticsChanged != nil {
+		DiagnosticsChanged(path)
+	}
+}
+
+// clearDiagnostics removes all diagnostics published by srv.
+func clearDiagnostics(srv *LspSrv) {
+	changed := []string{}
+	diagMu.Lock()
+	for path, fd := range diagnostics {
+		if fd.srv == srv {
+			delete(diagnostics, path)
+			changed = append(changed, path)
+		}
+	}
+	diagMu.Unlock()
+
+	if DiagnosticsChanged != nil {
+		for _, path := range changed {
+			DiagnosticsChanged(path)
+		}
+	}
+}
+
+// Diagnostics returns the diagnostics for the file at path, sorted by
+// position.
+func Diagnostics(path string) []Diagnostic {
+	diagMu.Lock()
+	defer diagMu.Unlock()
+	return diagnostics[path].diags
+}
+
+// FormatDiagnostics returns all known diagnostics, one per line, in the
+// form path:line:col: severity: message.
+// Columns are 1-based and counted in UTF-16 code units, like the
+// language server does, which is the same as counting characters unless
+// the line contains characters outside of the BMP.
+func FormatDiagnostics() string {
+	diagMu.Lock()
+	defer diagMu.Unlock()
+
+	paths := make([]string, 0, len(diagnostics))
+	for path := range diagnostics {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var out strings.Builder
+	for _, path := range paths {
+		for _, d := range diagnostics[path].diags {
+			sev := severityToString[d.Severity]
+			if sev == "" {
+				sev = severityToString[SeverityError]
+			}
+			msg := strings.Join(strings.Fields(d.Message), " ")
+			if d.Source != "" {
+				msg = d.Source + ": " + msg
+			}
+			fmt.Fprintf(&out, "%s:%d:%d: %s: %s\n", path, d.Range.Start.Line+1, d.Range.Start.Character+1, sev, msg)
+		}
+	}
+	return out.String()
+}
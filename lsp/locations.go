@@ -0,0 +1,155 @@
+package lsp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Call hierarchy types, introduced in version 3.16 of the protocol and
+// missing from tsprotocol.go.
+
+type CallHierarchyItem struct {
+	Name           string      `json:"name"`
+	Kind           SymbolKind  `json:"kind"`
+	Detail         string      `json:"detail,omitempty"`
+	URI            string      `json:"uri"`
+	Range          Range       `json:"range"`
+	SelectionRange Range       `json:"selectionRange"`
+	Data           interface{} `json:"data,omitempty"`
+}
+
+type CallHierarchyIncomingCall struct {
+	From       CallHierarchyItem `json:"from"`
+	FromRanges []Range           `json:"fromRanges"`
+}
+
+type CallHierarchyOutgoingCall struct {
+	To         CallHierarchyItem `json:"to"`
+	FromRanges []Range           `json:"fromRanges"`
+}
+
+type CallHierarchyCallsParams struct {
+	Item CallHierarchyItem `json:"item"`
+}
+
+var lookupMethods = map[string]string{
+	"def":     "textDocument/definition",
+	"impl":    "textDocument/implementation",
+	"typedef": "textDocument/typeDefinition",
+}
+
+// Lookup returns the definitions ("def"), implementations ("impl"), type
+// definitions ("typedef"), callers ("callers") or callees ("callees") of
+// the symbol at a. Each result is formatted as path:line:col, followed by
+// the name of the function for callers and callees.
+func (srv *LspSrv) Lookup(a LspBufferPos, kind string) ([]string, error) {
+	srv.Changed(a)
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(60*time.Second))
+	defer cancel()
+
+	tp := a.tdpp()
+
+	if method, ok := lookupMethods[kind]; ok {
+		var raw json.RawMessage
+		if err := srv.conn.Call(ctx, method, tp, &raw); err != nil {
+			return nil, err
+		}
+		locs := parseLocations(raw)
+		r := make([]string, 0, len(locs))
+		for _, loc := range locs {
+			r = append(r, formatLocation(loc.URI, loc.Range.Start, ""))
+		}
+		return dedup(r), nil
+	}
+
+	if kind != "callers" && kind != "callees" {
+		return nil, fmt.Errorf("unknown lookup %q", kind)
+	}
+
+	var items []CallHierarchyItem
+	if err := srv.conn.Call(ctx, "textDocument/prepareCallHierarchy", tp, &items); err != nil {
+		return nil, err
+	}
+
+	r := []string{}
+	for _, item := range items {
+		params := CallHierarchyCallsParams{Item: item}
+		if kind == "callers" {
+			var calls []CallHierarchyIncomingCall
+			if err := srv.conn.Call(ctx, "callHierarchy/incomingCalls", params, &calls); err != nil {
+				return nil, err
+			}
+			for _, call := range calls {
+				// point to the call site rather than the definition of the caller
+				pos := call.From.SelectionRange.Start
+				if len(call.FromRanges) > 0 {
+					pos = call.FromRanges[0].Start
+				}
+				r = append(r, formatLocation(call.From.URI, pos, call.From.Name))
+			}
+		} else {
+			var calls []CallHierarchyOutgoingCall
+			if err := srv.conn.Call(ctx, "callHierarchy/outgoingCalls", params, &calls); err != nil {
+				return nil, err
+			}
+			for _, call := range calls {
+				r = append(r, formatLocation(call.To.URI, call.To.SelectionRange.Start, call.To.Name))
+			}
+		}
+	}
+	return dedup(r), nil
+}
+
+// parseLocations parses the result of a request that can return either
+// Location, []Location or []LocationLink.
+func parseLocations(raw json.RawMessage) []Location {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || raw[0] == 'n' {
+		return nil
+	}
+	if raw[0] == '{' {
+		var loc Location
+		if json.Unmarshal(raw, &loc) != nil {
+			return nil
+		}
+		return []Location{loc}
+	}
+
+	var links []LocationLink
+	if json.Unmarshal(raw, &links) == nil && len(links) > 0 && links[0].TargetURI != "" {
+		locs := make([]Location, len(links))
+		for i := range links {
+			locs[i] = Location{URI: links[i].TargetURI, Range: links[i].TargetSelectionRange}
+		}
+		return locs
+	}
+
+	var locs []Location
+	json.Unmarshal(raw, &locs)
+	return locs
+}
+
+func formatLocation(uri string, pos Position, name string) string {
+	s := fmt.Sprintf("%s:%d:%d", strings.TrimPrefix(uri, sillyURI), pos.Line+1, pos.Character+1)
+	if name != "" {
+		s += ": " + name
+	}
+	return s
+}
+
+func dedup(v []string) []string {
+	seen := map[string]bool{}
+	r := v[:0]
+	for _, s := range v {
+		if !seen[s] {
+			seen[s] = true
+			r = append(r, s)
+		}
+	}
+	return r
+}
@@ -8,7 +8,6 @@ import (
 	"io"
 	"os"
 	"os/exec"
-	"path/filepath"
 	rdebug "runtime/debug"
 	"strconv"
 	"strings"
@@ -17,6 +16,7 @@ import (
 	"unicode/utf16"
 
 	"github.com/aarzilli/yacco/buf"
+	"github.com/aarzilli/yacco/config"
 	"github.com/aarzilli/yacco/util"
 
 	"github.com/sourcegraph/jsonrpc2"
@@ -66,44 +66,81 @@ func tojson(v interface{}) string {
 	return string(buf)
 }
 
-var lspConns = map[string]*LspSrv{}
+type lspKey struct {
+	lang, wd string
+}
+
+var lspConns = map[lspKey]*LspSrv{}
 var lspMu sync.Mutex
 
 const debug = false
 
 func Restart(wd string) {
-	if lspConns[wd] != nil {
-		log.Reset()
-		lspConns[wd].conn.Close()
-		lspConns[wd] = nil
+	lspMu.Lock()
+	defer lspMu.Unlock()
+	resetLog()
+	for k, srv := range lspConns {
+		if k.wd != wd {
+			continue
+		}
+		if srv != nil {
+			srv.conn.Close()
+			lspConns[k] = nil
+		} else {
+			delete(lspConns, k)
+		}
 	}
 }
 
 func Killall() {
-	for wd := range lspConns {
-		lspConns[wd].conn.Close()
-		lspConns[wd] = nil
+	lspMu.Lock()
+	defer lspMu.Unlock()
+	for k, srv := range lspConns {
+		if srv != nil {
+			srv.conn.Close()
+		}
+		lspConns[k] = nil
 	}
-	log.Reset()
+	resetLog()
 }
 
-func LspFor(lang, wd string, create bool, warn func(string), look func(string)) *LspSrv {
-	if lang != ".go" {
+// LspFor returns the language server for the file at path, using the
+// first matching rule in config.LspRules. A single server is started for
+// each language and workspace root.
+func LspFor(path, wd string, create bool, warn func(string), look func(string)) *LspSrv {
+	rule := config.LspRuleFor(path)
+	if rule == nil {
 		return nil
 	}
+	key := lspKey{rule.Lang, wd}
 
 	lspMu.Lock()
 	defer lspMu.Unlock()
 
-	if _, ok := lspConns[wd]; ok {
-		return lspConns[wd]
+	if _, ok := lspConns[key]; ok {
+		return lspConns[key]
 	}
 
 	if !create {
 		return nil
 	}
 
-	cmd := exec.Command("gopls", "serve")
+	argv := util.QuotedSplit(os.ExpandEnv(rule.Cmd))
+	if len(argv) == 0 {
+		lspConns[key] = nil
+		return nil
+	}
+
+	var options interface{}
+	if rule.Options != "" {
+		if err := json.Unmarshal([]byte(rule.Options), &options); err != nil {
+			warn(fmt.Sprintf("Lsp %s: malformed initialization options: %v", rule.Lang, err))
+			options = nil
+		}
+	}
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = wd
 	stdin, err := cmd.StdinPipe()
 	must(err)
 	stdout, err := cmd.StdoutPipe()
@@ -113,14 +150,21 @@ func LspFor(lang, wd string, create bool, warn func(string), look func(string))
 	go io.Copy(os.Stdout, stderr)
 	err = cmd.Start()
 	if err != nil {
-		lspConns[wd] = nil
+		lspLog(fmt.Sprintf("could not start %q for %s: %v\n", rule.Cmd, rule.Lang, err))
+		lspConns[key] = nil
 		return nil
 	}
+
+	srv := &LspSrv{lang: rule.Lang, options: options, warn: warn, look: look, revision: make(map[string]int), semantic: make(map[string]*semanticTokensState)}
+
 	go func() {
 		cmd.Wait()
 		lspMu.Lock()
 		defer lspMu.Unlock()
-		delete(lspConns, wd)
+		if cur, ok := lspConns[key]; ok && (cur == nil || cur == srv) {
+			delete(lspConns, key)
+		}
+		go clearDiagnostics(srv)
 	}()
 
 	if debug {
@@ -129,9 +173,10 @@ func LspFor(lang, wd string, create bool, warn func(string), look func(string))
 
 	stream := jsonrpc2.NewBufferedStream(&readerWriter{stdout, stdin}, &jsonrpc2.VSCodeObjectCodec{})
 
-	handler := &lspHandler{}
+	handler := &lspHandler{srv: srv}
 
 	client := jsonrpc2.NewConn(context.Background(), stream, handler)
+	srv.conn = client
 	var out InitializeResult
 
 	tdcc := &TextDocumentClientCapabilities{}
@@ -139,6 +184,14 @@ func LspFor(lang, wd string, create bool, warn func(string), look func(string))
 	tdcc.Completion.CompletionItem.DocumentationFormat = []MarkupKind{"plaintext"}
 	tdcc.Hover.ContentFormat = []MarkupKind{"plaintext"}
 	tdcc.SignatureHelp.SignatureInformation.DocumentationFormat = []MarkupKind{"plaintext"}
+	tdcc.DocumentSymbol = &struct {
+		DynamicRegistration bool `json:"dynamicRegistration,omitempty"`
+		SymbolKind          *struct {
+			ValueSet []SymbolKind `json:"valueSet,omitempty"`
+		} `json:"symbolKind,omitempty"`
+		HierarchicalDocumentSymbolSupport bool `json:"hierarchicalDocumentSymbolSupport,omitempty"`
+	}{HierarchicalDocumentSymbolSupport: true}
+	tdcc.SemanticTokens = semanticTokensClientCapabilities()
 	tdcc.CodeAction = &CodeActionClientCapabilities{
 		DataSupport: true,
 	}
@@ -155,14 +208,14 @@ func LspFor(lang, wd string, create bool, warn func(string), look func(string))
 				TextDocument: tdcc,
 				Workspace:    wcc,
 			},
+			InitializationOptions: options,
 		},
 		WorkspaceFoldersInitializeParams{}}, &out)
 
 	client.Notify(context.Background(), "initialized", &InitializedParams{})
 
-	srv := &LspSrv{conn: client, warn: warn, look: look, Capabilities: out.Capabilities, revision: make(map[string]int)}
-	handler.srv = srv
-	lspConns[wd] = srv
+	srv.Capabilities = out.Capabilities
+	lspConns[key] = srv
 	return srv
 }
 
@@ -337,56 +390,6 @@ func appendLocs(s string, defs []locationAndKind, curPath string, ln int) string
 	return s + "\n\n" + strings.Join(strdefs, "\n")
 }
 
-func (srv *LspSrv) Complete(a LspBufferPos) ([]string, string) {
-	srv.Changed(a)
-
-	first := true
-	insertPrefix := ""
-
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(60*time.Second))
-	defer cancel()
-	//ctx := context.Background()
-
-	tp := a.tdpp()
-
-	var cmpl CompletionList
-	srv.conn.Call(ctx, "textDocument/completion", tp, &cmpl)
-	r := make([]string, 0, len(cmpl.Items))
-	for _, cmplItem := range cmpl.Items {
-		if cmplItem.TextEdit == nil {
-			continue
-		}
-		if cmplItem.TextEdit.Range.Start.Line != cmplItem.TextEdit.Range.End.Line {
-			continue
-		}
-		if cmplItem.TextEdit.Range.Start.Line != a.Ln {
-			continue
-		}
-
-		nt := utf16.Encode([]rune(cmplItem.TextEdit.NewText))
-		commonidx := a.Col - cmplItem.TextEdit.Range.Start.Character
-		if commonidx < 0 || commonidx > len(nt) {
-			continue
-		}
-
-		if !issfx(nt[:commonidx], a.line) {
-			continue
-		}
-
-		nt = nt[commonidx:]
-
-		r = append(r, cmplItem.TextEdit.NewText)
-		if first {
-			first = false
-			insertPrefix = string(utf16.Decode(nt))
-		} else {
-			insertPrefix = commonPrefix2(insertPrefix, string(utf16.Decode(nt)))
-		}
-	}
-
-	return r, insertPrefix
-}
-
 func (srv *LspSrv) Rename(a LspBufferPos, to string) []TextDocumentEdit {
 	srv.Changed(a)
 	tp := a.tdpp()
@@ -405,6 +408,44 @@ func (srv *LspSrv) Rename(a LspBufferPos, to string) []TextDocumentEdit {
 	return we.DocumentChanges
 }
 
+// Format returns the edits needed to format the file of a, if sel is true
+// only the selection of a is formatted.
+func (srv *LspSrv) Format(a LspBufferPos, opts FormattingOptions, sel bool) ([]TextDocumentEdit, error) {
+	if sel && !srv.Capabilities.DocumentRangeFormattingProvider {
+		return nil, fmt.Errorf("language server does not support formatting a selection")
+	}
+	if !sel && !srv.Capabilities.DocumentFormattingProvider {
+		return nil, fmt.Errorf("language server does not support formatting")
+	}
+	srv.Changed(a)
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
+	defer cancel()
+
+	td := TextDocumentIdentifier{URI: "file://" + a.Path}
+	var edits []TextEdit
+	var err error
+	if sel {
+		err = srv.conn.Call(ctx, "textDocument/rangeFormatting", &DocumentRangeFormattingParams{
+			TextDocument: td,
+			Range:        Range{Start: Position{a.Ln, a.Col}, End: Position{a.EndLn, a.EndCol}},
+			Options:      opts,
+		}, &edits)
+	} else {
+		err = srv.conn.Call(ctx, "textDocument/formatting", &DocumentFormattingParams{
+			TextDocument: td,
+			Options:      opts,
+		}, &edits)
+	}
+	if err != nil || len(edits) == 0 {
+		return nil, err
+	}
+	return []TextDocumentEdit{{
+		TextDocument: VersionedTextDocumentIdentifier{URI: td.URI, Version: float64(a.b.RevCount)},
+		Edits:        edits,
+	}}, nil
+}
+
 func (srv *LspSrv) getCodeActionsList(ctx context.Context, a LspBufferPos) {
 	srv.codeActions = nil
 	cap := &CodeActionParams{
@@ -539,33 +580,112 @@ func commonPrefix2(a, b string) string {
 	return a[:l]
 }
 
+// Changed notifies the server of changes to the buffer of a since the last
+// time it was called. Changes are sent as ranges if the server supports
+// incremental synchronization, otherwise the full text is sent.
 func (srv *LspSrv) Changed(a LspBufferPos) {
-	if srv.revision[a.Path] == a.b.RevCount {
+	rev, opened := srv.revision[a.Path]
+	if opened && rev == a.b.RevCount {
 		return
 	}
-	if _, ok := srv.revision[a.Path]; !ok {
+	uri := "file://" + a.Path
+	if !opened {
+		a.b.TrackChanges()
+		srv.revision[a.Path] = a.b.RevCount
 		srv.conn.Notify(context.Background(), "textDocument/didOpen", DidOpenTextDocumentParams{
-			TextDocument: TextDocumentItem{URI: "file://" + a.Path, Version: 0},
+			TextDocument: TextDocumentItem{
+				URI:        uri,
+				LanguageID: srv.lang,
+				Version:    float64(a.b.RevCount),
+				Text:       string(a.b.SelectionRunes(util.Sel{0, a.b.Size()})),
+			},
 		})
+		return
 	}
+
+	changes, ok := a.b.ChangesSince(rev)
 	srv.revision[a.Path] = a.b.RevCount
-	srv.conn.Notify(context.Background(), "textDocument/didChange", DidChangeTextDocumentParams{
-		TextDocument: VersionedTextDocumentIdentifier{
-			URI:     "file://" + a.Path,
-			Version: float64(a.b.RevCount),
-		},
-		ContentChanges: []TextDocumentContentChangeEvent{
+
+	var events []TextDocumentContentChangeEvent
+	switch srv.syncKind() {
+	case None:
+		return
+	case Incremental:
+		if ok {
+			events = make([]TextDocumentContentChangeEvent, len(changes))
+			for i, ch := range changes {
+				events[i].Range = &Range{Start: Position{ch.StartLn, ch.StartCol}, End: Position{ch.EndLn, ch.EndCol}}
+				events[i].Text = ch.Text
+			}
+		}
+	}
+	if events == nil {
+		events = []TextDocumentContentChangeEvent{
 			TextDocumentContentChangeEvent{
 				Text: string(a.b.SelectionRunes(util.Sel{0, a.b.Size()})),
 			},
+		}
+	}
+
+	srv.conn.Notify(context.Background(), "textDocument/didChange", DidChangeTextDocumentParams{
+		TextDocument: VersionedTextDocumentIdentifier{
+			URI:     uri,
+			Version: float64(a.b.RevCount),
 		},
+		ContentChanges: events,
 	})
 }
 
+// syncKind returns how the server wants to be notified of changes to open
+// documents.
+func (srv *LspSrv) syncKind() TextDocumentSyncKind {
+	switch sync := srv.Capabilities.TextDocumentSync.(type) {
+	case float64:
+		return TextDocumentSyncKind(sync)
+	case map[string]interface{}:
+		if change, ok := sync["change"].(float64); ok {
+			return TextDocumentSyncKind(change)
+		}
+		return None
+	}
+	return Full
+}
+
+// DidClose notifies all servers that opened b that it was closed.
+func DidClose(b *buf.Buffer) {
+	path := b.Path()
+	lspMu.Lock()
+	srvs := []*LspSrv{}
+	for _, srv := range lspConns {
+		if srv != nil {
+			srvs = append(srvs, srv)
+		}
+	}
+	lspMu.Unlock()
+
+	for _, srv := range srvs {
+		if _, ok := srv.revision[path]; !ok {
+			continue
+		}
+		delete(srv.revision, path)
+		srv.semanticMu.Lock()
+		delete(srv.semantic, path)
+		srv.semanticMu.Unlock()
+		srv.conn.Notify(context.Background(), "textDocument/didClose", DidCloseTextDocumentParams{
+			TextDocument: TextDocumentIdentifier{URI: "file://" + path},
+		})
+	}
+	b.UntrackChanges()
+}
+
 type lspHandler struct {
 	srv *LspSrv
 }
 
+var defaultConfiguration = map[string]interface{}{
+	"enhancedHover": true,
+}
+
 var logMessageType = map[MessageType]string{
 	1: "ERROR ",
 	2: "WARN ",
@@ -586,10 +706,13 @@ func (h *lspHandler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonr
 		var params ConfigurationParams
 		must(json.Unmarshal(*req.Params, &params))
 
-		v := []map[string]interface{}{
-			map[string]interface{}{
-				"enhancedHover": true,
-			},
+		var cfg interface{} = defaultConfiguration
+		if h.srv.options != nil {
+			cfg = h.srv.options
+		}
+		v := make([]interface{}, len(params.Items))
+		for i := range v {
+			v[i] = cfg
 		}
 
 		var respJson json.RawMessage
@@ -611,7 +734,13 @@ func (h *lspHandler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonr
 		}
 
 	case "textDocument/publishDiagnostics":
-		// not interesting
+		var params PublishDiagnosticsParams
+		must(json.Unmarshal(*req.Params, &params))
+		path := params.URI
+		if strings.HasPrefix(path, sillyURI) {
+			path = path[len(sillyURI):]
+		}
+		setDiagnostics(h.srv, path, params.Diagnostics)
 
 	case "workspace/applyEdit":
 		if h.srv.applyEdits == nil {
@@ -663,16 +792,21 @@ func (h *lspHandler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonr
 
 type LspSrv struct {
 	conn         *jsonrpc2.Conn
+	lang         string
+	options      interface{}
 	warn         func(string)
 	Capabilities ServerCapabilities
 	revision     map[string]int
 	codeActions  []CodeAction
 	applyEdits   func([]TextDocumentEdit)
 	look         func(string)
+
+	semanticMu sync.Mutex
+	semantic   map[string]*semanticTokensState // last semantic tokens received for each path
 }
 
 func BufferToLsp(wd string, b *buf.Buffer, sel util.Sel, createLsp bool, warn func(string), look func(string)) (*LspSrv, LspBufferPos) {
-	srv := LspFor(filepath.Ext(b.Name), wd, createLsp, warn, look)
+	srv := LspFor(b.Path(), wd, createLsp, warn, look)
 	if srv == nil {
 		return nil, LspBufferPos{}
 	}
@@ -686,20 +820,31 @@ func BufferToLsp(wd string, b *buf.Buffer, sel util.Sel, createLsp bool, warn fu
 		Col:    col,
 		b:      b,
 		line:   utf16.Encode([]rune(linestr)),
-		EndLn:  endln,
+		EndLn:  endln - 1,
 		EndCol: endcol,
 	}
 }
 
 var log strings.Builder
+var logMu sync.Mutex
 
 func lspLog(s string) {
 	if logToStdout {
 		os.Stderr.WriteString(s)
 	}
+	logMu.Lock()
 	log.WriteString(s)
+	logMu.Unlock()
+}
+
+func resetLog() {
+	logMu.Lock()
+	log.Reset()
+	logMu.Unlock()
 }
 
 func GetLog() string {
+	logMu.Lock()
+	defer logMu.Unlock()
 	return log.String()
 }
@@ -0,0 +1,506 @@
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aarzilli/yacco/buf"
+	"github.com/aarzilli/yacco/config"
+	"github.com/aarzilli/yacco/hl"
+	"github.com/aarzilli/yacco/util"
+
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// When stubServerEnv is set the test binary acts as a language server
+// talking on stdin/stdout, see stubServer.
+const stubServerEnv = "YACCO_LSP_STUB"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(stubServerEnv) != "" {
+		stubServer()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+type stubHandler struct {
+}
+
+func (h *stubHandler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	switch req.Method {
+	case "initialize":
+		var params InitializeParams
+		must(json.Unmarshal(*req.Params, &params))
+		conn.Notify(ctx, "window/logMessage", &ShowMessageParams{Type: 3, Message: "initializationOptions " + tojson(params.InitializationOptions) + " pid " + tojson(os.Getpid())})
+		var out InitializeResult
+		out.Capabilities.DefinitionProvider = true
+		out.Capabilities.CompletionProvider = &CompletionOptions{ResolveProvider: true}
+		out.Capabilities.SignatureHelpProvider = &SignatureHelpOptions{}
+		out.Capabilities.DocumentFormattingProvider = true
+		out.Capabilities.SemanticTokensProvider = &SemanticTokensOptions{
+			Legend: SemanticTokensLegend{TokenTypes: []string{"function", "variable"}},
+			Full:   map[string]bool{"delta": true},
+		}
+		if opts, ok := params.InitializationOptions.(map[string]interface{}); ok {
+			out.Capabilities.TextDocumentSync = opts["sync"]
+		}
+		conn.Reply(ctx, req.ID, &out)
+	case "textDocument/didOpen":
+		var params DidOpenTextDocumentParams
+		must(json.Unmarshal(*req.Params, &params))
+		conn.Notify(ctx, "textDocument/publishDiagnostics", &PublishDiagnosticsParams{
+			URI: params.TextDocument.URI,
+			Diagnostics: []Diagnostic{
+				{Range: Range{Start: Position{2, 0}, End: Position{2, 1}}, Severity: SeverityError, Message: "second"},
+				{Range: Range{Start: Position{1, 2}, End: Position{1, 4}}, Severity: SeverityWarning, Source: "stub", Message: "something\n\twrong"},
+			},
+		})
+	case "textDocument/didChange":
+		var params DidChangeTextDocumentParams
+		must(json.Unmarshal(*req.Params, &params))
+		conn.Notify(ctx, "window/logMessage", &ShowMessageParams{Type: 3, Message: fmt.Sprintf("didChange %g %s", params.TextDocument.Version, tojson(params.ContentChanges))})
+	case "textDocument/didClose":
+		var params DidCloseTextDocumentParams
+		must(json.Unmarshal(*req.Params, &params))
+		conn.Notify(ctx, "window/logMessage", &ShowMessageParams{Type: 3, Message: "didClose " + params.TextDocument.URI})
+	case "textDocument/definition":
+		conn.Reply(ctx, req.ID, []LocationLink{
+			{TargetURI: "file:///def.a", TargetSelectionRange: Range{Start: Position{4, 1}}},
+			{TargetURI: "file:///def.a", TargetSelectionRange: Range{Start: Position{4, 1}}},
+			{TargetURI: "file:///other.a", TargetSelectionRange: Range{Start: Position{0, 0}}},
+		})
+	case "textDocument/implementation":
+		conn.Reply(ctx, req.ID, Location{URI: "file:///impl.a", Range: Range{Start: Position{9, 2}}})
+	case "textDocument/typeDefinition":
+		conn.Reply(ctx, req.ID, nil)
+	case "textDocument/prepareCallHierarchy":
+		conn.Reply(ctx, req.ID, []CallHierarchyItem{{Name: "f", URI: "file:///def.a"}})
+	case "callHierarchy/incomingCalls":
+		conn.Reply(ctx, req.ID, []CallHierarchyIncomingCall{
+			{From: CallHierarchyItem{Name: "g", URI: "file:///g.a", SelectionRange: Range{Start: Position{1, 0}}}, FromRanges: []Range{{Start: Position{3, 4}}}},
+		})
+	case "textDocument/completion":
+		conn.Reply(ctx, req.ID, CompletionList{Items: []CompletionItem{
+			{
+				Label:               "Println",
+				Kind:                FunctionCompletion,
+				TextEdit:            &TextEdit{Range: Range{Start: Position{0, 4}, End: Position{0, 6}}, NewText: "Println(${1:a ...any})$0"},
+				InsertTextFormat:    SnippetTextFormat,
+				Documentation:       MarkupContent{Kind: "plaintext", Value: "Println prints"},
+				AdditionalTextEdits: []TextEdit{{NewText: "import \"fmt\"\n"}},
+			},
+			{Label: "Printf", InsertText: "Printf"},
+			{Label: "Sprint", TextEdit: &TextEdit{Range: Range{Start: Position{0, 4}, End: Position{0, 6}}, NewText: "Sprint"}},
+		}})
+	case "completionItem/resolve":
+		var item CompletionItem
+		must(json.Unmarshal(*req.Params, &item))
+		item.Detail = "resolved " + item.Label
+		conn.Reply(ctx, req.ID, item)
+	case "textDocument/signatureHelp":
+		conn.Reply(ctx, req.ID, SignatureHelp{Signatures: []SignatureInformation{{
+			Label:         "Println(a ...any) (n int, err error)",
+			Documentation: "Println prints",
+			Parameters:    []ParameterInformation{{Label: []int{8, 16}}},
+		}}})
+	case "textDocument/formatting":
+		var params DocumentFormattingParams
+		must(json.Unmarshal(*req.Params, &params))
+		conn.Reply(ctx, req.ID, []TextEdit{{Range: Range{Start: Position{0, 0}, End: Position{0, 0}}, NewText: fmt.Sprintf("%g %v", params.Options.TabSize, params.Options.InsertSpaces)}})
+	case "textDocument/semanticTokens/full":
+		conn.Reply(ctx, req.ID, SemanticTokensResult{ResultID: "1", Data: []uint32{0, 0, 3, 0, 0, 1, 2, 1, 1, 0}})
+	case "textDocument/semanticTokens/full/delta":
+		var params SemanticTokensDeltaParams
+		must(json.Unmarshal(*req.Params, &params))
+		if params.PreviousResultID != "1" {
+			conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{Code: jsonrpc2.CodeInvalidParams, Message: "wrong result id " + params.PreviousResultID})
+			return
+		}
+		conn.Reply(ctx, req.ID, SemanticTokensResult{ResultID: "2", Edits: []SemanticTokensEdit{{Start: 5, DeleteCount: 5, Data: []uint32{0, 4, 2, 1, 0, 2, 0, 1, 5, 0}}}})
+	case "shutdown":
+		conn.Reply(ctx, req.ID, nil)
+	case "exit":
+		conn.Close()
+	default:
+		if !req.Notif {
+			conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{Code: jsonrpc2.CodeMethodNotFound, Message: req.Method})
+		}
+	}
+}
+
+func stubServer() {
+	stream := jsonrpc2.NewBufferedStream(&readerWriter{os.Stdin, os.Stdout}, &jsonrpc2.VSCodeObjectCodec{})
+	conn := jsonrpc2.NewConn(context.Background(), stream, &stubHandler{})
+	<-conn.DisconnectNotify()
+}
+
+func setupStubRules(t *testing.T) {
+	os.Setenv(stubServerEnv, "1")
+	oldRules := config.LspRules
+	config.LspRules = []util.LspRule{
+		{Lang: "alpha", NameRe: `\.a$`, Cmd: os.Args[0], Options: `{"name":"alpha","sync":2}`},
+		{Lang: "beta", NameRe: `\.(b|bb)$`, Cmd: os.Args[0]},
+	}
+	t.Cleanup(func() {
+		Killall()
+		// wait for all servers to exit
+		for {
+			lspMu.Lock()
+			n := len(lspConns)
+			lspMu.Unlock()
+			if n == 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		config.LspRules = oldRules
+		os.Unsetenv(stubServerEnv)
+	})
+}
+
+func waitLog(t *testing.T, s string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if strings.Contains(GetLog(), s) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %q in log:\n%s", s, GetLog())
+}
+
+func TestLspForRules(t *testing.T) {
+	setupStubRules(t)
+	warn := func(s string) { t.Log(s) }
+	wd, _ := os.Getwd()
+
+	if srv := LspFor("/some/file.c", wd, true, warn, nil); srv != nil {
+		t.Fatalf("server started for file without a rule")
+	}
+	if srv := LspFor("/some/file.a", wd, false, warn, nil); srv != nil {
+		t.Fatalf("server returned with create == false")
+	}
+
+	a := LspFor("/some/file.a", wd, true, warn, nil)
+	if a == nil {
+		t.Fatalf("could not start server for alpha")
+	}
+	if !a.Capabilities.DefinitionProvider {
+		t.Errorf("capabilities not read from the initialize response")
+	}
+	waitLog(t, `initializationOptions {"name":"alpha","sync":2}`)
+
+	b := LspFor("/some/file.bb", wd, true, warn, nil)
+	if b == nil {
+		t.Fatalf("could not start server for beta")
+	}
+	if a == b {
+		t.Fatalf("same server returned for two different languages")
+	}
+	waitLog(t, `initializationOptions null`)
+
+	if a2 := LspFor("/other/dir/file2.a", wd, false, warn, nil); a2 != a {
+		t.Errorf("second file of the same language didn't reuse the server")
+	}
+
+	wd2 := os.TempDir()
+	a3 := LspFor("/some/file.a", wd2, true, warn, nil)
+	if a3 == nil || a3 == a {
+		t.Errorf("different workspace root should start a new server (got %p, first %p)", a3, a)
+	}
+	if a.lang != "alpha" || b.lang != "beta" {
+		t.Errorf("wrong languages %q %q", a.lang, b.lang)
+	}
+
+	Restart(wd)
+	if srv := LspFor("/some/file.b", wd, false, warn, nil); srv != nil {
+		t.Errorf("server still returned after restart")
+	}
+	if srv := LspFor("/some/file.a", wd2, false, warn, nil); srv != a3 {
+		t.Errorf("restart killed a server for a different workspace root")
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	setupStubRules(t)
+	changed := make(chan string, 10)
+	DiagnosticsChanged = func(path string) { changed <- path }
+	defer func() { DiagnosticsChanged = nil }()
+	warn := func(s string) { t.Log(s) }
+	wd, _ := os.Getwd()
+
+	waitChanged := func(tgt string) {
+		select {
+		case path := <-changed:
+			if path != tgt {
+				t.Fatalf("diagnostics changed for %q, expected %q", path, tgt)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for diagnostics")
+		}
+	}
+
+	b, err := buf.NewBuffer(wd, "+test.a", true, "\t", hl.NilHighlighter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Replace([]rune("first line\nsecond line\nthird line\n"), &util.Sel{0, 0}, true, nil, 0)
+	srv, pos := BufferToLsp(wd, b, util.Sel{0, 0}, true, warn, nil)
+	if srv == nil {
+		t.Fatalf("could not start server")
+	}
+	srv.Changed(pos)
+	waitChanged(b.Path())
+
+	diags := Diagnostics(b.Path())
+	if len(diags) != 2 {
+		t.Fatalf("wrong number of diagnostics %d", len(diags))
+	}
+	if diags[0].Message != "something\n\twrong" || diags[1].Message != "second" {
+		t.Errorf("diagnostics not sorted by position: %#v", diags)
+	}
+
+	tgt := fmt.Sprintf("%s:2:3: warning: stub: something wrong\n%s:3:1: error: second\n", b.Path(), b.Path())
+	if out := FormatDiagnostics(); out != tgt {
+		t.Errorf("wrong output:\n%s\nexpected:\n%s", out, tgt)
+	}
+
+	Restart(wd)
+	waitChanged(b.Path())
+	if diags := Diagnostics(b.Path()); len(diags) != 0 {
+		t.Errorf("diagnostics not removed when the server exited")
+	}
+}
+
+func TestIncrementalSync(t *testing.T) {
+	setupStubRules(t)
+	warn := func(s string) { t.Log(s) }
+	wd, _ := os.Getwd()
+
+	for _, name := range []string{"+sync.a", "+sync.b"} {
+		b, err := buf.NewBuffer(wd, name, true, "\t", hl.NilHighlighter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Replace([]rune("first line\nsecond line\nthird line\n"), &util.Sel{0, 0}, true, nil, 0)
+		srv, pos := BufferToLsp(wd, b, util.Sel{0, 0}, true, warn, nil)
+		if srv == nil {
+			t.Fatalf("could not start server")
+		}
+		srv.Changed(pos)
+
+		b.Replace([]rune("2nd \U0001F600"), &util.Sel{11, 17}, true, nil, 0)
+		b.Replace([]rune("x"), &util.Sel{16, 16}, true, nil, 0)
+		b.Replace([]rune(""), &util.Sel{0, 6}, true, nil, 0)
+		srv.Changed(pos)
+
+		switch srv.syncKind() {
+		case Incremental:
+			waitLog(t, `didChange 4 [{"range":{"start":{"line":1,"character":0},"end":{"line":1,"character":6}},"text":"2nd 😀"},{"range":{"start":{"line":1,"character":6},"end":{"line":1,"character":6}},"text":"x"},{"range":{"start":{"line":0,"character":0},"end":{"line":0,"character":6}},"text":""}]`)
+		case Full:
+			waitLog(t, `didChange 4 [{"text":"line\n2nd 😀x line\nthird line\n"}]`)
+		default:
+			t.Fatalf("unexpected sync kind %v for %s", srv.syncKind(), name)
+		}
+
+		DidClose(b)
+		waitLog(t, "didClose file://"+b.Path())
+		if _, ok := b.ChangesSince(4); ok {
+			t.Errorf("changes still tracked after didClose")
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	setupStubRules(t)
+	warn := func(s string) { t.Log(s) }
+	wd, _ := os.Getwd()
+
+	b, err := buf.NewBuffer(wd, "+lookup.a", true, "\t", hl.NilHighlighter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, pos := BufferToLsp(wd, b, util.Sel{0, 0}, true, warn, nil)
+	if srv == nil {
+		t.Fatalf("could not start server")
+	}
+
+	for _, tc := range []struct {
+		kind string
+		tgt  []string
+	}{
+		{"def", []string{"/def.a:5:2", "/other.a:1:1"}},
+		{"impl", []string{"/impl.a:10:3"}},
+		{"typedef", []string{}},
+		{"callers", []string{"/g.a:4:5: g"}},
+	} {
+		locs, err := srv.Lookup(pos, tc.kind)
+		if err != nil {
+			t.Errorf("%s: %v", tc.kind, err)
+			continue
+		}
+		if fmt.Sprint(locs) != fmt.Sprint(tc.tgt) {
+			t.Errorf("%s: got %q expected %q", tc.kind, locs, tc.tgt)
+		}
+	}
+
+	if _, err := srv.Lookup(pos, "callees"); err == nil {
+		t.Errorf("error from the server not returned")
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	setupStubRules(t)
+	warn := func(s string) { t.Log(s) }
+	wd, _ := os.Getwd()
+
+	b, err := buf.NewBuffer(wd, "+compl.a", true, "\t", hl.NilHighlighter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Replace([]rune("fmt.Pr"), &util.Sel{0, 0}, true, nil, 0)
+	srv, pos := BufferToLsp(wd, b, util.Sel{6, 6}, true, warn, nil)
+	if srv == nil {
+		t.Fatalf("could not start server")
+	}
+
+	compls, prefix := srv.Complete(pos)
+	if len(compls) != 2 {
+		t.Fatalf("wrong number of completions %d", len(compls))
+	}
+	if prefix != "int" {
+		t.Errorf("wrong common prefix %q", prefix)
+	}
+
+	c := compls[0]
+	if c.Edit.NewText != "Println(a ...any)" {
+		t.Errorf("snippet not expanded: %q", c.Edit.NewText)
+	}
+	if c.Doc != "Println prints" || len(c.AdditionalEdits) != 1 {
+		t.Errorf("documentation or additional edits missing: %#v", c)
+	}
+	if c.Description() != "func Println\n\nPrintln prints" {
+		t.Errorf("wrong description %q", c.Description())
+	}
+
+	c = compls[1]
+	if c.Edit.Range.Start != (Position{0, 4}) || c.Edit.Range.End != (Position{0, 6}) || c.Edit.NewText != "Printf" {
+		t.Errorf("wrong edit for completion without textEdit: %#v", c.Edit)
+	}
+	srv.Resolve(&c)
+	if c.Detail != "resolved Printf" {
+		t.Errorf("completion not resolved: %#v", c)
+	}
+
+	if s := srv.SignatureHelp(pos); s != "Println(a ...any) (n int, err error)\n\ta ...any\n\nPrintln prints" {
+		t.Errorf("wrong signature help %q", s)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	setupStubRules(t)
+	warn := func(s string) { t.Log(s) }
+	wd, _ := os.Getwd()
+
+	b, err := buf.NewBuffer(wd, "+format.a", true, "\t", hl.NilHighlighter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, pos := BufferToLsp(wd, b, util.Sel{0, 0}, true, warn, nil)
+	if srv == nil {
+		t.Fatalf("could not start server")
+	}
+
+	tdes, err := srv.Format(pos, FormattingOptions{TabSize: 4, InsertSpaces: true}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tdes) != 1 || tdes[0].TextDocument.URI != "file://"+b.Path() || len(tdes[0].Edits) != 1 || tdes[0].Edits[0].NewText != "4 true" {
+		t.Errorf("wrong edits %#v", tdes)
+	}
+
+	if _, err := srv.Format(pos, FormattingOptions{TabSize: 8}, true); err == nil {
+		t.Errorf("range formatting should not be supported")
+	}
+}
+
+func TestParseSymbols(t *testing.T) {
+	hier := tojson([]DocumentSymbol{
+		{Name: "T", Kind: 23, SelectionRange: Range{Start: Position{5, 5}}, Children: []DocumentSymbol{
+			{Name: "b", Kind: 8, SelectionRange: Range{Start: Position{7, 1}}},
+			{Name: "a", Kind: 8, SelectionRange: Range{Start: Position{6, 1}}},
+		}},
+		{Name: "main", Kind: 12, Detail: "func()", SelectionRange: Range{Start: Position{1, 5}}},
+	})
+	info := tojson([]SymbolInformation{
+		{Name: "a", Kind: 8, ContainerName: "T", Location: Location{Range: Range{Start: Position{6, 1}}}},
+		{Name: "T", Kind: 23, Location: Location{Range: Range{Start: Position{5, 5}}}},
+	})
+
+	for _, tc := range []struct {
+		raw string
+		tgt string
+	}{
+		{hier, "0 Function main func() 1:5\n0 Struct T  5:5\n1 Field a  6:1\n1 Field b  7:1\n"},
+		{info, "0 Struct T  5:5\n1 Field a  6:1\n"},
+		{"null", ""},
+	} {
+		var out strings.Builder
+		for _, sym := range parseSymbols(json.RawMessage(tc.raw)) {
+			fmt.Fprintf(&out, "%d %s %s %s %d:%d\n", sym.Depth, sym.Kind, sym.Name, sym.Detail, sym.Range.Start.Line, sym.Range.Start.Character)
+		}
+		if out.String() != tc.tgt {
+			t.Errorf("wrong symbols for %s:\n%s\nexpected:\n%s", tc.raw, out.String(), tc.tgt)
+		}
+	}
+}
+
+func TestSemanticTokens(t *testing.T) {
+	setupStubRules(t)
+	warn := func(s string) { t.Log(s) }
+	wd, _ := os.Getwd()
+
+	b, err := buf.NewBuffer(wd, "+semantic.a", true, "\t", hl.NilHighlighter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, pos := BufferToLsp(wd, b, util.Sel{0, 0}, true, warn, nil)
+	if srv == nil {
+		t.Fatalf("could not start server")
+	}
+	if !srv.SemanticTokensSupported() {
+		t.Fatalf("semantic tokens not supported")
+	}
+
+	toString := func(toks []SemanticToken) string {
+		var out strings.Builder
+		for _, tok := range toks {
+			fmt.Fprintf(&out, "%d:%d-%d:%d %s\n", tok.Range.Start.Line, tok.Range.Start.Character, tok.Range.End.Line, tok.Range.End.Character, tok.Type)
+		}
+		return out.String()
+	}
+
+	srv.Changed(pos)
+	toks, err := srv.SemanticTokens(pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := toString(toks); s != "0:0-0:3 function\n1:2-1:3 variable\n" {
+		t.Errorf("wrong tokens (full):\n%s", s)
+	}
+
+	// second request is a delta, the token with an unknown type is skipped
+	toks, err = srv.SemanticTokens(pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := toString(toks); s != "0:0-0:3 function\n0:4-0:6 variable\n" {
+		t.Errorf("wrong tokens (delta):\n%s", s)
+	}
+}
@@ -0,0 +1,86 @@
+package lsp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Symbol is an entry of the outline of a document.
+type Symbol struct {
+	Name   string
+	Kind   string
+	Detail string
+	Depth  int   // nesting level, 0 for top level symbols
+	Range  Range // range of the name of the symbol
+}
+
+// DocumentSymbols returns the outline of the document of a, in the order
+// symbols appear in the document, children immediately follow their parent.
+func (srv *LspSrv) DocumentSymbols(a LspBufferPos) ([]Symbol, error) {
+	if !srv.Capabilities.DocumentSymbolProvider {
+		return nil, fmt.Errorf("language server does not support document symbols")
+	}
+	srv.Changed(a)
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
+	defer cancel()
+
+	var raw json.RawMessage
+	err := srv.conn.Call(ctx, "textDocument/documentSymbol", &DocumentSymbolParams{TextDocument: TextDocumentIdentifier{URI: "file://" + a.Path}}, &raw)
+	if err != nil {
+		return nil, err
+	}
+	return parseSymbols(raw), nil
+}
+
+// parseSymbols parses the result of a textDocument/documentSymbol request,
+// which could be either []DocumentSymbol or []SymbolInformation.
+func parseSymbols(raw json.RawMessage) []Symbol {
+	var probe []map[string]json.RawMessage
+	if json.Unmarshal(bytes.TrimSpace(raw), &probe) != nil || len(probe) == 0 {
+		return nil
+	}
+
+	r := []Symbol{}
+	if _, isInfo := probe[0]["location"]; isInfo {
+		var infos []SymbolInformation
+		json.Unmarshal(raw, &infos)
+		sort.SliceStable(infos, func(i, j int) bool {
+			return positionLess(infos[i].Location.Range.Start, infos[j].Location.Range.Start)
+		})
+		for _, info := range infos {
+			depth := 0
+			if info.ContainerName != "" {
+				depth = 1
+			}
+			r = append(r, Symbol{Name: info.Name, Kind: kindToString[info.Kind], Depth: depth, Range: info.Location.Range})
+		}
+		return r
+	}
+
+	var syms []DocumentSymbol
+	json.Unmarshal(raw, &syms)
+	var flatten func(syms []DocumentSymbol, depth int)
+	flatten = func(syms []DocumentSymbol, depth int) {
+		sort.SliceStable(syms, func(i, j int) bool {
+			return positionLess(syms[i].SelectionRange.Start, syms[j].SelectionRange.Start)
+		})
+		for _, sym := range syms {
+			r = append(r, Symbol{Name: sym.Name, Kind: kindToString[sym.Kind], Detail: sym.Detail, Depth: depth, Range: sym.SelectionRange})
+			flatten(sym.Children, depth+1)
+		}
+	}
+	flatten(syms, 0)
+	return r
+}
+
+func positionLess(a, b Position) bool {
+	if a.Line == b.Line {
+		return a.Character < b.Character
+	}
+	return a.Line < b.Line
+}
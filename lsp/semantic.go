@@ -0,0 +1,205 @@
+package lsp
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Semantic tokens types, introduced in version 3.16 of the protocol and
+// missing from tsprotocol.go.
+
+type SemanticTokensClientCapabilities struct {
+	Requests struct {
+		Range interface{} `json:"range,omitempty"`
+		Full  interface{} `json:"full,omitempty"`
+	} `json:"requests"`
+	TokenTypes     []string `json:"tokenTypes"`
+	TokenModifiers []string `json:"tokenModifiers"`
+	Formats        []string `json:"formats"`
+}
+
+type SemanticTokensLegend struct {
+	TokenTypes     []string `json:"tokenTypes"`
+	TokenModifiers []string `json:"tokenModifiers"`
+}
+
+type SemanticTokensOptions struct {
+	Legend SemanticTokensLegend `json:"legend"`
+	Range  interface{}          `json:"range,omitempty"`
+	Full   interface{}          `json:"full,omitempty"` // bool or {"delta": bool}
+}
+
+type SemanticTokensServerCapabilities struct {
+	SemanticTokensProvider *SemanticTokensOptions `json:"semanticTokensProvider,omitempty"`
+}
+
+type SemanticTokensParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+}
+
+type SemanticTokensDeltaParams struct {
+	TextDocument     TextDocumentIdentifier `json:"textDocument"`
+	PreviousResultID string                 `json:"previousResultId"`
+}
+
+type SemanticTokensEdit struct {
+	Start       int      `json:"start"`
+	DeleteCount int      `json:"deleteCount"`
+	Data        []uint32 `json:"data,omitempty"`
+}
+
+// SemanticTokensResult is the result of both textDocument/semanticTokens/full
+// and textDocument/semanticTokens/full/delta, the latter can return either
+// a list of edits or the full data.
+type SemanticTokensResult struct {
+	ResultID string               `json:"resultId,omitempty"`
+	Data     []uint32             `json:"data"`
+	Edits    []SemanticTokensEdit `json:"edits"`
+}
+
+var semanticTokenTypes = []string{
+	"namespace", "type", "class", "enum", "interface", "struct", "typeParameter", "parameter", "variable", "property", "enumMember", "event", "function", "method", "macro", "keyword", "modifier", "comment", "string", "number", "regexp", "operator",
+}
+
+func semanticTokensClientCapabilities() *SemanticTokensClientCapabilities {
+	r := &SemanticTokensClientCapabilities{
+		TokenTypes:     semanticTokenTypes,
+		TokenModifiers: []string{},
+		Formats:        []string{"relative"},
+	}
+	r.Requests.Full = map[string]bool{"delta": true}
+	return r
+}
+
+// SemanticToken is a range of the document classified by the language
+// server.
+type SemanticToken struct {
+	Range Range
+	Type  string
+}
+
+// semanticTokensState is the last result received for a document, used to
+// request deltas.
+type semanticTokensState struct {
+	resultID string
+	data     []uint32
+}
+
+// SemanticTokensSupported returns true if the server can return the
+// semantic tokens of a document.
+func (srv *LspSrv) SemanticTokensSupported() bool {
+	p := srv.Capabilities.SemanticTokensProvider
+	if p == nil {
+		return false
+	}
+	switch full := p.Full.(type) {
+	case bool:
+		return full
+	case map[string]interface{}:
+		return true
+	}
+	return false
+}
+
+func (srv *LspSrv) semanticTokensDelta() bool {
+	full, _ := srv.Capabilities.SemanticTokensProvider.Full.(map[string]interface{})
+	delta, _ := full["delta"].(bool)
+	return delta
+}
+
+// SemanticTokens returns the semantic tokens of the document of a, sorted
+// by position. Unlike other requests it does not send the changes to the
+// document, Changed must be called first.
+func (srv *LspSrv) SemanticTokens(a LspBufferPos) ([]SemanticToken, error) {
+	if !srv.SemanticTokensSupported() {
+		return nil, fmt.Errorf("language server does not support semantic tokens")
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
+	defer cancel()
+
+	doc := TextDocumentIdentifier{URI: "file://" + a.Path}
+
+	srv.semanticMu.Lock()
+	prev := srv.semantic[a.Path]
+	srv.semanticMu.Unlock()
+
+	var data []uint32
+	var resultID string
+	if prev != nil && prev.resultID != "" && srv.semanticTokensDelta() {
+		var res SemanticTokensResult
+		err := srv.conn.Call(ctx, "textDocument/semanticTokens/full/delta", &SemanticTokensDeltaParams{TextDocument: doc, PreviousResultID: prev.resultID}, &res)
+		if err == nil {
+			var ok bool
+			data, ok = applySemanticTokensEdits(prev.data, &res)
+			if ok {
+				resultID = res.ResultID
+			} else {
+				data = nil
+			}
+		}
+	}
+
+	if data == nil {
+		var res SemanticTokensResult
+		if err := srv.conn.Call(ctx, "textDocument/semanticTokens/full", &SemanticTokensParams{TextDocument: doc}, &res); err != nil {
+			return nil, err
+		}
+		data, resultID = res.Data, res.ResultID
+	}
+
+	srv.semanticMu.Lock()
+	srv.semantic[a.Path] = &semanticTokensState{resultID: resultID, data: data}
+	srv.semanticMu.Unlock()
+
+	return decodeSemanticTokens(data, srv.Capabilities.SemanticTokensProvider.Legend.TokenTypes), nil
+}
+
+// applySemanticTokensEdits applies the result of a delta request to the
+// data of the previous result.
+func applySemanticTokensEdits(data []uint32, res *SemanticTokensResult) ([]uint32, bool) {
+	if res.Edits == nil {
+		return res.Data, res.Data != nil
+	}
+	edits := append([]SemanticTokensEdit(nil), res.Edits...)
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].Start < edits[j].Start })
+
+	r := make([]uint32, 0, len(data))
+	cur := 0
+	for _, e := range edits {
+		if e.Start < cur || e.DeleteCount < 0 || e.Start+e.DeleteCount > len(data) {
+			return nil, false
+		}
+		r = append(r, data[cur:e.Start]...)
+		r = append(r, e.Data...)
+		cur = e.Start + e.DeleteCount
+	}
+	r = append(r, data[cur:]...)
+	return r, true
+}
+
+// decodeSemanticTokens converts the relative encoding of semantic tokens
+// to a list of ranges.
+func decodeSemanticTokens(data []uint32, types []string) []SemanticToken {
+	r := make([]SemanticToken, 0, len(data)/5)
+	line, char := 0, 0
+	for i := 0; i+5 <= len(data); i += 5 {
+		if data[i] != 0 {
+			line += int(data[i])
+			char = int(data[i+1])
+		} else {
+			char += int(data[i+1])
+		}
+		typ := int(data[i+3])
+		if typ >= len(types) {
+			continue
+		}
+		r = append(r, SemanticToken{
+			Range: Range{Start: Position{line, char}, End: Position{line, char + int(data[i+2])}},
+			Type:  types[typ],
+		})
+	}
+	return r
+}
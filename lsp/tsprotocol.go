@@ -970,6 +970,11 @@ type TextDocumentClientCapabilities struct {
 		 */
 		TagSupport bool `json:"tagSupport,omitempty"`
 	} `json:"publishDiagnostics,omitempty"`
+
+	/** SemanticTokens defined:
+	 * Capabilities specific to the various semantic token requests.
+	 */
+	SemanticTokens *SemanticTokensClientCapabilities `json:"semanticTokens,omitempty"`
 }
 
 // ClientCapabilities is:
@@ -1319,6 +1324,7 @@ type ServerCapabilities struct {
 	FoldingRangeServerCapabilities
 	DeclarationServerCapabilities
 	SelectionRangeServerCapabilities
+	SemanticTokensServerCapabilities
 }
 
 // InnerInitializeParams is:
@@ -2547,7 +2553,7 @@ type CompletionItem struct {
 	/** Documentation defined:
 	 * A human-readable string that represents a doc-comment.
 	 */
-	Documentation string `json:"documentation,omitempty"` // string | MarkupContent
+	Documentation interface{} `json:"documentation,omitempty"` // string | MarkupContent
 
 	/** Deprecated defined:
 	 * Indicates if this item is deprecated.
@@ -2694,13 +2700,13 @@ type ParameterInformation struct {
 	 * *Note*: a label of type string should be a substring of its containing signature label.
 	 * Its intended use case is to highlight the parameter label part in the `SignatureInformation.label`.
 	 */
-	Label string `json:"label"` // string | [number, number]
+	Label interface{} `json:"label"` // string | [number, number]
 
 	/** Documentation defined:
 	 * The human-readable doc-comment of this signature. Will be shown
 	 * in the UI but can be omitted.
 	 */
-	Documentation string `json:"documentation,omitempty"` // string | MarkupContent
+	Documentation interface{} `json:"documentation,omitempty"` // string | MarkupContent
 }
 
 // SignatureInformation is:
@@ -2721,7 +2727,7 @@ type SignatureInformation struct {
 	 * The human-readable doc-comment of this signature. Will be shown
 	 * in the UI but can be omitted.
 	 */
-	Documentation string `json:"documentation,omitempty"` // string | MarkupContent
+	Documentation interface{} `json:"documentation,omitempty"` // string | MarkupContent
 
 	/** Parameters defined:
 	 * The parameters of this signature.
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/aarzilli/yacco/buf"
+	"github.com/aarzilli/yacco/lsp"
+	"github.com/aarzilli/yacco/util"
+)
+
+const lspComplMax = 10
+
+// Completions requested to the language server, shown in the completion
+// popup while active. The list is filtered as the user types, up and down
+// arrows change the selected completion, tab or return accept it.
+var lspCompl struct {
+	active bool
+	gen    int // incremented every time a new list is received
+	srv    *lsp.LspSrv
+	ed     *Editor
+	pos    int // cursor position when the completions were requested
+	col    int // UTF-16 column of pos
+	all    []lsp.Completion
+	starts []int // buffer position where the edit of each completion starts
+	prefix string
+	shown  []int // indexes in all of the completions matching prefix
+	sel    int   // index in shown of the selected completion
+}
+
+// lspComplStart requests completions for the cursor position to the
+// language server, returns false if there is no language server for the
+// buffer.
+func lspComplStart(ec ExecContext) bool {
+	if ec.ed == nil || ec.buf != ec.ed.bodybuf || ec.fr.Sel.S != ec.fr.Sel.E {
+		return false
+	}
+	srv, lspb := lsp.BufferToLsp(Wnd.tagbuf.Dir, ec.buf, ec.fr.Sel, true, Warn, defaultLookForLsp)
+	if srv == nil {
+		return false
+	}
+	pos, rev := ec.fr.Sel.S, ec.buf.RevCount
+	go func() {
+		compls, _ := srv.Complete(lspb)
+		sideChan <- func() {
+			if ec.ed.closed || ec.fr.Sel.S != pos || ec.buf.RevCount != rev {
+				return
+			}
+			if len(compls) == 0 {
+				Compl.Start(ec, 0)
+				return
+			}
+			lspCompl.active = true
+			lspCompl.gen++
+			lspCompl.srv = srv
+			lspCompl.ed = ec.ed
+			lspCompl.pos = pos
+			lspCompl.col = lspb.Col
+			lspCompl.all = compls
+			lspCompl.starts = make([]int, len(compls))
+			cache := map[lsp.Position]int{}
+			for i := range compls {
+				start := compls[i].Edit.Range.Start
+				if _, ok := cache[start]; !ok {
+					cache[start] = ec.buf.UTF16Pos(start.Line, start.Character)
+				}
+				lspCompl.starts[i] = cache[start]
+			}
+			lspCompl.prefix = ""
+			lspCompl.shown = nil
+			lspCompl.sel = 0
+			Compl.Start(ec, 0)
+		}
+	}()
+	return true
+}
+
+// lspComplText filters the language server completions with the text typed
+// so far and returns the contents of the completion popup. Returns false
+// if the completions are no longer applicable.
+func lspComplText(p *Popup, ec ExecContext) (bool, string) {
+	if ec.ed != lspCompl.ed || ec.buf != ec.ed.bodybuf || ec.fr.Sel.S != ec.fr.Sel.E {
+		lspCompl.active = false
+		return false, ""
+	}
+	cur := ec.fr.Sel.S
+	moved := util.Sel{lspCompl.pos, cur}
+	if moved.S > moved.E {
+		moved.S, moved.E = moved.E, moved.S
+	}
+	if strings.Contains(string(ec.buf.SelectionRunes(moved)), "\n") {
+		lspCompl.active = false
+		return false, ""
+	}
+
+	shown := []int{}
+	for i := range lspCompl.all {
+		start := lspCompl.starts[i]
+		if start > cur {
+			continue
+		}
+		typed := strings.ToLower(string(ec.buf.SelectionRunes(util.Sel{start, cur})))
+		if strings.HasPrefix(strings.ToLower(lspCompl.all[i].Filter), typed) {
+			shown = append(shown, i)
+		}
+	}
+	if len(shown) == 0 {
+		lspCompl.active = false
+		return false, ""
+	}
+
+	prefix := string(ec.buf.SelectionRunes(util.Sel{lspCompl.pos, cur}))
+	if prefix != lspCompl.prefix || len(shown) != len(lspCompl.shown) {
+		lspCompl.sel = 0
+	}
+	lspCompl.prefix = prefix
+	lspCompl.shown = shown
+
+	first := (lspCompl.sel / lspComplMax) * lspComplMax
+	last := first + lspComplMax
+	if last > len(shown) {
+		last = len(shown)
+	}
+
+	var out strings.Builder
+	n := 0
+	for i := first; i < last; i++ {
+		label := lspCompl.all[shown[i]].Label
+		if nl := strings.Index(label, "\n"); nl >= 0 {
+			label = label[:nl] + "..."
+		}
+		if i == lspCompl.sel {
+			p.selected = util.Sel{n, n + len([]rune(label))}
+		}
+		out.WriteString(label)
+		n += len([]rune(label)) + 1
+		if i != last-1 {
+			out.WriteString("\n")
+		}
+	}
+	if last < len(shown) {
+		out.WriteString("\n...\n")
+	}
+	return true, out.String()
+}
+
+// complAfter shows the documentation of the selected language server
+// completion next to the completion popup.
+func complAfter(p *Popup, ec ExecContext) {
+	if !lspCompl.active {
+		return
+	}
+	idx := lspCompl.shown[lspCompl.sel]
+	c := lspCompl.all[idx]
+	tooltipContents = c.Description()
+	Tooltip.Start(ec, popupBeside)
+
+	srv, gen := lspCompl.srv, lspCompl.gen
+	go func() {
+		srv.Resolve(&c)
+		sideChan <- func() {
+			if !lspCompl.active || lspCompl.gen != gen {
+				return
+			}
+			lspCompl.all[idx] = c
+			if lspCompl.shown[lspCompl.sel] == idx && Compl.Visible && tooltipContents != c.Description() {
+				tooltipContents = c.Description()
+				Tooltip.Start(ec, popupBeside)
+			}
+		}
+	}()
+}
+
+// lspComplMove changes the selected completion.
+func lspComplMove(ec ExecContext, dir int) {
+	lspCompl.sel += dir
+	if lspCompl.sel < 0 {
+		lspCompl.sel = len(lspCompl.shown) - 1
+	}
+	if lspCompl.sel >= len(lspCompl.shown) {
+		lspCompl.sel = 0
+	}
+	Compl.Start(ec, 0)
+}
+
+// lspComplAccept applies the edits of the selected completion. If the
+// completion wasn't resolved yet (complAfter does it while it is selected)
+// it is applied as is and its additional edits are added when the language
+// server answers.
+func lspComplAccept(ec ExecContext) {
+	idx := lspCompl.shown[lspCompl.sel]
+	c := lspCompl.all[idx]
+	start := lspCompl.starts[idx]
+	typed := ec.fr.Sel.S - lspCompl.pos
+	col := lspCompl.col
+	srv := lspCompl.srv
+	HideCompl(true)
+
+	b := ec.buf
+	end := b.UTF16Pos(c.Edit.Range.End.Line, c.Edit.Range.End.Character)
+	if c.Edit.Range.End.Character >= col {
+		// the text typed after the completions were received is also replaced
+		end += typed
+	}
+	ops := []buf.ReplaceOp{{Text: []rune(c.Edit.NewText), Sel: util.Sel{start, end}}}
+	cursor := start + len(ops[0].Text)
+	for _, e := range c.AdditionalEdits {
+		op := buf.ReplaceOp{
+			Text: []rune(e.NewText),
+			Sel: util.Sel{
+				S: b.UTF16Pos(e.Range.Start.Line, e.Range.Start.Character),
+				E: b.UTF16Pos(e.Range.End.Line, e.Range.End.Character),
+			},
+		}
+		if op.Sel.E <= start {
+			cursor += len(op.Text) - (op.Sel.E - op.Sel.S)
+		}
+		ops = append(ops, op)
+	}
+	sort.SliceStable(ops, func(i, j int) bool { return ops[i].Sel.S < ops[j].Sel.S })
+
+	b.ReplaceAll(ops, ec.eventChan, util.EO_KBD)
+	ec.fr.Sel = util.Sel{cursor, cursor}
+	ec.br()
+
+	if len(c.AdditionalEdits) == 0 && srv.NeedsResolve(&c) {
+		rev := b.RevCount
+		go func() {
+			srv.Resolve(&c)
+			if len(c.AdditionalEdits) == 0 {
+				return
+			}
+			sideChan <- func() {
+				if ec.ed.closed || b.RevCount != rev {
+					// positions of the edits could be wrong now
+					return
+				}
+				lspComplAdditionalEdits(ec, c.AdditionalEdits, start)
+			}
+		}()
+	}
+}
+
+// lspComplAdditionalEdits applies the additional edits of a completion
+// after the completion itself was applied at start. Only edits before start
+// (usually imports) are applied, the position of the others changed.
+func lspComplAdditionalEdits(ec ExecContext, edits []lsp.TextEdit, start int) {
+	b := ec.buf
+	ops := []buf.ReplaceOp{}
+	cursor := ec.fr.Sel.S
+	for _, e := range edits {
+		op := buf.ReplaceOp{
+			Text: []rune(e.NewText),
+			Sel: util.Sel{
+				S: b.UTF16Pos(e.Range.Start.Line, e.Range.Start.Character),
+				E: b.UTF16Pos(e.Range.End.Line, e.Range.End.Character),
+			},
+		}
+		if op.Sel.E > start {
+			continue
+		}
+		cursor += len(op.Text) - (op.Sel.E - op.Sel.S)
+		ops = append(ops, op)
+	}
+	if len(ops) == 0 {
+		return
+	}
+	sort.SliceStable(ops, func(i, j int) bool { return ops[i].Sel.S < ops[j].Sel.S })
+	b.ReplaceAll(ops, ec.eventChan, util.EO_KBD)
+	ec.fr.Sel = util.Sel{cursor, cursor}
+	ec.br()
+}
+
+// lspSignatureHelp shows the signature of the function being called at the
+// cursor in the tooltip.
+func lspSignatureHelp(ec ExecContext) {
+	if ec.ed == nil || ec.buf != ec.ed.bodybuf {
+		return
+	}
+	srv, lspb := lsp.BufferToLsp(Wnd.tagbuf.Dir, ec.buf, ec.fr.Sel, false, Warn, defaultLookForLsp)
+	if srv == nil {
+		return
+	}
+	pos := ec.fr.Sel.S
+	go func() {
+		s := srv.SignatureHelp(lspb)
+		if s == "" {
+			return
+		}
+		sideChan <- func() {
+			if ec.ed.closed || ec.fr.Sel.S != pos || Compl.Visible {
+				return
+			}
+			tooltipContents = s
+			Tooltip.Start(ec, popupAlignLeft)
+		}
+	}()
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aarzilli/yacco/buf"
+	"github.com/aarzilli/yacco/hl"
+	"github.com/aarzilli/yacco/lsp"
+	"github.com/aarzilli/yacco/util"
+)
+
+const (
+	outlineBufferName      = "+Outline"
+	outlineRefreshInterval = time.Second
+)
+
+// Outline of the editor src, shown in +Outline. The first line of +Outline
+// is the path of the file, every other line is an entry.
+var outline struct {
+	src     *Editor
+	gen     int // incremented every time the source editor changes
+	rev     int // revision of the source buffer the outline was requested for
+	entries []outlineEntry
+}
+
+type outlineEntry struct {
+	lsp.Symbol
+	sel util.Sel // position of the name of the symbol in the source buffer
+}
+
+func OutlineCmd(ec ExecContext, arg string) {
+	src := ec.ed
+	if src != nil && src.bodybuf.Name == outlineBufferName {
+		src = outline.src
+	}
+	if src == nil || src.closed || src.bodybuf.IsDir() {
+		Warn("Outline: no file selected")
+		return
+	}
+
+	if _, err := EditFind(Wnd.tagbuf.Dir, outlineBufferName, false, true); err != nil {
+		Warn(err.Error())
+		return
+	}
+
+	if src != outline.src {
+		forgetOutline()
+		outline.src = src
+		outline.gen++
+		go outlineWatch(outline.gen)
+	}
+	updateOutline(true)
+}
+
+// outlineWatch updates the outline when the source buffer changes, until
+// the source editor changes or +Outline is closed.
+func outlineWatch(gen int) {
+	cont := make(chan bool, 1)
+	for {
+		time.Sleep(outlineRefreshInterval)
+		sideChan <- func() {
+			if gen != outline.gen {
+				cont <- false
+				return
+			}
+			if ed, _ := EditFind(Wnd.tagbuf.Dir, outlineBufferName, false, false); ed == nil || outline.src.closed {
+				forgetOutline()
+				outline.src = nil
+				outline.gen++
+				cont <- false
+				return
+			}
+			if outline.src.bodybuf.RevCount != outline.rev {
+				updateOutline(false)
+			}
+			cont <- true
+		}
+		if !<-cont {
+			return
+		}
+	}
+}
+
+// updateOutline recalculates the outline of the source editor, asking the
+// language server if one is available.
+func updateOutline(createLsp bool) {
+	src, gen := outline.src, outline.gen
+	outline.rev = src.bodybuf.RevCount
+	rev := outline.rev
+
+	srv, lspb := lsp.BufferToLsp(Wnd.tagbuf.Dir, src.bodybuf, util.Sel{0, 0}, createLsp, Warn, defaultLookForLsp)
+	if srv == nil || !srv.Capabilities.DocumentSymbolProvider {
+		showOutline(headerOutline(src.bodybuf))
+		return
+	}
+
+	go func() {
+		syms, err := srv.DocumentSymbols(lspb)
+		sideChan <- func() {
+			if gen != outline.gen || rev != src.bodybuf.RevCount {
+				return
+			}
+			if err != nil {
+				Warn("Outline: " + err.Error())
+				showOutline(headerOutline(src.bodybuf))
+				return
+			}
+			utf16pos := utf16PosFunc(src.bodybuf)
+			entries := make([]outlineEntry, len(syms))
+			for i := range syms {
+				entries[i].Symbol = syms[i]
+				entries[i].sel.S = utf16pos(syms[i].Range.Start.Line, syms[i].Range.Start.Character)
+				entries[i].sel.E = utf16pos(syms[i].Range.End.Line, syms[i].Range.End.Character)
+			}
+			showOutline(entries)
+		}
+	}()
+}
+
+// headerOutline returns the regions highlighted as headers (for example
+// the names of functions and types in Go) as an outline.
+func headerOutline(b *buf.Buffer) []outlineEntry {
+	if b.Hl == nil {
+		return nil
+	}
+	entries := []outlineEntry{}
+	colors := b.Highlight(0, b.Size())
+	for i := 0; i < len(colors); i++ {
+		if colors[i] != uint8(hl.RMT_HEADER) {
+			continue
+		}
+		start := i
+		for i < len(colors) && colors[i] == uint8(hl.RMT_HEADER) {
+			i++
+		}
+		name := strings.TrimSpace(string(b.SelectionRunes(util.Sel{start, i})))
+		if name != "" {
+			entries = append(entries, outlineEntry{Symbol: lsp.Symbol{Name: name}, sel: util.Sel{start, i}})
+		}
+	}
+	return entries
+}
+
+func forgetOutline() {
+	if outline.src != nil {
+		for i := range outline.entries {
+			outline.src.bodybuf.RmSel(&outline.entries[i].sel)
+		}
+	}
+	outline.entries = nil
+}
+
+func showOutline(entries []outlineEntry) {
+	ed, err := EditFind(Wnd.tagbuf.Dir, outlineBufferName, false, false)
+	if err != nil || ed == nil {
+		return
+	}
+
+	forgetOutline()
+	outline.entries = entries
+	for i := range outline.entries {
+		outline.src.bodybuf.AddSel(&outline.entries[i].sel)
+	}
+
+	var out strings.Builder
+	out.WriteString(outline.src.bodybuf.Path())
+	out.WriteString("\n")
+	for _, e := range entries {
+		out.WriteString(strings.Repeat("\t", e.Depth))
+		if e.Kind != "" {
+			out.WriteString(e.Kind)
+			out.WriteString(" ")
+		}
+		out.WriteString(e.Name)
+		if e.Detail != "" {
+			out.WriteString(" ")
+			out.WriteString(e.Detail)
+		}
+		out.WriteString("\n")
+	}
+
+	txt := []rune(out.String())
+	if string(ed.bodybuf.SelectionRunes(util.Sel{0, ed.bodybuf.Size()})) == string(txt) {
+		return
+	}
+	ed.bodybuf.Replace(txt, &util.Sel{0, ed.bodybuf.Size()}, true, nil, 0)
+	ed.bodybuf.Modified = false
+	ed.BufferRefresh()
+}
+
+// outlineLoad selects the symbol of the +Outline entry at origin in the
+// source editor.
+func outlineLoad(ec ExecContext, origin int, othered bool) bool {
+	if outline.src == nil || outline.src.closed || ec.ed == nil || ec.buf != ec.ed.bodybuf || ec.buf.Name != outlineBufferName {
+		return false
+	}
+	if origin < 0 {
+		origin = ec.fr.Sel.S
+	}
+	_, ln, _ := ec.buf.GetLine(origin, false)
+	i := ln - 2 // the first line is the path of the file
+	if i < 0 || i >= len(outline.entries) {
+		return false
+	}
+	sel := outline.entries[i].sel
+	s, e := ec.buf.Tonl(origin-1, -1), ec.buf.Tonl(origin, +1)
+	rule := LoadRule{Action: fmt.Sprintf("L%s:#%d,#%d", outline.src.bodybuf.Path(), sel.S, sel.E)}
+	return rule.Exec(ec, nil, s, e, othered, true)
+}
@@ -29,8 +29,9 @@ func Compile(rx string, find, bw bool) *Regex {
 	pgm = ast.Compile(pgm, bw)
 	pgm = append(pgm, instr{op: RX_MATCH})
 	return &Regex{
-		pgm: pgm,
-		ssz: resultSize(pgm),
+		pgm:   pgm,
+		ssz:   resultSize(pgm),
+		names: p.names,
 	}
 }
 
@@ -72,6 +73,16 @@ func CompileFuzzySearch(s []rune) *Regex {
 	}
 }
 
+// Maximum number of instructions of a program, counted repetitions nested
+// inside other counted repetitions multiply the size of the program.
+const maxProgramSize = 100000
+
+func checkProgramSize(pgm []instr) {
+	if len(pgm) > maxProgramSize {
+		panic(fmt.Errorf("Expression too large"))
+	}
+}
+
 func (n *nodeChar) Compile(pgm []instr, bw bool) []instr {
 	return append(pgm, instr{op: RX_CHAR, c: n.c})
 }
@@ -81,7 +92,14 @@ func (n *nodeClass) Compile(pgm []instr, bw bool) []instr {
 }
 
 func (n *nodeAssert) Compile(pgm []instr, bw bool) []instr {
-	return append(pgm, instr{op: RX_ASSERT, cname: n.name, check: n.check})
+	check := n.check
+	if bw {
+		// when matching backwards position i is after the i-th character
+		check = func(b Matchable, start, end, i int) bool {
+			return n.check(b, start, end, i+1)
+		}
+	}
+	return append(pgm, instr{op: RX_ASSERT, cname: n.name, check: check})
 }
 
 func (n *nodeGroup) Compile(pgm []instr, bw bool) []instr {
@@ -98,7 +116,7 @@ func (n *nodeGroup) Compile(pgm []instr, bw bool) []instr {
 }
 
 func (n *nodeRep) Compile(pgm []instr, bw bool) []instr {
-	if (n.min == 1) && (n.max <= 0) { // +
+	if (n.min == 1) && (n.max < 0) { // +
 		topl := len(pgm)
 		pgm = n.child.Compile(pgm, bw)
 		if n.greedy {
@@ -109,7 +127,7 @@ func (n *nodeRep) Compile(pgm []instr, bw bool) []instr {
 		return pgm
 	}
 
-	if (n.min == 0) && (n.max <= 0) { // *
+	if (n.min == 0) && (n.max < 0) { // *
 		topl := len(pgm)
 		pgm = append(pgm, instr{op: RX_SPLIT, L: []int{0, 0}})
 		pgm = n.child.Compile(pgm, bw)
@@ -124,7 +142,7 @@ func (n *nodeRep) Compile(pgm []instr, bw bool) []instr {
 		return pgm
 	}
 
-	if (n.min == 0) && (n.max == 1) { // +
+	if (n.min == 0) && (n.max == 1) { // ?
 		topl := len(pgm)
 		pgm = append(pgm, instr{op: RX_SPLIT, L: []int{0, 0}})
 		pgm = n.child.Compile(pgm, bw)
@@ -138,7 +156,64 @@ func (n *nodeRep) Compile(pgm []instr, bw bool) []instr {
 		return pgm
 	}
 
-	panic(fmt.Errorf("Unknown min/max combination for repeat node %d %d", n.min, n.max))
+	// counted repetition: min copies of the child followed by either a star
+	// or max-min nested optional copies
+	for i := 0; i < n.min; i++ {
+		pgm = n.child.Compile(pgm, bw)
+		checkProgramSize(pgm)
+	}
+	if n.max < 0 {
+		star := &nodeRep{min: 0, max: -1, greedy: n.greedy, child: n.child}
+		return star.Compile(pgm, bw)
+	}
+	splits := []int{}
+	for i := n.min; i < n.max; i++ {
+		splits = append(splits, len(pgm))
+		pgm = append(pgm, instr{op: RX_SPLIT, L: []int{0, 0}})
+		pgm = n.child.Compile(pgm, bw)
+		checkProgramSize(pgm)
+	}
+	endl := len(pgm)
+	for _, l := range splits {
+		if n.greedy {
+			pgm[l].L[0] = l + 1
+			pgm[l].L[1] = endl
+		} else {
+			pgm[l].L[0] = endl
+			pgm[l].L[1] = l + 1
+		}
+	}
+	return pgm
+}
+
+// Lookahead assertions are always matched forward and lookbehind assertions
+// backward, starting at the current position, regardless of the direction
+// of the enclosing expression. They can look outside of the range being
+// searched.
+func (n *nodeLook) Compile(pgm []instr, bw bool) []instr {
+	if n.sub == nil {
+		n.sub = &Regex{pgm: n.child.Compile([]instr{}, n.behind)}
+		n.sub.pgm = append(n.sub.pgm, instr{op: RX_MATCH})
+		n.sub.ssz = resultSize(n.sub.pgm)
+	}
+	sub := n.sub
+
+	dir := +1
+	if n.behind {
+		dir = -1
+	}
+
+	check := func(b Matchable, start, end, i int) bool {
+		if bw {
+			i++
+		}
+		if n.behind {
+			i--
+		}
+		return (sub.match(b, start, -1, i, dir) != nil) != n.neg
+	}
+
+	return append(pgm, instr{op: RX_ASSERT, cname: n.String(), check: check})
 }
 
 func (n *nodeAlt) Compile(pgm []instr, bw bool) []instr {
@@ -106,8 +106,14 @@ func resultSize(pgm []instr) int {
 }
 
 func (rx *Regex) Match(b Matchable, start, end int, dir int) []int {
+	return rx.match(b, start, end, start, dir)
+}
+
+// match runs the program starting at first, start and end are passed to
+// assertions.
+func (rx *Regex) match(b Matchable, start, end, first int, dir int) []int {
 	if len(rx.pgm) <= 0 {
-		return []int{start, start}
+		return []int{first, first}
 	}
 
 	if dir == 0 {
@@ -132,9 +138,9 @@ func (rx *Regex) Match(b Matchable, start, end int, dir int) []int {
 		fsave[i] = -1
 	}
 
-	clist.addthread(threadlet{0, fsave}, b, start, end, start)
+	clist.addthread(threadlet{0, fsave}, b, start, end, first)
 
-	for i := start; ; i += dir {
+	for i := first; ; i += dir {
 		if len(clist.threads) == 0 {
 			break
 		}
@@ -240,3 +246,24 @@ func (rx *Regex) Match(b Matchable, start, end int, dir int) []int {
 		return nil
 	}
 }
+
+// SubexpNames returns the names of the parenthesized subexpressions, the
+// name of the i-th subexpression is names[i], unnamed subexpressions have
+// an empty name.
+func (rx *Regex) SubexpNames() []string {
+	return rx.names
+}
+
+// SubexpIndex returns the number of the subexpression with the specified
+// name or -1 if there is no such subexpression.
+func (rx *Regex) SubexpIndex(name string) int {
+	if name == "" {
+		return -1
+	}
+	for i := range rx.names {
+		if rx.names[i] == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -8,6 +8,7 @@ import (
 
 func (p *parser) parseToplevel(str []rune) *nodeAlt {
 	p.nextgroup = 1
+	p.names = []string{""}
 	n, rest := p.parseAlt(str)
 	n.no = 0
 	if len(rest) != 0 {
@@ -33,27 +34,97 @@ func (p *parser) parseAlt(str []rune) (*nodeAlt, []rune) {
 	}
 }
 
-func (p *parser) parsePar(str []rune) (*nodeAlt, []rune) {
+func (p *parser) parsePar(str []rune) (node, []rune) {
 	rest := str
-	var no int
-	if (len(rest) >= 2) && (rest[0] == '?') && (rest[1] == ':') {
+	no := -1
+	var look *nodeLook
+	switch {
+	case hasPrefix(rest, "?:"):
 		rest = rest[2:]
-		no = -1
-	} else {
-		no = p.nextgroup
-		p.nextgroup++
+	case hasPrefix(rest, "?="), hasPrefix(rest, "?!"):
+		look = &nodeLook{neg: rest[1] == '!'}
+		rest = rest[2:]
+	case hasPrefix(rest, "?<="), hasPrefix(rest, "?<!"):
+		look = &nodeLook{behind: true, neg: rest[2] == '!'}
+		rest = rest[3:]
+	case hasPrefix(rest, "?P<"), hasPrefix(rest, "?<"):
+		if rest[1] == 'P' {
+			rest = rest[3:]
+		} else {
+			rest = rest[2:]
+		}
+		name, off := readGroupName(rest)
+		rest = rest[off:]
+		no = p.newgroup(name)
+	default:
+		no = p.newgroup("")
 	}
 
+	if look != nil {
+		p.look++
+	}
 	n, rest := p.parseAlt(rest)
+	if look != nil {
+		p.look--
+	}
 
 	if (len(rest) == 0) || (rest[0] != ')') {
 		panic(fmt.Errorf("Unmatched open parenthesis"))
 	}
 
 	n.no = no
+	if look != nil {
+		look.child = n
+		return look, rest[1:]
+	}
 	return n, rest[1:]
 }
 
+// newgroup returns the number of a new capturing group
+func (p *parser) newgroup(name string) int {
+	if p.look > 0 {
+		return -1
+	}
+	if name != "" {
+		for i := range p.names {
+			if p.names[i] == name {
+				panic(fmt.Errorf("Duplicate group name %s", name))
+			}
+		}
+	}
+	no := p.nextgroup
+	p.nextgroup++
+	p.names = append(p.names, name)
+	return no
+}
+
+func hasPrefix(str []rune, prefix string) bool {
+	i := 0
+	for _, ch := range prefix {
+		if i >= len(str) || str[i] != ch {
+			return false
+		}
+		i++
+	}
+	return true
+}
+
+// readGroupName reads the name of a named group up to the closing '>'
+func readGroupName(str []rune) (string, int) {
+	for i := range str {
+		if str[i] == '>' {
+			if i == 0 {
+				break
+			}
+			return string(str[:i]), i + 1
+		}
+		if !isw(str[i]) {
+			break
+		}
+	}
+	panic(fmt.Errorf("Invalid group name"))
+}
+
 func (p *parser) parseBranch(str []rune) (*nodeGroup, []rune) {
 	r := &nodeGroup{}
 	r.nodes = []node{}
@@ -137,6 +208,13 @@ func (p *parser) parseBranch(str []rune) (*nodeGroup, []rune) {
 				i += readRepeat(r, 0, -1, rest[i+1:])
 			case '?':
 				i += readRepeat(r, 0, 1, rest[i+1:])
+			case '{':
+				if min, max, off, ok := readCount(rest[i+1:]); ok {
+					i += off
+					i += readRepeat(r, min, max, rest[i+1:])
+				} else {
+					r.nodes = append(r.nodes, &nodeChar{'{'})
+				}
 			case '(':
 				n, newrest := p.parsePar(rest[i+1:])
 				r.nodes = append(r.nodes, n)
@@ -192,6 +270,48 @@ func readRepeat(r *nodeGroup, min, max int, rest []rune) int {
 	}
 }
 
+// Maximum number of repetitions of a counted repetition
+const maxRepeatCount = 1000
+
+// readCount reads the body of a counted repetition {n}, {n,} or {n,m}, if
+// str doesn't start with one the opening brace is a normal character.
+func readCount(str []rune) (min, max, off int, ok bool) {
+	readNum := func() int {
+		n := -1
+		for off < len(str) && str[off] >= '0' && str[off] <= '9' {
+			if n < 0 {
+				n = 0
+			}
+			n = n*10 + int(str[off]-'0')
+			if n > maxRepeatCount {
+				panic(fmt.Errorf("Repeat count too large"))
+			}
+			off++
+		}
+		return n
+	}
+
+	min = readNum()
+	if min < 0 || off >= len(str) {
+		return 0, 0, 0, false
+	}
+	max = min
+	if str[off] == ',' {
+		off++
+		max = readNum()
+		if off >= len(str) {
+			return 0, 0, 0, false
+		}
+	}
+	if str[off] != '}' {
+		return 0, 0, 0, false
+	}
+	if max >= 0 && max < min {
+		panic(fmt.Errorf("Invalid repeat count {%d,%d}", min, max))
+	}
+	return min, max, off + 1, true
+}
+
 func readCharclass(str []rune) (*nodeClass, int) {
 	escape := false
 	r := &nodeClass{}
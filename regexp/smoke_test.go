@@ -1,6 +1,7 @@
 package regexp_test
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/aarzilli/yacco/buf"
@@ -37,6 +38,29 @@ func testRegex(t *testing.T, rxSrc, in string, start int, tgt []int) []int {
 	}
 }
 
+// testRegexBw searches backwards from start, tgt is the start and end of
+// the match as edit/addr.go would select it.
+func testRegexBw(t *testing.T, rxSrc, in string, start int, tgt []int) {
+	rx := regexp.Compile(rxSrc, true, true)
+	buf, _ := buf.NewBuffer("/", "+Tag", true, " ", hl.NilHighlighter)
+	buf.Replace([]rune(in), &util.Sel{0, 0}, true, nil, util.EO_MOUSE)
+
+	out := rx.Match(buf, start, -1, -1)
+
+	if tgt == nil {
+		if out != nil {
+			t.Fatalf("Expected no match\nRX: <%s>\nIN: <%s>\nOUT: %v\nCODE:\n%s\n", rxSrc, in, out, rx.String())
+		}
+		return
+	}
+	if out == nil {
+		t.Fatalf("Expected match\nRX: <%s>\nIN: <%s>\nTGT: %v\nCODE:\n%s\n", rxSrc, in, tgt, rx.String())
+	}
+	if s, e := out[1]+1, out[0]+1; s != tgt[0] || e != tgt[1] {
+		t.Fatalf("Mismatched backwards match\nRX: <%s>\nIN: <%s> (start: %d)\nOUT: %d %d\nTGT: %v\nCODE:\n%s\n", rxSrc, in, start, s, e, tgt, rx.String())
+	}
+}
+
 func testRegexRep(t *testing.T, rx, in string, tgts []int) {
 	start := 0
 	for i := 0; 2*i+1 < len(tgts); i++ {
@@ -119,3 +143,79 @@ func TestFromGo(t *testing.T) {
 	testRegexRep(t, `[^\D[:digit:]]`, "abcd", nil)
 	testRegexRep(t, `\W`, "x", nil)
 }
+
+func TestCountedRepetition(t *testing.T) {
+	testRegexRep(t, `a{3}`, "aaaaaaa", []int{0, 3, 3, 6})
+	testRegexRep(t, `a{2,}`, "a aa aaaa", []int{2, 4, 5, 9})
+	testRegexRep(t, `a{1,2}`, "aaa", []int{0, 2, 2, 3})
+	testRegexRep(t, `a{1,2}?`, "aaa", []int{0, 1, 1, 2, 2, 3})
+	testRegexRep(t, `ba{0}c`, "bc bac", []int{0, 2})
+	testRegexRep(t, `x{2,3}y`, "xy xxy xxxxy", []int{3, 6, 8, 12})
+	testRegex(t, `(ab){2}`, "ababab", 0, []int{0, 4, 2, 4})
+	testRegex(t, `(?:a|b){2,3}c`, "abbac", 0, []int{1, 5})
+	testRegexRep(t, `\d{4}-\d{2}`, "on 2006-01-02", []int{3, 10})
+	testRegexRep(t, `a{`, "a{", []int{0, 2})
+	testRegexRep(t, `a{x}`, "a{x}", []int{0, 4})
+	testRegexRep(t, `a{1,2`, "a{1,2", []int{0, 5})
+	testRegexBw(t, `a{2}`, "aaaaa", 4, []int{3, 5})
+	testRegexBw(t, `b{1,2}a`, "xbbbax", 5, []int{2, 5})
+	testRegexBw(t, `x{2,}`, "xxxx yx", 6, []int{0, 4})
+
+	for _, bad := range []string{`(a{1000}){1000}`, `((a{100}){100}){100}`, `(?:a{2,1000}){1000}`, `a{1001}`} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("no error compiling %s", bad)
+				}
+			}()
+			regexp.Compile(bad, true, false)
+		}()
+	}
+	testRegexRep(t, `(?:(?=a{3})a){100}`, strings.Repeat("a", 102), []int{0, 100})
+}
+
+func TestNamedGroups(t *testing.T) {
+	testRegex(t, `(?P<first>\w+) (?<second>\w+)`, "hello world", 0, []int{0, 11, 0, 5, 6, 11})
+	testRegex(t, `(a)(?<x>b)(?:c)(d)`, "abcd", 0, []int{0, 4, 0, 1, 1, 2, 3, 4})
+
+	rx := regexp.Compile(`(a)(?<x>b)(?:c)(?P<y_1>d)`, true, false)
+	names := rx.SubexpNames()
+	if len(names) != 4 || names[0] != "" || names[1] != "" || names[2] != "x" || names[3] != "y_1" {
+		t.Fatalf("wrong names %q", names)
+	}
+	if rx.SubexpIndex("y_1") != 3 || rx.SubexpIndex("z") != -1 || rx.SubexpIndex("") != -1 {
+		t.Fatalf("wrong index")
+	}
+
+	for _, bad := range []string{`(?<>a)`, `(?<a b>a)`, `(?<a>a)(?<a>b)`, `(?<a`} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("no error compiling %s", bad)
+				}
+			}()
+			regexp.Compile(bad, true, false)
+		}()
+	}
+}
+
+func TestLookaround(t *testing.T) {
+	testRegexRep(t, `foo(?=bar)`, "foobaz foobar", []int{7, 10})
+	testRegexRep(t, `foo(?!bar)`, "foobar foobaz", []int{7, 10})
+	testRegexRep(t, `(?<=\$)\d+`, "12 $34 56", []int{4, 6})
+	testRegexRep(t, `(?<!\$)\b\d+`, "$12 34", []int{4, 6})
+	testRegexRep(t, `(?<=ab|b)c`, "xc bc abc", []int{4, 5, 8, 9})
+	testRegexRep(t, `\w+(?=\()`, "x = f(y)", []int{4, 5})
+	testRegex(t, `(a)(?=(b))(c)?`, "ab", 0, []int{0, 1, 0, 1, -1, -1})
+	testRegexRep(t, `(?<=^a)b`, "ab\nbb", []int{1, 2})
+	testRegexBw(t, `foo(?=bar)`, "foobar foobaz", 12, []int{0, 3})
+	testRegexBw(t, `(?<=x)y`, "xy zy", 4, []int{1, 2})
+	testRegexBw(t, `(?<!x)y`, "zy xy", 4, []int{1, 2})
+	testRegexBw(t, `a(?!b)`, "ac ab", 4, []int{0, 1})
+}
+
+func TestBackwardAsserts(t *testing.T) {
+	testRegexBw(t, `^b`, "ab\nbb", 4, []int{3, 4})
+	testRegexBw(t, `b$`, "ab\nbb", 4, []int{4, 5})
+	testRegexBw(t, `\bb`, "ab bb", 4, []int{3, 4})
+}
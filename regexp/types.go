@@ -52,15 +52,15 @@ func (n *nodeGroup) String() string {
 }
 
 type nodeRep struct {
-	min    int // minimum number of repetitions (0 or 1)
-	max    int // maximum number of repetitions (-1 for unbound or 1 for only one)
+	min    int // minimum number of repetitions
+	max    int // maximum number of repetitions (-1 for unbound)
 	greedy bool
 	child  node
 }
 
 func (n *nodeRep) String() string {
 	r := n.child.String()
-	return fmt.Sprintf("rep(%d%dv %s)", n.min, n.max, n.greedy, r)
+	return fmt.Sprintf("rep(%d %d %v %s)", n.min, n.max, n.greedy, r)
 }
 
 type nodeAssert struct {
@@ -85,8 +85,29 @@ func (n *nodeAlt) String() string {
 	return fmt.Sprintf("alt(%d %s)", n.no, strings.Join(r, " | "))
 }
 
+// nodeLook is a lookahead or lookbehind assertion
+type nodeLook struct {
+	behind bool
+	neg    bool
+	child  node
+	sub    *Regex // compiled child, shared by all copies of a repetition
+}
+
+func (n *nodeLook) String() string {
+	name := "ahead"
+	if n.behind {
+		name = "behind"
+	}
+	if n.neg {
+		name = "neg" + name
+	}
+	return fmt.Sprintf("look%s(%s)", name, n.child.String())
+}
+
 type parser struct {
 	nextgroup int
+	names     []string // names of groups, indexed by group number
+	look      int      // nesting depth of lookaround assertions, groups inside them don't capture
 }
 
 type instrCode uint8
@@ -114,8 +135,9 @@ type instr struct {
 }
 
 type Regex struct {
-	pgm []instr
-	ssz int
+	pgm   []instr
+	ssz   int
+	names []string
 }
 
 func (ix *instr) String() string {
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"time"
+
+	"github.com/aarzilli/yacco/buf"
+	"github.com/aarzilli/yacco/hl"
+	"github.com/aarzilli/yacco/lsp"
+	"github.com/aarzilli/yacco/util"
+)
+
+const semanticTokensInterval = 500 * time.Millisecond
+
+var semanticTokenColors = map[string]hl.RegionMatchType{
+	"function":      hl.RMT_FUNCTION,
+	"method":        hl.RMT_FUNCTION,
+	"macro":         hl.RMT_FUNCTION,
+	"type":          hl.RMT_TYPE,
+	"class":         hl.RMT_TYPE,
+	"enum":          hl.RMT_TYPE,
+	"interface":     hl.RMT_TYPE,
+	"struct":        hl.RMT_TYPE,
+	"typeParameter": hl.RMT_TYPE,
+	"variable":      hl.RMT_VARIABLE,
+	"property":      hl.RMT_VARIABLE,
+	"enumMember":    hl.RMT_VARIABLE,
+	"parameter":     hl.RMT_PARAMETER,
+	"keyword":       hl.RMT_KEYWORD,
+	"number":        hl.RMT_NUMBER,
+}
+
+// Revision of each buffer for which semantic tokens were last requested
+// and whether the request is still pending.
+var semanticTokensRequests = map[*buf.Buffer]*semanticTokensRequest{}
+
+type semanticTokensRequest struct {
+	rev     int
+	pending bool
+}
+
+// semanticTokensWatch periodically requests the semantic tokens of the
+// buffers that changed to their language server.
+func semanticTokensWatch() {
+	for {
+		time.Sleep(semanticTokensInterval)
+		sideChan <- updateSemanticTokens
+	}
+}
+
+func updateSemanticTokens() {
+	shown := map[*buf.Buffer]bool{}
+	for _, col := range Wnd.cols.cols {
+		for _, ed := range col.editors {
+			b := ed.bodybuf
+			if shown[b] {
+				continue
+			}
+			shown[b] = true
+			req := semanticTokensRequests[b]
+			if req == nil {
+				req = &semanticTokensRequest{rev: -1}
+				semanticTokensRequests[b] = req
+			}
+			if req.pending || req.rev == b.RevCount {
+				continue
+			}
+			requestSemanticTokens(b, req)
+		}
+	}
+	for b := range semanticTokensRequests {
+		if !shown[b] {
+			delete(semanticTokensRequests, b)
+		}
+	}
+}
+
+func requestSemanticTokens(b *buf.Buffer, req *semanticTokensRequest) {
+	if b.IsDir() {
+		return
+	}
+	if _, isfixed := b.Hl.(*hl.Fixed); isfixed {
+		return
+	}
+	srv, lspb := lsp.BufferToLsp(Wnd.tagbuf.Dir, b, util.Sel{0, 0}, false, Warn, defaultLookForLsp)
+	if srv == nil || !srv.SemanticTokensSupported() {
+		return
+	}
+
+	srv.Changed(lspb)
+	req.rev = b.RevCount
+	req.pending = true
+	rev := req.rev
+
+	go func() {
+		toks, err := srv.SemanticTokens(lspb)
+		sideChan <- func() {
+			req.pending = false
+			if err != nil || rev != b.RevCount {
+				// the buffer changed while waiting for the response, it
+				// will be requested again
+				req.rev = -1
+				return
+			}
+			setSemanticTokens(b, toks)
+		}
+	}()
+}
+
+// setSemanticTokens converts semantic tokens to colors for the highlighter
+// of b and redraws the editors showing it.
+func setSemanticTokens(b *buf.Buffer, toks []lsp.SemanticToken) {
+	o, ok := b.Hl.(*hl.Overlay)
+	if !ok {
+		if _, isfixed := b.Hl.(*hl.Fixed); isfixed {
+			return
+		}
+		o = hl.NewOverlay(b.Hl)
+		b.Hl = o
+	}
+
+	utf16pos := utf16PosFunc(b)
+	tokens := make([]hl.Token, 0, len(toks))
+	for _, tok := range toks {
+		color, ok := semanticTokenColors[tok.Type]
+		if !ok {
+			continue
+		}
+		t := hl.Token{
+			S:     utf16pos(tok.Range.Start.Line, tok.Range.Start.Character),
+			E:     utf16pos(tok.Range.End.Line, tok.Range.End.Character),
+			Color: color,
+		}
+		if len(tokens) > 0 && t.S < tokens[len(tokens)-1].E {
+			continue
+		}
+		tokens = append(tokens, t)
+	}
+	o.SetTokens(tokens)
+
+	for _, col := range Wnd.cols.cols {
+		for _, ed := range col.editors {
+			if ed.bodybuf == b {
+				// also refreshes the other editors showing b
+				ed.BufferRefreshEx(true, false, -1)
+				return
+			}
+		}
+	}
+}
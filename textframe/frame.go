@@ -6,6 +6,7 @@ import (
 	"image/draw"
 	"math"
 	"runtime"
+	"sort"
 	"time"
 
 	"github.com/aarzilli/yacco/otat"
@@ -59,10 +60,16 @@ type Frame struct {
 	Offset            int
 
 	Sel      util.Sel
+	Cursors  []util.Sel // additional selections, sorted and not overlapping
 	MarkSel  *util.Sel
 	SelColor int
 	PMatch   util.Sel
 
+	Underlines      []Underline
+	UnderlineColors []image.Uniform
+
+	AnsiColors []image.Uniform // colors of terminal output, see util.AnsiColor
+
 	glyphs   []glyph
 	ins      fixed.Point26_6
 	lastFull int
@@ -71,6 +78,7 @@ type Frame struct {
 		drawnVisibleTick bool
 		drawnSel         util.Sel
 		drawnPMatch      util.Sel
+		drawnCursors     int
 		selColor         int
 		reloaded         bool
 		scrollStart      int
@@ -91,10 +99,19 @@ Every selection is defined by a start point and an end point. Empty selections h
 The first selection is mandatory and if it is empty a tick (a vertical bar) is displayed at its start (and end) point, to disable the tick set visible to false.
 
 The color matrix must have as many rows as there are selections (empty or otherwise) in the frame plus one. In each row there must be at least two colors: the color at index 0 is the background color, the color at index 1 is the default foreground color. All other colors are foreground colors used as specified when using InsertColor.
+Unselected text with a color index that has the util.ColorAnsi bit set is drawn with AnsiColors instead.
 
 The very first row of the color matrix are the colors used for unselected text.
 */
 
+// Underline is a range of text drawn with a line under it, a mark is also
+// drawn in the left margin in correspondence of its first character.
+// Start and end are absolute positions, like Sel.
+type Underline struct {
+	util.Sel
+	Color int // index into UnderlineColors
+}
+
 type glyph struct {
 	r        rune
 	crune    rune
@@ -715,13 +732,17 @@ func (fr *Frame) drawTickOld(idx int) image.Rectangle {
 }
 
 func (fr *Frame) TickRect() image.Rectangle {
+	return fr.tickRectAt(fr.Sel.S)
+}
+
+func (fr *Frame) tickRectAt(pos int) image.Rectangle {
 	var x, y int
 	if len(fr.glyphs) == 0 {
 		p := fr.initialInsPoint()
 		x = p.X.Floor()
 		y = p.Y.Floor()
-	} else if fr.Sel.S-fr.Top < len(fr.glyphs) {
-		p := fr.glyphs[fr.Sel.S-fr.Top].p
+	} else if pos-fr.Top < len(fr.glyphs) {
+		p := fr.glyphs[pos-fr.Top].p
 		x = p.X.Floor()
 		y = p.Y.Floor()
 	} else {
@@ -765,6 +786,28 @@ func (fr *Frame) drawTickNew(idx int) image.Rectangle {
 	return r
 }
 
+// drawCursorTicks draws a tick for every visible empty cursor
+func (fr *Frame) drawCursorTicks() {
+	if !fr.VisibleTick {
+		return
+	}
+	for _, c := range fr.Cursors {
+		if c.S != c.E || c.S-fr.Top < 0 || c.S-fr.Top > len(fr.glyphs) {
+			continue
+		}
+		r := fr.tickRectAt(c.S)
+		draw.Draw(fr.B, fr.R.Intersect(r), &fr.Colors[0][1], fr.R.Intersect(r).Min, draw.Src)
+	}
+}
+
+// inCursor returns true if p is inside one of the cursors
+func (fr *Frame) inCursor(p int) bool {
+	i := sort.Search(len(fr.Cursors), func(i int) bool {
+		return fr.Cursors[i].E > p
+	})
+	return i < len(fr.Cursors) && fr.Cursors[i].S <= p
+}
+
 func (fr *Frame) deleteTick() image.Rectangle {
 	saved := fr.Sel
 	fr.Sel = fr.redrawOpt.drawnSel
@@ -796,6 +839,7 @@ func (fr *Frame) updateRedrawOpt() {
 	fr.redrawOpt.drawnVisibleTick = fr.reallyVisibleTick()
 	fr.redrawOpt.drawnSel = fr.Sel
 	fr.redrawOpt.drawnPMatch = fr.PMatch
+	fr.redrawOpt.drawnCursors = len(fr.Cursors)
 	fr.redrawOpt.selColor = fr.SelColor
 	fr.redrawOpt.reloaded = false
 	fr.redrawOpt.scrollStart = -1
@@ -893,7 +937,9 @@ func (fr *Frame) Redraw(flush bool, predrawRects *[]image.Rectangle) {
 	// Followed only if:
 	// - the frame wasn't reloaded (Clear, InsertColor weren't called) since last draw
 	// - at most the tick changed position
-	if !fr.redrawOpt.reloaded {
+	// - there are no additional cursors
+	multi := len(fr.Cursors) > 0 || fr.redrawOpt.drawnCursors > 0
+	if !fr.redrawOpt.reloaded && !multi {
 		if success, invalid := fr.redrawOptTickMoved(); success {
 			fr.updateRedrawOpt()
 			if flush && (fr.Flush != nil) {
@@ -912,7 +958,7 @@ func (fr *Frame) Redraw(flush bool, predrawRects *[]image.Rectangle) {
 	// FAST PATH 2
 	// Followed only after a scroll operation and there are no active selections
 	// Bitmaps are copied directly
-	if fr.redrawOpt.scrollStart >= 0 {
+	if fr.redrawOpt.scrollStart >= 0 && !multi {
 		if debugRedraw && fr.debugRedraw {
 			fmt.Printf("%p Redrawing (scroll) scrollStart: %d\n", fr, fr.redrawOpt.scrollStart)
 		}
@@ -954,6 +1000,7 @@ func (fr *Frame) Redraw(flush bool, predrawRects *[]image.Rectangle) {
 
 	// Tick drawing
 	fr.drawTick(1)
+	fr.drawCursorTicks()
 
 	if flush && (fr.Flush != nil) {
 		fr.Flush(fr.R)
@@ -974,6 +1021,61 @@ func (g *glyph) glyph(face font.Face) (dr image.Rectangle, mask image.Image, mas
 	return face.Glyph(g.p, r)
 }
 
+// SetUnderlines replaces the underlines of the frame, the next call to
+// Redraw will redraw the whole frame.
+func (fr *Frame) SetUnderlines(uls []Underline) {
+	fr.Underlines = uls
+	fr.redrawOpt.reloaded = true
+}
+
+func (fr *Frame) visibleUnderlines(n, m int) []Underline {
+	var r []Underline
+	for _, ul := range fr.Underlines {
+		if ul.S == ul.E || ul.Color < 0 || ul.Color >= len(fr.UnderlineColors) {
+			continue
+		}
+		if ul.E <= fr.Top+n || ul.S >= fr.Top+n+m {
+			continue
+		}
+		r = append(r, ul)
+	}
+	return r
+}
+
+// ansiColors returns the foreground and background colors of a color
+// index with the util.ColorAnsi bit set, the background is nil if it is the
+// default background.
+func (fr *Frame) ansiColors(c uint8) (fg, bg *image.Uniform) {
+	fg = &fr.Colors[0][1]
+	if i := int(c & 0x0f); i != 0 && i < len(fr.AnsiColors) {
+		fg = &fr.AnsiColors[i]
+	}
+	if i := int(c>>4) & 0x07; i != 0 && i < len(fr.AnsiColors) {
+		bg = &fr.AnsiColors[i]
+	}
+	return fg, bg
+}
+
+func (fr *Frame) drawGlyphBackground(g *glyph, color *image.Uniform) {
+	fm := fr.Font.Metrics()
+	r := fr.R.Intersect(image.Rect(g.p.X.Floor(), (g.p.Y - fm.Ascent).Floor(), (g.p.X + g.width).Floor(), (g.p.Y + fm.Descent).Floor()))
+	draw.Draw(fr.B, r, color, r.Min, draw.Src)
+}
+
+func (fr *Frame) drawUnderline(g *glyph, ul *Underline, first bool) {
+	fm := fr.Font.Metrics()
+	color := &fr.UnderlineColors[ul.Color]
+	if g.r != '\n' {
+		y := g.p.Y.Floor() + fm.Descent.Floor()/2
+		r := fr.R.Intersect(image.Rect(g.p.X.Floor(), y, (g.p.X + g.width).Floor(), y+1))
+		draw.Draw(fr.B, r, color, r.Min, draw.Src)
+	}
+	if first {
+		r := fr.R.Intersect(image.Rect(fr.R.Min.X, (g.p.Y - fm.Ascent).Floor(), fr.leftMargin.Floor()-1, (g.p.Y + fm.Descent).Floor()))
+		draw.Draw(fr.B, r, color, r.Min, draw.Src)
+	}
+}
+
 func (fr *Frame) redrawIntl(glyphs []glyph, drawSels bool, n int) {
 	ssel := 0
 	cury := fixed.I(0)
@@ -998,8 +1100,16 @@ func (fr *Frame) redrawIntl(glyphs []glyph, drawSels bool, n int) {
 		if fr.Sel.S != fr.Sel.E && (in(fr.Sel.S) || in(fr.Sel.E) || between(n, fr.Sel.S-fr.Top, fr.Sel.E-fr.Top)) {
 			fr.redrawSelection(fr.Sel.S-fr.Top, fr.Sel.E-fr.Top, &fr.Colors[fr.SelColor+1][0], nil)
 		}
+
+		for _, c := range fr.Cursors {
+			if c.S != c.E && (in(c.S) || in(c.E) || between(n, c.S-fr.Top, c.E-fr.Top)) {
+				fr.redrawSelection(c.S-fr.Top, c.E-fr.Top, &fr.Colors[1][0], nil)
+			}
+		}
 	}
 
+	uls := fr.visibleUnderlines(n, len(glyphs))
+
 	for i, g := range glyphs {
 		// Selection drawing
 		if ssel != 0 {
@@ -1013,7 +1123,12 @@ func (fr *Frame) redrawIntl(glyphs []glyph, drawSels bool, n int) {
 			}
 		}
 
-		onpmatch := (fr.PMatch.S != fr.PMatch.E) && (i+fr.Top+n == fr.PMatch.S) && (len(fr.Colors) > 4) && (ssel == 0)
+		gsel := ssel
+		if gsel == 0 && len(fr.Cursors) > 0 && fr.inCursor(i+fr.Top+n) {
+			gsel = 1
+		}
+
+		onpmatch := (fr.PMatch.S != fr.PMatch.E) && (i+fr.Top+n == fr.PMatch.S) && (len(fr.Colors) > 4) && (gsel == 0)
 
 		midlineh := (fr.Font.Metrics().Height - fr.Font.Metrics().Descent).Floor() / 2
 
@@ -1047,17 +1162,31 @@ func (fr *Frame) redrawIntl(glyphs []glyph, drawSels bool, n int) {
 			var color *image.Uniform
 			if onpmatch && len(fr.Colors) > 4 && int(g.color) < len(fr.Colors[4]) {
 				color = &fr.Colors[4][g.color]
-			} else if ssel >= 0 && ssel < len(fr.Colors) {
-				if g.color >= 0 && int(g.color) < len(fr.Colors[ssel]) {
-					color = &fr.Colors[ssel][g.color]
+			} else if gsel == 0 && g.color&util.ColorAnsi != 0 {
+				var bgcolor *image.Uniform
+				color, bgcolor = fr.ansiColors(g.color)
+				if bgcolor != nil && g.r != '\n' {
+					fr.drawGlyphBackground(&glyphs[i], bgcolor)
+				}
+			} else if gsel >= 0 && gsel < len(fr.Colors) {
+				if g.color >= 0 && int(g.color) < len(fr.Colors[gsel]) {
+					color = &fr.Colors[gsel][g.color]
 				} else {
-					color = &fr.Colors[ssel][1]
+					color = &fr.Colors[gsel][1]
 				}
 			} else {
 				color = &fr.Colors[1][1]
 			}
 			draw.DrawMask(fr.B, dr, color, dr.Min, mask, mp, draw.Over)
 		}
+
+		// Underline drawing
+		for j := range uls {
+			reali := i + fr.Top + n
+			if reali >= uls[j].S && reali < uls[j].E {
+				fr.drawUnderline(&glyphs[i], &uls[j], reali == uls[j].S)
+			}
+		}
 	}
 }
 
@@ -1069,7 +1198,14 @@ func (fr *Frame) drawSingleGlyph(g *glyph, ssel int) {
 		//mp := image.Point{dr.Min.X - gr.Min.X, dr.Min.Y - gr.Min.Y}
 		color := &fr.Colors[1][1]
 		bgcolor := &fr.Colors[1][0]
-		if (ssel >= 0) && (ssel < len(fr.Colors)) && (g.color >= 0) && (int(g.color) < len(fr.Colors[ssel])) {
+		if ssel == 0 && g.color&util.ColorAnsi != 0 {
+			var ansibg *image.Uniform
+			color, ansibg = fr.ansiColors(g.color)
+			bgcolor = &fr.Colors[0][0]
+			if ansibg != nil {
+				bgcolor = ansibg
+			}
+		} else if (ssel >= 0) && (ssel < len(fr.Colors)) && (g.color >= 0) && (int(g.color) < len(fr.Colors[ssel])) {
 			color = &fr.Colors[ssel][g.color]
 			bgcolor = &fr.Colors[ssel][0]
 		}
@@ -1140,6 +1276,15 @@ func (fr *Frame) LineNo() int {
 	return int(float32(fr.R.Max.Y-fr.R.Min.Y) / float32(fr.Font.Metrics().Height.Floor()))
 }
 
+// Columns returns the number of characters as wide as 'x' that fit in a line
+func (fr *Frame) Columns() int {
+	_, _, _, xw, _ := fr.Font.Glyph(fixed.P(0, 0), 'x')
+	if xw <= 0 {
+		return 0
+	}
+	return int((fixed.I(fr.R.Max.X-fr.R.Min.X) - 2*fr.margin) / xw)
+}
+
 func (fr *Frame) Inside(p int) bool {
 	rp := p - fr.Top
 	//println("Inside", p, rp, fr.lastFull)
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aarzilli/yacco/util"
+)
+
+const (
+	undoTreeBufferName      = "+Undo"
+	undoTreeRefreshInterval = time.Second
+)
+
+// Undo tree of the editor src, shown in +Undo. The first line of +Undo is
+// the path of the file, every other line is a state of the tree.
+var undoTree struct {
+	src    *Editor
+	gen    int // incremented every time the source editor changes
+	rev    int // revision of the source buffer when the tree was shown
+	states []int
+}
+
+// undoTreeRedirect returns the execution context of the source editor if
+// ec is the +Undo buffer.
+func undoTreeRedirect(ec ExecContext) ExecContext {
+	if ec.ed == nil || ec.ed.bodybuf.Name != undoTreeBufferName || undoTree.src == nil || undoTree.src.closed {
+		return ec
+	}
+	if srcec := editorExecContext(undoTree.src); srcec != nil {
+		return *srcec
+	}
+	return ec
+}
+
+func showUndoTree(src *Editor) {
+	if src == nil || src.closed || src.bodybuf.IsDir() {
+		Warn("Undo: no file selected")
+		return
+	}
+
+	if _, err := EditFind(Wnd.tagbuf.Dir, undoTreeBufferName, false, true); err != nil {
+		Warn(err.Error())
+		return
+	}
+
+	if src != undoTree.src {
+		undoTree.src = src
+		undoTree.gen++
+		go undoTreeWatch(undoTree.gen)
+	}
+	updateUndoTree()
+}
+
+// undoTreeWatch updates +Undo when the source buffer changes, until the
+// source editor changes or +Undo is closed.
+func undoTreeWatch(gen int) {
+	cont := make(chan bool, 1)
+	for {
+		time.Sleep(undoTreeRefreshInterval)
+		sideChan <- func() {
+			if gen != undoTree.gen {
+				cont <- false
+				return
+			}
+			if ed, _ := EditFind(Wnd.tagbuf.Dir, undoTreeBufferName, false, false); ed == nil || undoTree.src.closed {
+				undoTree.src = nil
+				undoTree.states = nil
+				undoTree.gen++
+				cont <- false
+				return
+			}
+			if undoTree.src.bodybuf.RevCount != undoTree.rev {
+				updateUndoTree()
+			}
+			cont <- true
+		}
+		if !<-cont {
+			return
+		}
+	}
+}
+
+func updateUndoTree() {
+	if undoTree.src == nil || undoTree.src.closed {
+		return
+	}
+	ed, err := EditFind(Wnd.tagbuf.Dir, undoTreeBufferName, false, false)
+	if err != nil || ed == nil {
+		return
+	}
+
+	b := undoTree.src.bodybuf
+	undoTree.rev = b.RevCount
+	states := b.UndoStates()
+	undoTree.states = undoTree.states[:0]
+
+	var out strings.Builder
+	out.WriteString(b.Path())
+	out.WriteString("\n")
+	for _, s := range states {
+		undoTree.states = append(undoTree.states, s.Id)
+		if s.Current {
+			out.WriteString("* ")
+		} else {
+			out.WriteString("  ")
+		}
+		out.WriteString(strings.Repeat("\t", s.Depth))
+		if s.Id == 0 {
+			out.WriteString("#0 original")
+		} else {
+			fmt.Fprintf(&out, "#%d %s ago %s", s.Id, time.Since(s.Ts).Round(time.Second), s.Descr)
+		}
+		if s.Saved {
+			out.WriteString(" (saved)")
+		}
+		out.WriteString("\n")
+	}
+
+	txt := []rune(out.String())
+	if string(ed.bodybuf.SelectionRunes(util.Sel{0, ed.bodybuf.Size()})) == string(txt) {
+		return
+	}
+	ed.bodybuf.Replace(txt, &util.Sel{0, ed.bodybuf.Size()}, true, nil, 0)
+	ed.bodybuf.Modified = false
+	ed.BufferRefresh()
+}
+
+// undoTreeLoad changes the text of the source editor to the state of the
+// +Undo line at origin.
+func undoTreeLoad(ec ExecContext, origin int, othered bool) bool {
+	if undoTree.src == nil || undoTree.src.closed || ec.ed == nil || ec.buf != ec.ed.bodybuf || ec.buf.Name != undoTreeBufferName {
+		return false
+	}
+	if origin < 0 {
+		origin = ec.fr.Sel.S
+	}
+	_, ln, _ := ec.buf.GetLine(origin, false)
+	i := ln - 2 // the first line is the path of the file
+	if i < 0 || i >= len(undoTree.states) {
+		return false
+	}
+	srcec := editorExecContext(undoTree.src)
+	if srcec == nil {
+		return false
+	}
+	if err := srcec.buf.UndoToState(undoTree.states[i], &srcec.fr.Sel); err != nil {
+		Warn("Undo: " + err.Error())
+		return true
+	}
+	srcec.br()
+	updateUndoTree()
+	return true
+}
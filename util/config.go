@@ -2,6 +2,7 @@ package util
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 
 	"golang.org/x/mobile/event/key"
@@ -19,7 +20,8 @@ import (
 // the initial position of the cursor
 //
 // In either case expressions like $1, $2 etc... inside Action string
-// will be replaced with the corrisponding matching group of Re.
+// will be replaced with the corrisponding matching group of Re, ${name}
+// with the group called name.
 //
 // An 'L' type action will only succeed if the specified file exists,
 // is a UTF8 file and is less than 10MB. If any of this conditions
@@ -32,8 +34,48 @@ type LoadRule struct {
 }
 
 type SaveRule struct {
-	Ext string
-	Cmd string
+	Ext string // apply to files with this extension
+	Cmd string // command executed after saving, or LspFormatSaveRule
+}
+
+// LspFormatSaveRule as the command of a save rule formats the buffer with
+// its language server before saving it.
+const LspFormatSaveRule = "Lsp format"
+
+// LspRule describes which language server to start for a file.
+//
+// Cmd is split with QuotedSplit after expanding environment variables,
+// Options, if not empty, must be a JSON value and is sent to the server
+// as initializationOptions (and as the answer to workspace/configuration
+// requests).
+// Servers are shared between all files with the same Lang in the same
+// workspace root.
+type LspRule struct {
+	Lang    string // language identifier, sent as languageId
+	NameRe  string // only apply to files matching this regular expression
+	Cmd     string // command line of the language server
+	Options string // initialization options
+
+	re *regexp.Regexp // compiled NameRe, never modified after NewLspRule
+}
+
+// NewLspRule returns a rule with its regular expression already compiled,
+// rules are used by many goroutines.
+func NewLspRule(lang, nameRe, cmd, options string) (LspRule, error) {
+	re, err := regexp.Compile(nameRe)
+	if err != nil {
+		return LspRule{}, err
+	}
+	return LspRule{Lang: lang, NameRe: nameRe, Cmd: cmd, Options: options, re: re}, nil
+}
+
+func (rule *LspRule) Match(name string) bool {
+	re := rule.re
+	if re == nil {
+		// not created by NewLspRule
+		re = regexp.MustCompile(rule.NameRe)
+	}
+	return re.MatchString(name)
 }
 
 var keynames = map[key.Code]string{
@@ -0,0 +1,184 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maximum number of entries kept in the history file, when it grows past
+// twice this size it is rewritten keeping only the most recent entries
+const MAX_HISTORY_FILE_LEN = 5000
+
+// HistoryEntry is a command executed in a win window
+type HistoryEntry struct {
+	When time.Time
+	Dir  string
+	Cmd  string
+}
+
+// History is the history of commands executed in win windows, it is
+// stored in a file shared by all instances of win, one entry per line as:
+//
+//	<unix time> TAB <directory> TAB <command>
+type History struct {
+	Path    string
+	Entries []HistoryEntry
+	Rev     int // incremented every time Entries changes
+
+	mu  sync.Mutex
+	off int64 // size of the file the last time it was read
+}
+
+func HistoryPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".config/yacco/history")
+}
+
+// Load reads the entries appended to the history file since the last call
+func (h *History) Load() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.load()
+}
+
+func (h *History) load() error {
+	fh, err := os.Open(h.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if h.off != 0 {
+				h.Entries, h.off = nil, 0
+				h.Rev++
+			}
+			return nil
+		}
+		return err
+	}
+	defer fh.Close()
+
+	fi, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == h.off {
+		return nil
+	}
+	if fi.Size() < h.off {
+		// the file was rewritten by someone else
+		h.Entries, h.off = nil, 0
+		h.Rev++
+	}
+
+	if _, err := fh.Seek(h.off, io.SeekStart); err != nil {
+		return err
+	}
+	rd := bufio.NewReader(fh)
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			// incomplete lines are being written right now, read them next time
+			break
+		}
+		h.off += int64(len(line))
+		if e, ok := parseHistoryLine(line[:len(line)-1]); ok {
+			h.Entries = append(h.Entries, e)
+			h.Rev++
+		}
+	}
+	return nil
+}
+
+func parseHistoryLine(line string) (HistoryEntry, bool) {
+	v := strings.SplitN(line, "\t", 3)
+	if len(v) != 3 {
+		return HistoryEntry{}, false
+	}
+	t, err := strconv.ParseInt(v[0], 10, 64)
+	if err != nil {
+		return HistoryEntry{}, false
+	}
+	return HistoryEntry{time.Unix(t, 0), v[1], v[2]}, true
+}
+
+func (e *HistoryEntry) String() string {
+	return fmt.Sprintf("%d\t%s\t%s\n", e.When.Unix(), e.Dir, e.Cmd)
+}
+
+// Append adds a command to the history file
+func (h *History) Append(dir, cmd string) error {
+	cmd = strings.TrimSpace(strings.Replace(cmd, "\n", " ", -1))
+	if cmd == "" {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	os.MkdirAll(filepath.Dir(h.Path), 0700)
+	fh, err := os.OpenFile(h.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	e := HistoryEntry{time.Now(), dir, cmd}
+	_, err = fh.Write([]byte(e.String()))
+	fh.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := h.load(); err != nil {
+		return err
+	}
+	if len(h.Entries) > 2*MAX_HISTORY_FILE_LEN {
+		return h.trim()
+	}
+	return nil
+}
+
+// trim rewrites the history file keeping only the last MAX_HISTORY_FILE_LEN entries
+func (h *History) trim() error {
+	entries := h.Entries[len(h.Entries)-MAX_HISTORY_FILE_LEN:]
+	fh, err := ioutil.TempFile(filepath.Dir(h.Path), ".history")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fh)
+	for i := range entries {
+		w.WriteString(entries[i].String())
+	}
+	err = w.Flush()
+	fh.Close()
+	if err == nil {
+		err = os.Rename(fh.Name(), h.Path)
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+		return err
+	}
+	h.Entries, h.off = nil, 0
+	return h.load()
+}
+
+// Commands returns up to n distinct commands executed in dir (or in any
+// directory if dir is empty) that contain needle, most recent first
+func (h *History) Commands(dir, needle string, n int) []HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r := []HistoryEntry{}
+	seen := map[string]bool{}
+	for i := len(h.Entries) - 1; i >= 0 && (n < 0 || len(r) < n); i-- {
+		e := h.Entries[i]
+		if (dir != "" && e.Dir != dir) || seen[e.Cmd] || !strings.Contains(e.Cmd, needle) {
+			continue
+		}
+		seen[e.Cmd] = true
+		r = append(r, e)
+	}
+	return r
+}
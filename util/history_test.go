@@ -0,0 +1,63 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func historyCmds(v []HistoryEntry) []string {
+	r := []string{}
+	for i := range v {
+		r = append(r, v[i].Cmd)
+	}
+	return r
+}
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yacco-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history")
+
+	h1 := &History{Path: path}
+	h2 := &History{Path: path}
+
+	h1.Append("/a", "ls -l\n")
+	h1.Append("/b", "make")
+	h2.Append("/a", "go test")
+	h1.Append("/a", "ls -l")
+	h2.Append("/a", "  ")
+
+	if err := h1.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(h1.Entries) != 4 {
+		t.Fatalf("wrong number of entries: %d", len(h1.Entries))
+	}
+
+	out := historyCmds(h1.Commands("/a", "", -1))
+	if arrayOut(out) != "<ls -l>, <go test>, " {
+		t.Fatalf("wrong commands for /a: %s", arrayOut(out))
+	}
+	out = historyCmds(h1.Commands("", "", 2))
+	if arrayOut(out) != "<ls -l>, <go test>, " {
+		t.Fatalf("wrong global commands: %s", arrayOut(out))
+	}
+	out = historyCmds(h2.Commands("", "ma", -1))
+	if arrayOut(out) != "<make>, " {
+		t.Fatalf("wrong search result: %s", arrayOut(out))
+	}
+
+	rev := h1.Rev
+	if err := h1.Load(); err != nil || h1.Rev != rev {
+		t.Fatalf("revision changed without new entries: %d %d %v", rev, h1.Rev, err)
+	}
+	h2.Append("/b", "make install")
+	if err := h1.Load(); err != nil || h1.Rev == rev {
+		t.Fatalf("revision not changed by new entries: %d %v", h1.Rev, err)
+	}
+}
@@ -451,6 +451,22 @@ func (buf *BufferConn) ReadAddr() ([]int, error) {
 	return iv, nil
 }
 
+// ReadProps returns the properties of the buffer
+func (buf *BufferConn) ReadProps() (map[string]string, error) {
+	b := make([]byte, 8192)
+	n, err := buf.PropFd.ReadAt(b, 0)
+	if err != nil {
+		return nil, err
+	}
+	props := map[string]string{}
+	for _, line := range strings.Split(string(b[:n]), "\n") {
+		if v := strings.SplitN(line, "=", 2); len(v) == 2 {
+			props[v[0]] = v[1]
+		}
+	}
+	return props, nil
+}
+
 func (buf *BufferConn) ReadXData() ([]byte, error) {
 	b := make([]byte, 1024)
 	r := []byte{}
@@ -698,6 +714,20 @@ func QuotedSplit(s string) []string {
 	return r
 }
 
+// Color indices with the ColorAnsi bit set are colors of terminal output:
+// the low four bits are the foreground color and the next three bits are
+// the background color. Black (0) means the default color in both cases.
+const ColorAnsi = 0x80
+
+// AnsiColor returns the color index for ANSI foreground color fg (0 to 15)
+// and background color bg (0 to 7).
+func AnsiColor(fg, bg int) uint8 {
+	if fg == 0 && bg == 0 {
+		return 1
+	}
+	return ColorAnsi | uint8(bg&0x07)<<4 | uint8(fg&0x0f)
+}
+
 func MixColorHack(rs []rune, cs []uint8) []byte {
 	r := make([]byte, 0, 2*len(rs))
 	bs := make([]byte, 10)
@@ -725,3 +755,17 @@ func UnmixColorHack(data []byte) (text []rune, color []uint8) {
 
 	return text, color
 }
+
+// IsEditProgramName returns true if name can be the name of a named Edit
+// program (letters, digits, '_' and '-').
+func IsEditProgramName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, ch := range name {
+		if !(ch == '_' || ch == '-' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9')) {
+			return false
+		}
+	}
+	return true
+}
@@ -445,6 +445,9 @@ func (w *Window) UiEventLoop(ei *util.EventOrRunnable, events <-chan util.EventO
 
 		if lp.sfr != nil {
 			if e.Where.In(lp.sfr.Fr.R) {
+				if addCursorClick(lp, e, events) {
+					break
+				}
 				ee, could := specialDblClick(lp.bodybuf, &lp.sfr.Fr, e, events)
 				if !could {
 					_, ee = lp.sfr.OnClick(e, events)
@@ -998,6 +1001,19 @@ func (lp *LogicalPos) bufferRefreshable(ontag bool) func() {
 func (w *Window) Type(lp LogicalPos, e key.Event) {
 	ec := lp.asExecContext(true)
 
+	if lp.tagfr == nil && lp.ed != nil && lp.ed.eventChan != nil && lp.ed.bodybuf.Props["send-keys"] == "1" {
+		// every key typed in the body is sent to the program reading the
+		// event file, as a character or a key name
+		k := util.KeyEvent(e)
+		if e.Rune >= ' ' && e.Modifiers&(key.ModControl|key.ModAlt|key.ModMeta) == 0 {
+			k = string(e.Rune)
+		}
+		if k != "" {
+			util.Fmtevent2(lp.ed.eventChan, util.EO_KBD, false, false, false, -1, 0, 0, k, nil)
+		}
+		return
+	}
+
 	otherKeys := func() {
 		ec := lp.asExecContext(true)
 		//fmt.Printf("keypress: <%s>\n", util.KeyEvent(e))
@@ -1012,7 +1028,7 @@ func (w *Window) Type(lp LogicalPos, e key.Event) {
 			LastTypeTime = time.Time{}
 			HideCompl(false)
 			//println("Execute command: <" + cmd + ">")
-			fcmd.F(ec)
+			eachCursorCmd(ec, fcmd)
 			if Tooltip.Visible {
 				// hide tooltip if we moved to a position where it shouldn't be visible
 				HideCompl(false)
@@ -1024,9 +1040,14 @@ func (w *Window) Type(lp LogicalPos, e key.Event) {
 				activeCol = nil
 			}
 			if ec.buf != nil {
-				ec.buf.Replace([]rune{e.Rune}, &ec.fr.Sel, true, ec.eventChan, util.EO_KBD)
+				eachCursor(ec, func(ec ExecContext, first bool) {
+					ec.buf.Replace([]rune{e.Rune}, &ec.fr.Sel, first, ec.eventChan, util.EO_KBD)
+				})
 				ec.br()
 				Compl.Start(ec, 0)
+				if e.Rune == '(' || e.Rune == ',' {
+					lspSignatureHelp(ec)
+				}
 			}
 		}
 	}
@@ -1039,7 +1060,9 @@ func (w *Window) Type(lp LogicalPos, e key.Event) {
 			tch = ec.ed.bodybuf.Props["indentchar"]
 		}
 
-		ec.buf.Replace([]rune(tch), &ec.fr.Sel, true, ec.eventChan, util.EO_KBD)
+		eachCursor(ec, func(ec ExecContext, first bool) {
+			ec.buf.Replace([]rune(tch), &ec.fr.Sel, first, ec.eventChan, util.EO_KBD)
+		})
 		ec.br()
 	}
 
@@ -1058,6 +1081,9 @@ func (w *Window) Type(lp LogicalPos, e key.Event) {
 			util.Fmtevent2(ec.ed.eventChan, util.EO_KBD, true, false, false, 0, 0, 0, "Escape", nil)
 			return
 		}
+		if lp.tagfr == nil && collapseCursors(lp.ed) {
+			return
+		}
 		if ec.buf != nil {
 			var fr *textframe.Frame
 			if lp.tagfr != nil {
@@ -1072,6 +1098,11 @@ func (w *Window) Type(lp LogicalPos, e key.Event) {
 		}
 
 	case key.CodeReturnEnter:
+		if Compl.Visible && lspCompl.active {
+			LastTypeTime = time.Now()
+			lspComplAccept(ec)
+			return
+		}
 		HideCompl(true)
 		if (lp.ed != nil) && lp.ed.eventChanSpecial {
 			LastTypeTime = time.Time{}
@@ -1101,29 +1132,32 @@ func (w *Window) Type(lp LogicalPos, e key.Event) {
 		} else {
 			LastTypeTime = time.Now()
 			nl := "\n"
-			indent := ""
-
-			if (ec.ed != nil) && (ec.ed.bodybuf == ec.buf) && (ec.ed.bodybuf.Props["indent"] == "on") && (ec.fr.Sel.S == ec.fr.Sel.E) {
-				is := ec.buf.Tonl(ec.fr.Sel.S-1, -1)
-				ie := is
-				for {
-					cr := ec.buf.At(ie)
-					if cr == 0 {
-						break
-					}
-					if (cr != ' ') && (cr != '\t') {
-						break
-					}
-					ie++
-				}
-				indent = string(ec.buf.SelectionRunes(util.Sel{is, ie}))
-			}
 
 			if (ec.buf != nil) && (ec.br != nil) {
-				ec.buf.Replace([]rune(nl), &ec.fr.Sel, true, ec.eventChan, util.EO_KBD)
-				if indent != "" {
-					ec.buf.Replace([]rune(indent), &ec.fr.Sel, true, ec.eventChan, util.EO_KBD)
-				}
+				eachCursor(ec, func(ec ExecContext, first bool) {
+					indent := ""
+					if (ec.ed != nil) && (ec.ed.bodybuf == ec.buf) && (ec.ed.bodybuf.Props["indent"] == "on") && (ec.fr.Sel.S == ec.fr.Sel.E) {
+						is := ec.buf.Tonl(ec.fr.Sel.S-1, -1)
+						ie := is
+						for {
+							cr := ec.buf.At(ie)
+							if cr == 0 {
+								break
+							}
+							if (cr != ' ') && (cr != '\t') {
+								break
+							}
+							ie++
+						}
+						indent = string(ec.buf.SelectionRunes(util.Sel{is, ie}))
+					}
+
+					ec.buf.Replace([]rune(nl), &ec.fr.Sel, first, ec.eventChan, util.EO_KBD)
+					if indent != "" {
+						// with multiple cursors all changes must be a single undo step
+						ec.buf.Replace([]rune(indent), &ec.fr.Sel, first && len(ec.fr.Cursors) == 0, ec.eventChan, util.EO_KBD)
+					}
+				})
 				ec.br()
 			}
 		}
@@ -1152,6 +1186,8 @@ func (w *Window) Type(lp LogicalPos, e key.Event) {
 		ec := lp.asExecContext(true)
 		if ec.buf != nil {
 			switch {
+			case Compl.Visible && lspCompl.active:
+				lspComplAccept(ec)
 			case Compl.Visible:
 				ec.buf.Replace([]rune(complPrefixSuffix), &ec.fr.Sel, true, ec.eventChan, util.EO_KBD)
 				ec.br()
@@ -1173,7 +1209,20 @@ func (w *Window) Type(lp LogicalPos, e key.Event) {
 		LastTypeTime = time.Now()
 		if !Compl.Visible {
 			ec := lp.asExecContext(true)
-			Compl.Start(ec, 0)
+			if !lspComplStart(ec) {
+				Compl.Start(ec, 0)
+			}
+		}
+
+	case key.CodeUpArrow, key.CodeDownArrow:
+		if Compl.Visible && lspCompl.active {
+			dir := +1
+			if e.Code == key.CodeUpArrow {
+				dir = -1
+			}
+			lspComplMove(ec, dir)
+		} else {
+			otherKeys()
 		}
 
 	default:
@@ -1280,6 +1329,9 @@ func completeClick(events <-chan util.EventOrRunnable, completeAction, cancelAct
 
 func clickExec1(lp LogicalPos, e util.MouseDownEvent) {
 	if lp.sfr != nil {
+		if lp.ed != nil && lp.sfr == &lp.ed.sfr {
+			lp.ed.SetCursors(nil)
+		}
 		lp.sfr.Fr.SelColor = 0
 		activeSel.Set(lp)
 		activeEditor = lp.ed
@@ -16,6 +16,7 @@ import (
 	"github.com/aarzilli/yacco/config"
 	"github.com/aarzilli/yacco/edit"
 	"github.com/aarzilli/yacco/ibus"
+	"github.com/aarzilli/yacco/lsp"
 	"github.com/aarzilli/yacco/util"
 
 	"golang.org/x/exp/shiny/driver"
@@ -53,6 +54,8 @@ var editorColors = [][]image.Uniform{
 	config.TheColorScheme.EditorSel3,                // 2 third button selection
 	config.TheColorScheme.EditorMatchingParenthesis, // 3 matching parenthesis
 }
+var diagnosticColors = make([]image.Uniform, len(config.DefaultDiagnostics))
+var ansiColors = make([]image.Uniform, len(config.DefaultAnsi))
 
 func setTheme(t string) {
 	cs, ok := config.ColorSchemeMap[t]
@@ -73,6 +76,12 @@ func setTheme(t string) {
 	editorColors[3] = config.TheColorScheme.EditorSel3
 	editorColors[4] = config.TheColorScheme.EditorMatchingParenthesis
 
+	copy(diagnosticColors, config.DefaultDiagnostics)
+	copy(diagnosticColors, config.TheColorScheme.EditorDiagnostics)
+
+	copy(ansiColors, config.DefaultAnsi)
+	copy(ansiColors, config.TheColorScheme.Ansi)
+
 	if Wnd.cols != nil {
 		for _, col := range Wnd.cols.cols {
 			for _, ed := range col.editors {
@@ -166,6 +175,11 @@ func realmain(s screen.Screen) {
 
 	debug.FreeOSMemory()
 
+	if config.EnableHighlighting {
+		go semanticTokensWatch()
+	}
+	go diskWatch()
+
 	Wnd.EventLoop()
 }
 
@@ -196,6 +210,7 @@ func main() {
 	}
 
 	edit.Warnfn = Warn
+	lsp.DiagnosticsChanged = lspDiagnosticsChanged
 	edit.NewJob = func(canintl bool, wd, cmd, input string, buf *buf.Buffer, resultChan chan<- string) {
 		if canintl {
 			for _, col := range Wnd.cols.cols {